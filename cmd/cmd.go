@@ -2,6 +2,11 @@ package cmd
 
 import (
 	"context"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/musix/backhaul/internal/client"
 	"github.com/musix/backhaul/internal/config"
@@ -15,40 +20,91 @@ var (
 	logger = utils.NewLogger("info")
 )
 
-func Run(configPath string, parentctx context.Context) {
-	// Load and parse the configuration file
+// LoadConfig loads the configuration file and applies the default values.
+func LoadConfig(configPath string) (*config.Config, error) {
 	cfg, err := loadConfig(configPath)
 	if err != nil {
-		logger.Fatalf("failed to load configuration: %v", err)
+		return nil, err
 	}
 
-	// Apply default values to the configuration
-	applyDefaults(cfg)
+	if err := applyDefaults(cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
 
+// Run starts the server or client of cfg and returns once it is shut down
+// after parentctx is done, or with an error once it stopped because it could
+// not be set up.
+func Run(cfg *config.Config, parentctx context.Context) error {
 	// Create a context for graceful shutdown handling
 	ctx, cancel := context.WithCancel(parentctx)
 	defer cancel()
 
 	// Determine whether to run as a server or client
 	if cfg.Server.BindAddr != "" {
+		// Take over the listeners of the previous instance before listening
+		if cfg.Server.HandoffSocket != "" {
+			done := utils.InitHandoff(ctx, cfg.Server.HandoffSocket, stopProcess, logger)
+			defer func() {
+				cancel()
+				<-done
+			}()
+		}
+
 		srv := server.NewServer(&cfg.Server, ctx) // server
-		go srv.Start()
 
-		// Wait for shutdown signal
-		<-ctx.Done()
+		// Runs until the shutdown signal
+		err := srv.Start()
 		srv.Stop()
 		logger.Println("shutting down server...")
+		return err
 
 	} else if cfg.Client.RemoteAddr != "" {
 		clnt := client.NewClient(&cfg.Client, ctx) // client
-		go clnt.Start()
 
-		// Wait for shutdown signal
-		<-ctx.Done()
+		// Runs until the shutdown signal
+		err := clnt.Start()
 		clnt.Stop()
 		logger.Println("shutting down client...")
-	} else {
-		logger.Fatalf("neither server nor client configuration is properly set.")
+		return err
+	}
+
+	return fmt.Errorf("neither server nor client configuration is properly set")
+}
+
+// LogStats logs the summary of everything forwarded since the process started,
+// across reloads, and writes it to the stats_file of cfg.
+func LogStats(cfg *config.Config) {
+	path := cfg.Client.StatsFile
+	if cfg.Server.BindAddr != "" {
+		path = cfg.Server.StatsFile
+	}
+	utils.LogStats(logger, path)
+}
+
+// WaitForRelease waits until the tunnel and web ports of a stopped server are
+// free again or timeout passes, so a reload can start the new server as soon
+// as the old one let go of its listeners instead of after a fixed pause.
+func WaitForRelease(cfg *config.Config, timeout time.Duration) {
+	if cfg.Server.BindAddr == "" {
+		return // clients do not listen
+	}
+
+	network := "tcp"
+	if cfg.Server.Transport == config.QUIC {
+		network = "udp"
+	}
+
+	var addrs []string
+	for _, addr := range strings.Split(cfg.Server.BindAddr, ",") {
+		addrs = append(addrs, strings.TrimSpace(addr))
+	}
+
+	deadline := time.Now().Add(timeout)
+	utils.WaitReleased(network, addrs, timeout)
+	if cfg.Server.WebPort > 0 {
+		utils.WaitReleased("tcp", []string{fmt.Sprintf(":%d", cfg.Server.WebPort)}, time.Until(deadline))
 	}
 }
 
@@ -60,3 +116,9 @@ func loadConfig(configPath string) (*config.Config, error) {
 	}
 	return &cfg, nil
 }
+
+// stopProcess shuts down like SIGTERM does, e.g. once the next instance took
+// over the listeners.
+func stopProcess() {
+	syscall.Kill(os.Getpid(), syscall.SIGTERM)
+}
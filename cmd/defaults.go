@@ -1,7 +1,13 @@
 package cmd
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
 	"github.com/musix/backhaul/internal/config"
+	"github.com/musix/backhaul/internal/utils"
 
 	"github.com/sirupsen/logrus"
 )
@@ -18,14 +24,28 @@ const ( // Default values
 	defaultDialTimeout    = 10 // 10 seconds
 	// related to smux
 	defaultMuxVersion       = 1
-	defaultMaxFrameSize     = 32768   // 32KB
-	defaultMaxReceiveBuffer = 4194304 // 4MB
-	defaultMaxStreamBuffer  = 65536   // 256KB
+	defaultMaxFrameSize     = 32768     // 32KB
+	defaultMaxReceiveBuffer = 4194304   // 4MB
+	defaultMaxStreamBuffer  = 65536     // 256KB
+	maxMuxFrameSize         = 65535     // the smux frame length is 16 bits
+	maxMuxReceiveBuffer     = 268435456 // 256MB
 	defaultSnifferLog       = "backhaul.json"
 	defaultMuxCon           = 8
+	defaultMaxTokenLength   = 1024
+	maxHandshakeDelay       = 1500 // ms, clients wait 2 seconds for the handshake response
+	defaultBanTime          = 600  // 10 minutes
+	defaultHandshakeTimeout = 2    // 2 seconds, only for client
+	defaultStatsdPrefix     = "backhaul."
+	maxSensibleMuxCon       = 1024 // streams on one TCP connection, a loss on it stalls all of them
+	defaultBackpressure     = 1000 // ms, tunnel connections held back after the server signaled a full tunnel channel
+	defaultWebhookInterval  = 60   // seconds between stats snapshots posted to the webhook
+	defaultSessionTTL       = 3600 // seconds a client session is kept after its control channel dropped, with pinning
+	defaultBackendPoolIdle  = 30   // seconds an idle backend connection is kept
 )
 
-func applyDefaults(cfg *config.Config) {
+// applyDefaults fills in the unset options of cfg, it returns an error for the
+// options it cannot make sense of.
+func applyDefaults(cfg *config.Config) error {
 	// Token
 	if cfg.Server.Token == "" {
 		cfg.Server.Token = defaultToken
@@ -33,8 +53,21 @@ func applyDefaults(cfg *config.Config) {
 	if cfg.Client.Token == "" {
 		cfg.Client.Token = defaultToken
 	}
+	if cfg.Server.MaxTokenLength <= 0 {
+		cfg.Server.MaxTokenLength = defaultMaxTokenLength
+	}
+	if cfg.Server.MaxTokenLength < len(cfg.Server.Token) {
+		cfg.Server.MaxTokenLength = len(cfg.Server.Token) // never reject the configured token itself
+	}
 
 	// Nodelay default is false if not valid value found
+	// The users and backends facing sockets follow nodelay unless set on their own
+	if cfg.Server.LocalNodelay == nil {
+		cfg.Server.LocalNodelay = &cfg.Server.Nodelay
+	}
+	if cfg.Client.BackendNodelay == nil {
+		cfg.Client.BackendNodelay = &cfg.Client.Nodelay
+	}
 
 	// Channel size
 	if cfg.Server.ChannelSize <= 0 {
@@ -78,6 +111,20 @@ func applyDefaults(cfg *config.Config) {
 		cfg.Client.Keepalive = defaultKeepAlive
 	}
 
+	// Keep-alive probe interval and count, 0 means the usual timing
+	if cfg.Server.KeepaliveInterval < 0 {
+		cfg.Server.KeepaliveInterval = 0
+	}
+	if cfg.Server.KeepaliveCount < 0 {
+		cfg.Server.KeepaliveCount = 0
+	}
+	if cfg.Client.KeepaliveInterval < 0 {
+		cfg.Client.KeepaliveInterval = 0
+	}
+	if cfg.Client.KeepaliveCount < 0 {
+		cfg.Client.KeepaliveCount = 0
+	}
+
 	// Mux version
 	if cfg.Server.MuxVersion <= 0 || cfg.Server.MuxVersion > 2 {
 		cfg.Server.MuxVersion = defaultMuxVersion
@@ -85,6 +132,21 @@ func applyDefaults(cfg *config.Config) {
 	if cfg.Client.MuxVersion <= 0 || cfg.Client.MuxVersion > 2 {
 		cfg.Client.MuxVersion = defaultMuxVersion
 	}
+	// Handshake version, 0 is the legacy framing every server understands
+	if cfg.Client.HandshakeVersion < 0 {
+		cfg.Client.HandshakeVersion = 0
+	}
+	if cfg.Client.HandshakeVersion > int(utils.HandshakeVersion) {
+		cfg.Client.HandshakeVersion = int(utils.HandshakeVersion)
+	}
+	// The client ID is carried from handshake version 2 on
+	if len(cfg.Client.ClientID) > 255 {
+		logger.Warnf("client_id is longer than 255 bytes, using its first 255 bytes")
+		cfg.Client.ClientID = cfg.Client.ClientID[:255]
+	}
+	if cfg.Client.ClientID != "" && cfg.Client.HandshakeVersion < 2 {
+		cfg.Client.HandshakeVersion = 2
+	}
 	// MaxFrameSize
 	if cfg.Server.MaxFrameSize <= 0 {
 		cfg.Server.MaxFrameSize = defaultMaxFrameSize
@@ -106,6 +168,10 @@ func applyDefaults(cfg *config.Config) {
 	if cfg.Client.MaxStreamBuffer <= 0 {
 		cfg.Client.MaxStreamBuffer = defaultMaxStreamBuffer
 	}
+	// Keep the smux buffers in the range smux accepts
+	validateMuxBuffers("server", &cfg.Server.MaxFrameSize, &cfg.Server.MaxReceiveBuffer, &cfg.Server.MaxStreamBuffer)
+	validateMuxBuffers("client", &cfg.Client.MaxFrameSize, &cfg.Client.MaxReceiveBuffer, &cfg.Client.MaxStreamBuffer)
+
 	// WebPort returns 0 if not exists
 
 	// SnifferLog
@@ -115,6 +181,201 @@ func applyDefaults(cfg *config.Config) {
 	if cfg.Client.SnifferLog == "" {
 		cfg.Client.SnifferLog = defaultSnifferLog
 	}
+	// Sniffer limits, 0 means unlimited
+	if cfg.Server.SnifferMaxPorts < 0 {
+		cfg.Server.SnifferMaxPorts = 0
+	}
+	if cfg.Client.SnifferMaxPorts < 0 {
+		cfg.Client.SnifferMaxPorts = 0
+	}
+	if cfg.Server.SnifferRetention < 0 {
+		cfg.Server.SnifferRetention = 0
+	}
+	if cfg.Client.SnifferRetention < 0 {
+		cfg.Client.SnifferRetention = 0
+	}
+
+	// Pool keepalive, 0 means disabled
+	if cfg.Server.PoolKeepalive < 0 {
+		cfg.Server.PoolKeepalive = 0
+	}
+	if cfg.Client.PoolKeepalive < 0 {
+		cfg.Client.PoolKeepalive = 0
+	}
+
+	// Tunnel bandwidth in KB/s, 0 means unlimited
+	if cfg.Server.MaxTunnelBandwidth < 0 {
+		cfg.Server.MaxTunnelBandwidth = 0
+	}
+	if cfg.Server.MaxTunnelUpstream <= 0 {
+		cfg.Server.MaxTunnelUpstream = cfg.Server.MaxTunnelBandwidth
+	}
+	if cfg.Server.MaxTunnelDownstream <= 0 {
+		cfg.Server.MaxTunnelDownstream = cfg.Server.MaxTunnelBandwidth
+	}
+	if cfg.Client.MaxTunnelBandwidth < 0 {
+		cfg.Client.MaxTunnelBandwidth = 0
+	}
+	if cfg.Client.MaxTunnelUpstream <= 0 {
+		cfg.Client.MaxTunnelUpstream = cfg.Client.MaxTunnelBandwidth
+	}
+	if cfg.Client.MaxTunnelDownstream <= 0 {
+		cfg.Client.MaxTunnelDownstream = cfg.Client.MaxTunnelBandwidth
+	}
+
+	// MSS clamp, 0 means disabled
+	if cfg.Server.MSSClamp < 0 {
+		cfg.Server.MSSClamp = 0
+	}
+	if cfg.Client.MSSClamp < 0 {
+		cfg.Client.MSSClamp = 0
+	}
+
+	// Read/write deadlines and the backend idle timeout, 0 means disabled
+	if cfg.Server.ReadDeadline < 0 {
+		cfg.Server.ReadDeadline = 0
+	}
+	if cfg.Server.WriteDeadline < 0 {
+		cfg.Server.WriteDeadline = 0
+	}
+	if cfg.Client.ReadDeadline < 0 {
+		cfg.Client.ReadDeadline = 0
+	}
+	if cfg.Client.WriteDeadline < 0 {
+		cfg.Client.WriteDeadline = 0
+	}
+	if cfg.Client.BackendIdleTimeout < 0 {
+		cfg.Client.BackendIdleTimeout = 0
+	}
+
+	// Queue wait threshold, 0 means disabled
+	if cfg.Server.QueueThreshold < 0 {
+		cfg.Server.QueueThreshold = 0
+	}
+
+	// Channel auto-scaling, 0 keeps channel_size fixed
+	if cfg.Server.ChannelSizeMax < 0 {
+		cfg.Server.ChannelSizeMax = 0
+	}
+	if cfg.Server.ChannelSizeMax > 0 && cfg.Server.ChannelSizeMax <= cfg.Server.ChannelSize {
+		logger.Warnf("channel_size_max %d is not above channel_size %d, the channel size stays fixed", cfg.Server.ChannelSizeMax, cfg.Server.ChannelSize)
+		cfg.Server.ChannelSizeMax = 0
+	}
+
+	// Unacknowledged heartbeats, 0 means disabled
+	if cfg.Server.HeartbeatMisses < 0 {
+		cfg.Server.HeartbeatMisses = 0
+	}
+
+	// Handshake bans, 0 means disabled
+	if cfg.Server.BanAfter < 0 {
+		cfg.Server.BanAfter = 0
+	}
+	if cfg.Server.BanTime <= 0 {
+		cfg.Server.BanTime = defaultBanTime
+	}
+
+	// Client sessions, pinning needs them kept for a while
+	if cfg.Server.SessionTTL < 0 {
+		cfg.Server.SessionTTL = 0
+	}
+	if cfg.Server.SessionPinning && cfg.Server.SessionTTL == 0 {
+		cfg.Server.SessionTTL = defaultSessionTTL
+	}
+
+	// Idle mux session reaping, 0 means disabled. At least one session stays
+	// open, it requests new ones when connections arrive
+	if cfg.Server.SessionIdleTimeout < 0 {
+		cfg.Server.SessionIdleTimeout = 0
+	}
+	if cfg.Server.SessionIdleMin < 1 {
+		cfg.Server.SessionIdleMin = 1
+	}
+
+	// Concurrent handshake cap, 0 means unlimited
+	if cfg.Server.MaxHandshakes < 0 {
+		cfg.Server.MaxHandshakes = 0
+	}
+
+	// Port mapping listener cap, 0 means unlimited
+	if cfg.Server.MaxPortMappings < 0 {
+		cfg.Server.MaxPortMappings = 0
+	}
+
+	// Overload thresholds, 0 means not checked
+	if cfg.Server.OverloadGoroutines < 0 {
+		cfg.Server.OverloadGoroutines = 0
+	}
+	if cfg.Server.OverloadMemory < 0 {
+		cfg.Server.OverloadMemory = 0
+	}
+
+	// Probe timeout, 0 means disabled
+	if cfg.Server.ProbeTimeout < 0 {
+		cfg.Server.ProbeTimeout = 0
+	}
+
+	// Unauthorized request summary, 0 means a warning per request
+	if cfg.Server.AuthLogInterval < 0 {
+		cfg.Server.AuthLogInterval = 0
+	}
+
+	// Handshake delay, 0 means disabled
+	if cfg.Server.HandshakeDelay < 0 {
+		cfg.Server.HandshakeDelay = 0
+	}
+	if cfg.Server.HandshakeDelay > maxHandshakeDelay {
+		cfg.Server.HandshakeDelay = maxHandshakeDelay
+	}
+
+	// StatsD metric prefix
+	if cfg.Server.StatsdPrefix == "" {
+		cfg.Server.StatsdPrefix = defaultStatsdPrefix
+	}
+	if cfg.Client.StatsdPrefix == "" {
+		cfg.Client.StatsdPrefix = defaultStatsdPrefix
+	}
+
+	// Stats webhook interval
+	if cfg.Server.WebhookInterval <= 0 {
+		cfg.Server.WebhookInterval = defaultWebhookInterval
+	}
+	if cfg.Client.WebhookInterval <= 0 {
+		cfg.Client.WebhookInterval = defaultWebhookInterval
+	}
+
+	// Pinned certificate fingerprint, accepted with colons and in any case
+	if cfg.Client.TLSPinnedCert != "" {
+		pin := strings.ToLower(strings.ReplaceAll(cfg.Client.TLSPinnedCert, ":", ""))
+		if _, err := hex.DecodeString(pin); err != nil || len(pin) != sha256.Size*2 {
+			return fmt.Errorf("tls_pinned_cert %q is not a SHA-256 fingerprint", cfg.Client.TLSPinnedCert)
+		}
+		cfg.Client.TLSPinnedCert = pin
+	}
+
+	// Hold after a full tunnel channel signal, only sent by servers with tunnel_backpressure
+	if cfg.Client.BackpressureDelay <= 0 {
+		cfg.Client.BackpressureDelay = defaultBackpressure
+	}
+
+	// Backoff for unresolvable backend names, 0 means disabled
+	if cfg.Client.UnresolvedBackoff < 0 {
+		cfg.Client.UnresolvedBackoff = 0
+	}
+
+	// Backend connection pool, 0 means disabled
+	if cfg.Client.BackendPool < 0 {
+		cfg.Client.BackendPool = 0
+	}
+	if cfg.Client.BackendPoolIdle <= 0 {
+		cfg.Client.BackendPoolIdle = defaultBackendPoolIdle
+	}
+
+	// Per target connection limit, 0 means unlimited
+	if cfg.Client.MaxPerTargetConnections < 0 {
+		cfg.Client.MaxPerTargetConnections = 0
+	}
+
 	// Heartbeat
 	if cfg.Server.Heartbeat < 1 { // Minimum accepted interval is 1 second
 		cfg.Server.Heartbeat = deafultHeartbeat
@@ -124,9 +385,92 @@ func applyDefaults(cfg *config.Config) {
 	if cfg.Client.DialTimeout < 1 { // Minimum accepted value is 1 second
 		cfg.Client.DialTimeout = defaultDialTimeout
 	}
+	if cfg.Client.HandshakeTimeout < 1 { // Minimum accepted value is 1 second
+		cfg.Client.HandshakeTimeout = defaultHandshakeTimeout
+	}
 
 	// Mux concurrancy
 	if cfg.Server.MuxCon < 1 {
 		cfg.Server.MuxCon = defaultMuxCon
 	}
+	if cfg.Server.MuxMaxStreams < cfg.Server.MuxCon {
+		// Fewer streams than mux_con would stall a session before the next one is set up
+		if cfg.Server.MuxMaxStreams != 0 {
+			logger.Warnf("[server] mux_max_streams %d is lower than mux_con, using %d", cfg.Server.MuxMaxStreams, cfg.Server.MuxCon)
+		}
+		cfg.Server.MuxMaxStreams = cfg.Server.MuxCon
+	}
+	if cfg.Server.MuxSessionStreams < 0 {
+		cfg.Server.MuxSessionStreams = 0
+	}
+	switch cfg.Server.Transport {
+	case config.TCPMUX, config.WSMUX, config.WSSMUX:
+		validateMuxConcurrency(&cfg.Server)
+	}
+
+	// Each side buffers what it receives, the server the downloads and the client the uploads
+	if cfg.Server.BindAddr != "" && isMuxTransport(cfg.Server.Transport) {
+		logMuxBuffers("server", "client", "download (backend to user)", cfg.Server.MuxVersion, cfg.Server.MaxReceiveBuffer, cfg.Server.MaxStreamBuffer)
+	} else if cfg.Client.RemoteAddr != "" && isMuxTransport(cfg.Client.Transport) {
+		logMuxBuffers("client", "server", "upload (user to backend)", cfg.Client.MuxVersion, cfg.Client.MaxReceiveBuffer, cfg.Client.MaxStreamBuffer)
+	}
+
+	return nil
+}
+
+func isMuxTransport(transport config.TransportType) bool {
+	switch transport {
+	case config.TCPMUX, config.TCPSINGLE, config.WSMUX, config.WSSMUX:
+		return true
+	}
+	return false
+}
+
+// logMuxBuffers tells which traffic direction tuned smux buffers apply to, so
+// operators can bias the buffering of an asymmetric tunnel to the dominant one.
+func logMuxBuffers(section string, peer string, direction string, version int, receiveBuffer int, streamBuffer int) {
+	if receiveBuffer != defaultMaxReceiveBuffer || streamBuffer != defaultMaxStreamBuffer {
+		logger.Infof("[%s] mux_recievebuffer %d and mux_streambuffer %d buffer the %s direction, set them on the %s for the opposite one",
+			section, receiveBuffer, streamBuffer, direction, peer)
+	}
+
+	// Only smux v2 has a window per stream
+	if version < 2 && streamBuffer != defaultMaxStreamBuffer {
+		logger.Warnf("[%s] mux_streambuffer only applies with mux_version 2, streams share mux_recievebuffer with version %d", section, version)
+	}
+}
+
+// validateMuxBuffers clamps out of range smux buffer sizes and logs the value
+// that is used instead, so a typo can not break the sessions or exhaust memory.
+func validateMuxBuffers(section string, frameSize *int, receiveBuffer *int, streamBuffer *int) {
+	if *frameSize > maxMuxFrameSize {
+		logger.Warnf("[%s] mux_framesize %d is larger than %d, using %d", section, *frameSize, maxMuxFrameSize, maxMuxFrameSize)
+		*frameSize = maxMuxFrameSize
+	}
+
+	if *receiveBuffer > maxMuxReceiveBuffer {
+		logger.Warnf("[%s] mux_recievebuffer %d is larger than %d, using %d", section, *receiveBuffer, maxMuxReceiveBuffer, maxMuxReceiveBuffer)
+		*receiveBuffer = maxMuxReceiveBuffer
+	}
+
+	if *streamBuffer > *receiveBuffer {
+		logger.Warnf("[%s] mux_streambuffer %d is larger than mux_recievebuffer, using %d", section, *streamBuffer, *receiveBuffer)
+		*streamBuffer = *receiveBuffer
+	}
+}
+
+// validateMuxConcurrency warns about mux_con and mux_max_streams values that
+// do not fit the smux buffers, they work but streams of a busy session stall each other.
+func validateMuxConcurrency(cfg *config.ServerConfig) {
+	if cfg.MuxCon > maxSensibleMuxCon {
+		logger.Warnf("[server] mux_con %d is very high, a single TCP connection carries up to %d connections and packet loss on it stalls all of them", cfg.MuxCon, cfg.MuxMaxStreams)
+	} else if cfg.MuxMaxStreams > maxSensibleMuxCon {
+		logger.Warnf("[server] mux_max_streams %d is very high, a single TCP connection carries up to %d connections and packet loss on it stalls all of them", cfg.MuxMaxStreams, cfg.MuxMaxStreams)
+	}
+
+	// Streams share the session receive buffer, in smux v2 each of them may fill a stream buffer
+	if cfg.MuxVersion == 2 && cfg.MuxMaxStreams*cfg.MaxStreamBuffer > cfg.MaxReceiveBuffer {
+		logger.Warnf("[server] mux_max_streams %d streams of mux_streambuffer %d bytes need %d bytes, more than mux_recievebuffer %d, busy streams will stall each other",
+			cfg.MuxMaxStreams, cfg.MaxStreamBuffer, cfg.MuxMaxStreams*cfg.MaxStreamBuffer, cfg.MaxReceiveBuffer)
+	}
 }
@@ -2,9 +2,11 @@ package client
 
 import (
 	"context"
+	"fmt"
 	"time"
 
 	"github.com/musix/backhaul/internal/utils"
+	"github.com/musix/backhaul/internal/web"
 
 	"github.com/musix/backhaul/internal/config"
 
@@ -34,8 +36,9 @@ func NewClient(cfg *config.ClientConfig, parentCtx context.Context) *Client {
 	}
 }
 
-// Run starts the client and begins dialing the tunnel server
-func (c *Client) Start() {
+// Run starts the client and begins dialing the tunnel server. It returns an
+// error, after stopping the client, when the transport cannot be set up.
+func (c *Client) Start() error {
 	// for pprof
 	if c.config.PPROF {
 		go func() {
@@ -44,122 +47,344 @@ func (c *Client) Start() {
 		}()
 	}
 
+	// for opentelemetry traces
+	if c.config.OTLPEndpoint != "" {
+		utils.InitTracing(c.ctx, c.config.OTLPEndpoint, "backhaul-client", c.logger)
+	}
+
+	// for recording connections of specific ports
+	if c.config.RecordDir != "" && len(c.config.RecordPorts) > 0 {
+		utils.InitRecording(c.ctx, c.config.RecordDir, c.config.RecordPorts, c.logger)
+	}
+
+	// for per connection JSON lines
+	if c.config.ConnLog != "" {
+		utils.InitConnLog(c.ctx, c.config.ConnLog, int64(c.config.ConnLogMaxSize)*1024*1024, string(c.config.Transport), c.logger)
+	}
+
+	// for reconciling the bytes read and written of forwarded connections
+	if c.config.FlowCheck {
+		utils.InitFlowCheck(c.ctx, c.logger)
+	}
+
+	// for the live event stream of the web monitor
+	if c.config.WebPort > 0 && c.config.WebToken != "" {
+		web.InitEvents(c.ctx, c.config.WebToken, c.logger)
+	}
+
+	// for the running configuration on the status page of the web monitor
+	if c.config.WebPort > 0 {
+		web.SetTransportInfo(c.transportInfo())
+	}
+
+	// for a total bandwidth cap shared by all connections
+	utils.InitBandwidthLimit(c.ctx, c.config.MaxTunnelUpstream, c.config.MaxTunnelDownstream, c.logger)
+
+	// for bbr and other congestion control algorithms on tunnel and local connections
+	if c.config.CongestionControl != "" {
+		utils.InitCongestionControl(c.ctx, c.config.CongestionControl, c.logger)
+	}
+
+	// for the socket buffers of tunnel and local connections
+	if c.config.SocketReadBuffer > 0 || c.config.SocketWriteBuffer > 0 {
+		utils.InitSocketBuffers(c.ctx, c.config.SocketReadBuffer*1024, c.config.SocketWriteBuffer*1024, c.logger)
+	}
+
+	// A negative keep-alive period disables keep-alive, as with net.Dialer
+	keepAlive := time.Duration(c.config.Keepalive) * time.Second
+	if c.config.DisableKeepAlive {
+		keepAlive = -1
+	}
+
+	// for faster dead peer detection on tunnel connections
+	if c.config.KeepaliveInterval > 0 || c.config.KeepaliveCount > 0 {
+		utils.InitKeepAliveProbes(c.ctx, time.Duration(c.config.KeepaliveInterval)*time.Second, c.config.KeepaliveCount, c.logger)
+	}
+
+	// for exporting metrics to a StatsD collector
+	if c.config.StatsdAddr != "" {
+		utils.InitStatsd(c.ctx, c.config.StatsdAddr, c.config.StatsdPrefix, c.config.StatsdTags, c.logger)
+	}
+
+	// for pushing stats snapshots to a webhook
+	if c.config.StatsWebhook != "" {
+		utils.InitWebhook(c.ctx, c.config.StatsWebhook, time.Duration(c.config.WebhookInterval)*time.Second, c.config.WebhookHeader, string(c.config.Transport), c.logger)
+	}
+
 	c.logger.Infof("client with remote address %s started successfully", c.config.RemoteAddr)
 
+	// run starts the transport once it is set up
+	var run func()
+
 	if c.config.Transport == config.TCP {
 		tcpConfig := &transport.TcpConfig{
-			RemoteAddr:     c.config.RemoteAddr,
-			Nodelay:        c.config.Nodelay,
-			KeepAlive:      time.Duration(c.config.Keepalive) * time.Second,
-			RetryInterval:  time.Duration(c.config.RetryInterval) * time.Second,
-			DialTimeOut:    time.Duration(c.config.DialTimeout) * time.Second,
-			ConnPoolSize:   c.config.ConnectionPool,
-			Token:          c.config.Token,
-			Sniffer:        c.config.Sniffer,
-			WebPort:        c.config.WebPort,
-			SnifferLog:     c.config.SnifferLog,
-			AggressivePool: c.config.AggressivePool,
+			RemoteAddr:              c.config.RemoteAddr,
+			Nodelay:                 c.config.Nodelay,
+			BackendNodelay:          *c.config.BackendNodelay,
+			KeepAlive:               keepAlive,
+			RetryInterval:           time.Duration(c.config.RetryInterval) * time.Second,
+			DialTimeOut:             time.Duration(c.config.DialTimeout) * time.Second,
+			ConnPoolSize:            c.config.ConnectionPool,
+			Token:                   c.config.Token,
+			Sniffer:                 c.config.Sniffer,
+			WebPort:                 c.config.WebPort,
+			SnifferMaxPorts:         c.config.SnifferMaxPorts,
+			SnifferRetention:        time.Duration(c.config.SnifferRetention) * time.Second,
+			SnifferLog:              c.config.SnifferLog,
+			AggressivePool:          c.config.AggressivePool,
+			PoolKeepalive:           time.Duration(c.config.PoolKeepalive) * time.Second,
+			Ports:                   c.config.Ports,
+			MaxPerTargetConnections: c.config.MaxPerTargetConnections,
+			BlockedTargetPorts:      c.config.BlockedTargetPorts,
+			MSSClamp:                c.config.MSSClamp,
+			ReadDeadline:            time.Duration(c.config.ReadDeadline) * time.Second,
+			WriteDeadline:           time.Duration(c.config.WriteDeadline) * time.Second,
+			BackendProxy:            c.config.BackendProxy,
+			BackendProbe:            c.config.BackendProbe,
+			EarlyPool:               c.config.EarlyPool,
+			HeartbeatAck:            c.config.HeartbeatAck,
+			HandshakeTimeout:        time.Duration(c.config.HandshakeTimeout) * time.Second,
+			UnresolvedBackoff:       time.Duration(c.config.UnresolvedBackoff) * time.Second,
+			LowLatencyPorts:         c.config.LowLatencyPorts,
+			BackpressureDelay:       time.Duration(c.config.BackpressureDelay) * time.Millisecond,
+			Encryption:              c.config.Encryption,
+			HandshakeVersion:        byte(c.config.HandshakeVersion),
+			ClientID:                c.config.ClientID,
+			BackendPool:             c.config.BackendPool,
+			BackendPoolIdle:         time.Duration(c.config.BackendPoolIdle) * time.Second,
+			BackendIdle:             time.Duration(c.config.BackendIdleTimeout) * time.Second,
+			SlowDial:                time.Duration(c.config.SlowDial) * time.Millisecond,
 		}
 		tcpClient := transport.NewTCPClient(c.ctx, tcpConfig, c.logger)
-		go tcpClient.Start()
+		run = tcpClient.Start
 
 	} else if c.config.Transport == config.TCPMUX {
 		tcpMuxConfig := &transport.TcpMuxConfig{
-			RemoteAddr:       c.config.RemoteAddr,
-			Nodelay:          c.config.Nodelay,
-			KeepAlive:        time.Duration(c.config.Keepalive) * time.Second,
-			RetryInterval:    time.Duration(c.config.RetryInterval) * time.Second,
-			DialTimeOut:      time.Duration(c.config.DialTimeout) * time.Second,
-			ConnPoolSize:     c.config.ConnectionPool,
-			Token:            c.config.Token,
-			MuxVersion:       c.config.MuxVersion,
-			MaxFrameSize:     c.config.MaxFrameSize,
-			MaxReceiveBuffer: c.config.MaxReceiveBuffer,
-			MaxStreamBuffer:  c.config.MaxStreamBuffer,
-			Sniffer:          c.config.Sniffer,
-			WebPort:          c.config.WebPort,
-			SnifferLog:       c.config.SnifferLog,
-			AggressivePool:   c.config.AggressivePool,
+			RemoteAddr:              c.config.RemoteAddr,
+			Nodelay:                 c.config.Nodelay,
+			BackendNodelay:          *c.config.BackendNodelay,
+			KeepAlive:               keepAlive,
+			RetryInterval:           time.Duration(c.config.RetryInterval) * time.Second,
+			DialTimeOut:             time.Duration(c.config.DialTimeout) * time.Second,
+			ConnPoolSize:            c.config.ConnectionPool,
+			Token:                   c.config.Token,
+			MuxVersion:              c.config.MuxVersion,
+			MaxFrameSize:            c.config.MaxFrameSize,
+			MaxReceiveBuffer:        c.config.MaxReceiveBuffer,
+			MaxStreamBuffer:         c.config.MaxStreamBuffer,
+			Sniffer:                 c.config.Sniffer,
+			WebPort:                 c.config.WebPort,
+			SnifferMaxPorts:         c.config.SnifferMaxPorts,
+			SnifferRetention:        time.Duration(c.config.SnifferRetention) * time.Second,
+			SnifferLog:              c.config.SnifferLog,
+			AggressivePool:          c.config.AggressivePool,
+			MaxPerTargetConnections: c.config.MaxPerTargetConnections,
+			BlockedTargetPorts:      c.config.BlockedTargetPorts,
+			MSSClamp:                c.config.MSSClamp,
+			ReadDeadline:            time.Duration(c.config.ReadDeadline) * time.Second,
+			WriteDeadline:           time.Duration(c.config.WriteDeadline) * time.Second,
+			BackendProxy:            c.config.BackendProxy,
+			BackendProbe:            c.config.BackendProbe,
+			HeartbeatAck:            c.config.HeartbeatAck,
+			HandshakeTimeout:        time.Duration(c.config.HandshakeTimeout) * time.Second,
+			UnresolvedBackoff:       time.Duration(c.config.UnresolvedBackoff) * time.Second,
+			LowLatencyPorts:         c.config.LowLatencyPorts,
+			OrderedStreams:          c.config.OrderedStreams,
+			BackpressureDelay:       time.Duration(c.config.BackpressureDelay) * time.Millisecond,
+			Encryption:              c.config.Encryption,
+			HandshakeVersion:        byte(c.config.HandshakeVersion),
+			ClientID:                c.config.ClientID,
+			BackendPool:             c.config.BackendPool,
+			BackendPoolIdle:         time.Duration(c.config.BackendPoolIdle) * time.Second,
+			BackendIdle:             time.Duration(c.config.BackendIdleTimeout) * time.Second,
+			SlowDial:                time.Duration(c.config.SlowDial) * time.Millisecond,
+		}
+		tcpMuxClient, err := transport.NewMuxClient(c.ctx, tcpMuxConfig, c.logger)
+		if err != nil {
+			c.cancel()
+			return err
 		}
-		tcpMuxClient := transport.NewMuxClient(c.ctx, tcpMuxConfig, c.logger)
-		go tcpMuxClient.Start()
+		run = tcpMuxClient.Start
+
+	} else if c.config.Transport == config.TCPSINGLE {
+		tcpSingleConfig := &transport.TcpSingleConfig{
+			RemoteAddr:              c.config.RemoteAddr,
+			Nodelay:                 c.config.Nodelay,
+			BackendNodelay:          *c.config.BackendNodelay,
+			KeepAlive:               keepAlive,
+			RetryInterval:           time.Duration(c.config.RetryInterval) * time.Second,
+			DialTimeOut:             time.Duration(c.config.DialTimeout) * time.Second,
+			Token:                   c.config.Token,
+			MuxVersion:              c.config.MuxVersion,
+			MaxFrameSize:            c.config.MaxFrameSize,
+			MaxReceiveBuffer:        c.config.MaxReceiveBuffer,
+			MaxStreamBuffer:         c.config.MaxStreamBuffer,
+			Sniffer:                 c.config.Sniffer,
+			WebPort:                 c.config.WebPort,
+			SnifferMaxPorts:         c.config.SnifferMaxPorts,
+			SnifferRetention:        time.Duration(c.config.SnifferRetention) * time.Second,
+			SnifferLog:              c.config.SnifferLog,
+			MaxPerTargetConnections: c.config.MaxPerTargetConnections,
+			BlockedTargetPorts:      c.config.BlockedTargetPorts,
+			MSSClamp:                c.config.MSSClamp,
+			ReadDeadline:            time.Duration(c.config.ReadDeadline) * time.Second,
+			WriteDeadline:           time.Duration(c.config.WriteDeadline) * time.Second,
+			BackendProxy:            c.config.BackendProxy,
+			BackendProbe:            c.config.BackendProbe,
+			HeartbeatAck:            c.config.HeartbeatAck,
+			HandshakeTimeout:        time.Duration(c.config.HandshakeTimeout) * time.Second,
+			UnresolvedBackoff:       time.Duration(c.config.UnresolvedBackoff) * time.Second,
+			HandshakeVersion:        byte(c.config.HandshakeVersion),
+			ClientID:                c.config.ClientID,
+			BackendPool:             c.config.BackendPool,
+			BackendPoolIdle:         time.Duration(c.config.BackendPoolIdle) * time.Second,
+			BackendIdle:             time.Duration(c.config.BackendIdleTimeout) * time.Second,
+			SlowDial:                time.Duration(c.config.SlowDial) * time.Millisecond,
+		}
+		tcpSingleClient, err := transport.NewTcpSingleClient(c.ctx, tcpSingleConfig, c.logger)
+		if err != nil {
+			c.cancel()
+			return err
+		}
+		run = tcpSingleClient.Start
 
 	} else if c.config.Transport == config.WS || c.config.Transport == config.WSS {
 		WsConfig := &transport.WsConfig{
-			RemoteAddr:     c.config.RemoteAddr,
-			Nodelay:        c.config.Nodelay,
-			KeepAlive:      time.Duration(c.config.Keepalive) * time.Second,
-			RetryInterval:  time.Duration(c.config.RetryInterval) * time.Second,
-			DialTimeOut:    time.Duration(c.config.DialTimeout) * time.Second,
-			ConnPoolSize:   c.config.ConnectionPool,
-			Token:          c.config.Token,
-			Sniffer:        c.config.Sniffer,
-			WebPort:        c.config.WebPort,
-			SnifferLog:     c.config.SnifferLog,
-			Mode:           c.config.Transport,
-			AggressivePool: c.config.AggressivePool,
-			EdgeIP:         c.config.EdgeIP,
+			RemoteAddr:              c.config.RemoteAddr,
+			Nodelay:                 c.config.Nodelay,
+			BackendNodelay:          *c.config.BackendNodelay,
+			KeepAlive:               keepAlive,
+			RetryInterval:           time.Duration(c.config.RetryInterval) * time.Second,
+			DialTimeOut:             time.Duration(c.config.DialTimeout) * time.Second,
+			ConnPoolSize:            c.config.ConnectionPool,
+			Token:                   c.config.Token,
+			Sniffer:                 c.config.Sniffer,
+			WebPort:                 c.config.WebPort,
+			SnifferMaxPorts:         c.config.SnifferMaxPorts,
+			SnifferRetention:        time.Duration(c.config.SnifferRetention) * time.Second,
+			SnifferLog:              c.config.SnifferLog,
+			Mode:                    c.config.Transport,
+			AggressivePool:          c.config.AggressivePool,
+			EdgeIP:                  c.config.EdgeIP,
+			TLSPSK:                  c.config.TLSPSK,
+			TLSServerName:           c.config.TLSServerName,
+			TLSPinnedCert:           c.config.TLSPinnedCert,
+			MaxPerTargetConnections: c.config.MaxPerTargetConnections,
+			BlockedTargetPorts:      c.config.BlockedTargetPorts,
+			MSSClamp:                c.config.MSSClamp,
+			BackendProxy:            c.config.BackendProxy,
+			BackendProbe:            c.config.BackendProbe,
+			UnresolvedBackoff:       time.Duration(c.config.UnresolvedBackoff) * time.Second,
+			StandbyChannel:          c.config.StandbyChannel,
+			BackpressureDelay:       time.Duration(c.config.BackpressureDelay) * time.Millisecond,
+			BackendPool:             c.config.BackendPool,
+			BackendPoolIdle:         time.Duration(c.config.BackendPoolIdle) * time.Second,
+			SlowDial:                time.Duration(c.config.SlowDial) * time.Millisecond,
 		}
 		WsClient := transport.NewWSClient(c.ctx, WsConfig, c.logger)
-		go WsClient.Start()
+		run = WsClient.Start
 
 	} else if c.config.Transport == config.WSMUX || c.config.Transport == config.WSSMUX {
 		wsMuxConfig := &transport.WsMuxConfig{
-			RemoteAddr:       c.config.RemoteAddr,
-			Nodelay:          c.config.Nodelay,
-			KeepAlive:        time.Duration(c.config.Keepalive) * time.Second,
-			RetryInterval:    time.Duration(c.config.RetryInterval) * time.Second,
-			DialTimeOut:      time.Duration(c.config.DialTimeout) * time.Second,
-			ConnPoolSize:     c.config.ConnectionPool,
-			Token:            c.config.Token,
-			MuxVersion:       c.config.MuxVersion,
-			MaxFrameSize:     c.config.MaxFrameSize,
-			MaxReceiveBuffer: c.config.MaxReceiveBuffer,
-			MaxStreamBuffer:  c.config.MaxStreamBuffer,
-			Sniffer:          c.config.Sniffer,
-			WebPort:          c.config.WebPort,
-			SnifferLog:       c.config.SnifferLog,
-			Mode:             c.config.Transport,
-			AggressivePool:   c.config.AggressivePool,
-			EdgeIP:           c.config.EdgeIP,
+			RemoteAddr:              c.config.RemoteAddr,
+			Nodelay:                 c.config.Nodelay,
+			BackendNodelay:          *c.config.BackendNodelay,
+			KeepAlive:               keepAlive,
+			RetryInterval:           time.Duration(c.config.RetryInterval) * time.Second,
+			DialTimeOut:             time.Duration(c.config.DialTimeout) * time.Second,
+			ConnPoolSize:            c.config.ConnectionPool,
+			Token:                   c.config.Token,
+			MuxVersion:              c.config.MuxVersion,
+			MaxFrameSize:            c.config.MaxFrameSize,
+			MaxReceiveBuffer:        c.config.MaxReceiveBuffer,
+			MaxStreamBuffer:         c.config.MaxStreamBuffer,
+			Sniffer:                 c.config.Sniffer,
+			WebPort:                 c.config.WebPort,
+			SnifferMaxPorts:         c.config.SnifferMaxPorts,
+			SnifferRetention:        time.Duration(c.config.SnifferRetention) * time.Second,
+			SnifferLog:              c.config.SnifferLog,
+			Mode:                    c.config.Transport,
+			AggressivePool:          c.config.AggressivePool,
+			EdgeIP:                  c.config.EdgeIP,
+			TLSPSK:                  c.config.TLSPSK,
+			TLSServerName:           c.config.TLSServerName,
+			TLSPinnedCert:           c.config.TLSPinnedCert,
+			MaxPerTargetConnections: c.config.MaxPerTargetConnections,
+			BlockedTargetPorts:      c.config.BlockedTargetPorts,
+			MSSClamp:                c.config.MSSClamp,
+			ReadDeadline:            time.Duration(c.config.ReadDeadline) * time.Second,
+			WriteDeadline:           time.Duration(c.config.WriteDeadline) * time.Second,
+			BackendProxy:            c.config.BackendProxy,
+			BackendProbe:            c.config.BackendProbe,
+			UnresolvedBackoff:       time.Duration(c.config.UnresolvedBackoff) * time.Second,
+			StandbyChannel:          c.config.StandbyChannel,
+			OrderedStreams:          c.config.OrderedStreams,
+			BackpressureDelay:       time.Duration(c.config.BackpressureDelay) * time.Millisecond,
+			ControlGrace:            time.Duration(c.config.ControlGrace) * time.Second,
+			BackendPool:             c.config.BackendPool,
+			BackendPoolIdle:         time.Duration(c.config.BackendPoolIdle) * time.Second,
+			BackendIdle:             time.Duration(c.config.BackendIdleTimeout) * time.Second,
+			SlowDial:                time.Duration(c.config.SlowDial) * time.Millisecond,
 		}
-		wsMuxClient := transport.NewWSMuxClient(c.ctx, wsMuxConfig, c.logger)
-		go wsMuxClient.Start()
+		wsMuxClient, err := transport.NewWSMuxClient(c.ctx, wsMuxConfig, c.logger)
+		if err != nil {
+			c.cancel()
+			return err
+		}
+		run = wsMuxClient.Start
 
 	} else if c.config.Transport == config.QUIC {
 		quicConfig := &transport.QuicConfig{
-			RemoteAddr:     c.config.RemoteAddr,
-			Nodelay:        c.config.Nodelay,
-			KeepAlive:      time.Duration(c.config.Keepalive) * time.Second,
-			RetryInterval:  time.Duration(c.config.RetryInterval) * time.Second,
-			DialTimeOut:    time.Duration(c.config.DialTimeout) * time.Second,
-			ConnectionPool: c.config.ConnectionPool,
-			Token:          c.config.Token,
-			Sniffer:        c.config.Sniffer,
-			WebPort:        c.config.WebPort,
-			SnifferLog:     c.config.SnifferLog,
-			AggressivePool: c.config.AggressivePool,
+			RemoteAddr:              c.config.RemoteAddr,
+			Nodelay:                 c.config.Nodelay,
+			BackendNodelay:          *c.config.BackendNodelay,
+			KeepAlive:               keepAlive,
+			RetryInterval:           time.Duration(c.config.RetryInterval) * time.Second,
+			DialTimeOut:             time.Duration(c.config.DialTimeout) * time.Second,
+			ConnectionPool:          c.config.ConnectionPool,
+			Token:                   c.config.Token,
+			Sniffer:                 c.config.Sniffer,
+			WebPort:                 c.config.WebPort,
+			SnifferMaxPorts:         c.config.SnifferMaxPorts,
+			SnifferRetention:        time.Duration(c.config.SnifferRetention) * time.Second,
+			SnifferLog:              c.config.SnifferLog,
+			AggressivePool:          c.config.AggressivePool,
+			MaxPerTargetConnections: c.config.MaxPerTargetConnections,
+			BlockedTargetPorts:      c.config.BlockedTargetPorts,
+			MSSClamp:                c.config.MSSClamp,
+			HandshakeTimeout:        time.Duration(c.config.HandshakeTimeout) * time.Second,
 		}
 		quicClient := transport.NewQuicClient(c.ctx, quicConfig, c.logger)
-		go quicClient.ChannelDialer(true)
+		run = func() { quicClient.ChannelDialer(true) }
 
 	} else if c.config.Transport == config.UDP {
 		udpConfig := &transport.UdpConfig{
-			RemoteAddr:     c.config.RemoteAddr,
-			RetryInterval:  time.Duration(c.config.RetryInterval) * time.Second,
-			DialTimeOut:    time.Duration(c.config.DialTimeout) * time.Second,
-			ConnPoolSize:   c.config.ConnectionPool,
-			Token:          c.config.Token,
-			Sniffer:        c.config.Sniffer,
-			WebPort:        c.config.WebPort,
-			SnifferLog:     c.config.SnifferLog,
-			AggressivePool: c.config.AggressivePool,
+			RemoteAddr:       c.config.RemoteAddr,
+			RetryInterval:    time.Duration(c.config.RetryInterval) * time.Second,
+			DialTimeOut:      time.Duration(c.config.DialTimeout) * time.Second,
+			ConnPoolSize:     c.config.ConnectionPool,
+			Token:            c.config.Token,
+			Sniffer:          c.config.Sniffer,
+			WebPort:          c.config.WebPort,
+			SnifferMaxPorts:  c.config.SnifferMaxPorts,
+			SnifferRetention: time.Duration(c.config.SnifferRetention) * time.Second,
+			SnifferLog:       c.config.SnifferLog,
+			AggressivePool:   c.config.AggressivePool,
+			HandshakeTimeout: time.Duration(c.config.HandshakeTimeout) * time.Second,
+			HandshakeVersion: byte(c.config.HandshakeVersion),
+			ClientID:         c.config.ClientID,
 		}
 		udpClient := transport.NewUDPClient(c.ctx, udpConfig, c.logger)
-		go udpClient.Start()
+		run = udpClient.Start
 
 	} else {
-		c.logger.Fatal("invalid transport type: ", c.config.Transport)
+		c.cancel()
+		return fmt.Errorf("invalid transport type: %s", c.config.Transport)
+	}
+
+	// On a reload the tunnel starts once the running instance released it
+	if utils.WaitCutover(c.ctx) {
+		go run()
 	}
 
 	<-c.ctx.Done()
@@ -169,9 +394,52 @@ func (c *Client) Start() {
 	// supress other logs
 	c.logger.SetLevel(logrus.FatalLevel)
 
+	return nil
 }
 func (c *Client) Stop() {
 	if c.cancel != nil {
 		c.cancel()
 	}
 }
+
+// transportInfo describes the transport and its key settings for the web monitor.
+func (c *Client) transportInfo() web.TransportInfo {
+	info := web.TransportInfo{
+		Transport:  string(c.config.Transport),
+		Parameters: []string{fmt.Sprintf("connection_pool %d", c.config.ConnectionPool)},
+	}
+
+	switch c.config.Transport {
+	case config.TCPMUX, config.TCPSINGLE, config.WSMUX, config.WSSMUX:
+		info.Parameters = append(info.Parameters,
+			fmt.Sprintf("mux_session %d", c.config.MuxSession),
+			fmt.Sprintf("mux_version %d", c.config.MuxVersion),
+			fmt.Sprintf("mux_framesize %d", c.config.MaxFrameSize),
+			fmt.Sprintf("mux_recievebuffer %d", c.config.MaxReceiveBuffer),
+			fmt.Sprintf("mux_streambuffer %d", c.config.MaxStreamBuffer),
+		)
+	}
+	if c.config.BackendPool > 0 {
+		info.Parameters = append(info.Parameters, fmt.Sprintf("backend_pool %d", c.config.BackendPool))
+	}
+
+	features := []struct {
+		name    string
+		enabled bool
+	}{
+		{"nodelay", c.config.Nodelay},
+		{"encryption", c.config.Encryption && (c.config.Transport == config.TCP || c.config.Transport == config.TCPMUX)},
+		{"tls", c.config.Transport == config.WSS || c.config.Transport == config.WSSMUX || c.config.Transport == config.QUIC},
+		{"tls_psk", c.config.TLSPSK && (c.config.Transport == config.WSS || c.config.Transport == config.WSSMUX)},
+		{"aggressive_pool", c.config.AggressivePool},
+		{"early_pool", c.config.EarlyPool && c.config.Transport == config.TCP},
+		{"sniffer", c.config.Sniffer},
+	}
+	for _, feature := range features {
+		if feature.enabled {
+			info.Features = append(info.Features, feature.name)
+		}
+	}
+
+	return info
+}
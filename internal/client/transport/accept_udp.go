@@ -7,6 +7,7 @@ import (
 	"net"
 	"time"
 
+	"github.com/musix/backhaul/internal/utils"
 	"github.com/musix/backhaul/internal/web"
 	"github.com/sirupsen/logrus"
 )
@@ -16,17 +17,24 @@ const BufferSize = 16 * 1024
 func UDPDialer(tcp net.Conn, remoteAddr string, logger *logrus.Logger, usage *web.Usage, remotePort int, sniffer bool) {
 	remoteUDPAddr, err := net.ResolveUDPAddr("udp", remoteAddr)
 	if err != nil {
-		logger.Fatalf("failed to resolve remote address: %v", err)
+		logger.Errorf("failed to resolve remote address %s: %v", remoteAddr, err)
+		tcp.Close()
+		return
 	}
 
 	// Dial the remote UDP server
 	remoteConn, err := net.DialUDP("udp", nil, remoteUDPAddr)
 	if err != nil {
-		logger.Fatalf("failed to dial remote UDP address: %v", err)
+		logger.Errorf("failed to dial remote UDP address %s: %v", remoteAddr, err)
+		tcp.Close()
+		return
 	}
 
 	defer remoteConn.Close()
 
+	utils.OpenConnection()
+	defer utils.CloseConnection()
+
 	done := make(chan struct{})
 
 	go func() {
@@ -82,6 +90,7 @@ func tcpToUDP(tcp net.Conn, udp *net.UDPConn, logger *logrus.Logger, usage *web.
 		}
 
 		logger.Tracef("read %d bytes from TCP, wrote %d bytes to UDP", packetSize, totalWritten)
+		utils.CountTraffic(true, totalWritten)
 
 		if sniffer {
 			usage.AddOrUpdatePort(remotePort, uint64(totalWritten))
@@ -145,6 +154,7 @@ func udpToTCP(tcp net.Conn, udp *net.UDPConn, logger *logrus.Logger, usage *web.
 		}
 
 		logger.Tracef("read %d bytes from UDP, wrote %d bytes to TCP", r, totalWritten)
+		utils.CountTraffic(false, r)
 
 		if sniffer {
 			usage.AddOrUpdatePort(remotePort, uint64(totalWritten))
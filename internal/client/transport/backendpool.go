@@ -0,0 +1,191 @@
+package transport
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/musix/backhaul/internal/utils"
+	"github.com/sirupsen/logrus"
+)
+
+// BackendPool keeps a few connections dialed ahead to every backend in use, a
+// forwarded connection takes one of them instead of waiting for the dial. The
+// connections are fresh and never reused once a forwarded connection ends, so
+// this works with every protocol. Idle connections are closed after maxIdle,
+// backends tend to drop them anyway, and a backend not used within maxIdle is
+// no longer kept warm. A nil BackendPool dials every connection.
+type BackendPool struct {
+	ctx     context.Context
+	size    int
+	maxIdle time.Duration
+	dial    func(address string) (net.Conn, error)
+	logger  *logrus.Logger
+
+	mu      sync.Mutex
+	targets map[string]*backendTarget
+	reaping bool
+}
+
+type backendTarget struct {
+	idle     []idleBackend // oldest first
+	dialing  int
+	lastUsed time.Time
+}
+
+type idleBackend struct {
+	conn   net.Conn
+	dialed time.Time
+}
+
+// NewBackendPool returns nil when size is 0, which disables the pool. dial
+// opens a connection to a backend the way a forwarded connection would.
+func NewBackendPool(ctx context.Context, size int, maxIdle time.Duration, dial func(address string) (net.Conn, error), logger *logrus.Logger) *BackendPool {
+	if size <= 0 {
+		return nil
+	}
+	return &BackendPool{
+		ctx:     ctx,
+		size:    size,
+		maxIdle: maxIdle,
+		dial:    dial,
+		logger:  logger,
+		targets: make(map[string]*backendTarget),
+	}
+}
+
+// Get returns an idle connection to address and dials a replacement in the
+// background, or falls back to dial when there is none. nodelay disables
+// Nagle on an idle connection for interactive traffic.
+func (p *BackendPool) Get(address string, nodelay bool, dial func() (net.Conn, error)) (net.Conn, error) {
+	if p == nil {
+		return dial()
+	}
+
+	p.mu.Lock()
+	if !p.reaping {
+		p.reaping = true
+		go p.reap()
+	}
+
+	target, ok := p.targets[address]
+	if !ok {
+		target = &backendTarget{}
+		p.targets[address] = target
+	}
+	target.lastUsed = time.Now()
+
+	var conn net.Conn
+	for len(target.idle) > 0 && conn == nil {
+		// The newest connection is the least likely to be dropped by the backend
+		last := target.idle[len(target.idle)-1]
+		target.idle = target.idle[:len(target.idle)-1]
+		if time.Since(last.dialed) < p.maxIdle {
+			conn = last.conn
+		} else {
+			last.conn.Close()
+		}
+	}
+	p.fill(address, target)
+	p.mu.Unlock()
+
+	if conn != nil {
+		if tcpConn, ok := conn.(interface{ SetNoDelay(bool) error }); ok && nodelay {
+			tcpConn.SetNoDelay(true)
+		}
+		return conn, nil
+	}
+	return dial()
+}
+
+// fill dials the connections target is short of, p.mu is held.
+func (p *BackendPool) fill(address string, target *backendTarget) {
+	for len(target.idle)+target.dialing < p.size {
+		target.dialing++
+		go func() {
+			conn, err := p.dial(address)
+
+			p.mu.Lock()
+			defer p.mu.Unlock()
+
+			target.dialing--
+			if err != nil {
+				p.logger.Debugf("failed to dial idle backend connection to %s: %v", address, err)
+				return
+			}
+			if p.ctx.Err() != nil || p.targets[address] != target {
+				conn.Close()
+				return
+			}
+			target.idle = append(target.idle, idleBackend{conn: conn, dialed: time.Now()})
+		}()
+	}
+}
+
+// reap closes idle connections older than maxIdle and stops keeping backends
+// warm that were not used within maxIdle, until ctx is done.
+func (p *BackendPool) reap() {
+	ticker := time.NewTicker(p.maxIdle / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.ctx.Done():
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			for address, target := range p.targets {
+				for _, idle := range target.idle {
+					idle.conn.Close()
+				}
+				delete(p.targets, address)
+			}
+			return
+
+		case <-ticker.C:
+			p.mu.Lock()
+			for address, target := range p.targets {
+				unused := time.Since(target.lastUsed) > p.maxIdle
+
+				fresh := target.idle[:0]
+				for _, idle := range target.idle {
+					if unused || time.Since(idle.dialed) >= p.maxIdle {
+						idle.conn.Close()
+					} else {
+						fresh = append(fresh, idle)
+					}
+				}
+				target.idle = fresh
+
+				if unused {
+					delete(p.targets, address)
+				} else {
+					p.fill(address, target)
+				}
+			}
+			p.mu.Unlock()
+		}
+	}
+}
+
+// timedDial times the backend dials of dial as the backend.dial StatsD timer
+// tagged with the target port, so slow backends show apart from the tunnel
+// latency. Dials slower than slow are logged, 0 logs none. Failed dials are
+// left out, their time is mostly the dial timeout.
+func timedDial(port int, target string, slow time.Duration, logger *logrus.Logger, dial func() (net.Conn, error)) func() (net.Conn, error) {
+	return func() (net.Conn, error) {
+		started := time.Now()
+		conn, err := dial()
+		if err != nil {
+			return nil, err
+		}
+
+		took := time.Since(started)
+		utils.StatsdTiming("backend.dial", took, "port:"+strconv.Itoa(port))
+		if slow > 0 && took > slow {
+			logger.Warnf("dialing backend %s took %v, more than %v", target, took.Round(time.Millisecond), slow)
+		}
+		return conn, nil
+	}
+}
@@ -0,0 +1,46 @@
+package transport
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// DialHold holds back new tunnel connections for a while once the server
+// signaled that its tunnel channel is full, instead of dialing into a channel
+// that discards them. Every further signal extends the hold.
+type DialHold struct {
+	delay time.Duration
+	until atomic.Int64 // unix nanoseconds the hold ends at
+}
+
+func NewDialHold(delay time.Duration) *DialHold {
+	return &DialHold{delay: delay}
+}
+
+// Hold starts the hold or extends it by delay from now.
+func (h *DialHold) Hold() {
+	h.until.Store(time.Now().Add(h.delay).UnixNano())
+}
+
+// Held reports whether new tunnel connections are held back, the pool does
+// not grow meanwhile.
+func (h *DialHold) Held() bool {
+	return time.Now().UnixNano() < h.until.Load()
+}
+
+// Wait blocks until the hold is over, it returns false if ctx is done first.
+func (h *DialHold) Wait(ctx context.Context) bool {
+	for {
+		remaining := time.Until(time.Unix(0, h.until.Load()))
+		if remaining <= 0 {
+			return true
+		}
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(remaining):
+		}
+	}
+}
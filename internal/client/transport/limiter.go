@@ -0,0 +1,53 @@
+package transport
+
+import (
+	"sync"
+)
+
+// TargetLimiter caps the number of concurrent connections dialed to each
+// local backend address. A limit of 0 disables the check.
+type TargetLimiter struct {
+	limit  int
+	mu     sync.Mutex
+	active map[string]int
+}
+
+func NewTargetLimiter(limit int) *TargetLimiter {
+	return &TargetLimiter{
+		limit:  limit,
+		active: make(map[string]int),
+	}
+}
+
+// Acquire reserves a connection slot for the target, it returns false when the
+// target already has the maximum number of connections.
+func (l *TargetLimiter) Acquire(target string) bool {
+	if l.limit <= 0 {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.active[target] >= l.limit {
+		return false
+	}
+	l.active[target]++
+
+	return true
+}
+
+// Release frees a slot previously reserved with Acquire.
+func (l *TargetLimiter) Release(target string) {
+	if l.limit <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.active[target]--
+	if l.active[target] <= 0 {
+		delete(l.active, target)
+	}
+}
@@ -0,0 +1,134 @@
+package transport
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// mirrorBacklog bounds the reads queued for a mirror. A mirror that falls
+// further behind is dropped, it never slows down the primary backend.
+const mirrorBacklog = 64
+
+// splitMirror splits a "primary+mirror" target, e.g.
+// "127.0.0.1:80+127.0.0.1:8080", the mirror is empty for a plain target.
+func splitMirror(target string) (string, string) {
+	primary, mirror, _ := strings.Cut(target, "+")
+	return strings.TrimSpace(primary), strings.TrimSpace(mirror)
+}
+
+// mirrorConn copies what is read from a tunnel connection to a mirror backend
+// whose responses are discarded, for shadow testing a backend with real
+// traffic. Errors of the mirror only end the mirroring.
+type mirrorConn struct {
+	net.Conn
+	copies   chan []byte
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// mirrorTraffic returns conn copying its reads to mirror, or conn itself when
+// there is no mirror or it may not be dialed. The mirror is dialed in the
+// background, the reads are queued meanwhile.
+func mirrorTraffic(ctx context.Context, conn net.Conn, mirror string, blocked []int, dial func(address string) (net.Conn, error), logger *logrus.Logger) net.Conn {
+	if mirror == "" {
+		return conn
+	}
+
+	port, resolvedAddr, err := ResolveRemoteAddr(mirror)
+	if err != nil {
+		logger.Warnf("not mirroring to %s: %v", mirror, err)
+		return conn
+	}
+	if portListed(port, blocked) {
+		logger.Warnf("not mirroring to %s, port %d is blocked", resolvedAddr, port)
+		return conn
+	}
+
+	m := &mirrorConn{
+		Conn:   conn,
+		copies: make(chan []byte, mirrorBacklog),
+		done:   make(chan struct{}),
+	}
+	go m.forward(ctx, resolvedAddr, dial, logger)
+	return m
+}
+
+func (m *mirrorConn) Read(b []byte) (int, error) {
+	n, err := m.Conn.Read(b)
+	if n > 0 {
+		select {
+		case <-m.done:
+		case m.copies <- append([]byte(nil), b[:n]...):
+		default:
+			// A gap would corrupt the mirrored stream, so the mirror is dropped as a whole
+			m.stop()
+		}
+	}
+	return n, err
+}
+
+func (m *mirrorConn) Close() error {
+	m.stop()
+	return m.Conn.Close()
+}
+
+// SetLinger passes a reset on to the TCP connection underneath.
+func (m *mirrorConn) SetLinger(sec int) error {
+	if tcpConn, ok := m.Conn.(interface{ SetLinger(int) error }); ok {
+		return tcpConn.SetLinger(sec)
+	}
+	return nil
+}
+
+func (m *mirrorConn) stop() {
+	m.stopOnce.Do(func() { close(m.done) })
+}
+
+func (m *mirrorConn) forward(ctx context.Context, address string, dial func(address string) (net.Conn, error), logger *logrus.Logger) {
+	mirror, err := dial(address)
+	if err != nil {
+		logger.Debugf("failed to dial mirror %s: %v", address, err)
+		m.stop()
+		return
+	}
+	defer mirror.Close()
+
+	go io.Copy(io.Discard, mirror)
+
+	write := func(b []byte) bool {
+		if _, err := mirror.Write(b); err != nil {
+			logger.Debugf("stopped mirroring to %s: %v", address, err)
+			m.stop()
+			return false
+		}
+		return true
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case b := <-m.copies:
+			if !write(b) {
+				return
+			}
+		case <-m.done:
+			// Hand over what was read before the connection closed
+			for {
+				select {
+				case b := <-m.copies:
+					if !write(b) {
+						return
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package transport
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// probeBackends dials every backend target once after the control channel is
+// up, the tunnel status only reads connected when all of them are reachable.
+// Targets use the "port" or "host:port" format of the port mappings.
+func probeBackends(ctx context.Context, status *string, connected string, targets []string, proxy string, timeout time.Duration, logger *logrus.Logger) {
+	if len(targets) == 0 {
+		return
+	}
+
+	*status = connected + ", checking backends"
+
+	unreachable := 0
+	for _, target := range targets {
+		_, resolvedAddr, err := ResolveRemoteAddr(target)
+		if err != nil {
+			logger.Errorf("invalid backend probe target %s: %v", target, err)
+			unreachable++
+			continue
+		}
+
+		conn, err := BackendDialer(ctx, resolvedAddr, proxy, timeout, 0, true, 0)
+		if err != nil {
+			logger.Warnf("backend %s is not reachable: %v", resolvedAddr, err)
+			unreachable++
+			continue
+		}
+		conn.Close()
+
+		logger.Debugf("backend %s is reachable", resolvedAddr)
+	}
+
+	// The tunnel was restarted while probing, the status belongs to the new run
+	if ctx.Err() != nil {
+		return
+	}
+
+	if unreachable > 0 {
+		*status = fmt.Sprintf("%s, %d/%d backends unreachable", connected, unreachable, len(targets))
+		return
+	}
+
+	*status = connected
+	logger.Infof("all %d backends are reachable", len(targets))
+}
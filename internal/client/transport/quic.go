@@ -28,26 +28,35 @@ type QuicTransport struct {
 	usageMonitor      *web.Usage
 	activeMu          sync.Mutex
 	restartMutex      sync.Mutex
+	restartPacer      restartPacer
 	activeConnections int
+	targetLimiter     *TargetLimiter
 }
 
 type QuicConfig struct {
-	RemoteAddr       string
-	Token            string
-	SnifferLog       string
-	TunnelStatus     string
-	Nodelay          bool
-	Sniffer          bool
-	KeepAlive        time.Duration
-	RetryInterval    time.Duration
-	DialTimeOut      time.Duration
-	MuxVersion       int
-	MaxFrameSize     int
-	MaxReceiveBuffer int
-	MaxStreamBuffer  int
-	ConnectionPool   int
-	WebPort          int
-	AggressivePool bool
+	RemoteAddr              string
+	Token                   string
+	SnifferLog              string
+	TunnelStatus            string
+	Nodelay                 bool
+	BackendNodelay          bool // Nodelay of the sockets facing the backends
+	Sniffer                 bool
+	KeepAlive               time.Duration
+	RetryInterval           time.Duration
+	DialTimeOut             time.Duration
+	MuxVersion              int
+	MaxFrameSize            int
+	MaxReceiveBuffer        int
+	MaxStreamBuffer         int
+	ConnectionPool          int
+	WebPort                 int
+	SnifferMaxPorts         int
+	SnifferRetention        time.Duration
+	AggressivePool          bool
+	MaxPerTargetConnections int           // Concurrent connections allowed per local address, 0 means unlimited
+	MSSClamp                int           // TCP_MAXSEG for local connections, 0 disables clamping
+	BlockedTargetPorts      []int         // Destination ports never dialed, whatever the server requests
+	HandshakeTimeout        time.Duration // Wait for the handshake response once connected, separate from DialTimeOut
 }
 
 func NewQuicClient(parentCtx context.Context, config *QuicConfig, logger *logrus.Logger) *QuicTransport {
@@ -69,13 +78,19 @@ func NewQuicClient(parentCtx context.Context, config *QuicConfig, logger *logrus
 		controlChannel:    nil, // will be set when a control connection is established
 		activeConnections: 0,
 		activeMu:          sync.Mutex{},
-		usageMonitor:      web.NewDataStore(fmt.Sprintf(":%v", config.WebPort), ctx, config.SnifferLog, config.Sniffer, &config.TunnelStatus, logger),
+		usageMonitor:      web.NewDataStore(fmt.Sprintf(":%v", config.WebPort), ctx, config.SnifferLog, config.Sniffer, &config.TunnelStatus, logger, config.SnifferMaxPorts, config.SnifferRetention),
+		targetLimiter:     NewTargetLimiter(config.MaxPerTargetConnections),
 	}
 
 	return client
 }
 
 func (c *QuicTransport) Restart() {
+	// Nothing to restart once the tunnel is shutting down, e.g. for a config reload
+	if c.parentctx.Err() != nil {
+		return
+	}
+
 	if !c.restartMutex.TryLock() {
 		c.logger.Warn("client is already restarting")
 		return
@@ -83,6 +98,7 @@ func (c *QuicTransport) Restart() {
 	defer c.restartMutex.Unlock()
 
 	c.logger.Info("restarting client...")
+	utils.CountRestart()
 	if c.cancel != nil {
 		c.cancel()
 	}
@@ -90,7 +106,8 @@ func (c *QuicTransport) Restart() {
 	//Close tunnel channel connection
 	c.closeControlChannel("restart")
 
-	time.Sleep(2 * time.Second)
+	// Redial right away unless the tunnel keeps dropping
+	c.restartPacer.wait(c.config.RetryInterval)
 
 	ctx, cancel := context.WithCancel(c.parentctx)
 	c.ctx = ctx
@@ -98,11 +115,15 @@ func (c *QuicTransport) Restart() {
 
 	// Re-initialize variables
 	c.controlChannel = nil
-	c.usageMonitor = web.NewDataStore(fmt.Sprintf(":%v", c.config.WebPort), ctx, c.config.SnifferLog, c.config.Sniffer, &c.config.TunnelStatus, c.logger)
+	c.usageMonitor = web.NewDataStore(fmt.Sprintf(":%v", c.config.WebPort), ctx, c.config.SnifferLog, c.config.Sniffer, &c.config.TunnelStatus, c.logger, c.config.SnifferMaxPorts, c.config.SnifferRetention)
 	c.config.TunnelStatus = ""
 	c.activeConnections = 0
 	c.activeMu = sync.Mutex{}
 
+	if c.parentctx.Err() != nil {
+		return
+	}
+
 	go c.ChannelDialer(true)
 
 }
@@ -142,7 +163,7 @@ func (c *QuicTransport) ChannelDialer(coldStart bool) {
 			}
 
 			// Set a read deadline for the token response
-			if err := stream.SetReadDeadline(time.Now().Add(2 * time.Second)); err != nil {
+			if err := stream.SetReadDeadline(time.Now().Add(c.config.HandshakeTimeout)); err != nil {
 				c.logger.Errorf("failed to set read deadline: %v", err)
 				stream.Close()
 				qConn.CloseWithError(1, "failed to set read deadline")
@@ -164,9 +185,10 @@ func (c *QuicTransport) ChannelDialer(coldStart bool) {
 			// Resetting the deadline (removes any existing deadline)
 			stream.SetReadDeadline(time.Time{})
 
-			if message == c.config.Token {
+			if utils.ValidToken(message, c.config.Token, 0) {
 				c.controlChannel = qConn
 				c.logger.Info("quic control channel established successfully")
+				utils.MarkReady(c.ctx)
 
 				// close stream
 				stream.Close()
@@ -357,6 +379,19 @@ func (c *QuicTransport) localDialer(stream quic.Stream, remoteAddr string) {
 			return
 		}
 	}
+	if portListed(port, c.config.BlockedTargetPorts) {
+		c.logger.Warnf("refusing connection to %s, port %d is blocked", remoteAddr, port)
+		stream.Close()
+		return
+	}
+
+	if !c.targetLimiter.Acquire(remoteAddr) {
+		c.logger.Warnf("connection limit reached for local address %s, rejecting connection", remoteAddr)
+		stream.Close()
+		return
+	}
+	defer c.targetLimiter.Release(remoteAddr)
+
 	localConnection, err := c.tcpDialer(remoteAddr)
 	if err != nil {
 		c.logger.Errorf("connecting to local address %s is not possible", remoteAddr)
@@ -365,7 +400,7 @@ func (c *QuicTransport) localDialer(stream quic.Stream, remoteAddr string) {
 	}
 
 	c.logger.Debugf("connected to local address %s successfully", remoteAddr)
-	utils.QConnectionHandler(localConnection, stream, c.logger, c.usageMonitor, int(port), c.config.Sniffer)
+	utils.QConnectionHandler(localConnection, stream, c.logger, c.usageMonitor, int(port), c.config.Sniffer, false)
 }
 
 func (c *QuicTransport) tcpDialer(address string) (*net.TCPConn, error) {
@@ -377,6 +412,7 @@ func (c *QuicTransport) tcpDialer(address string) (*net.TCPConn, error) {
 
 	// options
 	dialer := &net.Dialer{
+		Control:   utils.MSSControl(c.config.MSSClamp, c.logger),
 		Timeout:   c.config.DialTimeOut, // Set the connection timeout
 		KeepAlive: c.config.KeepAlive,   // Set the keep-alive duration
 	}
@@ -394,7 +430,7 @@ func (c *QuicTransport) tcpDialer(address string) (*net.TCPConn, error) {
 		return nil, fmt.Errorf("failed to convert net.Conn to *net.TCPConn")
 	}
 
-	if !c.config.Nodelay {
+	if !c.config.BackendNodelay {
 		err = tcpConn.SetNoDelay(false)
 		if err != nil {
 			tcpConn.Close()
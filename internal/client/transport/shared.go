@@ -2,18 +2,25 @@ package transport
 
 import (
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
 	"runtime"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/musix/backhaul/internal/config"
+	"github.com/musix/backhaul/internal/utils"
+	"github.com/musix/backhaul/internal/web"
+	"github.com/sirupsen/logrus"
 )
 
 func ResolveRemoteAddr(remoteAddr string) (int, string, error) {
@@ -42,7 +49,17 @@ func ResolveRemoteAddr(remoteAddr string) (int, string, error) {
 	return port, remoteAddr, nil
 }
 
-func TcpDialer(ctx context.Context, address string, timeout time.Duration, keepAlive time.Duration, nodelay bool, retry int) (*net.TCPConn, error) {
+// portListed reports whether port is one of ports, e.g. the blocked target ports.
+func portListed(port int, ports []int) bool {
+	for _, p := range ports {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
+
+func TcpDialer(ctx context.Context, address string, timeout time.Duration, keepAlive time.Duration, nodelay bool, retry int, mss int) (*net.TCPConn, error) {
 	var tcpConn *net.TCPConn
 	var err error
 
@@ -51,7 +68,7 @@ func TcpDialer(ctx context.Context, address string, timeout time.Duration, keepA
 
 	for i := 0; i < retries; i++ {
 		// Attempt to establish a TCP connection
-		tcpConn, err = attemptTcpDialer(ctx, address, timeout, keepAlive, nodelay)
+		tcpConn, err = attemptTcpDialer(ctx, address, timeout, keepAlive, nodelay, mss)
 		if err == nil {
 			// Connection successful
 			return tcpConn, nil
@@ -70,18 +87,30 @@ func TcpDialer(ctx context.Context, address string, timeout time.Duration, keepA
 	return nil, err
 }
 
-func attemptTcpDialer(ctx context.Context, address string, timeout time.Duration, keepAlive time.Duration, nodelay bool) (*net.TCPConn, error) {
+func attemptTcpDialer(ctx context.Context, address string, timeout time.Duration, keepAlive time.Duration, nodelay bool, mss int) (*net.TCPConn, error) {
 	//Resolve the address to a TCP address
 	tcpAddr, err := net.ResolveTCPAddr("tcp", address)
 	if err != nil {
-		return nil, fmt.Errorf("DNS resolution: %v", err)
+		return nil, fmt.Errorf("DNS resolution: %w", err)
 	}
 
 	// Options
 	dialer := &net.Dialer{
-		Control:   ReusePortControl,
-		Timeout:   timeout,   // Set the connection timeout
-		KeepAlive: keepAlive, // Set the keep-alive duration
+		Control: func(network, address string, s syscall.RawConn) error {
+			if err := ReusePortControl(network, address, s); err != nil {
+				return err
+			}
+			if err := utils.CongestionControl(network, address, s); err != nil {
+				return err
+			}
+			if err := utils.SocketBuffers(network, address, s); err != nil {
+				return err
+			}
+			return utils.MSSControl(mss, nil)(network, address, s)
+		},
+		Timeout:         timeout,                          // Set the connection timeout
+		KeepAlive:       keepAlive,                        // Set the keep-alive duration
+		KeepAliveConfig: utils.KeepAliveConfig(keepAlive), // and the probes, which take precedence
 	}
 
 	// Dial the TCP connection with a timeout
@@ -135,7 +164,29 @@ func ReusePortControl(network, address string, s syscall.RawConn) error {
 	return controlErr
 }
 
-func WebSocketDialer(ctx context.Context, addr string, edgeIP string, path string, timeout time.Duration, keepalive time.Duration, nodelay bool, token string, mode config.TransportType, retry int) (*websocket.Conn, error) {
+// skipReplacement reports whether a pool connection the server just used is
+// left unreplaced for a pending pool shrink. That is only done while more idle
+// connections are left than assignments on their way, a shrink that could
+// leave a forward waiting for a new connection stays pending for a later one.
+func skipReplacement(controlFlow chan struct{}, poolConnections *int32, assigning *int32) bool {
+	select {
+	case <-controlFlow:
+	default:
+		return false
+	}
+
+	if atomic.LoadInt32(poolConnections) > atomic.LoadInt32(assigning) {
+		return true
+	}
+
+	select {
+	case controlFlow <- struct{}{}:
+	default:
+	}
+	return false
+}
+
+func WebSocketDialer(ctx context.Context, addr string, edgeIP string, path string, timeout time.Duration, keepalive time.Duration, nodelay bool, token string, mode config.TransportType, tlsConfig *tls.Config, muxVersion int, retry int) (*websocket.Conn, error) {
 	var tunnelWSConn *websocket.Conn
 	var err error
 
@@ -144,7 +195,7 @@ func WebSocketDialer(ctx context.Context, addr string, edgeIP string, path strin
 
 	for i := 0; i < retries; i++ {
 		// Attempt to dial the WebSocket
-		tunnelWSConn, err = attemptDialWebSocket(ctx, addr, edgeIP, path, timeout, keepalive, nodelay, token, mode)
+		tunnelWSConn, err = attemptDialWebSocket(ctx, addr, edgeIP, path, timeout, keepalive, nodelay, token, mode, tlsConfig, muxVersion)
 		if err == nil {
 			// If successful, return the connection
 			return tunnelWSConn, nil
@@ -163,11 +214,16 @@ func WebSocketDialer(ctx context.Context, addr string, edgeIP string, path strin
 	return nil, err
 }
 
-func attemptDialWebSocket(ctx context.Context, addr string, edgeIP string, path string, timeout time.Duration, keepalive time.Duration, nodelay bool, token string, mode config.TransportType) (*websocket.Conn, error) {
+func attemptDialWebSocket(ctx context.Context, addr string, edgeIP string, path string, timeout time.Duration, keepalive time.Duration, nodelay bool, token string, mode config.TransportType, tlsConfig *tls.Config, muxVersion int) (*websocket.Conn, error) {
 	// Setup headers with authorization
 	headers := http.Header{}
 	headers.Add("Authorization", fmt.Sprintf("Bearer %v", token))
 
+	// Lets the server refuse a wsmux client with another mux version right away
+	if muxVersion > 0 {
+		headers.Set(utils.MuxVersionHeader, strconv.Itoa(muxVersion))
+	}
+
 	var wsURL string
 	dialer := websocket.Dialer{}
 
@@ -190,7 +246,7 @@ func attemptDialWebSocket(ctx context.Context, addr string, edgeIP string, path
 			EnableCompression: true,
 			HandshakeTimeout:  45 * time.Second, // default handshake timeout
 			NetDial: func(_, addr string) (net.Conn, error) {
-				conn, err := TcpDialer(ctx, edgeIP, timeout, keepalive, nodelay, 1)
+				conn, err := TcpDialer(ctx, edgeIP, timeout, keepalive, nodelay, 1, 0)
 				if err != nil {
 					return nil, err
 				}
@@ -200,17 +256,17 @@ func attemptDialWebSocket(ctx context.Context, addr string, edgeIP string, path
 	} else if mode == config.WSS || mode == config.WSSMUX {
 		wsURL = fmt.Sprintf("wss://%s%s", addr, path)
 
-		// Create a TLS configuration that allows insecure connections
-		tlsConfig := &tls.Config{
-			InsecureSkipVerify: true, // Skip server certificate verification
+		// Fall back to a TLS configuration that allows insecure connections
+		if tlsConfig == nil {
+			tlsConfig = ClientTLSConfig(token, false, "", "")
 		}
 
 		dialer = websocket.Dialer{
 			EnableCompression: true,
-			TLSClientConfig:   tlsConfig,        // Pass the insecure TLS config here
+			TLSClientConfig:   tlsConfig,
 			HandshakeTimeout:  45 * time.Second, // default handshake timeout
 			NetDial: func(_, addr string) (net.Conn, error) {
-				conn, err := TcpDialer(ctx, edgeIP, timeout, keepalive, nodelay, 1)
+				conn, err := TcpDialer(ctx, edgeIP, timeout, keepalive, nodelay, 1, 0)
 				if err != nil {
 					return nil, err
 				}
@@ -220,9 +276,145 @@ func attemptDialWebSocket(ctx context.Context, addr string, edgeIP string, path
 	}
 
 	// Dial to the WebSocket server
-	tunnelWSConn, _, err := dialer.Dial(wsURL, headers)
+	tunnelWSConn, resp, err := dialer.Dial(wsURL, headers)
 	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusConflict {
+			return nil, fmt.Errorf("server already has a control channel for this token, is another client using it? %w", err)
+		}
+		if resp != nil && resp.StatusCode == http.StatusPreconditionFailed {
+			if version, err := strconv.Atoi(resp.Header.Get(utils.MuxVersionHeader)); err == nil {
+				return nil, utils.MuxVersionMismatch("the server", version, muxVersion)
+			}
+		}
 		return nil, err
 	}
+
+	// The dialer offers permessage-deflate, the server decides whether to use it
+	compression := "off"
+	if strings.Contains(resp.Header.Get("Sec-WebSocket-Extensions"), "permessage-deflate") {
+		compression = "permessage-deflate"
+	}
+	web.SetNegotiated("compression", compression)
+
 	return tunnelWSConn, nil
 }
+
+// ClientTLSConfig builds the TLS configuration used by the wss and wssmux dialers.
+// In PSK mode the server certificate must be derived from the shared token.
+// A pinnedCert, the hex SHA-256 fingerprint of the server certificate, accepts
+// only that certificate, and the certificate must also be valid for serverName
+// if set. serverName alone verifies the certificate against the system roots.
+// Otherwise certificate verification is skipped.
+func ClientTLSConfig(token string, psk bool, serverName string, pinnedCert string) *tls.Config {
+	var checks []func(tls.ConnectionState) error
+	if psk {
+		checks = append(checks, utils.VerifyPSKCertificate(token))
+	}
+	if pinnedCert != "" {
+		checks = append(checks, verifyPinnedCertificate(pinnedCert, serverName))
+	}
+
+	if len(checks) == 0 {
+		return &tls.Config{
+			ServerName:         serverName,
+			InsecureSkipVerify: serverName == "", // Skip server certificate verification unless a name is expected
+		}
+	}
+
+	return &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: true, // Chain verification is replaced by VerifyConnection
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			for _, check := range checks {
+				if err := check(cs); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}
+}
+
+// verifyPinnedCertificate accepts only the server certificate with the SHA-256
+// fingerprint pinned, which must be valid for serverName when it is set. Self
+// signed certificates can be pinned, they are not checked against any root.
+func verifyPinnedCertificate(pinned string, serverName string) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return errors.New("tls: server presented no certificate")
+		}
+
+		leaf := cs.PeerCertificates[0]
+		fingerprint := sha256.Sum256(leaf.Raw)
+		if hex.EncodeToString(fingerprint[:]) != pinned {
+			return fmt.Errorf("tls: server certificate fingerprint %x does not match tls_pinned_cert", fingerprint)
+		}
+
+		if serverName != "" {
+			if err := leaf.VerifyHostname(serverName); err != nil {
+				return fmt.Errorf("tls: pinned certificate is not valid for %s: %w", serverName, err)
+			}
+		}
+
+		return nil
+	}
+}
+
+// restartPacer spaces the restarts of a client. The first one redials right
+// away, one following it within the retry interval waits for the rest of it.
+type restartPacer struct {
+	last time.Time
+}
+
+// wait returns once the client may redial, it is called with the restart lock held.
+func (p *restartPacer) wait(interval time.Duration) {
+	if elapsed := time.Since(p.last); elapsed < interval {
+		time.Sleep(interval - elapsed)
+	}
+	p.last = time.Now()
+}
+
+// handshakeFallback picks the control channel handshake version within one
+// reconnect cycle. A server that predates the versioned handshake reads it as
+// a long legacy token and never answers, so after an unanswered handshake the
+// legacy one is tried once right away. Nothing is remembered across cycles,
+// every reconnect tries the configured version first, so a dropped answer or
+// an on-path attacker cannot downgrade the client for good.
+type handshakeFallback struct {
+	trying bool // the legacy handshake is tried after an unanswered one
+}
+
+// version returns the handshake version to send instead of configured.
+func (f *handshakeFallback) version(configured byte) byte {
+	if f.trying {
+		return 0
+	}
+	return configured
+}
+
+// unanswered reports whether the handshake is retried right away with the
+// legacy version.
+func (f *handshakeFallback) unanswered(configured byte, logger *logrus.Logger) bool {
+	if f.trying {
+		// Not an older server, the server is just not answering
+		f.trying = false
+		return false
+	}
+	if configured == 0 {
+		return false
+	}
+
+	f.trying = true
+	logger.Warnf("no answer to the version %d handshake, retrying with the legacy handshake in case the server predates it", configured)
+	return true
+}
+
+// answered records that the server answered the handshake.
+func (f *handshakeFallback) answered(configured byte, logger *logrus.Logger) {
+	if !f.trying {
+		return
+	}
+
+	f.trying = false
+	logger.Warnf("the server only answered the legacy handshake, connected without client_id and session resumption, the next reconnect tries version %d again", configured)
+}
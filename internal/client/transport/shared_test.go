@@ -0,0 +1,90 @@
+package transport
+
+import (
+	"sync/atomic"
+	"testing"
+)
+
+// pool follows the counters a transport keeps for its pool connections.
+type pool struct {
+	controlFlow     chan struct{}
+	poolConnections int32
+	assigning       int32
+	dialed          int
+}
+
+// signal handles an SG_Chan as the channel handlers do, the server announced
+// a forward that takes one of the idle pool connections.
+func (p *pool) signal() {
+	atomic.AddInt32(&p.assigning, 1)
+	if !skipReplacement(p.controlFlow, &p.poolConnections, &p.assigning) {
+		p.dialed++
+		atomic.AddInt32(&p.poolConnections, 1)
+	}
+}
+
+// assign hands an idle pool connection to the forward that was announced.
+func (p *pool) assign() {
+	atomic.AddInt32(&p.poolConnections, -1)
+	atomic.AddInt32(&p.assigning, -1)
+}
+
+func TestSkipReplacementShrinksPool(t *testing.T) {
+	p := &pool{controlFlow: make(chan struct{}, 100), poolConnections: 4}
+
+	// The pool size is lowered by two while the connections are in use
+	p.controlFlow <- struct{}{}
+	p.controlFlow <- struct{}{}
+
+	for i := 0; i < 2; i++ {
+		p.signal()
+		p.assign()
+	}
+
+	if p.dialed != 0 {
+		t.Errorf("dialed %d replacements while shrinking the pool, want none", p.dialed)
+	}
+	if p.poolConnections != 2 {
+		t.Errorf("pool has %d connections after shrinking by two, want 2", p.poolConnections)
+	}
+	if len(p.controlFlow) != 0 {
+		t.Errorf("%d shrinks are still pending, want none", len(p.controlFlow))
+	}
+
+	// With the shrinks done a used connection is replaced again
+	p.signal()
+	p.assign()
+	if p.dialed != 1 {
+		t.Errorf("dialed %d replacements after the shrink, want 1", p.dialed)
+	}
+}
+
+func TestSkipReplacementKeepsAssignedConnections(t *testing.T) {
+	p := &pool{controlFlow: make(chan struct{}, 100), poolConnections: 2}
+	p.controlFlow <- struct{}{}
+
+	// Both idle connections are announced before either is assigned, skipping
+	// a replacement would leave the second forward without a connection
+	atomic.AddInt32(&p.assigning, 1)
+	p.signal()
+
+	if p.dialed != 1 {
+		t.Errorf("dialed %d replacements with every connection announced, want 1", p.dialed)
+	}
+	if len(p.controlFlow) != 1 {
+		t.Errorf("%d shrinks are pending, want the one to stay for a later connection", len(p.controlFlow))
+	}
+}
+
+func TestSkipReplacementWithoutShrink(t *testing.T) {
+	p := &pool{controlFlow: make(chan struct{}, 100), poolConnections: 4}
+
+	for i := 0; i < 3; i++ {
+		p.signal()
+		p.assign()
+	}
+
+	if p.dialed != 3 {
+		t.Errorf("dialed %d replacements for 3 used connections, want 3", p.dialed)
+	}
+}
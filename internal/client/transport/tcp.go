@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -21,25 +22,57 @@ type TcpTransport struct {
 	cancel          context.CancelFunc
 	logger          *logrus.Logger
 	controlChannel  net.Conn
+	resume          string // resumption token of the last handshake answer
 	usageMonitor    *web.Usage
 	restartMutex    sync.Mutex
+	restartPacer    restartPacer
 	poolConnections int32
 	loadConnections int32
+	assigning       int32 // connections requested with SG_Chan that no pool connection was assigned yet
 	controlFlow     chan struct{}
+	targetLimiter   *TargetLimiter
+	unresolved      *UnresolvedTargets
+	backendPool     *BackendPool
+	dialHold        *DialHold
 }
 type TcpConfig struct {
-	RemoteAddr     string
-	Token          string
-	SnifferLog     string
-	TunnelStatus   string
-	KeepAlive      time.Duration
-	RetryInterval  time.Duration
-	DialTimeOut    time.Duration
-	ConnPoolSize   int
-	WebPort        int
-	Nodelay        bool
-	Sniffer        bool
-	AggressivePool bool
+	RemoteAddr              string
+	Token                   string
+	SnifferLog              string
+	TunnelStatus            string
+	KeepAlive               time.Duration
+	RetryInterval           time.Duration
+	DialTimeOut             time.Duration
+	ConnPoolSize            int
+	WebPort                 int
+	SnifferMaxPorts         int
+	SnifferRetention        time.Duration
+	Nodelay                 bool
+	BackendNodelay          bool // Nodelay of the sockets facing the backends
+	Sniffer                 bool
+	AggressivePool          bool
+	PoolKeepalive           time.Duration // Least server ping interval assumed on idle pool connections, 0 disables the check
+	MaxPerTargetConnections int           // Concurrent connections allowed per local address, 0 means unlimited
+	Ports                   []string      // "port" or "port=address" mappings to register on the server
+	MSSClamp                int           // TCP_MAXSEG for local connections, 0 disables clamping
+	ReadDeadline            time.Duration // Bound on a single read in the copy loop, 0 disables it
+	WriteDeadline           time.Duration // Bound on a single write in the copy loop, 0 disables it
+	BackendIdle             time.Duration // Close a forwarded connection after no data in either direction for this long, 0 disables it
+	BackendProxy            string        // HTTP CONNECT proxy URL for local connections, empty dials them directly
+	BackendProbe            []string      // Backends dialed once after connecting, the status reports unreachable ones
+	EarlyPool               bool          // Dial the initial pool while waiting for the token response
+	BlockedTargetPorts      []int         // Destination ports never dialed, whatever the server requests
+	LowLatencyPorts         []int         // Destination ports whose connections skip Nagle even without Nodelay
+	HeartbeatAck            bool          // Echo heartbeats back to the server
+	HandshakeTimeout        time.Duration // Wait for the handshake response once connected, separate from DialTimeOut
+	HandshakeVersion        byte          // Framing of the control channel handshake, 0 is the legacy one every server understands
+	ClientID                string        // Stable ID sent in the handshake so the server resumes the session of this client, needs HandshakeVersion 2
+	UnresolvedBackoff       time.Duration // Fail connections to a backend name that did not resolve for this long, 0 disables it
+	BackendPool             int           // Idle connections kept dialed to every backend in use, 0 dials each forwarded connection
+	BackendPoolIdle         time.Duration // Idle backend connections are closed after this long, and backends unused for this long are no longer kept warm
+	SlowDial                time.Duration // Log backend dials slower than this, 0 logs none
+	BackpressureDelay       time.Duration // Hold back new tunnel connections this long after the server signaled a full tunnel channel
+	Encryption              bool          // Encrypt tunnel connections with keys derived from the token, the server has to enable it as well
 }
 
 func NewTCPClient(parentCtx context.Context, config *TcpConfig, logger *logrus.Logger) *TcpTransport {
@@ -54,12 +87,19 @@ func NewTCPClient(parentCtx context.Context, config *TcpConfig, logger *logrus.L
 		cancel:          cancel,
 		logger:          logger,
 		controlChannel:  nil, // will be set when a control connection is established
-		usageMonitor:    web.NewDataStore(fmt.Sprintf(":%v", config.WebPort), ctx, config.SnifferLog, config.Sniffer, &config.TunnelStatus, logger),
+		usageMonitor:    web.NewDataStore(fmt.Sprintf(":%v", config.WebPort), ctx, config.SnifferLog, config.Sniffer, &config.TunnelStatus, logger, config.SnifferMaxPorts, config.SnifferRetention),
 		poolConnections: 0,
 		loadConnections: 0,
 		controlFlow:     make(chan struct{}, 100),
+		targetLimiter:   NewTargetLimiter(config.MaxPerTargetConnections),
+		unresolved:      NewUnresolvedTargets(config.UnresolvedBackoff, logger),
+		dialHold:        NewDialHold(config.BackpressureDelay),
 	}
 
+	// The connections kept warm are dialed like those of forwarded connections
+	client.backendPool = NewBackendPool(parentCtx, config.BackendPool, config.BackendPoolIdle, func(address string) (net.Conn, error) {
+		return BackendDialer(parentCtx, address, config.BackendProxy, config.DialTimeOut, config.KeepAlive, config.BackendNodelay, config.MSSClamp)
+	}, logger)
 	return client
 }
 
@@ -73,6 +113,11 @@ func (c *TcpTransport) Start() {
 	go c.channelDialer()
 }
 func (c *TcpTransport) Restart() {
+	// Nothing to restart once the tunnel is shutting down, e.g. for a config reload
+	if c.parentctx.Err() != nil {
+		return
+	}
+
 	if !c.restartMutex.TryLock() {
 		c.logger.Warn("client is already restarting")
 		return
@@ -80,6 +125,7 @@ func (c *TcpTransport) Restart() {
 	defer c.restartMutex.Unlock()
 
 	c.logger.Info("restarting client...")
+	utils.CountRestart()
 
 	// for removing timeout logs
 	level := c.logger.Level
@@ -94,7 +140,8 @@ func (c *TcpTransport) Restart() {
 		c.controlChannel.Close()
 	}
 
-	time.Sleep(2 * time.Second)
+	// Redial right away unless the tunnel keeps dropping
+	c.restartPacer.wait(c.config.RetryInterval)
 
 	ctx, cancel := context.WithCancel(c.parentctx)
 	c.ctx = ctx
@@ -102,35 +149,48 @@ func (c *TcpTransport) Restart() {
 
 	// Re-initialize variables
 	c.controlChannel = nil
-	c.usageMonitor = web.NewDataStore(fmt.Sprintf(":%v", c.config.WebPort), ctx, c.config.SnifferLog, c.config.Sniffer, &c.config.TunnelStatus, c.logger)
+	c.usageMonitor = web.NewDataStore(fmt.Sprintf(":%v", c.config.WebPort), ctx, c.config.SnifferLog, c.config.Sniffer, &c.config.TunnelStatus, c.logger, c.config.SnifferMaxPorts, c.config.SnifferRetention)
 	c.config.TunnelStatus = ""
 	c.poolConnections = 0
 	c.loadConnections = 0
+	c.assigning = 0
 	c.controlFlow = make(chan struct{}, 100)
 
 	// set the log level again
 	c.logger.SetLevel(level)
 
+	if c.parentctx.Err() != nil {
+		return
+	}
+
 	go c.Start()
 }
 
 func (c *TcpTransport) channelDialer() {
 	c.logger.Info("attempting to establish a new control channel connection...")
 
+	// Every cycle starts with the configured handshake version
+	var handshake handshakeFallback
+
 	for {
 		select {
 		case <-c.ctx.Done():
 			return
 		default:
-			tunnelTCPConn, err := TcpDialer(c.ctx, c.config.RemoteAddr, c.config.DialTimeOut, c.config.KeepAlive, c.config.Nodelay, 3)
+			tunnelTCPConn, err := c.dialTunnel()
 			if err != nil {
 				c.logger.Errorf("channel dialer: %v", err)
 				time.Sleep(c.config.RetryInterval)
 				continue
 			}
 
-			// Sending security token
-			err = utils.SendBinaryTransportString(tunnelTCPConn, c.config.Token, utils.SG_Chan)
+			// Sending security token, SG_Ports announces that port mappings follow it
+			signal := utils.SG_Chan
+			if len(c.config.Ports) > 0 {
+				signal = utils.SG_Ports
+			}
+
+			err = utils.SendHandshake(tunnelTCPConn, utils.Handshake{Token: c.config.Token, Signal: signal, Version: handshake.version(c.config.HandshakeVersion), ClientID: c.config.ClientID, Resume: c.resume})
 			if err != nil {
 				c.logger.Errorf("failed to send security token: %v", err)
 				tunnelTCPConn.Close()
@@ -138,14 +198,21 @@ func (c *TcpTransport) channelDialer() {
 			}
 
 			// Set a read deadline for the token response
-			if err := tunnelTCPConn.SetReadDeadline(time.Now().Add(2 * time.Second)); err != nil {
+			if err := tunnelTCPConn.SetReadDeadline(time.Now().Add(c.config.HandshakeTimeout)); err != nil {
 				c.logger.Errorf("failed to set read deadline: %v", err)
 				tunnelTCPConn.Close()
 				continue
 			}
 
+			// The control channel is already queued on the server, so the pool
+			// connections dialed from here on are handed out only after it
+			var earlyPool chan net.Conn
+			if c.config.EarlyPool {
+				earlyPool = c.dialEarlyPool()
+			}
+
 			// Receive response
-			message, _, err := utils.ReceiveBinaryTransportString(tunnelTCPConn)
+			reply, err := utils.ReceiveHandshake(tunnelTCPConn)
 			if err != nil {
 				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 					c.logger.Warn("timeout while waiting for control channel response")
@@ -153,25 +220,47 @@ func (c *TcpTransport) channelDialer() {
 					c.logger.Errorf("failed to receive control channel response: %v", err)
 				}
 				tunnelTCPConn.Close() // Close connection on error or timeout
-				time.Sleep(c.config.RetryInterval)
+				go discardEarlyPool(earlyPool)
+				// An older server does not answer the versioned handshake
+				if !handshake.unanswered(c.config.HandshakeVersion, c.logger) {
+					time.Sleep(c.config.RetryInterval)
+				}
 				continue
 			}
 			// Resetting the deadline (removes any existing deadline)
 			tunnelTCPConn.SetReadDeadline(time.Time{})
+			handshake.answered(c.config.HandshakeVersion, c.logger)
+
+			if utils.ValidToken(reply.Token, c.config.Token, 0) {
+				// Presented on the next handshake, the server then resumes the session right away
+				c.resume = reply.Resume
+
+				if signal == utils.SG_Ports {
+					if err := utils.SendBinaryString(tunnelTCPConn, strings.Join(c.config.Ports, ",")); err != nil {
+						c.logger.Errorf("failed to send port mappings: %v", err)
+						tunnelTCPConn.Close()
+						go discardEarlyPool(earlyPool)
+						continue
+					}
+					c.logger.Infof("requested %d port mappings from the server", len(c.config.Ports))
+				}
 
-			if message == c.config.Token {
 				c.controlChannel = tunnelTCPConn
 				c.logger.Info("control channel established successfully")
+				utils.MarkReady(c.ctx)
+				web.SetNegotiated("handshake", fmt.Sprintf("v%d", reply.Version))
 
 				c.config.TunnelStatus = "Connected (TCP)"
-				go c.poolMaintainer()
+				go probeBackends(c.ctx, &c.config.TunnelStatus, c.config.TunnelStatus, c.config.BackendProbe, c.config.BackendProxy, c.config.DialTimeOut, c.logger)
+				go c.poolMaintainer(earlyPool)
 				go c.channelHandler()
 
 				return
 
 			} else {
-				c.logger.Errorf("invalid token received. Expected: %s, Received: %s. Retrying...", c.config.Token, message)
+				c.logger.Errorf("invalid token received. Expected: %s, Received: %s. Retrying...", c.config.Token, reply.Token)
 				tunnelTCPConn.Close() // Close connection if the token is invalid
+				go discardEarlyPool(earlyPool)
 				time.Sleep(c.config.RetryInterval)
 				continue
 			}
@@ -179,9 +268,58 @@ func (c *TcpTransport) channelDialer() {
 	}
 }
 
-func (c *TcpTransport) poolMaintainer() {
-	for i := 0; i < c.config.ConnPoolSize; i++ { //initial pool filling
-		go c.tunnelDialer()
+// dialEarlyPool dials the initial pool connections in parallel, they are
+// delivered on the returned channel which is closed when all dials are done.
+func (c *TcpTransport) dialEarlyPool() chan net.Conn {
+	conns := make(chan net.Conn, c.config.ConnPoolSize)
+	var wg sync.WaitGroup
+
+	for i := 0; i < c.config.ConnPoolSize; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			tcpConn, err := c.dialTunnel()
+			if err != nil {
+				c.logger.Error("tunnel server dialer: ", err)
+				return
+			}
+			conns <- tcpConn
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(conns)
+	}()
+
+	return conns
+}
+
+// discardEarlyPool closes the pool connections dialed for a failed handshake,
+// otherwise the server would take them for control channel candidates.
+func discardEarlyPool(conns chan net.Conn) {
+	if conns == nil {
+		return
+	}
+	for tcpConn := range conns {
+		tcpConn.Close()
+	}
+}
+
+// poolMaintainer fills the pool, with the early pool connections when
+// earlyPool is not nil, and then resizes it to the load.
+func (c *TcpTransport) poolMaintainer(earlyPool chan net.Conn) {
+	if earlyPool != nil {
+		go func() {
+			for tcpConn := range earlyPool {
+				go c.tunnelHandler(tcpConn)
+			}
+		}()
+	} else {
+		for i := 0; i < c.config.ConnPoolSize; i++ { //initial pool filling
+			go c.tunnelDialer()
+		}
 	}
 
 	// factors
@@ -205,6 +343,7 @@ func (c *TcpTransport) poolMaintainer() {
 	defer tickerLoad.Stop()
 
 	newPoolSize := c.config.ConnPoolSize // intial value
+	utils.GaugePoolSize(newPoolSize)
 	var poolConnectionsSum int32 = 0
 
 	for {
@@ -226,14 +365,18 @@ func (c *TcpTransport) poolMaintainer() {
 			atomic.StoreInt32(&poolConnectionsSum, 0)                                   // Reset
 
 			// Dynamically adjust the pool size based on current connections
-			if (loadConnections + a) > poolConnectionsAvg*b {
+			if (loadConnections+a) > poolConnectionsAvg*b && !c.dialHold.Held() {
 				c.logger.Debugf("increasing pool size: %d -> %d, avg pool conn: %d, avg load conn: %d", newPoolSize, newPoolSize+1, poolConnectionsAvg, loadConnections)
+				web.PublishEvent("pool", web.PoolEvent{From: newPoolSize, To: newPoolSize + 1})
+				utils.GaugePoolSize(newPoolSize + 1)
 				newPoolSize++
 
 				// Add a new connection to the pool
 				go c.tunnelDialer()
 			} else if float64(loadConnections+x) < float64(poolConnectionsAvg)*y && newPoolSize > c.config.ConnPoolSize {
 				c.logger.Debugf("decreasing pool size: %d -> %d, avg pool conn: %d, avg load conn: %d", newPoolSize, newPoolSize-1, poolConnectionsAvg, loadConnections)
+				web.PublishEvent("pool", web.PoolEvent{From: newPoolSize, To: newPoolSize - 1})
+				utils.GaugePoolSize(newPoolSize - 1)
 				newPoolSize--
 
 				// send a signal to controlFlow
@@ -278,18 +421,31 @@ func (c *TcpTransport) channelHandler() {
 			switch msg {
 			case utils.SG_Chan:
 				atomic.AddInt32(&c.loadConnections, 1)
+				atomic.AddInt32(&c.assigning, 1)
 
-				select {
-				case <-c.controlFlow: // Do nothing
-
-				default:
+				if skipReplacement(c.controlFlow, &c.poolConnections, &c.assigning) {
+					c.logger.Debug("channel signal received, not replacing the used connection to shrink the pool")
+				} else {
 					c.logger.Debug("channel signal received, initiating tunnel dialer")
 					go c.tunnelDialer()
 				}
 
+			case utils.SG_Busy:
+				c.logger.Debugf("server tunnel channel is full, holding back new tunnel connections for %v", c.config.BackpressureDelay)
+				c.dialHold.Hold()
+
 			case utils.SG_HB:
 				c.logger.Debug("heartbeat signal received successfully")
 
+				// Echo the heartbeat so the server can tell the control channel is alive
+				if c.config.HeartbeatAck {
+					if err := utils.SendBinaryByte(c.controlChannel, utils.SG_HB); err != nil {
+						c.logger.Errorf("failed to send heartbeat acknowledgment: %v", err)
+						go c.Restart()
+						return
+					}
+				}
+
 			case utils.SG_Closed:
 				c.logger.Warn("control channel has been closed by the server")
 				go c.Restart()
@@ -313,32 +469,105 @@ func (c *TcpTransport) channelHandler() {
 }
 
 // Dialing to the tunnel server, chained functions, without retry
+// dialTunnel dials a tunnel connection to the server, encrypted when enabled
+func (c *TcpTransport) dialTunnel() (net.Conn, error) {
+	tcpConn, err := TcpDialer(c.ctx, c.config.RemoteAddr, c.config.DialTimeOut, c.config.KeepAlive, c.config.Nodelay, 3, 0)
+	if err != nil {
+		return nil, err
+	}
+	if c.config.Encryption {
+		return utils.EncryptConn(tcpConn, c.config.Token, true), nil
+	}
+	return tcpConn, nil
+}
+
 func (c *TcpTransport) tunnelDialer() {
+	// The server signaled its tunnel channel is full, dialing now would only be discarded
+	if !c.dialHold.Wait(c.ctx) {
+		return
+	}
+
 	c.logger.Debugf("initiating new connection to tunnel server at %s", c.config.RemoteAddr)
 
 	// Dial to the tunnel server
-	tcpConn, err := TcpDialer(c.ctx, c.config.RemoteAddr, c.config.DialTimeOut, c.config.KeepAlive, c.config.Nodelay, 3)
+	tcpConn, err := c.dialTunnel()
 	if err != nil {
 		c.logger.Error("tunnel server dialer: ", err)
 
 		return
 	}
 
+	c.tunnelHandler(tcpConn)
+}
+
+// tunnelHandler waits on a pool connection until the server sends the address to forward to
+func (c *TcpTransport) tunnelHandler(tcpConn net.Conn) {
+	var err error
+
 	// Increment active connections counter
 	atomic.AddInt32(&c.poolConnections, 1)
 
-	// Attempt to receive the remote address from the tunnel server
-	remoteAddr, transport, err := utils.ReceiveBinaryTransportString(tcpConn)
+	var remoteAddr string
+	var transport byte
+
+	// Interval of the server pings seen so far, 0 until two arrived
+	var lastPing time.Time
+	var pingInterval time.Duration
+
+	for {
+		// An idle connection that misses several server pings is considered dead.
+		// The server sets its own interval, so the deadline is only armed once
+		// the server is seen pinging, never shorter than the pings it sends.
+		if c.config.PoolKeepalive > 0 && pingInterval > 0 {
+			tcpConn.SetReadDeadline(time.Now().Add(3 * max(pingInterval, c.config.PoolKeepalive)))
+		}
+
+		// Attempt to receive the remote address from the tunnel server
+		remoteAddr, transport, err = utils.ReceiveBinaryTransportString(tcpConn)
+		if err == nil && transport == utils.SG_Ping {
+			c.logger.Trace("ping received from the server")
+
+			now := time.Now()
+			if !lastPing.IsZero() {
+				pingInterval = max(pingInterval, now.Sub(lastPing))
+			}
+			lastPing = now
+
+			// The server probes idle connections, answer with the same payload
+			if remoteAddr != "" {
+				if err = utils.SendBinaryTransportString(tcpConn, remoteAddr, utils.SG_Ping); err != nil {
+					break
+				}
+			}
+			continue
+		}
+		break
+	}
 
 	// Decrement active connections after successful or failed connection
 	atomic.AddInt32(&c.poolConnections, -1)
 
 	if err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() && c.ctx.Err() == nil {
+			c.logger.Debugf("idle pool connection %s missed keepalive probes, replacing it", tcpConn.RemoteAddr().String())
+			tcpConn.Close()
+			go c.tunnelDialer()
+			return
+		}
 		c.logger.Debugf("failed to receive port from tunnel connection %s: %v", tcpConn.RemoteAddr().String(), err)
 		tcpConn.Close()
 		return
 	}
 
+	// The server used this connection for one of the forwards it announced
+	atomic.AddInt32(&c.assigning, -1)
+
+	// Resetting the deadline (removes any existing deadline)
+	tcpConn.SetReadDeadline(time.Time{})
+
+	// A "primary+mirror" target copies the traffic to the mirror as well
+	remoteAddr, mirrorAddr := splitMirror(remoteAddr)
+
 	// Extract the port from the received address
 	port, resolvedAddr, err := ResolveRemoteAddr(remoteAddr)
 	if err != nil {
@@ -347,9 +576,15 @@ func (c *TcpTransport) tunnelDialer() {
 		return
 	}
 
+	if portListed(port, c.config.BlockedTargetPorts) {
+		c.logger.Warnf("refusing connection to %s, port %d is blocked", resolvedAddr, port)
+		tcpConn.Close()
+		return
+	}
+
 	if transport == utils.SG_TCP {
 		// Dial local server using the received address
-		c.localDialer(tcpConn, resolvedAddr, port)
+		c.localDialer(tcpConn, resolvedAddr, mirrorAddr, port)
 
 	} else if transport == utils.SG_UDP {
 		UDPDialer(tcpConn, resolvedAddr, c.logger, c.usageMonitor, port, c.config.Sniffer)
@@ -361,15 +596,47 @@ func (c *TcpTransport) tunnelDialer() {
 
 }
 
-func (c *TcpTransport) localDialer(tcpConn net.Conn, remoteAddr string, port int) {
-	localConnection, err := TcpDialer(c.ctx, remoteAddr, c.config.DialTimeOut, c.config.KeepAlive, c.config.Nodelay, 1)
+func (c *TcpTransport) localDialer(tcpConn net.Conn, remoteAddr string, mirrorAddr string, port int) {
+	if c.unresolved.Degraded(remoteAddr) {
+		c.logger.Debugf("refusing connection to %s, the name does not resolve", remoteAddr)
+		tcpConn.Close()
+		return
+	}
+
+	if !c.targetLimiter.Acquire(remoteAddr) {
+		c.logger.Warnf("connection limit reached for local address %s, rejecting connection", remoteAddr)
+		tcpConn.Close()
+		return
+	}
+	defer c.targetLimiter.Release(remoteAddr)
+
+	trace := utils.StartConnTrace(c.ctx, port, remoteAddr)
+
+	// Interactive traffic, e.g. SSH, should not wait for small writes to be coalesced
+	lowLatency := portListed(port, c.config.LowLatencyPorts)
+	if c.config.Nodelay || lowLatency {
+		if conn, ok := utils.TCPConn(tcpConn); ok {
+			conn.SetNoDelay(true)
+		}
+	}
+
+	localConnection, err := c.backendPool.Get(remoteAddr, c.config.BackendNodelay || lowLatency, timedDial(port, remoteAddr, c.config.SlowDial, c.logger, func() (net.Conn, error) {
+		return BackendDialer(c.ctx, remoteAddr, c.config.BackendProxy, c.config.DialTimeOut, c.config.KeepAlive, c.config.BackendNodelay || lowLatency, c.config.MSSClamp)
+	}))
+	c.unresolved.Dialed(remoteAddr, err)
 	if err != nil {
 		c.logger.Errorf("local dialer: %v", err)
+		trace.Fail(err)
 		tcpConn.Close()
 		return
 	}
 
 	c.logger.Debugf("connected to local address %s successfully", remoteAddr)
+	trace.Event("backend dialed")
+
+	from := mirrorTraffic(c.ctx, tcpConn, mirrorAddr, c.config.BlockedTargetPorts, func(address string) (net.Conn, error) {
+		return BackendDialer(c.ctx, address, c.config.BackendProxy, c.config.DialTimeOut, c.config.KeepAlive, c.config.BackendNodelay || lowLatency, c.config.MSSClamp)
+	}, c.logger)
 
-	utils.TCPConnectionHandler(tcpConn, localConnection, c.logger, c.usageMonitor, port, c.config.Sniffer)
+	utils.TCPConnectionHandler(from, localConnection, c.logger, c.usageMonitor, port, remoteAddr, c.config.Sniffer, trace, utils.OpDeadlines{Read: c.config.ReadDeadline, Write: c.config.WriteDeadline, Idle: c.config.BackendIdle})
 }
@@ -23,33 +23,62 @@ type TcpMuxTransport struct {
 	cancel          context.CancelFunc
 	logger          *logrus.Logger
 	controlChannel  net.Conn
+	resume          string // resumption token of the last handshake answer
 	usageMonitor    *web.Usage
 	restartMutex    sync.Mutex
+	restartPacer    restartPacer
 	poolConnections int32
 	loadConnections int32
 	controlFlow     chan struct{}
+	targetLimiter   *TargetLimiter
+	unresolved      *UnresolvedTargets
+	backendPool     *BackendPool
+	dialHold        *DialHold
 }
 
 type TcpMuxConfig struct {
-	RemoteAddr       string
-	Token            string
-	SnifferLog       string
-	TunnelStatus     string
-	Nodelay          bool
-	Sniffer          bool
-	KeepAlive        time.Duration
-	RetryInterval    time.Duration
-	DialTimeOut      time.Duration
-	MuxVersion       int
-	MaxFrameSize     int
-	MaxReceiveBuffer int
-	MaxStreamBuffer  int
-	ConnPoolSize     int
-	WebPort          int
-	AggressivePool   bool
+	RemoteAddr              string
+	Token                   string
+	SnifferLog              string
+	TunnelStatus            string
+	Nodelay                 bool
+	BackendNodelay          bool // Nodelay of the sockets facing the backends
+	Sniffer                 bool
+	KeepAlive               time.Duration
+	RetryInterval           time.Duration
+	DialTimeOut             time.Duration
+	MuxVersion              int
+	MaxFrameSize            int
+	MaxReceiveBuffer        int
+	MaxStreamBuffer         int
+	ConnPoolSize            int
+	WebPort                 int
+	SnifferMaxPorts         int
+	SnifferRetention        time.Duration
+	AggressivePool          bool
+	MaxPerTargetConnections int           // Concurrent connections allowed per local address, 0 means unlimited
+	MSSClamp                int           // TCP_MAXSEG for local connections, 0 disables clamping
+	ReadDeadline            time.Duration // Bound on a single read in the copy loop, 0 disables it
+	WriteDeadline           time.Duration // Bound on a single write in the copy loop, 0 disables it
+	BackendIdle             time.Duration // Close a forwarded connection after no data in either direction for this long, 0 disables it
+	BackendProxy            string        // HTTP CONNECT proxy URL for local connections, empty dials them directly
+	BackendProbe            []string      // Backends dialed once after connecting, the status reports unreachable ones
+	BlockedTargetPorts      []int         // Destination ports never dialed, whatever the server requests
+	LowLatencyPorts         []int         // Destination ports whose connections skip Nagle even without Nodelay
+	HeartbeatAck            bool          // Echo heartbeats back to the server
+	HandshakeTimeout        time.Duration // Wait for the handshake response once connected, separate from DialTimeOut
+	HandshakeVersion        byte          // Framing of the control channel handshake, 0 is the legacy one every server understands
+	ClientID                string        // Stable ID sent in the handshake so the server resumes the session of this client, needs HandshakeVersion 2
+	UnresolvedBackoff       time.Duration // Fail connections to a backend name that did not resolve for this long, 0 disables it
+	BackendPool             int           // Idle connections kept dialed to every backend in use, 0 dials each forwarded connection
+	BackendPoolIdle         time.Duration // Idle backend connections are closed after this long, and backends unused for this long are no longer kept warm
+	SlowDial                time.Duration // Log backend dials slower than this, 0 logs none
+	OrderedStreams          bool          // Dial the backend of a stream before accepting the next one of the session
+	BackpressureDelay       time.Duration // Hold back new tunnel connections this long after the server signaled a full tunnel channel
+	Encryption              bool          // Encrypt tunnel connections with keys derived from the token, the server has to enable it as well
 }
 
-func NewMuxClient(parentCtx context.Context, config *TcpMuxConfig, logger *logrus.Logger) *TcpMuxTransport {
+func NewMuxClient(parentCtx context.Context, config *TcpMuxConfig, logger *logrus.Logger) (*TcpMuxTransport, error) {
 	// Create a derived context from the parent context
 	ctx, cancel := context.WithCancel(parentCtx)
 
@@ -69,13 +98,26 @@ func NewMuxClient(parentCtx context.Context, config *TcpMuxConfig, logger *logru
 		cancel:          cancel,
 		logger:          logger,
 		controlChannel:  nil, // will be set when a control connection is established
-		usageMonitor:    web.NewDataStore(fmt.Sprintf(":%v", config.WebPort), ctx, config.SnifferLog, config.Sniffer, &config.TunnelStatus, logger),
+		usageMonitor:    web.NewDataStore(fmt.Sprintf(":%v", config.WebPort), ctx, config.SnifferLog, config.Sniffer, &config.TunnelStatus, logger, config.SnifferMaxPorts, config.SnifferRetention),
 		poolConnections: 0,
 		loadConnections: 0,
 		controlFlow:     make(chan struct{}, 100),
+		targetLimiter:   NewTargetLimiter(config.MaxPerTargetConnections),
+		unresolved:      NewUnresolvedTargets(config.UnresolvedBackoff, logger),
+		dialHold:        NewDialHold(config.BackpressureDelay),
 	}
 
-	return client
+	// The session would fail on every connection with an invalid configuration
+	if err := smux.VerifyConfig(client.smuxConfig); err != nil {
+		cancel()
+		return nil, fmt.Errorf("invalid mux configuration: %w", err)
+	}
+
+	// The connections kept warm are dialed like those of forwarded connections
+	client.backendPool = NewBackendPool(parentCtx, config.BackendPool, config.BackendPoolIdle, func(address string) (net.Conn, error) {
+		return BackendDialer(parentCtx, address, config.BackendProxy, config.DialTimeOut, config.KeepAlive, config.BackendNodelay, config.MSSClamp)
+	}, logger)
+	return client, nil
 }
 
 func (c *TcpMuxTransport) Start() {
@@ -89,6 +131,11 @@ func (c *TcpMuxTransport) Start() {
 }
 
 func (c *TcpMuxTransport) Restart() {
+	// Nothing to restart once the tunnel is shutting down, e.g. for a config reload
+	if c.parentctx.Err() != nil {
+		return
+	}
+
 	if !c.restartMutex.TryLock() {
 		c.logger.Warn("client is already restarting")
 		return
@@ -96,6 +143,7 @@ func (c *TcpMuxTransport) Restart() {
 	defer c.restartMutex.Unlock()
 
 	c.logger.Info("restarting client...")
+	utils.CountRestart()
 
 	// for removing timeout logs
 	level := c.logger.Level
@@ -110,7 +158,8 @@ func (c *TcpMuxTransport) Restart() {
 		c.controlChannel.Close()
 	}
 
-	time.Sleep(2 * time.Second)
+	// Redial right away unless the tunnel keeps dropping
+	c.restartPacer.wait(c.config.RetryInterval)
 
 	ctx, cancel := context.WithCancel(c.parentctx)
 	c.ctx = ctx
@@ -118,7 +167,7 @@ func (c *TcpMuxTransport) Restart() {
 
 	// Re-initialize variables
 	c.controlChannel = nil
-	c.usageMonitor = web.NewDataStore(fmt.Sprintf(":%v", c.config.WebPort), ctx, c.config.SnifferLog, c.config.Sniffer, &c.config.TunnelStatus, c.logger)
+	c.usageMonitor = web.NewDataStore(fmt.Sprintf(":%v", c.config.WebPort), ctx, c.config.SnifferLog, c.config.Sniffer, &c.config.TunnelStatus, c.logger, c.config.SnifferMaxPorts, c.config.SnifferRetention)
 	c.config.TunnelStatus = ""
 	c.poolConnections = 0
 	c.loadConnections = 0
@@ -127,6 +176,10 @@ func (c *TcpMuxTransport) Restart() {
 	// set the log level again
 	c.logger.SetLevel(level)
 
+	if c.parentctx.Err() != nil {
+		return
+	}
+
 	go c.Start()
 
 }
@@ -134,12 +187,15 @@ func (c *TcpMuxTransport) Restart() {
 func (c *TcpMuxTransport) channelDialer() {
 	c.logger.Info("attempting to establish a new tcpmux control channel connection...")
 
+	// Every cycle starts with the configured handshake version
+	var handshake handshakeFallback
+
 	for {
 		select {
 		case <-c.ctx.Done():
 			return
 		default:
-			tunnelConn, err := TcpDialer(c.ctx, c.config.RemoteAddr, c.config.DialTimeOut, c.config.KeepAlive, c.config.Nodelay, 3)
+			tunnelConn, err := c.dialTunnel()
 			if err != nil {
 				c.logger.Errorf("channel dialer: %v", err)
 				time.Sleep(c.config.RetryInterval)
@@ -147,7 +203,7 @@ func (c *TcpMuxTransport) channelDialer() {
 			}
 
 			// Sending security token
-			err = utils.SendBinaryTransportString(tunnelConn, c.config.Token, utils.SG_Chan)
+			err = utils.SendHandshake(tunnelConn, utils.Handshake{Token: c.config.Token, Signal: utils.SG_Chan, Version: handshake.version(c.config.HandshakeVersion), ClientID: c.config.ClientID, Resume: c.resume})
 			if err != nil {
 				c.logger.Errorf("failed to send security token: %v", err)
 				tunnelConn.Close()
@@ -155,13 +211,13 @@ func (c *TcpMuxTransport) channelDialer() {
 			}
 
 			// Set a read deadline for the token response
-			if err := tunnelConn.SetReadDeadline(time.Now().Add(2 * time.Second)); err != nil {
+			if err := tunnelConn.SetReadDeadline(time.Now().Add(c.config.HandshakeTimeout)); err != nil {
 				c.logger.Errorf("failed to set read deadline: %v", err)
 				tunnelConn.Close()
 				continue
 			}
 			// Receive response
-			message, _, err := utils.ReceiveBinaryTransportString(tunnelConn)
+			reply, err := utils.ReceiveHandshake(tunnelConn)
 			if err != nil {
 				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 					c.logger.Warn("timeout while waiting for control channel response")
@@ -169,24 +225,43 @@ func (c *TcpMuxTransport) channelDialer() {
 					c.logger.Errorf("failed to receive control channel response: %v", err)
 				}
 				tunnelConn.Close() // Close connection on error or timeout
-				time.Sleep(c.config.RetryInterval)
+				// An older server does not answer the versioned handshake
+				if !handshake.unanswered(c.config.HandshakeVersion, c.logger) {
+					time.Sleep(c.config.RetryInterval)
+				}
 				continue
 			}
 			// Resetting the deadline (removes any existing deadline)
 			tunnelConn.SetReadDeadline(time.Time{})
+			handshake.answered(c.config.HandshakeVersion, c.logger)
+
+			if utils.ValidToken(reply.Token, c.config.Token, 0) {
+				// Presented on the next handshake, the server then resumes the session right away
+				c.resume = reply.Resume
+
+				// Newer servers tell their mux version, sessions would fail later on a mismatch
+				if version := utils.SignaledMuxVersion(reply.Signal); version != 0 && version != c.config.MuxVersion {
+					c.logger.Error(utils.MuxVersionMismatch("the server", version, c.config.MuxVersion))
+					_ = utils.SendBinaryByte(tunnelConn, utils.MuxSignal(c.config.MuxVersion))
+					tunnelConn.Close()
+					time.Sleep(c.config.RetryInterval)
+					continue
+				}
 
-			if message == c.config.Token {
 				c.controlChannel = tunnelConn
 				c.logger.Info("control channel established successfully")
+				utils.MarkReady(c.ctx)
+				web.SetNegotiated("handshake", fmt.Sprintf("v%d", reply.Version))
 
 				c.config.TunnelStatus = "Connected (TCPMux)"
+				go probeBackends(c.ctx, &c.config.TunnelStatus, c.config.TunnelStatus, c.config.BackendProbe, c.config.BackendProxy, c.config.DialTimeOut, c.logger)
 
 				go c.poolMaintainer()
 				go c.channelHandler()
 
 				return
 			} else {
-				c.logger.Errorf("invalid token received. Expected: %s, Received: %s. Retrying...", c.config.Token, message)
+				c.logger.Errorf("invalid token received. Expected: %s, Received: %s. Retrying...", c.config.Token, reply.Token)
 				tunnelConn.Close() // Close connection if the token is invalid
 				time.Sleep(c.config.RetryInterval)
 				continue
@@ -222,6 +297,7 @@ func (c *TcpMuxTransport) poolMaintainer() {
 	defer tickerLoad.Stop()
 
 	newPoolSize := c.config.ConnPoolSize // intial value
+	utils.GaugePoolSize(newPoolSize)
 	var poolConnectionsSum int32 = 0
 
 	for {
@@ -243,14 +319,18 @@ func (c *TcpMuxTransport) poolMaintainer() {
 			atomic.StoreInt32(&poolConnectionsSum, 0)                                   // Reset
 
 			// Dynamically adjust the pool size based on current connections
-			if (loadConnections + a) > poolConnectionsAvg*b {
+			if (loadConnections+a) > poolConnectionsAvg*b && !c.dialHold.Held() {
 				c.logger.Debugf("increasing pool size: %d -> %d, avg pool conn: %d, avg load conn: %d", newPoolSize, newPoolSize+1, poolConnectionsAvg, loadConnections)
+				web.PublishEvent("pool", web.PoolEvent{From: newPoolSize, To: newPoolSize + 1})
+				utils.GaugePoolSize(newPoolSize + 1)
 				newPoolSize++
 
 				// Add a new connection to the pool
 				go c.tunnelDialer()
 			} else if float64(loadConnections+x) < float64(poolConnectionsAvg)*y && newPoolSize > c.config.ConnPoolSize {
 				c.logger.Debugf("decreasing pool size: %d -> %d, avg pool conn: %d, avg load conn: %d", newPoolSize, newPoolSize-1, poolConnectionsAvg, loadConnections)
+				web.PublishEvent("pool", web.PoolEvent{From: newPoolSize, To: newPoolSize - 1})
+				utils.GaugePoolSize(newPoolSize - 1)
 				newPoolSize--
 
 				// send a signal to controlFlow
@@ -304,9 +384,22 @@ func (c *TcpMuxTransport) channelHandler() {
 					go c.tunnelDialer()
 				}
 
+			case utils.SG_Busy:
+				c.logger.Debugf("server tunnel channel is full, holding back new tunnel connections for %v", c.config.BackpressureDelay)
+				c.dialHold.Hold()
+
 			case utils.SG_HB:
 				c.logger.Debug("heartbeat signal received successfully")
 
+				// Echo the heartbeat so the server can tell the control channel is alive
+				if c.config.HeartbeatAck {
+					if err := utils.SendBinaryByte(c.controlChannel, utils.SG_HB); err != nil {
+						c.logger.Errorf("failed to send heartbeat acknowledgment: %v", err)
+						go c.Restart()
+						return
+					}
+				}
+
 			case utils.SG_Closed:
 				c.logger.Warn("control channel has been closed by the server")
 				go c.Restart()
@@ -322,11 +415,29 @@ func (c *TcpMuxTransport) channelHandler() {
 	}
 }
 
+// dialTunnel dials a tunnel connection to the server, encrypted when enabled
+func (c *TcpMuxTransport) dialTunnel() (net.Conn, error) {
+	// Streams of every port share the connection, so low latency ports need Nagle off on it
+	tcpConn, err := TcpDialer(c.ctx, c.config.RemoteAddr, c.config.DialTimeOut, c.config.KeepAlive, c.config.Nodelay || len(c.config.LowLatencyPorts) > 0, 3, 0)
+	if err != nil {
+		return nil, err
+	}
+	if c.config.Encryption {
+		return utils.EncryptConn(tcpConn, c.config.Token, true), nil
+	}
+	return tcpConn, nil
+}
+
 func (c *TcpMuxTransport) tunnelDialer() {
+	// The server signaled its tunnel channel is full, dialing now would only be discarded
+	if !c.dialHold.Wait(c.ctx) {
+		return
+	}
+
 	c.logger.Debugf("initiating new tunnel connection to address %s", c.config.RemoteAddr)
 
 	// Dial to the tunnel server
-	tunnelConn, err := TcpDialer(c.ctx, c.config.RemoteAddr, c.config.DialTimeOut, c.config.KeepAlive, c.config.Nodelay, 3)
+	tunnelConn, err := c.dialTunnel()
 	if err != nil {
 		c.logger.Errorf("tunnel server dialer: %v", err)
 
@@ -350,6 +461,7 @@ func (c *TcpMuxTransport) handleSession(tunnelConn net.Conn) {
 		c.logger.Errorf("failed to create mux session: %v", err)
 		return
 	}
+	utils.LogMuxSession(session, c.smuxConfig, c.logger)
 
 	for {
 		select {
@@ -358,6 +470,7 @@ func (c *TcpMuxTransport) handleSession(tunnelConn net.Conn) {
 		default:
 			stream, err := session.AcceptStream()
 			if err != nil {
+				utils.WarnMuxMismatch(err, session, c.smuxConfig.Version, c.logger)
 				c.logger.Trace("session is closed: ", err)
 				session.Close()
 				return
@@ -372,12 +485,32 @@ func (c *TcpMuxTransport) handleSession(tunnelConn net.Conn) {
 				return
 			}
 
-			go c.localDialer(stream, remoteAddr)
+			if !c.config.OrderedStreams {
+				go c.localDialer(stream, remoteAddr, nil)
+				continue
+			}
+
+			// Backends are dialed in the order the server opened the streams
+			dialed := make(chan struct{})
+			go c.localDialer(stream, remoteAddr, dialed)
+			<-dialed
 		}
 	}
 }
 
-func (c *TcpMuxTransport) localDialer(stream *smux.Stream, remoteAddr string) {
+// localDialer forwards stream to its backend, dialed is closed once the
+// backend connection is set up or failed, a nil dialed is not signaled.
+func (c *TcpMuxTransport) localDialer(stream *smux.Stream, remoteAddr string, dialed chan struct{}) {
+	signalDialed := sync.OnceFunc(func() {
+		if dialed != nil {
+			close(dialed)
+		}
+	})
+	defer signalDialed()
+
+	// A "primary+mirror" target copies the traffic to the mirror as well
+	remoteAddr, mirrorAddr := splitMirror(remoteAddr)
+
 	// Extract the port from the received address
 	port, resolvedAddr, err := ResolveRemoteAddr(remoteAddr)
 	if err != nil {
@@ -386,14 +519,48 @@ func (c *TcpMuxTransport) localDialer(stream *smux.Stream, remoteAddr string) {
 		return
 	}
 
-	localConnection, err := TcpDialer(c.ctx, resolvedAddr, c.config.DialTimeOut, c.config.KeepAlive, c.config.Nodelay, 1)
+	if portListed(port, c.config.BlockedTargetPorts) {
+		c.logger.Warnf("refusing connection to %s, port %d is blocked", resolvedAddr, port)
+		stream.Close()
+		return
+	}
+
+	if c.unresolved.Degraded(resolvedAddr) {
+		c.logger.Debugf("refusing connection to %s, the name does not resolve", resolvedAddr)
+		stream.Close()
+		return
+	}
+
+	if !c.targetLimiter.Acquire(resolvedAddr) {
+		c.logger.Warnf("connection limit reached for local address %s, rejecting connection", resolvedAddr)
+		stream.Close()
+		return
+	}
+	defer c.targetLimiter.Release(resolvedAddr)
+
+	trace := utils.StartConnTrace(c.ctx, int(port), resolvedAddr)
+
+	// Interactive traffic, e.g. SSH, should not wait for small writes to be coalesced
+	nodelay := c.config.BackendNodelay || portListed(port, c.config.LowLatencyPorts)
+
+	localConnection, err := c.backendPool.Get(resolvedAddr, nodelay, timedDial(port, resolvedAddr, c.config.SlowDial, c.logger, func() (net.Conn, error) {
+		return BackendDialer(c.ctx, resolvedAddr, c.config.BackendProxy, c.config.DialTimeOut, c.config.KeepAlive, nodelay, c.config.MSSClamp)
+	}))
+	c.unresolved.Dialed(resolvedAddr, err)
 	if err != nil {
 		c.logger.Errorf("local dialer: %v", err)
+		trace.Fail(err)
 		stream.Close()
 		return
 	}
 
 	c.logger.Debugf("connected to local address %s successfully", remoteAddr)
+	trace.Event("backend dialed")
+	signalDialed()
+
+	from := mirrorTraffic(c.ctx, stream, mirrorAddr, c.config.BlockedTargetPorts, func(address string) (net.Conn, error) {
+		return BackendDialer(c.ctx, address, c.config.BackendProxy, c.config.DialTimeOut, c.config.KeepAlive, nodelay, c.config.MSSClamp)
+	}, c.logger)
 
-	utils.TCPConnectionHandler(stream, localConnection, c.logger, c.usageMonitor, int(port), c.config.Sniffer)
+	utils.TCPConnectionHandler(from, localConnection, c.logger, c.usageMonitor, int(port), resolvedAddr, c.config.Sniffer, trace, utils.OpDeadlines{Read: c.config.ReadDeadline, Write: c.config.WriteDeadline, Idle: c.config.BackendIdle})
 }
@@ -0,0 +1,416 @@
+package transport
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/musix/backhaul/internal/utils"
+	"github.com/musix/backhaul/internal/web"
+
+	"github.com/sirupsen/logrus"
+	"github.com/xtaci/smux"
+)
+
+// TcpSingleTransport keeps the control channel and all tunneled connections on
+// one smux session over a single TCP connection, the first stream accepted
+// from the server carries the control signals.
+type TcpSingleTransport struct {
+	config         *TcpSingleConfig
+	smuxConfig     *smux.Config
+	parentctx      context.Context
+	ctx            context.Context
+	cancel         context.CancelFunc
+	logger         *logrus.Logger
+	session        *smux.Session
+	controlChannel net.Conn // reserved control stream of the session
+	resume         string   // resumption token of the last handshake answer
+	usageMonitor   *web.Usage
+	restartMutex   sync.Mutex
+	restartPacer   restartPacer
+	targetLimiter  *TargetLimiter
+	unresolved     *UnresolvedTargets
+	backendPool    *BackendPool
+}
+
+type TcpSingleConfig struct {
+	RemoteAddr              string
+	Token                   string
+	SnifferLog              string
+	TunnelStatus            string
+	Nodelay                 bool
+	BackendNodelay          bool // Nodelay of the sockets facing the backends
+	Sniffer                 bool
+	KeepAlive               time.Duration
+	RetryInterval           time.Duration
+	DialTimeOut             time.Duration
+	MuxVersion              int
+	MaxFrameSize            int
+	MaxReceiveBuffer        int
+	MaxStreamBuffer         int
+	WebPort                 int
+	SnifferMaxPorts         int
+	SnifferRetention        time.Duration
+	MaxPerTargetConnections int           // Concurrent connections allowed per local address, 0 means unlimited
+	MSSClamp                int           // TCP_MAXSEG for local connections, 0 disables clamping
+	ReadDeadline            time.Duration // Bound on a single read in the copy loop, 0 disables it
+	WriteDeadline           time.Duration // Bound on a single write in the copy loop, 0 disables it
+	BackendIdle             time.Duration // Close a forwarded connection after no data in either direction for this long, 0 disables it
+	BackendProxy            string        // HTTP CONNECT proxy URL for local connections, empty dials them directly
+	BackendProbe            []string      // Backends dialed once after connecting, the status reports unreachable ones
+	BlockedTargetPorts      []int         // Destination ports never dialed, whatever the server requests
+	HeartbeatAck            bool          // Echo heartbeats back to the server
+	HandshakeTimeout        time.Duration // Wait for the handshake response once connected, separate from DialTimeOut
+	HandshakeVersion        byte          // Framing of the control channel handshake, 0 is the legacy one every server understands
+	ClientID                string        // Stable ID sent in the handshake so the server resumes the session of this client, needs HandshakeVersion 2
+	UnresolvedBackoff       time.Duration // Fail connections to a backend name that did not resolve for this long, 0 disables it
+	BackendPool             int           // Idle connections kept dialed to every backend in use, 0 dials each forwarded connection
+	BackendPoolIdle         time.Duration // Idle backend connections are closed after this long, and backends unused for this long are no longer kept warm
+	SlowDial                time.Duration // Log backend dials slower than this, 0 logs none
+}
+
+func NewTcpSingleClient(parentCtx context.Context, config *TcpSingleConfig, logger *logrus.Logger) (*TcpSingleTransport, error) {
+	// Create a derived context from the parent context
+	ctx, cancel := context.WithCancel(parentCtx)
+
+	// Initialize the TcpSingleTransport struct
+	client := &TcpSingleTransport{
+		smuxConfig: &smux.Config{
+			Version:           config.MuxVersion,
+			KeepAliveInterval: 20 * time.Second,
+			KeepAliveTimeout:  40 * time.Second,
+			MaxFrameSize:      config.MaxFrameSize,
+			MaxReceiveBuffer:  config.MaxReceiveBuffer,
+			MaxStreamBuffer:   config.MaxStreamBuffer,
+		},
+		config:         config,
+		parentctx:      parentCtx,
+		ctx:            ctx,
+		cancel:         cancel,
+		logger:         logger,
+		session:        nil, // will be set when the tunnel connection is established
+		controlChannel: nil,
+		usageMonitor:   web.NewDataStore(fmt.Sprintf(":%v", config.WebPort), ctx, config.SnifferLog, config.Sniffer, &config.TunnelStatus, logger, config.SnifferMaxPorts, config.SnifferRetention),
+		targetLimiter:  NewTargetLimiter(config.MaxPerTargetConnections),
+		unresolved:     NewUnresolvedTargets(config.UnresolvedBackoff, logger),
+	}
+
+	// The session would fail on every connection with an invalid configuration
+	if err := smux.VerifyConfig(client.smuxConfig); err != nil {
+		cancel()
+		return nil, fmt.Errorf("invalid mux configuration: %w", err)
+	}
+
+	// The connections kept warm are dialed like those of forwarded connections
+	client.backendPool = NewBackendPool(parentCtx, config.BackendPool, config.BackendPoolIdle, func(address string) (net.Conn, error) {
+		return BackendDialer(parentCtx, address, config.BackendProxy, config.DialTimeOut, config.KeepAlive, config.BackendNodelay, config.MSSClamp)
+	}, logger)
+	return client, nil
+}
+
+func (c *TcpSingleTransport) Start() {
+	if c.config.WebPort > 0 {
+		go c.usageMonitor.Monitor()
+	}
+
+	c.config.TunnelStatus = "Disconnected (TCPSingle)"
+
+	go c.channelDialer()
+}
+
+func (c *TcpSingleTransport) Restart() {
+	// Nothing to restart once the tunnel is shutting down, e.g. for a config reload
+	if c.parentctx.Err() != nil {
+		return
+	}
+
+	if !c.restartMutex.TryLock() {
+		c.logger.Warn("client is already restarting")
+		return
+	}
+	defer c.restartMutex.Unlock()
+
+	c.logger.Info("restarting client...")
+	utils.CountRestart()
+
+	// for removing timeout logs
+	level := c.logger.Level
+	c.logger.SetLevel(logrus.FatalLevel)
+
+	if c.cancel != nil {
+		c.cancel()
+	}
+
+	// Closing the session closes the control stream and every tunneled stream
+	if c.session != nil {
+		c.session.Close()
+	}
+
+	// Redial right away unless the tunnel keeps dropping
+	c.restartPacer.wait(c.config.RetryInterval)
+
+	ctx, cancel := context.WithCancel(c.parentctx)
+	c.ctx = ctx
+	c.cancel = cancel
+
+	// Re-initialize variables
+	c.session = nil
+	c.controlChannel = nil
+	c.usageMonitor = web.NewDataStore(fmt.Sprintf(":%v", c.config.WebPort), ctx, c.config.SnifferLog, c.config.Sniffer, &c.config.TunnelStatus, c.logger, c.config.SnifferMaxPorts, c.config.SnifferRetention)
+	c.config.TunnelStatus = ""
+
+	// set the log level again
+	c.logger.SetLevel(level)
+
+	if c.parentctx.Err() != nil {
+		return
+	}
+
+	go c.Start()
+}
+
+func (c *TcpSingleTransport) channelDialer() {
+	c.logger.Info("attempting to establish a new tcpsingle tunnel connection...")
+
+	// Every cycle starts with the configured handshake version
+	var handshake handshakeFallback
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		default:
+			tunnelConn, err := TcpDialer(c.ctx, c.config.RemoteAddr, c.config.DialTimeOut, c.config.KeepAlive, c.config.Nodelay, 3, 0)
+			if err != nil {
+				c.logger.Errorf("channel dialer: %v", err)
+				time.Sleep(c.config.RetryInterval)
+				continue
+			}
+
+			// Sending security token
+			err = utils.SendHandshake(tunnelConn, utils.Handshake{Token: c.config.Token, Signal: utils.SG_Chan, Version: handshake.version(c.config.HandshakeVersion), ClientID: c.config.ClientID, Resume: c.resume})
+			if err != nil {
+				c.logger.Errorf("failed to send security token: %v", err)
+				tunnelConn.Close()
+				continue
+			}
+
+			// Set a read deadline for the token response
+			if err := tunnelConn.SetReadDeadline(time.Now().Add(c.config.HandshakeTimeout)); err != nil {
+				c.logger.Errorf("failed to set read deadline: %v", err)
+				tunnelConn.Close()
+				continue
+			}
+			// Receive response
+			reply, err := utils.ReceiveHandshake(tunnelConn)
+			if err != nil {
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					c.logger.Warn("timeout while waiting for control channel response")
+				} else {
+					c.logger.Errorf("failed to receive control channel response: %v", err)
+				}
+				tunnelConn.Close() // Close connection on error or timeout
+				// An older server does not answer the versioned handshake
+				if !handshake.unanswered(c.config.HandshakeVersion, c.logger) {
+					time.Sleep(c.config.RetryInterval)
+				}
+				continue
+			}
+			// Resetting the deadline (removes any existing deadline)
+			tunnelConn.SetReadDeadline(time.Time{})
+			handshake.answered(c.config.HandshakeVersion, c.logger)
+
+			if !utils.ValidToken(reply.Token, c.config.Token, 0) {
+				c.logger.Errorf("invalid token received. Expected: %s, Received: %s. Retrying...", c.config.Token, reply.Token)
+				tunnelConn.Close() // Close connection if the token is invalid
+				time.Sleep(c.config.RetryInterval)
+				continue
+			}
+
+			// Presented on the next handshake, the server then resumes the session right away
+			c.resume = reply.Resume
+
+			// Newer servers tell their mux version, the session would fail on a mismatch
+			if version := utils.SignaledMuxVersion(reply.Signal); version != 0 && version != c.config.MuxVersion {
+				c.logger.Error(utils.MuxVersionMismatch("the server", version, c.config.MuxVersion))
+				tunnelConn.Close()
+				time.Sleep(c.config.RetryInterval)
+				continue
+			}
+
+			// SMUX server, the tunnel server opens the streams
+			session, err := smux.Server(tunnelConn, c.smuxConfig)
+			if err != nil {
+				c.logger.Errorf("failed to create mux session: %v", err)
+				tunnelConn.Close()
+				continue
+			}
+			utils.LogMuxSession(session, c.smuxConfig, c.logger)
+
+			// The first stream is reserved for control signals
+			session.SetDeadline(time.Now().Add(c.config.HandshakeTimeout))
+			controlStream, err := session.AcceptStream()
+			if err != nil {
+				utils.WarnMuxMismatch(err, session, c.smuxConfig.Version, c.logger)
+				c.logger.Errorf("failed to accept control stream: %v", err)
+				session.Close()
+				time.Sleep(c.config.RetryInterval)
+				continue
+			}
+			session.SetDeadline(time.Time{})
+
+			c.session = session
+			c.controlChannel = controlStream
+			c.logger.Info("control channel established successfully")
+			utils.MarkReady(c.ctx)
+			web.SetNegotiated("handshake", fmt.Sprintf("v%d", reply.Version))
+
+			c.config.TunnelStatus = "Connected (TCPSingle)"
+			go probeBackends(c.ctx, &c.config.TunnelStatus, c.config.TunnelStatus, c.config.BackendProbe, c.config.BackendProxy, c.config.DialTimeOut, c.logger)
+
+			go c.channelHandler()
+			go c.handleSession(session)
+
+			return
+		}
+	}
+}
+
+func (c *TcpSingleTransport) channelHandler() {
+	msgChan := make(chan byte, 1000)
+
+	// Goroutine to handle the blocking ReceiveBinaryByte
+	go func() {
+		for {
+			select {
+			case <-c.ctx.Done():
+				return
+			default:
+				msg, err := utils.ReceiveBinaryByte(c.controlChannel)
+				if err != nil {
+					if c.cancel != nil {
+						c.logger.Error("failed to read from control channel. ", err)
+						go c.Restart()
+					}
+					return
+				}
+				msgChan <- msg
+			}
+		}
+	}()
+
+	// Main loop to listen for context cancellation or received messages
+	for {
+		select {
+		case <-c.ctx.Done():
+			_ = utils.SendBinaryByte(c.controlChannel, utils.SG_Closed)
+			return
+
+		case msg := <-msgChan:
+			switch msg {
+			case utils.SG_HB:
+				c.logger.Debug("heartbeat signal received successfully")
+
+				// Echo the heartbeat so the server can tell the control channel is alive
+				if c.config.HeartbeatAck {
+					if err := utils.SendBinaryByte(c.controlChannel, utils.SG_HB); err != nil {
+						c.logger.Errorf("failed to send heartbeat acknowledgment: %v", err)
+						go c.Restart()
+						return
+					}
+				}
+
+			case utils.SG_Closed:
+				c.logger.Warn("control channel has been closed by the server")
+				go c.Restart()
+				return
+
+			default:
+				c.logger.Errorf("unexpected response from channel: %v.", msg)
+				go c.Restart()
+				return
+			}
+		}
+	}
+}
+
+func (c *TcpSingleTransport) handleSession(session *smux.Session) {
+	for {
+		stream, err := session.AcceptStream()
+		if err != nil {
+			if c.ctx.Err() == nil {
+				utils.WarnMuxMismatch(err, session, c.smuxConfig.Version, c.logger)
+				c.logger.Error("tunnel session is closed: ", err)
+				go c.Restart()
+			}
+			return
+		}
+
+		go func() {
+			remoteAddr, err := utils.ReceiveBinaryString(stream)
+			if err != nil {
+				c.logger.Errorf("unable to get port from stream: %v", err)
+				stream.Close()
+				return
+			}
+
+			c.localDialer(stream, remoteAddr)
+		}()
+	}
+}
+
+func (c *TcpSingleTransport) localDialer(stream *smux.Stream, remoteAddr string) {
+	// A "primary+mirror" target copies the traffic to the mirror as well
+	remoteAddr, mirrorAddr := splitMirror(remoteAddr)
+
+	// Extract the port from the received address
+	port, resolvedAddr, err := ResolveRemoteAddr(remoteAddr)
+	if err != nil {
+		c.logger.Infof("failed to resolve remote port: %v", err)
+		stream.Close()
+		return
+	}
+
+	if portListed(port, c.config.BlockedTargetPorts) {
+		c.logger.Warnf("refusing connection to %s, port %d is blocked", resolvedAddr, port)
+		stream.Close()
+		return
+	}
+
+	if c.unresolved.Degraded(resolvedAddr) {
+		c.logger.Debugf("refusing connection to %s, the name does not resolve", resolvedAddr)
+		stream.Close()
+		return
+	}
+
+	if !c.targetLimiter.Acquire(resolvedAddr) {
+		c.logger.Warnf("connection limit reached for local address %s, rejecting connection", resolvedAddr)
+		stream.Close()
+		return
+	}
+	defer c.targetLimiter.Release(resolvedAddr)
+
+	trace := utils.StartConnTrace(c.ctx, int(port), resolvedAddr)
+
+	localConnection, err := c.backendPool.Get(resolvedAddr, false, timedDial(port, resolvedAddr, c.config.SlowDial, c.logger, func() (net.Conn, error) {
+		return BackendDialer(c.ctx, resolvedAddr, c.config.BackendProxy, c.config.DialTimeOut, c.config.KeepAlive, c.config.BackendNodelay, c.config.MSSClamp)
+	}))
+	c.unresolved.Dialed(resolvedAddr, err)
+	if err != nil {
+		c.logger.Errorf("local dialer: %v", err)
+		trace.Fail(err)
+		stream.Close()
+		return
+	}
+
+	c.logger.Debugf("connected to local address %s successfully", remoteAddr)
+	trace.Event("backend dialed")
+
+	from := mirrorTraffic(c.ctx, stream, mirrorAddr, c.config.BlockedTargetPorts, func(address string) (net.Conn, error) {
+		return BackendDialer(c.ctx, address, c.config.BackendProxy, c.config.DialTimeOut, c.config.KeepAlive, c.config.BackendNodelay, c.config.MSSClamp)
+	}, c.logger)
+
+	utils.TCPConnectionHandler(from, localConnection, c.logger, c.usageMonitor, int(port), resolvedAddr, c.config.Sniffer, trace, utils.OpDeadlines{Read: c.config.ReadDeadline, Write: c.config.WriteDeadline, Idle: c.config.BackendIdle})
+}
@@ -22,21 +22,28 @@ type UdpTransport struct {
 	controlChannel  net.Conn
 	usageMonitor    *web.Usage
 	restartMutex    sync.Mutex
+	restartPacer    restartPacer
 	poolConnections int32
 	loadConnections int32
+	assigning       int32 // connections requested with SG_Chan that no pool connection was assigned yet
 	controlFlow     chan struct{}
 }
 type UdpConfig struct {
-	RemoteAddr     string
-	Token          string
-	SnifferLog     string
-	TunnelStatus   string
-	RetryInterval  time.Duration
-	DialTimeOut    time.Duration
-	ConnPoolSize   int
-	WebPort        int
-	Sniffer        bool
-	AggressivePool bool
+	RemoteAddr       string
+	Token            string
+	SnifferLog       string
+	TunnelStatus     string
+	RetryInterval    time.Duration
+	DialTimeOut      time.Duration
+	ConnPoolSize     int
+	WebPort          int
+	SnifferMaxPorts  int
+	SnifferRetention time.Duration
+	Sniffer          bool
+	AggressivePool   bool
+	HandshakeTimeout time.Duration // Wait for the handshake response once connected, separate from DialTimeOut
+	HandshakeVersion byte          // Framing of the control channel handshake, 0 is the legacy one every server understands
+	ClientID         string        // Stable ID sent in the handshake so the server resumes the session of this client, needs HandshakeVersion 2
 }
 
 func NewUDPClient(parentCtx context.Context, config *UdpConfig, logger *logrus.Logger) *UdpTransport {
@@ -51,7 +58,7 @@ func NewUDPClient(parentCtx context.Context, config *UdpConfig, logger *logrus.L
 		cancel:          cancel,
 		logger:          logger,
 		controlChannel:  nil, // will be set when a control connection is established
-		usageMonitor:    web.NewDataStore(fmt.Sprintf(":%v", config.WebPort), ctx, config.SnifferLog, config.Sniffer, &config.TunnelStatus, logger),
+		usageMonitor:    web.NewDataStore(fmt.Sprintf(":%v", config.WebPort), ctx, config.SnifferLog, config.Sniffer, &config.TunnelStatus, logger, config.SnifferMaxPorts, config.SnifferRetention),
 		poolConnections: 0,
 		loadConnections: 0,
 		controlFlow:     make(chan struct{}, 100),
@@ -71,6 +78,11 @@ func (c *UdpTransport) Start() {
 }
 
 func (c *UdpTransport) Restart() {
+	// Nothing to restart once the tunnel is shutting down, e.g. for a config reload
+	if c.parentctx.Err() != nil {
+		return
+	}
+
 	if !c.restartMutex.TryLock() {
 		c.logger.Warn("client is already restarting")
 		return
@@ -78,6 +90,7 @@ func (c *UdpTransport) Restart() {
 	defer c.restartMutex.Unlock()
 
 	c.logger.Info("restarting client...")
+	utils.CountRestart()
 
 	// for removing timeout logs
 	level := c.logger.Level
@@ -92,7 +105,8 @@ func (c *UdpTransport) Restart() {
 		c.controlChannel.Close()
 	}
 
-	time.Sleep(2 * time.Second)
+	// Redial right away unless the tunnel keeps dropping
+	c.restartPacer.wait(c.config.RetryInterval)
 
 	ctx, cancel := context.WithCancel(c.parentctx)
 	c.ctx = ctx
@@ -100,15 +114,20 @@ func (c *UdpTransport) Restart() {
 
 	// Re-initialize variables
 	c.controlChannel = nil
-	c.usageMonitor = web.NewDataStore(fmt.Sprintf(":%v", c.config.WebPort), ctx, c.config.SnifferLog, c.config.Sniffer, &c.config.TunnelStatus, c.logger)
+	c.usageMonitor = web.NewDataStore(fmt.Sprintf(":%v", c.config.WebPort), ctx, c.config.SnifferLog, c.config.Sniffer, &c.config.TunnelStatus, c.logger, c.config.SnifferMaxPorts, c.config.SnifferRetention)
 	c.config.TunnelStatus = ""
 	c.poolConnections = 0
 	c.loadConnections = 0
+	c.assigning = 0
 	c.controlFlow = make(chan struct{}, 100)
 
 	// set the log level again
 	c.logger.SetLevel(level)
 
+	if c.parentctx.Err() != nil {
+		return
+	}
+
 	go c.Start()
 
 }
@@ -116,12 +135,15 @@ func (c *UdpTransport) Restart() {
 func (c *UdpTransport) channelDialer() {
 	c.logger.Info("attempting to establish a new control channel connection...")
 
+	// Every cycle starts with the configured handshake version
+	var handshake handshakeFallback
+
 	for {
 		select {
 		case <-c.ctx.Done():
 			return
 		default:
-			tunnelTCPConn, err := TcpDialer(c.ctx, c.config.RemoteAddr, c.config.DialTimeOut, 30, true, 3)
+			tunnelTCPConn, err := TcpDialer(c.ctx, c.config.RemoteAddr, c.config.DialTimeOut, 30, true, 3, 0)
 			if err != nil {
 				c.logger.Errorf("channel dialer: %v", err)
 				time.Sleep(c.config.RetryInterval)
@@ -129,7 +151,7 @@ func (c *UdpTransport) channelDialer() {
 			}
 
 			// Sending security token
-			err = utils.SendBinaryTransportString(tunnelTCPConn, c.config.Token, utils.SG_Chan)
+			err = utils.SendHandshake(tunnelTCPConn, utils.Handshake{Token: c.config.Token, Signal: utils.SG_Chan, Version: handshake.version(c.config.HandshakeVersion), ClientID: c.config.ClientID})
 			if err != nil {
 				c.logger.Errorf("failed to send security token: %v", err)
 				tunnelTCPConn.Close()
@@ -137,14 +159,14 @@ func (c *UdpTransport) channelDialer() {
 			}
 
 			// Set a read deadline for the token response
-			if err := tunnelTCPConn.SetReadDeadline(time.Now().Add(2 * time.Second)); err != nil {
+			if err := tunnelTCPConn.SetReadDeadline(time.Now().Add(c.config.HandshakeTimeout)); err != nil {
 				c.logger.Errorf("failed to set read deadline: %v", err)
 				tunnelTCPConn.Close()
 				continue
 			}
 
 			// Receive response
-			message, _, err := utils.ReceiveBinaryTransportString(tunnelTCPConn)
+			reply, err := utils.ReceiveHandshake(tunnelTCPConn)
 			if err != nil {
 				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 					c.logger.Warn("timeout while waiting for control channel response")
@@ -152,15 +174,21 @@ func (c *UdpTransport) channelDialer() {
 					c.logger.Errorf("failed to receive control channel response: %v", err)
 				}
 				tunnelTCPConn.Close() // Close connection on error or timeout
-				time.Sleep(c.config.RetryInterval)
+				// An older server does not answer the versioned handshake
+				if !handshake.unanswered(c.config.HandshakeVersion, c.logger) {
+					time.Sleep(c.config.RetryInterval)
+				}
 				continue
 			}
 			// Resetting the deadline (removes any existing deadline)
 			tunnelTCPConn.SetReadDeadline(time.Time{})
+			handshake.answered(c.config.HandshakeVersion, c.logger)
 
-			if message == c.config.Token {
+			if utils.ValidToken(reply.Token, c.config.Token, 0) {
 				c.controlChannel = tunnelTCPConn
 				c.logger.Info("control channel established successfully")
+				utils.MarkReady(c.ctx)
+				web.SetNegotiated("handshake", fmt.Sprintf("v%d", reply.Version))
 
 				c.config.TunnelStatus = "Connected (UDP)"
 
@@ -170,7 +198,7 @@ func (c *UdpTransport) channelDialer() {
 				return
 
 			} else {
-				c.logger.Errorf("invalid token received. Expected: %s, Received: %s. Retrying...", c.config.Token, message)
+				c.logger.Errorf("invalid token received. Expected: %s, Received: %s. Retrying...", c.config.Token, reply.Token)
 				tunnelTCPConn.Close() // Close connection if the token is invalid
 				time.Sleep(c.config.RetryInterval)
 				continue
@@ -205,6 +233,7 @@ func (c *UdpTransport) poolMaintainer() {
 	defer tickerLoad.Stop()
 
 	newPoolSize := c.config.ConnPoolSize // intial value
+	utils.GaugePoolSize(newPoolSize)
 	var poolConnectionsSum int32 = 0
 
 	for {
@@ -228,12 +257,16 @@ func (c *UdpTransport) poolMaintainer() {
 			// Dynamically adjust the pool size based on current connections
 			if (loadConnections + a) > poolConnectionsAvg*b {
 				c.logger.Debugf("increasing pool size: %d -> %d, avg pool conn: %d, avg load conn: %d", newPoolSize, newPoolSize+1, poolConnectionsAvg, loadConnections)
+				web.PublishEvent("pool", web.PoolEvent{From: newPoolSize, To: newPoolSize + 1})
+				utils.GaugePoolSize(newPoolSize + 1)
 				newPoolSize++
 
 				// Add a new connection to the pool
 				go c.tunnelDialer()
 			} else if float64(loadConnections+x) < float64(poolConnectionsAvg)*y && newPoolSize > c.config.ConnPoolSize {
 				c.logger.Debugf("decreasing pool size: %d -> %d, avg pool conn: %d, avg load conn: %d", newPoolSize, newPoolSize-1, poolConnectionsAvg, loadConnections)
+				web.PublishEvent("pool", web.PoolEvent{From: newPoolSize, To: newPoolSize - 1})
+				utils.GaugePoolSize(newPoolSize - 1)
 				newPoolSize--
 
 				// send a signal to controlFlow
@@ -278,11 +311,11 @@ func (c *UdpTransport) channelHandler() {
 			switch msg {
 			case utils.SG_Chan:
 				atomic.AddInt32(&c.loadConnections, 1)
+				atomic.AddInt32(&c.assigning, 1)
 
-				select {
-				case <-c.controlFlow: // Do nothing
-
-				default:
+				if skipReplacement(c.controlFlow, &c.poolConnections, &c.assigning) {
+					c.logger.Debug("channel signal received, not replacing the used connection to shrink the pool")
+				} else {
 					c.logger.Debug("channel signal received, initiating tunnel dialer")
 					go c.tunnelDialer()
 				}
@@ -378,6 +411,7 @@ func (c *UdpTransport) handleTunnelConn(tunConn *net.UDPConn) {
 
 		// Decrement active connections after successful or failed connection
 		atomic.AddInt32(&c.poolConnections, -1)
+		atomic.AddInt32(&c.assigning, -1)
 
 		if err != nil {
 			c.logger.Error("failed to find remote address:", err)
@@ -406,20 +440,25 @@ func (c *UdpTransport) localDialer(remoteAddr string, port int, tunConn *net.UDP
 
 	defer remoteConn.Close()
 
+	utils.OpenConnection()
+	defer utils.CloseConnection()
+
 	done := make(chan struct{})
 	c.logger.Debugf("start to copy from tunnel %s to local %s", tunConn.LocalAddr(), remoteAddr)
 	go func() {
-		c.udpCopy(remoteConn, tunConn, port)
+		c.udpCopy(remoteConn, tunConn, port, false)
 		done <- struct{}{}
 	}()
 
-	c.udpCopy(tunConn, remoteConn, port)
+	c.udpCopy(tunConn, remoteConn, port, true)
 
 	<-done
 
 }
 
-func (c *UdpTransport) udpCopy(srcConn, dstConn *net.UDPConn, port int) {
+// udpCopy forwards the datagrams of srcConn to dstConn, upstream when srcConn
+// is the tunnel.
+func (c *UdpTransport) udpCopy(srcConn, dstConn *net.UDPConn, port int, upstream bool) {
 	buf := make([]byte, 16*1024)
 	readTimeout := 60 * time.Second
 
@@ -457,6 +496,7 @@ func (c *UdpTransport) udpCopy(srcConn, dstConn *net.UDPConn, port int) {
 		if c.config.Sniffer {
 			c.usageMonitor.AddOrUpdatePort(port, uint64(totalWritten))
 		}
+		utils.CountTraffic(upstream, totalWritten)
 
 		c.logger.Debugf("forwarded %d bytes from %s to %s", n, srcConn.LocalAddr().String(), dstConn.RemoteAddr().String())
 	}
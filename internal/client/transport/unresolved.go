@@ -0,0 +1,88 @@
+package transport
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// UnresolvedTargets remembers backend names that failed to resolve, so the
+// connections to them fail at once for a while instead of each one waiting on
+// DNS and logging an error. A backoff of 0 disables it.
+type UnresolvedTargets struct {
+	backoff time.Duration
+	mu      sync.Mutex
+	until   map[string]time.Time // host name to the time its next connection may try it again
+	logger  *logrus.Logger
+}
+
+func NewUnresolvedTargets(backoff time.Duration, logger *logrus.Logger) *UnresolvedTargets {
+	return &UnresolvedTargets{
+		backoff: backoff,
+		until:   make(map[string]time.Time),
+		logger:  logger,
+	}
+}
+
+// Degraded reports whether a connection to target should fail without being
+// dialed. Once per backoff a connection is let through to resolve the name again.
+func (u *UnresolvedTargets) Degraded(target string) bool {
+	if u.backoff <= 0 {
+		return false
+	}
+
+	host, _, err := net.SplitHostPort(target)
+	if err != nil {
+		return false
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	until, ok := u.until[host]
+	if !ok {
+		return false
+	}
+	if time.Now().Before(until) {
+		return true
+	}
+
+	// This connection checks the name, the others keep failing meanwhile
+	u.until[host] = time.Now().Add(u.backoff)
+	return false
+}
+
+// Dialed records the outcome of dialing target, err is nil on success.
+func (u *UnresolvedTargets) Dialed(target string, err error) {
+	if u.backoff <= 0 {
+		return
+	}
+
+	host, _, splitErr := net.SplitHostPort(target)
+	if splitErr != nil {
+		return
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	_, degraded := u.until[host]
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		if !degraded {
+			u.logger.Errorf("backend %s does not resolve, failing its connections for %v at a time: %v", host, u.backoff, err)
+		}
+		u.until[host] = time.Now().Add(u.backoff)
+		return
+	}
+
+	// Any other outcome means the name resolved
+	if degraded {
+		delete(u.until, host)
+		u.logger.Infof("backend %s resolves again", host)
+	}
+}
@@ -3,7 +3,10 @@ package transport
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"net"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -24,26 +27,50 @@ type WsTransport struct {
 	logger          *logrus.Logger
 	controlChannel  *websocket.Conn
 	restartMutex    sync.Mutex
+	restartPacer    restartPacer
 	usageMonitor    *web.Usage
 	poolConnections int32
 	loadConnections int32
+	assigning       int32 // connections requested with SG_Chan that no pool connection was assigned yet
 	controlFlow     chan struct{}
+	tlsConfig       *tls.Config
+	targetLimiter   *TargetLimiter
+	unresolved      *UnresolvedTargets
+	backendPool     *BackendPool
+	dialHold        *DialHold
 }
 type WsConfig struct {
-	RemoteAddr     string
-	Token          string
-	SnifferLog     string
-	TunnelStatus   string
-	Nodelay        bool
-	Sniffer        bool
-	KeepAlive      time.Duration
-	RetryInterval  time.Duration
-	DialTimeOut    time.Duration
-	ConnPoolSize   int
-	WebPort        int
-	Mode           config.TransportType
-	AggressivePool bool
-	EdgeIP         string
+	RemoteAddr              string
+	Token                   string
+	SnifferLog              string
+	TunnelStatus            string
+	Nodelay                 bool
+	BackendNodelay          bool // Nodelay of the sockets facing the backends
+	Sniffer                 bool
+	KeepAlive               time.Duration
+	RetryInterval           time.Duration
+	DialTimeOut             time.Duration
+	ConnPoolSize            int
+	WebPort                 int
+	SnifferMaxPorts         int
+	SnifferRetention        time.Duration
+	Mode                    config.TransportType
+	AggressivePool          bool
+	EdgeIP                  string
+	TLSPSK                  bool
+	TLSServerName           string        // Expected name of the server certificate, also sent as SNI
+	TLSPinnedCert           string        // Hex SHA-256 fingerprint of the only accepted server certificate
+	StandbyChannel          bool          // Keep a second control channel that takes over when the first one fails
+	MaxPerTargetConnections int           // Concurrent connections allowed per local address, 0 means unlimited
+	MSSClamp                int           // TCP_MAXSEG for local connections, 0 disables clamping
+	BackendProxy            string        // HTTP CONNECT proxy URL for local connections, empty dials them directly
+	BackendProbe            []string      // Backends dialed once after connecting, the status reports unreachable ones
+	BlockedTargetPorts      []int         // Destination ports never dialed, whatever the server requests
+	UnresolvedBackoff       time.Duration // Fail connections to a backend name that did not resolve for this long, 0 disables it
+	BackendPool             int           // Idle connections kept dialed to every backend in use, 0 dials each forwarded connection
+	BackendPoolIdle         time.Duration // Idle backend connections are closed after this long, and backends unused for this long are no longer kept warm
+	SlowDial                time.Duration // Log backend dials slower than this, 0 logs none
+	BackpressureDelay       time.Duration // Hold back new tunnel connections this long after the server signaled a full tunnel channel
 }
 
 func NewWSClient(parentCtx context.Context, config *WsConfig, logger *logrus.Logger) *WsTransport {
@@ -58,12 +85,20 @@ func NewWSClient(parentCtx context.Context, config *WsConfig, logger *logrus.Log
 		cancel:          cancel,
 		logger:          logger,
 		controlChannel:  nil, // will be set when a control connection is established
-		usageMonitor:    web.NewDataStore(fmt.Sprintf(":%v", config.WebPort), ctx, config.SnifferLog, config.Sniffer, &config.TunnelStatus, logger),
+		usageMonitor:    web.NewDataStore(fmt.Sprintf(":%v", config.WebPort), ctx, config.SnifferLog, config.Sniffer, &config.TunnelStatus, logger, config.SnifferMaxPorts, config.SnifferRetention),
 		poolConnections: 0,
 		loadConnections: 0,
 		controlFlow:     make(chan struct{}, 100),
+		tlsConfig:       ClientTLSConfig(config.Token, config.TLSPSK, config.TLSServerName, config.TLSPinnedCert),
+		targetLimiter:   NewTargetLimiter(config.MaxPerTargetConnections),
+		unresolved:      NewUnresolvedTargets(config.UnresolvedBackoff, logger),
+		dialHold:        NewDialHold(config.BackpressureDelay),
 	}
 
+	// The connections kept warm are dialed like those of forwarded connections
+	client.backendPool = NewBackendPool(parentCtx, config.BackendPool, config.BackendPoolIdle, func(address string) (net.Conn, error) {
+		return BackendDialer(parentCtx, address, config.BackendProxy, config.DialTimeOut, config.KeepAlive, config.BackendNodelay, config.MSSClamp)
+	}, logger)
 	return client
 }
 
@@ -79,6 +114,11 @@ func (c *WsTransport) Start() {
 
 }
 func (c *WsTransport) Restart() {
+	// Nothing to restart once the tunnel is shutting down, e.g. for a config reload
+	if c.parentctx.Err() != nil {
+		return
+	}
+
 	if !c.restartMutex.TryLock() {
 		c.logger.Warn("client is already restarting")
 		return
@@ -86,6 +126,7 @@ func (c *WsTransport) Restart() {
 	defer c.restartMutex.Unlock()
 
 	c.logger.Info("restarting client...")
+	utils.CountRestart()
 
 	// for removing timeout logs
 	level := c.logger.Level
@@ -100,7 +141,8 @@ func (c *WsTransport) Restart() {
 		c.controlChannel.Close()
 	}
 
-	time.Sleep(2 * time.Second)
+	// Redial right away unless the tunnel keeps dropping
+	c.restartPacer.wait(c.config.RetryInterval)
 
 	ctx, cancel := context.WithCancel(c.parentctx)
 	c.ctx = ctx
@@ -108,15 +150,20 @@ func (c *WsTransport) Restart() {
 
 	// Re-initialize variables
 	c.controlChannel = nil
-	c.usageMonitor = web.NewDataStore(fmt.Sprintf(":%v", c.config.WebPort), ctx, c.config.SnifferLog, c.config.Sniffer, &c.config.TunnelStatus, c.logger)
+	c.usageMonitor = web.NewDataStore(fmt.Sprintf(":%v", c.config.WebPort), ctx, c.config.SnifferLog, c.config.Sniffer, &c.config.TunnelStatus, c.logger, c.config.SnifferMaxPorts, c.config.SnifferRetention)
 	c.config.TunnelStatus = ""
 	c.poolConnections = 0
 	c.loadConnections = 0
+	c.assigning = 0
 	c.controlFlow = make(chan struct{}, 100)
 
 	// set the log level again
 	c.logger.SetLevel(level)
 
+	if c.parentctx.Err() != nil {
+		return
+	}
+
 	go c.Start()
 }
 
@@ -128,7 +175,7 @@ func (c *WsTransport) channelDialer() {
 		case <-c.ctx.Done():
 			return
 		default:
-			tunnelWSConn, err := WebSocketDialer(c.ctx, c.config.RemoteAddr, c.config.EdgeIP, "/channel", c.config.DialTimeOut, c.config.KeepAlive, c.config.Nodelay, c.config.Token, c.config.Mode, 3)
+			tunnelWSConn, err := WebSocketDialer(c.ctx, c.config.RemoteAddr, c.config.EdgeIP, "/channel", c.config.DialTimeOut, c.config.KeepAlive, c.config.Nodelay, c.config.Token, c.config.Mode, c.tlsConfig, 0, 3)
 			if err != nil {
 				c.logger.Errorf("control channel dialer: %v", err)
 				time.Sleep(c.config.RetryInterval)
@@ -136,8 +183,10 @@ func (c *WsTransport) channelDialer() {
 			}
 			c.controlChannel = tunnelWSConn
 			c.logger.Info("control channel established successfully")
+			utils.MarkReady(c.ctx)
 
 			c.config.TunnelStatus = fmt.Sprintf("Connected (%s)", c.config.Mode)
+			go probeBackends(c.ctx, &c.config.TunnelStatus, c.config.TunnelStatus, c.config.BackendProbe, c.config.BackendProxy, c.config.DialTimeOut, c.logger)
 
 			go c.poolMaintainer()
 			go c.channelHandler()
@@ -173,6 +222,7 @@ func (c *WsTransport) poolMaintainer() {
 	defer tickerLoad.Stop()
 
 	newPoolSize := c.config.ConnPoolSize // intial value
+	utils.GaugePoolSize(newPoolSize)
 	var poolConnectionsSum int32 = 0
 
 	for {
@@ -194,14 +244,18 @@ func (c *WsTransport) poolMaintainer() {
 			atomic.StoreInt32(&poolConnectionsSum, 0)                                   // Reset
 
 			// Dynamically adjust the pool size based on current connections
-			if (loadConnections + a) > poolConnectionsAvg*b {
+			if (loadConnections+a) > poolConnectionsAvg*b && !c.dialHold.Held() {
 				c.logger.Debugf("increasing pool size: %d -> %d, avg pool conn: %d, avg load conn: %d", newPoolSize, newPoolSize+1, poolConnectionsAvg, loadConnections)
+				web.PublishEvent("pool", web.PoolEvent{From: newPoolSize, To: newPoolSize + 1})
+				utils.GaugePoolSize(newPoolSize + 1)
 				newPoolSize++
 
 				// Add a new connection to the pool
 				go c.tunnelDialer()
 			} else if float64(loadConnections+x) < float64(poolConnectionsAvg)*y && newPoolSize > c.config.ConnPoolSize {
 				c.logger.Debugf("decreasing pool size: %d -> %d, avg pool conn: %d, avg load conn: %d", newPoolSize, newPoolSize-1, poolConnectionsAvg, loadConnections)
+				web.PublishEvent("pool", web.PoolEvent{From: newPoolSize, To: newPoolSize - 1})
+				utils.GaugePoolSize(newPoolSize - 1)
 				newPoolSize--
 
 				// send a signal to controlFlow
@@ -213,29 +267,67 @@ func (c *WsTransport) poolMaintainer() {
 }
 
 func (c *WsTransport) channelHandler() {
-	msgChan := make(chan byte, 1000)
+	// Messages and read errors of the control channel and of the standby one
+	reads := make(chan controlRead, 1000)
+	go readControl(c.ctx, c.controlChannel, reads)
+
+	// Standby control channel, it takes over at once when the control channel fails
+	var standby *websocket.Conn
+	standbyReady := make(chan *websocket.Conn, 1)
+	defer func() {
+		if standby != nil {
+			standby.Close()
+		}
+	}()
 
-	// Goroutine to handle the blocking ReceiveBinaryString
-	go func() {
-		for {
-			select {
-			case <-c.ctx.Done():
-				return
+	dialStandby := func() {
+		if !c.config.StandbyChannel {
+			return
+		}
 
-			default:
-				_, msg, err := c.controlChannel.ReadMessage()
-				if err != nil {
-					if c.cancel != nil {
-						c.logger.Error("failed to read from channel connection. ", err)
-						go c.Restart()
-					}
+		go func() {
+			for {
+				conn, err := WebSocketDialer(c.ctx, c.config.RemoteAddr, c.config.EdgeIP, "/standby", c.config.DialTimeOut, c.config.KeepAlive, c.config.Nodelay, c.config.Token, c.config.Mode, c.tlsConfig, 0, 3)
+				if err == nil {
+					standbyReady <- conn
 					return
 				}
+				c.logger.Warnf("standby control channel dialer: %v", err)
 
-				msgChan <- msg[0]
+				select {
+				case <-c.ctx.Done():
+					return
+				case <-time.After(c.config.RetryInterval):
+				}
 			}
+		}()
+	}
+	dialStandby()
+
+	// failover makes the standby the control channel, false when there is none
+	failover := func(err error) bool {
+		if standby == nil {
+			return false
 		}
-	}()
+
+		c.logger.Warnf("control channel failed, switching over to the standby control channel: %v", err)
+		c.controlChannel.Close()
+		c.controlChannel = standby
+		standby = nil
+		dialStandby()
+		return true
+	}
+
+	// send writes a signal to the control channel, once more after a failover
+	send := func(signal byte) error {
+		err := c.controlChannel.WriteMessage(websocket.BinaryMessage, []byte{signal})
+		if err != nil && failover(err) {
+			if err = c.controlChannel.WriteMessage(websocket.BinaryMessage, []byte{utils.SG_Swap}); err == nil {
+				err = c.controlChannel.WriteMessage(websocket.BinaryMessage, []byte{signal})
+			}
+		}
+		return err
+	}
 
 	// Main loop to listen for context cancellation or received messages
 	for {
@@ -244,36 +336,74 @@ func (c *WsTransport) channelHandler() {
 			_ = c.controlChannel.WriteMessage(websocket.BinaryMessage, []byte{utils.SG_Closed})
 			return
 
-		case msg := <-msgChan:
-			switch msg {
+		case conn := <-standbyReady:
+			standby = conn
+			go readControl(c.ctx, conn, reads)
+			c.logger.Debug("standby control channel established")
+
+		case read := <-reads:
+			if standby != nil && read.conn == standby {
+				if read.err != nil {
+					c.logger.Debugf("standby control channel closed: %v", read.err)
+					standby.Close()
+					standby = nil
+					dialStandby()
+					continue
+				}
+
+				// The server switched over first
+				failover(errors.New("the server switched over"))
+			} else if read.conn != c.controlChannel {
+				continue // a control channel that was switched away from
+			}
+
+			if read.err != nil {
+				if failover(read.err) {
+					_ = c.controlChannel.WriteMessage(websocket.BinaryMessage, []byte{utils.SG_Swap})
+					continue
+				}
+				c.logger.Error("failed to read from channel connection. ", read.err)
+				go c.Restart()
+				return
+			}
+
+			switch read.msg {
 			case utils.SG_Chan:
 				atomic.AddInt32(&c.loadConnections, 1)
-				select {
-				case <-c.controlFlow: // Do nothing
+				atomic.AddInt32(&c.assigning, 1)
 
-				default:
+				if skipReplacement(c.controlFlow, &c.poolConnections, &c.assigning) {
+					c.logger.Debug("channel signal received, not replacing the used connection to shrink the pool")
+				} else {
 					c.logger.Debug("channel signal received, initiating tunnel dialer")
 					go c.tunnelDialer()
 				}
 
+			case utils.SG_Busy:
+				c.logger.Debugf("server tunnel channel is full, holding back new tunnel connections for %v", c.config.BackpressureDelay)
+				c.dialHold.Hold()
+
 			case utils.SG_HB:
 				c.logger.Debug("heartbeat signal received successfully")
 				// send heartbeat back
-				err := c.controlChannel.WriteMessage(websocket.BinaryMessage, []byte{utils.SG_HB})
+				err := send(utils.SG_HB)
 				if err != nil {
-					c.logger.Errorf("failed to send heartbeat: %v", msg)
+					c.logger.Errorf("failed to send heartbeat: %v", read.msg)
 					go c.Restart()
 					return
 				}
 				c.logger.Trace("heartbeat signal sent successfully")
 
+			case utils.SG_Swap:
+				c.logger.Trace("server switched over to the standby control channel")
+
 			case utils.SG_Closed:
 				c.logger.Warn("control channel has been closed by the server")
 				go c.Restart()
 				return
 
 			default:
-				c.logger.Errorf("unexpected response from channel: %v", msg)
+				c.logger.Errorf("unexpected response from channel: %v", read.msg)
 				go c.Restart()
 				return
 			}
@@ -282,10 +412,15 @@ func (c *WsTransport) channelHandler() {
 }
 
 func (c *WsTransport) tunnelDialer() {
+	// The server signaled its tunnel channel is full, dialing now would only be discarded
+	if !c.dialHold.Wait(c.ctx) {
+		return
+	}
+
 	c.logger.Debugf("initiating new websocket tunnel connection to address %s", c.config.RemoteAddr)
 
 	// Dial to the tunnel server
-	tunnelConn, err := WebSocketDialer(c.ctx, c.config.RemoteAddr, c.config.EdgeIP, "/tunnel", c.config.DialTimeOut, c.config.KeepAlive, c.config.Nodelay, c.config.Token, c.config.Mode, 3)
+	tunnelConn, err := WebSocketDialer(c.ctx, c.config.RemoteAddr, c.config.EdgeIP, "/tunnel", c.config.DialTimeOut, c.config.KeepAlive, c.config.Nodelay, c.config.Token, c.config.Mode, c.tlsConfig, 0, 3)
 	if err != nil {
 		c.logger.Errorf("tunnel server dialer: %v", err)
 
@@ -318,6 +453,7 @@ func (c *WsTransport) tunnelDialer() {
 
 			// Decrement active connections
 			atomic.AddInt32(&c.poolConnections, -1)
+			atomic.AddInt32(&c.assigning, -1)
 
 			remoteAddr := string(remoteAddrBytes)
 
@@ -336,7 +472,29 @@ func (c *WsTransport) tunnelDialer() {
 }
 
 func (c *WsTransport) localDialer(tunnelCon *websocket.Conn, remoteAddr string, port int) {
-	localConn, err := TcpDialer(c.ctx, remoteAddr, c.config.DialTimeOut, c.config.KeepAlive, c.config.Nodelay, 1)
+	if portListed(port, c.config.BlockedTargetPorts) {
+		c.logger.Warnf("refusing connection to %s, port %d is blocked", remoteAddr, port)
+		tunnelCon.Close()
+		return
+	}
+
+	if c.unresolved.Degraded(remoteAddr) {
+		c.logger.Debugf("refusing connection to %s, the name does not resolve", remoteAddr)
+		tunnelCon.Close()
+		return
+	}
+
+	if !c.targetLimiter.Acquire(remoteAddr) {
+		c.logger.Warnf("connection limit reached for local address %s, rejecting connection", remoteAddr)
+		tunnelCon.Close()
+		return
+	}
+	defer c.targetLimiter.Release(remoteAddr)
+
+	localConn, err := c.backendPool.Get(remoteAddr, false, timedDial(port, remoteAddr, c.config.SlowDial, c.logger, func() (net.Conn, error) {
+		return BackendDialer(c.ctx, remoteAddr, c.config.BackendProxy, c.config.DialTimeOut, c.config.KeepAlive, c.config.BackendNodelay, c.config.MSSClamp)
+	}))
+	c.unresolved.Dialed(remoteAddr, err)
 	if err != nil {
 		c.logger.Errorf("local dialer: %v", err)
 		tunnelCon.Close()
@@ -344,5 +502,5 @@ func (c *WsTransport) localDialer(tunnelCon *websocket.Conn, remoteAddr string,
 	}
 	c.logger.Debugf("connected to local address %s successfully", remoteAddr)
 
-	utils.WSConnectionHandler(tunnelCon, localConn, c.logger, c.usageMonitor, int(port), c.config.Sniffer)
+	utils.WSConnectionHandler(tunnelCon, localConn, c.logger, c.usageMonitor, int(port), c.config.Sniffer, false)
 }
@@ -2,7 +2,10 @@ package transport
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"net"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -26,32 +29,60 @@ type WsMuxTransport struct {
 	controlChannel  *websocket.Conn
 	usageMonitor    *web.Usage
 	restartMutex    sync.Mutex
+	restartPacer    restartPacer
 	poolConnections int32
 	loadConnections int32
 	controlFlow     chan struct{}
+	tlsConfig       *tls.Config
+	targetLimiter   *TargetLimiter
+	unresolved      *UnresolvedTargets
+	backendPool     *BackendPool
+	dialHold        *DialHold
 }
 type WsMuxConfig struct {
-	RemoteAddr       string
-	Token            string
-	SnifferLog       string
-	TunnelStatus     string
-	Nodelay          bool
-	Sniffer          bool
-	KeepAlive        time.Duration
-	RetryInterval    time.Duration
-	DialTimeOut      time.Duration
-	MuxVersion       int
-	MaxFrameSize     int
-	MaxReceiveBuffer int
-	MaxStreamBuffer  int
-	ConnPoolSize     int
-	WebPort          int
-	Mode             config.TransportType
-	AggressivePool   bool
-	EdgeIP           string
+	RemoteAddr              string
+	Token                   string
+	SnifferLog              string
+	TunnelStatus            string
+	Nodelay                 bool
+	BackendNodelay          bool // Nodelay of the sockets facing the backends
+	Sniffer                 bool
+	KeepAlive               time.Duration
+	RetryInterval           time.Duration
+	DialTimeOut             time.Duration
+	MuxVersion              int
+	MaxFrameSize            int
+	MaxReceiveBuffer        int
+	MaxStreamBuffer         int
+	ConnPoolSize            int
+	WebPort                 int
+	SnifferMaxPorts         int
+	SnifferRetention        time.Duration
+	Mode                    config.TransportType
+	AggressivePool          bool
+	EdgeIP                  string
+	TLSPSK                  bool
+	TLSServerName           string        // Expected name of the server certificate, also sent as SNI
+	TLSPinnedCert           string        // Hex SHA-256 fingerprint of the only accepted server certificate
+	StandbyChannel          bool          // Keep a second control channel that takes over when the first one fails
+	MaxPerTargetConnections int           // Concurrent connections allowed per local address, 0 means unlimited
+	MSSClamp                int           // TCP_MAXSEG for local connections, 0 disables clamping
+	ReadDeadline            time.Duration // Bound on a single read in the copy loop, 0 disables it
+	WriteDeadline           time.Duration // Bound on a single write in the copy loop, 0 disables it
+	BackendIdle             time.Duration // Close a forwarded connection after no data in either direction for this long, 0 disables it
+	BackendProxy            string        // HTTP CONNECT proxy URL for local connections, empty dials them directly
+	BackendProbe            []string      // Backends dialed once after connecting, the status reports unreachable ones
+	BlockedTargetPorts      []int         // Destination ports never dialed, whatever the server requests
+	UnresolvedBackoff       time.Duration // Fail connections to a backend name that did not resolve for this long, 0 disables it
+	BackendPool             int           // Idle connections kept dialed to every backend in use, 0 dials each forwarded connection
+	BackendPoolIdle         time.Duration // Idle backend connections are closed after this long, and backends unused for this long are no longer kept warm
+	SlowDial                time.Duration // Log backend dials slower than this, 0 logs none
+	OrderedStreams          bool          // Dial the backend of a stream before accepting the next one of the session
+	BackpressureDelay       time.Duration // Hold back new tunnel connections this long after the server signaled a full tunnel channel
+	ControlGrace            time.Duration // Reconnect a failed control channel for this long while the mux sessions keep serving, 0 restarts right away
 }
 
-func NewWSMuxClient(parentCtx context.Context, config *WsMuxConfig, logger *logrus.Logger) *WsMuxTransport {
+func NewWSMuxClient(parentCtx context.Context, config *WsMuxConfig, logger *logrus.Logger) (*WsMuxTransport, error) {
 	// Create a derived context from the parent context
 	ctx, cancel := context.WithCancel(parentCtx)
 
@@ -71,13 +102,27 @@ func NewWSMuxClient(parentCtx context.Context, config *WsMuxConfig, logger *logr
 		cancel:          cancel,
 		logger:          logger,
 		controlChannel:  nil, // will be set when a control connection is established
-		usageMonitor:    web.NewDataStore(fmt.Sprintf(":%v", config.WebPort), ctx, config.SnifferLog, config.Sniffer, &config.TunnelStatus, logger),
+		usageMonitor:    web.NewDataStore(fmt.Sprintf(":%v", config.WebPort), ctx, config.SnifferLog, config.Sniffer, &config.TunnelStatus, logger, config.SnifferMaxPorts, config.SnifferRetention),
 		poolConnections: 0,
 		loadConnections: 0,
 		controlFlow:     make(chan struct{}, 100),
+		tlsConfig:       ClientTLSConfig(config.Token, config.TLSPSK, config.TLSServerName, config.TLSPinnedCert),
+		targetLimiter:   NewTargetLimiter(config.MaxPerTargetConnections),
+		unresolved:      NewUnresolvedTargets(config.UnresolvedBackoff, logger),
+		dialHold:        NewDialHold(config.BackpressureDelay),
 	}
 
-	return client
+	// The session would fail on every connection with an invalid configuration
+	if err := smux.VerifyConfig(client.smuxConfig); err != nil {
+		cancel()
+		return nil, fmt.Errorf("invalid mux configuration: %w", err)
+	}
+
+	// The connections kept warm are dialed like those of forwarded connections
+	client.backendPool = NewBackendPool(parentCtx, config.BackendPool, config.BackendPoolIdle, func(address string) (net.Conn, error) {
+		return BackendDialer(parentCtx, address, config.BackendProxy, config.DialTimeOut, config.KeepAlive, config.BackendNodelay, config.MSSClamp)
+	}, logger)
+	return client, nil
 }
 
 func (c *WsMuxTransport) Start() {
@@ -91,6 +136,11 @@ func (c *WsMuxTransport) Start() {
 }
 
 func (c *WsMuxTransport) Restart() {
+	// Nothing to restart once the tunnel is shutting down, e.g. for a config reload
+	if c.parentctx.Err() != nil {
+		return
+	}
+
 	if !c.restartMutex.TryLock() {
 		c.logger.Warn("client is already restarting")
 		return
@@ -98,6 +148,7 @@ func (c *WsMuxTransport) Restart() {
 	defer c.restartMutex.Unlock()
 
 	c.logger.Info("restarting client...")
+	utils.CountRestart()
 
 	// for removing timeout logs
 	level := c.logger.Level
@@ -112,7 +163,8 @@ func (c *WsMuxTransport) Restart() {
 		c.controlChannel.Close()
 	}
 
-	time.Sleep(2 * time.Second)
+	// Redial right away unless the tunnel keeps dropping
+	c.restartPacer.wait(c.config.RetryInterval)
 
 	ctx, cancel := context.WithCancel(c.parentctx)
 	c.ctx = ctx
@@ -120,7 +172,7 @@ func (c *WsMuxTransport) Restart() {
 
 	// Re-initialize variables
 	c.controlChannel = nil
-	c.usageMonitor = web.NewDataStore(fmt.Sprintf(":%v", c.config.WebPort), ctx, c.config.SnifferLog, c.config.Sniffer, &c.config.TunnelStatus, c.logger)
+	c.usageMonitor = web.NewDataStore(fmt.Sprintf(":%v", c.config.WebPort), ctx, c.config.SnifferLog, c.config.Sniffer, &c.config.TunnelStatus, c.logger, c.config.SnifferMaxPorts, c.config.SnifferRetention)
 	c.config.TunnelStatus = ""
 	c.poolConnections = 0
 	c.loadConnections = 0
@@ -129,6 +181,10 @@ func (c *WsMuxTransport) Restart() {
 	// set the log level again
 	c.logger.SetLevel(level)
 
+	if c.parentctx.Err() != nil {
+		return
+	}
+
 	go c.Start()
 }
 
@@ -141,7 +197,7 @@ func (c *WsMuxTransport) channelDialer() {
 			return
 		default:
 
-			tunnelWSConn, err := WebSocketDialer(c.ctx, c.config.RemoteAddr, c.config.EdgeIP, "/channel", c.config.DialTimeOut, c.config.KeepAlive, c.config.Nodelay, c.config.Token, c.config.Mode, 3)
+			tunnelWSConn, err := WebSocketDialer(c.ctx, c.config.RemoteAddr, c.config.EdgeIP, "/channel", c.config.DialTimeOut, c.config.KeepAlive, c.config.Nodelay, c.config.Token, c.config.Mode, c.tlsConfig, c.config.MuxVersion, 3)
 			if err != nil {
 				c.logger.Errorf("control channel dialer: %v", err)
 				time.Sleep(c.config.RetryInterval)
@@ -149,8 +205,10 @@ func (c *WsMuxTransport) channelDialer() {
 			}
 			c.controlChannel = tunnelWSConn
 			c.logger.Info("control channel established successfully")
+			utils.MarkReady(c.ctx)
 
 			c.config.TunnelStatus = fmt.Sprintf("Connected (%s)", c.config.Mode)
+			go probeBackends(c.ctx, &c.config.TunnelStatus, c.config.TunnelStatus, c.config.BackendProbe, c.config.BackendProxy, c.config.DialTimeOut, c.logger)
 
 			go c.poolMaintainer()
 			go c.channelHandler()
@@ -186,6 +244,7 @@ func (c *WsMuxTransport) poolMaintainer() {
 	defer tickerLoad.Stop()
 
 	newPoolSize := c.config.ConnPoolSize // intial value
+	utils.GaugePoolSize(newPoolSize)
 	var poolConnectionsSum int32 = 0
 
 	for {
@@ -207,14 +266,18 @@ func (c *WsMuxTransport) poolMaintainer() {
 			atomic.StoreInt32(&poolConnectionsSum, 0)                                   // Reset
 
 			// Dynamically adjust the pool size based on current connections
-			if (loadConnections + a) > poolConnectionsAvg*b {
+			if (loadConnections+a) > poolConnectionsAvg*b && !c.dialHold.Held() {
 				c.logger.Debugf("increasing pool size: %d -> %d, avg pool conn: %d, avg load conn: %d", newPoolSize, newPoolSize+1, poolConnectionsAvg, loadConnections)
+				web.PublishEvent("pool", web.PoolEvent{From: newPoolSize, To: newPoolSize + 1})
+				utils.GaugePoolSize(newPoolSize + 1)
 				newPoolSize++
 
 				// Add a new connection to the pool
 				go c.tunnelDialer()
 			} else if float64(loadConnections+x) < float64(poolConnectionsAvg)*y && newPoolSize > c.config.ConnPoolSize {
 				c.logger.Debugf("decreasing pool size: %d -> %d, avg pool conn: %d, avg load conn: %d", newPoolSize, newPoolSize-1, poolConnectionsAvg, loadConnections)
+				web.PublishEvent("pool", web.PoolEvent{From: newPoolSize, To: newPoolSize - 1})
+				utils.GaugePoolSize(newPoolSize - 1)
 				newPoolSize--
 
 				// send a signal to controlFlow
@@ -226,28 +289,101 @@ func (c *WsMuxTransport) poolMaintainer() {
 }
 
 func (c *WsMuxTransport) channelHandler() {
-	msgChan := make(chan byte, 1000)
+	// Messages and read errors of the control channel and of the standby one
+	reads := make(chan controlRead, 1000)
+	go readControl(c.ctx, c.controlChannel, reads)
 
-	// Goroutine to handle the blocking ReceiveBinaryString
-	go func() {
-		for {
-			select {
-			case <-c.ctx.Done():
-				return
+	// Standby control channel, it takes over at once when the control channel fails
+	var standby *websocket.Conn
+	standbyReady := make(chan *websocket.Conn, 1)
+	defer func() {
+		if standby != nil {
+			standby.Close()
+		}
+	}()
 
-			default:
-				_, msg, err := c.controlChannel.ReadMessage()
-				if err != nil {
-					if c.cancel != nil {
-						c.logger.Error("failed to read from channel connection. ", err)
-						go c.Restart()
-					}
+	dialStandby := func() {
+		if !c.config.StandbyChannel {
+			return
+		}
+
+		go func() {
+			for {
+				conn, err := WebSocketDialer(c.ctx, c.config.RemoteAddr, c.config.EdgeIP, "/standby", c.config.DialTimeOut, c.config.KeepAlive, c.config.Nodelay, c.config.Token, c.config.Mode, c.tlsConfig, c.config.MuxVersion, 3)
+				if err == nil {
+					standbyReady <- conn
+					return
+				}
+				c.logger.Warnf("standby control channel dialer: %v", err)
+
+				select {
+				case <-c.ctx.Done():
 					return
+				case <-time.After(c.config.RetryInterval):
 				}
-				msgChan <- msg[0]
 			}
+		}()
+	}
+	dialStandby()
+
+	// failover makes the standby the control channel, false when there is none
+	failover := func(err error) bool {
+		if standby == nil {
+			return false
 		}
-	}()
+
+		c.logger.Warnf("control channel failed, switching over to the standby control channel: %v", err)
+		c.controlChannel.Close()
+		c.controlChannel = standby
+		standby = nil
+		dialStandby()
+		return true
+	}
+
+	// send writes a signal to the control channel, once more after a failover
+	send := func(signal byte) error {
+		err := c.controlChannel.WriteMessage(websocket.BinaryMessage, []byte{signal})
+		if err != nil && failover(err) {
+			if err = c.controlChannel.WriteMessage(websocket.BinaryMessage, []byte{utils.SG_Swap}); err == nil {
+				err = c.controlChannel.WriteMessage(websocket.BinaryMessage, []byte{signal})
+			}
+		}
+		return err
+	}
+
+	// resume reconnects the control channel within ControlGrace while the mux
+	// sessions keep serving, false when it did not
+	resume := func(err error) bool {
+		if c.config.ControlGrace <= 0 {
+			return false
+		}
+
+		c.logger.Warnf("control channel failed, reconnecting it within %v: %v", c.config.ControlGrace, err)
+		c.config.TunnelStatus = fmt.Sprintf("Reconnecting (%s)", c.config.Mode)
+		c.controlChannel.Close()
+
+		deadline := time.Now().Add(c.config.ControlGrace)
+		for time.Now().Before(deadline) {
+			conn, err := WebSocketDialer(c.ctx, c.config.RemoteAddr, c.config.EdgeIP, "/channel", c.config.DialTimeOut, c.config.KeepAlive, c.config.Nodelay, c.config.Token, c.config.Mode, c.tlsConfig, c.config.MuxVersion, 1)
+			if err == nil {
+				c.controlChannel = conn
+				go readControl(c.ctx, conn, reads)
+				c.config.TunnelStatus = fmt.Sprintf("Connected (%s)", c.config.Mode)
+				c.logger.Info("control channel reconnected, mux sessions kept")
+				return true
+			}
+			c.logger.Debugf("control channel reconnect: %v", err)
+
+			select {
+			case <-c.ctx.Done():
+				return true // the handler returns on the next iteration
+			case <-time.After(c.config.RetryInterval):
+			}
+		}
+
+		c.logger.Errorf("failed to reconnect the control channel within %v", c.config.ControlGrace)
+		return false
+	}
 
 	for {
 		select {
@@ -255,8 +391,41 @@ func (c *WsMuxTransport) channelHandler() {
 			_ = c.controlChannel.WriteMessage(websocket.BinaryMessage, []byte{utils.SG_Closed})
 			return
 
-		case msg := <-msgChan:
-			switch msg {
+		case conn := <-standbyReady:
+			standby = conn
+			go readControl(c.ctx, conn, reads)
+			c.logger.Debug("standby control channel established")
+
+		case read := <-reads:
+			if standby != nil && read.conn == standby {
+				if read.err != nil {
+					c.logger.Debugf("standby control channel closed: %v", read.err)
+					standby.Close()
+					standby = nil
+					dialStandby()
+					continue
+				}
+
+				// The server switched over first
+				failover(errors.New("the server switched over"))
+			} else if read.conn != c.controlChannel {
+				continue // a control channel that was switched away from
+			}
+
+			if read.err != nil {
+				if failover(read.err) {
+					_ = c.controlChannel.WriteMessage(websocket.BinaryMessage, []byte{utils.SG_Swap})
+					continue
+				}
+				if resume(read.err) {
+					continue
+				}
+				c.logger.Error("failed to read from channel connection. ", read.err)
+				go c.Restart()
+				return
+			}
+
+			switch read.msg {
 			case utils.SG_Chan:
 				atomic.AddInt32(&c.loadConnections, 1)
 				select {
@@ -267,23 +436,30 @@ func (c *WsMuxTransport) channelHandler() {
 					go c.tunnelDialer()
 				}
 
+			case utils.SG_Busy:
+				c.logger.Debugf("server tunnel channel is full, holding back new tunnel connections for %v", c.config.BackpressureDelay)
+				c.dialHold.Hold()
+
 			case utils.SG_HB:
 				c.logger.Debug("heartbeat received successfully")
-				err := c.controlChannel.WriteMessage(websocket.BinaryMessage, []byte{utils.SG_HB})
-				if err != nil {
-					c.logger.Errorf("failed to send heartbeat: %v", msg)
+				err := send(utils.SG_HB)
+				if err != nil && !resume(err) {
+					c.logger.Errorf("failed to send heartbeat: %v", read.msg)
 					go c.Restart()
 					return
 				}
 				c.logger.Trace("heartbeat signal sent successfully")
 
+			case utils.SG_Swap:
+				c.logger.Trace("server switched over to the standby control channel")
+
 			case utils.SG_Closed:
 				c.logger.Warn("control channel has been closed by the server")
 				go c.Restart()
 				return
 
 			default:
-				c.logger.Errorf("unexpected response from control channel: %v", msg)
+				c.logger.Errorf("unexpected response from control channel: %v", read.msg)
 				go c.Restart()
 				return
 			}
@@ -293,10 +469,15 @@ func (c *WsMuxTransport) channelHandler() {
 }
 
 func (c *WsMuxTransport) tunnelDialer() {
+	// The server signaled its tunnel channel is full, dialing now would only be discarded
+	if !c.dialHold.Wait(c.ctx) {
+		return
+	}
+
 	c.logger.Debugf("initiating new %s tunnel connection to address %s", c.config.Mode, c.config.RemoteAddr)
 
 	// Dial to the tunnel server
-	tunnelWSConn, err := WebSocketDialer(c.ctx, c.config.RemoteAddr, c.config.EdgeIP, "/tunnel", c.config.DialTimeOut, c.config.KeepAlive, c.config.Nodelay, c.config.Token, c.config.Mode, 3)
+	tunnelWSConn, err := WebSocketDialer(c.ctx, c.config.RemoteAddr, c.config.EdgeIP, "/tunnel", c.config.DialTimeOut, c.config.KeepAlive, c.config.Nodelay, c.config.Token, c.config.Mode, c.tlsConfig, c.config.MuxVersion, 3)
 	if err != nil {
 		c.logger.Errorf("tunnel server dialer: %v", err)
 
@@ -320,6 +501,7 @@ func (c *WsMuxTransport) handleSession(tunnelConn *websocket.Conn) {
 		c.logger.Errorf("failed to create mux session: %v", err)
 		return
 	}
+	utils.LogMuxSession(session, c.smuxConfig, c.logger)
 
 	for {
 		select {
@@ -328,6 +510,7 @@ func (c *WsMuxTransport) handleSession(tunnelConn *websocket.Conn) {
 		default:
 			stream, err := session.AcceptStream()
 			if err != nil {
+				utils.WarnMuxMismatch(err, session, c.smuxConfig.Version, c.logger)
 				c.logger.Debug("session is closed: ", err)
 				session.Close()
 				return
@@ -341,12 +524,32 @@ func (c *WsMuxTransport) handleSession(tunnelConn *websocket.Conn) {
 				}
 				return
 			}
-			go c.localDialer(stream, remoteAddr)
+			if !c.config.OrderedStreams {
+				go c.localDialer(stream, remoteAddr, nil)
+				continue
+			}
+
+			// Backends are dialed in the order the server opened the streams
+			dialed := make(chan struct{})
+			go c.localDialer(stream, remoteAddr, dialed)
+			<-dialed
 		}
 	}
 }
 
-func (c *WsMuxTransport) localDialer(stream *smux.Stream, remoteAddr string) {
+// localDialer forwards stream to its backend, dialed is closed once the
+// backend connection is set up or failed, a nil dialed is not signaled.
+func (c *WsMuxTransport) localDialer(stream *smux.Stream, remoteAddr string, dialed chan struct{}) {
+	signalDialed := sync.OnceFunc(func() {
+		if dialed != nil {
+			close(dialed)
+		}
+	})
+	defer signalDialed()
+
+	// A "primary+mirror" target copies the traffic to the mirror as well
+	remoteAddr, mirrorAddr := splitMirror(remoteAddr)
+
 	// Extract the port from the received address
 	port, resolvedAddr, err := ResolveRemoteAddr(remoteAddr)
 	if err != nil {
@@ -355,14 +558,45 @@ func (c *WsMuxTransport) localDialer(stream *smux.Stream, remoteAddr string) {
 		return
 	}
 
-	localConnection, err := TcpDialer(c.ctx, resolvedAddr, c.config.DialTimeOut, c.config.KeepAlive, c.config.Nodelay, 1)
+	if portListed(port, c.config.BlockedTargetPorts) {
+		c.logger.Warnf("refusing connection to %s, port %d is blocked", resolvedAddr, port)
+		stream.Close()
+		return
+	}
+
+	if c.unresolved.Degraded(resolvedAddr) {
+		c.logger.Debugf("refusing connection to %s, the name does not resolve", resolvedAddr)
+		stream.Close()
+		return
+	}
+
+	if !c.targetLimiter.Acquire(resolvedAddr) {
+		c.logger.Warnf("connection limit reached for local address %s, rejecting connection", resolvedAddr)
+		stream.Close()
+		return
+	}
+	defer c.targetLimiter.Release(resolvedAddr)
+
+	trace := utils.StartConnTrace(c.ctx, int(port), resolvedAddr)
+
+	localConnection, err := c.backendPool.Get(resolvedAddr, false, timedDial(port, resolvedAddr, c.config.SlowDial, c.logger, func() (net.Conn, error) {
+		return BackendDialer(c.ctx, resolvedAddr, c.config.BackendProxy, c.config.DialTimeOut, c.config.KeepAlive, c.config.BackendNodelay, c.config.MSSClamp)
+	}))
+	c.unresolved.Dialed(resolvedAddr, err)
 	if err != nil {
 		c.logger.Errorf("local dialer: %v", err)
+		trace.Fail(err)
 		stream.Close()
 		return
 	}
 
 	c.logger.Debugf("connected to local address %s successfully", remoteAddr)
+	trace.Event("backend dialed")
+	signalDialed()
+
+	from := mirrorTraffic(c.ctx, stream, mirrorAddr, c.config.BlockedTargetPorts, func(address string) (net.Conn, error) {
+		return BackendDialer(c.ctx, address, c.config.BackendProxy, c.config.DialTimeOut, c.config.KeepAlive, c.config.BackendNodelay, c.config.MSSClamp)
+	}, c.logger)
 
-	utils.TCPConnectionHandler(stream, localConnection, c.logger, c.usageMonitor, int(port), c.config.Sniffer)
+	utils.TCPConnectionHandler(from, localConnection, c.logger, c.usageMonitor, int(port), resolvedAddr, c.config.Sniffer, trace, utils.OpDeadlines{Read: c.config.ReadDeadline, Write: c.config.WriteDeadline, Idle: c.config.BackendIdle})
 }
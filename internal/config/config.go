@@ -4,64 +4,197 @@ package config
 type TransportType string
 
 const (
-	TCP    TransportType = "tcp"
-	TCPMUX TransportType = "tcpmux"
-	WS     TransportType = "ws"
-	WSS    TransportType = "wss"
-	WSMUX  TransportType = "wsmux"
-	WSSMUX TransportType = "wssmux"
-	QUIC   TransportType = "quic"
-	UDP    TransportType = "udp"
+	TCP       TransportType = "tcp"
+	TCPMUX    TransportType = "tcpmux"
+	TCPSINGLE TransportType = "tcpsingle"
+	WS        TransportType = "ws"
+	WSS       TransportType = "wss"
+	WSMUX     TransportType = "wsmux"
+	WSSMUX    TransportType = "wssmux"
+	QUIC      TransportType = "quic"
+	UDP       TransportType = "udp"
 )
 
 // ServerConfig represents the configuration for the server.
 type ServerConfig struct {
-	BindAddr         string        `toml:"bind_addr"`
-	Transport        TransportType `toml:"transport"`
-	Token            string        `toml:"token"`
-	Nodelay          bool          `toml:"nodelay"`
-	Keepalive        int           `toml:"keepalive_period"`
-	ChannelSize      int           `toml:"channel_size"`
-	LogLevel         string        `toml:"log_level"`
-	Ports            []string      `toml:"ports"`
-	PPROF            bool          `toml:"pprof"`
-	MuxSession       int           `toml:"mux_session"`
-	MuxVersion       int           `toml:"mux_version"`
-	MaxFrameSize     int           `toml:"mux_framesize"`
-	MaxReceiveBuffer int           `toml:"mux_recievebuffer"`
-	MaxStreamBuffer  int           `toml:"mux_streambuffer"`
-	Sniffer          bool          `toml:"sniffer"`
-	WebPort          int           `toml:"web_port"`
-	SnifferLog       string        `toml:"sniffer_log"`
-	TLSCertFile      string        `toml:"tls_cert"`
-	TLSKeyFile       string        `toml:"tls_key"`
-	Heartbeat        int           `toml:"heartbeat"`
-	MuxCon           int           `toml:"mux_con"`
-	AcceptUDP        bool          `toml:"accept_udp"`
+	BindAddr            string        `toml:"bind_addr"`
+	Transport           TransportType `toml:"transport"`
+	Token               string        `toml:"token"`
+	MaxTokenLength      int           `toml:"max_token_length"`
+	Nodelay             bool          `toml:"nodelay"`
+	LocalNodelay        *bool         `toml:"local_nodelay"`
+	Keepalive           int           `toml:"keepalive_period"`
+	KeepaliveInterval   int           `toml:"keepalive_interval"`
+	KeepaliveCount      int           `toml:"keepalive_count"`
+	DisableKeepAlive    bool          `toml:"disable_keepalive"`
+	ChannelSize         int           `toml:"channel_size"`
+	LogLevel            string        `toml:"log_level"`
+	Ports               []string      `toml:"ports"`
+	PPROF               bool          `toml:"pprof"`
+	MuxSession          int           `toml:"mux_session"`
+	MuxVersion          int           `toml:"mux_version"`
+	MaxFrameSize        int           `toml:"mux_framesize"`
+	MaxReceiveBuffer    int           `toml:"mux_recievebuffer"`
+	MaxStreamBuffer     int           `toml:"mux_streambuffer"`
+	Sniffer             bool          `toml:"sniffer"`
+	WebPort             int           `toml:"web_port"`
+	SnifferLog          string        `toml:"sniffer_log"`
+	SnifferMaxPorts     int           `toml:"sniffer_max_ports"`
+	SnifferRetention    int           `toml:"sniffer_retention"`
+	TLSCertFile         string        `toml:"tls_cert"`
+	TLSKeyFile          string        `toml:"tls_key"`
+	TLSPSK              bool          `toml:"tls_psk"`
+	Heartbeat           int           `toml:"heartbeat"`
+	MuxCon              int           `toml:"mux_con"`
+	AcceptUDP           bool          `toml:"accept_udp"`
+	PoolKeepalive       int           `toml:"pool_keepalive"`
+	OTLPEndpoint        string        `toml:"otlp_endpoint"`
+	ClientPorts         []string      `toml:"client_ports"`
+	LowLatencyPorts     []string      `toml:"low_latency_ports"`
+	ProxyProtocolPorts  []string      `toml:"proxy_protocol_ports"`
+	ProxyProtocolTLVs   []string      `toml:"proxy_protocol_tlvs"`
+	PrefacePorts        []string      `toml:"preface_ports"`
+	PrefaceAccept       []string      `toml:"preface_accept_ports"`
+	MSSClamp            int           `toml:"mss_clamp"`
+	ReadDeadline        int           `toml:"read_deadline"`
+	WriteDeadline       int           `toml:"write_deadline"`
+	QueueThreshold      int           `toml:"queue_threshold"`
+	StatsFile           string        `toml:"stats_file"`
+	HandshakeDelay      int           `toml:"handshake_delay"`
+	RecordDir           string        `toml:"record_dir"`
+	RecordPorts         []int         `toml:"record_ports"`
+	HTTPPorts           []string      `toml:"http_ports"`
+	HTTPHosts           []string      `toml:"http_hosts"`
+	ConnLog             string        `toml:"conn_log"`
+	ConnLogMaxSize      int           `toml:"conn_log_max_size"`
+	FlowCheck           bool          `toml:"flow_check"`
+	AccessLog           string        `toml:"access_log"`
+	AccessLogPorts      []int         `toml:"access_log_ports"`
+	AccessLogMaxSize    int           `toml:"access_log_max_size"`
+	MaxTunnelBandwidth  int           `toml:"max_tunnel_bandwidth"`
+	MaxTunnelUpstream   int           `toml:"max_tunnel_upstream"`
+	MaxTunnelDownstream int           `toml:"max_tunnel_downstream"`
+	HeartbeatMisses     int           `toml:"heartbeat_misses"`
+	ChannelSizeMax      int           `toml:"channel_size_max"`
+	GeoIPDB             string        `toml:"geoip_db"`
+	GeoIPTargets        []string      `toml:"geoip_targets"`
+	GeoIPAllow          []string      `toml:"geoip_allow"`
+	GeoIPDeny           []string      `toml:"geoip_deny"`
+	GeoIPLog            bool          `toml:"geoip_log"`
+	RejectDuplicate     bool          `toml:"reject_duplicate_channel"`
+	CongestionControl   string        `toml:"congestion_control"`
+	SocketReadBuffer    int           `toml:"socket_read_buffer"`
+	SocketWriteBuffer   int           `toml:"socket_write_buffer"`
+	WebToken            string        `toml:"web_token"`
+	BanAfter            int           `toml:"handshake_ban_after"`
+	BanTime             int           `toml:"handshake_ban_time"`
+	SessionTTL          int           `toml:"session_ttl"`
+	SessionPinning      bool          `toml:"session_pinning"`
+	AuthLogInterval     int           `toml:"auth_log_interval"`
+	StatsdAddr          string        `toml:"statsd_addr"`
+	StatsdPrefix        string        `toml:"statsd_prefix"`
+	StatsdTags          []string      `toml:"statsd_tags"`
+	StatsWebhook        string        `toml:"stats_webhook"`
+	WebhookInterval     int           `toml:"stats_webhook_interval"`
+	WebhookHeader       string        `toml:"stats_webhook_header"`
+	SessionIdleTimeout  int           `toml:"session_idle_timeout"`
+	SessionIdleMin      int           `toml:"session_idle_min"`
+	MaxHandshakes       int           `toml:"max_handshakes"`
+	ProbeTimeout        int           `toml:"probe_timeout"`
+	OrderedStreams      bool          `toml:"ordered_streams"`
+	HandoffSocket       string        `toml:"handoff_socket"`
+	MuxMaxStreams       int           `toml:"mux_max_streams"`
+	MuxSessionStreams   int           `toml:"mux_session_streams"`
+	TunnelBackpressure  bool          `toml:"tunnel_backpressure"`
+	ControlGrace        int           `toml:"control_grace"`
+	MaxConnections      int           `toml:"max_connections"`
+	RejectHTTPPorts     []string      `toml:"max_connections_http_ports"`
+	RejectRetryAfter    int           `toml:"max_connections_retry_after"`
+	Encryption          bool          `toml:"encryption"`
+	MaxPortMappings     int           `toml:"max_port_mappings"`
+	OverloadGoroutines  int           `toml:"overload_goroutines"`
+	OverloadMemory      int           `toml:"overload_memory"`
+	PortWeights         []string      `toml:"port_weights"`
+	MaxLifetime         int           `toml:"max_lifetime"`
+	LifetimePorts       []string      `toml:"max_lifetime_ports"`
 }
 
 // ClientConfig represents the configuration for the client.
 type ClientConfig struct {
-	RemoteAddr       string        `toml:"remote_addr"`
-	Transport        TransportType `toml:"transport"`
-	Token            string        `toml:"token"`
-	ConnectionPool   int           `toml:"connection_pool"`
-	RetryInterval    int           `toml:"retry_interval"`
-	Nodelay          bool          `toml:"nodelay"`
-	Keepalive        int           `toml:"keepalive_period"`
-	LogLevel         string        `toml:"log_level"`
-	PPROF            bool          `toml:"pprof"`
-	MuxSession       int           `toml:"mux_session"`
-	MuxVersion       int           `toml:"mux_version"`
-	MaxFrameSize     int           `toml:"mux_framesize"`
-	MaxReceiveBuffer int           `toml:"mux_recievebuffer"`
-	MaxStreamBuffer  int           `toml:"mux_streambuffer"`
-	Sniffer          bool          `toml:"sniffer"`
-	WebPort          int           `toml:"web_port"`
-	SnifferLog       string        `toml:"sniffer_log"`
-	DialTimeout      int           `toml:"dial_timeout"`
-	AggressivePool   bool          `toml:"aggressive_pool"`
-	EdgeIP           string        `toml:"edge_ip"`
+	RemoteAddr              string        `toml:"remote_addr"`
+	Transport               TransportType `toml:"transport"`
+	Token                   string        `toml:"token"`
+	ConnectionPool          int           `toml:"connection_pool"`
+	RetryInterval           int           `toml:"retry_interval"`
+	Nodelay                 bool          `toml:"nodelay"`
+	BackendNodelay          *bool         `toml:"backend_nodelay"`
+	Keepalive               int           `toml:"keepalive_period"`
+	KeepaliveInterval       int           `toml:"keepalive_interval"`
+	KeepaliveCount          int           `toml:"keepalive_count"`
+	DisableKeepAlive        bool          `toml:"disable_keepalive"`
+	LogLevel                string        `toml:"log_level"`
+	PPROF                   bool          `toml:"pprof"`
+	MuxSession              int           `toml:"mux_session"`
+	MuxVersion              int           `toml:"mux_version"`
+	MaxFrameSize            int           `toml:"mux_framesize"`
+	MaxReceiveBuffer        int           `toml:"mux_recievebuffer"`
+	MaxStreamBuffer         int           `toml:"mux_streambuffer"`
+	Sniffer                 bool          `toml:"sniffer"`
+	WebPort                 int           `toml:"web_port"`
+	SnifferLog              string        `toml:"sniffer_log"`
+	SnifferMaxPorts         int           `toml:"sniffer_max_ports"`
+	SnifferRetention        int           `toml:"sniffer_retention"`
+	DialTimeout             int           `toml:"dial_timeout"`
+	HandshakeTimeout        int           `toml:"handshake_timeout"`
+	AggressivePool          bool          `toml:"aggressive_pool"`
+	PoolKeepalive           int           `toml:"pool_keepalive"`
+	MaxPerTargetConnections int           `toml:"max_per_target_connections"`
+	OTLPEndpoint            string        `toml:"otlp_endpoint"`
+	Ports                   []string      `toml:"ports"`
+	MSSClamp                int           `toml:"mss_clamp"`
+	ReadDeadline            int           `toml:"read_deadline"`
+	WriteDeadline           int           `toml:"write_deadline"`
+	BackendIdleTimeout      int           `toml:"backend_idle_timeout"`
+	SlowDial                int           `toml:"slow_dial_threshold"`
+	EdgeIP                  string        `toml:"edge_ip"`
+	TLSPSK                  bool          `toml:"tls_psk"`
+	TLSServerName           string        `toml:"tls_server_name"`
+	TLSPinnedCert           string        `toml:"tls_pinned_cert"`
+	StandbyChannel          bool          `toml:"standby_channel"`
+	UnresolvedBackoff       int           `toml:"unresolved_backoff"`
+	BackendPool             int           `toml:"backend_pool"`
+	BackendPoolIdle         int           `toml:"backend_pool_idle"`
+	BackendProxy            string        `toml:"backend_proxy"`
+	StatsFile               string        `toml:"stats_file"`
+	BackendProbe            []string      `toml:"backend_probe"`
+	RecordDir               string        `toml:"record_dir"`
+	RecordPorts             []int         `toml:"record_ports"`
+	EarlyPool               bool          `toml:"early_pool"`
+	BlockedTargetPorts      []int         `toml:"blocked_target_ports"`
+	LowLatencyPorts         []int         `toml:"low_latency_ports"`
+	ConnLog                 string        `toml:"conn_log"`
+	ConnLogMaxSize          int           `toml:"conn_log_max_size"`
+	FlowCheck               bool          `toml:"flow_check"`
+	MaxTunnelBandwidth      int           `toml:"max_tunnel_bandwidth"`
+	MaxTunnelUpstream       int           `toml:"max_tunnel_upstream"`
+	MaxTunnelDownstream     int           `toml:"max_tunnel_downstream"`
+	CongestionControl       string        `toml:"congestion_control"`
+	SocketReadBuffer        int           `toml:"socket_read_buffer"`
+	SocketWriteBuffer       int           `toml:"socket_write_buffer"`
+	WebToken                string        `toml:"web_token"`
+	StatsdAddr              string        `toml:"statsd_addr"`
+	StatsdPrefix            string        `toml:"statsd_prefix"`
+	StatsdTags              []string      `toml:"statsd_tags"`
+	StatsWebhook            string        `toml:"stats_webhook"`
+	WebhookInterval         int           `toml:"stats_webhook_interval"`
+	WebhookHeader           string        `toml:"stats_webhook_header"`
+	HeartbeatAck            bool          `toml:"heartbeat_ack"`
+	OrderedStreams          bool          `toml:"ordered_streams"`
+	BackpressureDelay       int           `toml:"backpressure_delay"`
+	ControlGrace            int           `toml:"control_grace"`
+	Encryption              bool          `toml:"encryption"`
+	HandshakeVersion        int           `toml:"handshake_version"`
+	ClientID                string        `toml:"client_id"`
 }
 
 // Config represents the complete configuration, including both server and client settings.
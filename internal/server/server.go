@@ -2,13 +2,19 @@ package server
 
 import (
 	"context"
+	"fmt"
 	"net/http"
 	_ "net/http/pprof"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/musix/backhaul/internal/config"
 	"github.com/musix/backhaul/internal/server/transport"
 	"github.com/musix/backhaul/internal/utils"
+	"github.com/musix/backhaul/internal/web"
 
 	"github.com/sirupsen/logrus"
 )
@@ -30,7 +36,11 @@ func NewServer(cfg *config.ServerConfig, parentCtx context.Context) *Server {
 	}
 }
 
-func (s *Server) Start() {
+// Start runs the transport until the server is stopped. It returns an error,
+// after stopping the server, when the transport cannot be set up or fails to
+// set up one of its listeners, a server missing one of its ports is not worth
+// running.
+func (s *Server) Start() error {
 	// for pprof and debugging
 	if s.config.PPROF {
 		go func() {
@@ -39,31 +49,162 @@ func (s *Server) Start() {
 		}()
 	}
 
+	// for opentelemetry traces
+	if s.config.OTLPEndpoint != "" {
+		utils.InitTracing(s.ctx, s.config.OTLPEndpoint, "backhaul-server", s.logger)
+	}
+
+	// for recording connections of specific ports
+	if s.config.RecordDir != "" && len(s.config.RecordPorts) > 0 {
+		utils.InitRecording(s.ctx, s.config.RecordDir, s.config.RecordPorts, s.logger)
+	}
+
+	// for per connection JSON lines
+	if s.config.ConnLog != "" {
+		utils.InitConnLog(s.ctx, s.config.ConnLog, int64(s.config.ConnLogMaxSize)*1024*1024, string(s.config.Transport), s.logger)
+	}
+
+	// for reconciling the bytes read and written of forwarded connections
+	if s.config.FlowCheck {
+		utils.InitFlowCheck(s.ctx, s.logger)
+	}
+
+	// for Common Log Format lines of HTTP requests on specific ports
+	if s.config.AccessLog != "" && len(s.config.AccessLogPorts) > 0 {
+		utils.InitAccessLog(s.ctx, s.config.AccessLog, int64(s.config.AccessLogMaxSize)*1024*1024, s.config.AccessLogPorts, s.logger)
+	}
+
+	// for the live event stream of the web monitor
+	if s.config.WebPort > 0 && s.config.WebToken != "" {
+		web.InitEvents(s.ctx, s.config.WebToken, s.logger)
+	}
+
+	// for the running configuration on the status page of the web monitor
+	if s.config.WebPort > 0 {
+		web.SetTransportInfo(s.transportInfo())
+	}
+
+	// for refusing new connections while the process is overloaded
+	if s.config.OverloadGoroutines > 0 || s.config.OverloadMemory > 0 {
+		utils.InitOverload(s.ctx, s.config.OverloadGoroutines, s.config.OverloadMemory, s.logger)
+	}
+
+	// for a total bandwidth cap shared by all connections
+	utils.InitBandwidthLimit(s.ctx, s.config.MaxTunnelUpstream, s.config.MaxTunnelDownstream, s.logger)
+
+	// for bbr and other congestion control algorithms on tunnel and local connections
+	if s.config.CongestionControl != "" {
+		utils.InitCongestionControl(s.ctx, s.config.CongestionControl, s.logger)
+	}
+
+	// for the socket buffers of tunnel and local connections
+	if s.config.SocketReadBuffer > 0 || s.config.SocketWriteBuffer > 0 {
+		utils.InitSocketBuffers(s.ctx, s.config.SocketReadBuffer*1024, s.config.SocketWriteBuffer*1024, s.logger)
+	}
+
+	// A negative keep-alive period disables keep-alive, as with net.Dialer
+	keepAlive := time.Duration(s.config.Keepalive) * time.Second
+	if s.config.DisableKeepAlive {
+		keepAlive = -1
+	}
+
+	// for faster dead peer detection on tunnel connections
+	if s.config.KeepaliveInterval > 0 || s.config.KeepaliveCount > 0 {
+		utils.InitKeepAliveProbes(s.ctx, time.Duration(s.config.KeepaliveInterval)*time.Second, s.config.KeepaliveCount, s.logger)
+	}
+
+	// for exporting metrics to a StatsD collector
+	if s.config.StatsdAddr != "" {
+		utils.InitStatsd(s.ctx, s.config.StatsdAddr, s.config.StatsdPrefix, s.config.StatsdTags, s.logger)
+	}
+
+	// for pushing stats snapshots to a webhook
+	if s.config.StatsWebhook != "" {
+		utils.InitWebhook(s.ctx, s.config.StatsWebhook, time.Duration(s.config.WebhookInterval)*time.Second, s.config.WebhookHeader, string(s.config.Transport), s.logger)
+	}
+
+	// Only the tcp and tcpmux transports listen on more than one address
+	if strings.Contains(s.config.BindAddr, ",") && s.config.Transport != config.TCP && s.config.Transport != config.TCPMUX {
+		s.cancel()
+		return fmt.Errorf("multiple bind addresses are not supported by the %s transport", s.config.Transport)
+	}
+
+	// errs reports the listeners the transport failed to set up, run starts
+	// the transport once it is set up
+	var errs <-chan error
+	var run func()
+
 	if s.config.Transport == config.TCP {
 		tcpConfig := &transport.TcpConfig{
-			BindAddr:    s.config.BindAddr,
-			Nodelay:     s.config.Nodelay,
-			KeepAlive:   time.Duration(s.config.Keepalive) * time.Second,
-			Heartbeat:   time.Duration(s.config.Heartbeat) * time.Second,
-			Token:       s.config.Token,
-			ChannelSize: s.config.ChannelSize,
-			Ports:       s.config.Ports,
-			Sniffer:     s.config.Sniffer,
-			WebPort:     s.config.WebPort,
-			SnifferLog:  s.config.SnifferLog,
-			AcceptUDP:   s.config.AcceptUDP,
+			BindAddr:         s.config.BindAddr,
+			Nodelay:          s.config.Nodelay,
+			LocalNodelay:     *s.config.LocalNodelay,
+			KeepAlive:        keepAlive,
+			Heartbeat:        time.Duration(s.config.Heartbeat) * time.Second,
+			Token:            s.config.Token,
+			MaxTokenLength:   s.config.MaxTokenLength,
+			ChannelSize:      s.config.ChannelSize,
+			Ports:            s.config.Ports,
+			Sniffer:          s.config.Sniffer,
+			WebPort:          s.config.WebPort,
+			SnifferMaxPorts:  s.config.SnifferMaxPorts,
+			SnifferRetention: time.Duration(s.config.SnifferRetention) * time.Second,
+			SnifferLog:       s.config.SnifferLog,
+			AcceptUDP:        s.config.AcceptUDP,
+			PoolKeepalive:    time.Duration(s.config.PoolKeepalive) * time.Second,
+			ClientPorts:      s.config.ClientPorts,
+			MSSClamp:         s.config.MSSClamp,
+			ReadDeadline:     time.Duration(s.config.ReadDeadline) * time.Second,
+			WriteDeadline:    time.Duration(s.config.WriteDeadline) * time.Second,
+			QueueThreshold:   time.Duration(s.config.QueueThreshold) * time.Millisecond,
+			HandshakeDelay:   time.Duration(s.config.HandshakeDelay) * time.Millisecond,
+			HTTPPorts:        s.config.HTTPPorts,
+			HTTPHosts:        s.config.HTTPHosts,
+			HeartbeatMisses:  s.config.HeartbeatMisses,
+			ChannelSizeMax:   s.config.ChannelSizeMax,
+			GeoIPDB:          s.config.GeoIPDB,
+			GeoIPTargets:     s.config.GeoIPTargets,
+			GeoIPAllow:       s.config.GeoIPAllow,
+			GeoIPDeny:        s.config.GeoIPDeny,
+			GeoIPLog:         s.config.GeoIPLog,
+			BanAfter:         s.config.BanAfter,
+			BanTime:          time.Duration(s.config.BanTime) * time.Second,
+			LowLatencyPorts:  s.config.LowLatencyPorts,
+			ProxyProtocol:    s.config.ProxyProtocolPorts,
+			ProbeTimeout:     time.Duration(s.config.ProbeTimeout) * time.Millisecond,
+			ProxyTLVs:        s.config.ProxyProtocolTLVs,
+			Backpressure:     s.config.TunnelBackpressure,
+			MaxConns:         s.config.MaxConnections,
+			Encryption:       s.config.Encryption,
+			SessionTTL:       time.Duration(s.config.SessionTTL) * time.Second,
+			SessionPinning:   s.config.SessionPinning,
+			RejectHTTPPorts:  s.config.RejectHTTPPorts,
+			RejectRetryAfter: s.config.RejectRetryAfter,
+			MaxPortMappings:  s.config.MaxPortMappings,
+			PortWeights:      s.config.PortWeights,
+			MaxLifetime:      time.Duration(s.config.MaxLifetime) * time.Second,
+			LifetimePorts:    s.config.LifetimePorts,
+			PrefacePorts:     s.config.PrefacePorts,
+			PrefaceAccept:    s.config.PrefaceAccept,
 		}
 
-		tcpServer := transport.NewTCPServer(s.ctx, tcpConfig, s.logger)
-		go tcpServer.Start()
+		tcpServer, err := transport.NewTCPServer(s.ctx, tcpConfig, s.logger)
+		if err != nil {
+			s.cancel()
+			return err
+		}
+		run = tcpServer.Start
+		errs = tcpServer.Errors()
 
 	} else if s.config.Transport == config.TCPMUX {
 		tcpMuxConfig := &transport.TcpMuxConfig{
 			BindAddr:         s.config.BindAddr,
 			Nodelay:          s.config.Nodelay,
-			KeepAlive:        time.Duration(s.config.Keepalive) * time.Second,
+			LocalNodelay:     *s.config.LocalNodelay,
+			KeepAlive:        keepAlive,
 			Heartbeat:        time.Duration(s.config.Heartbeat) * time.Second,
 			Token:            s.config.Token,
+			MaxTokenLength:   s.config.MaxTokenLength,
 			ChannelSize:      s.config.ChannelSize,
 			Ports:            s.config.Ports,
 			MuxCon:           s.config.MuxCon,
@@ -73,39 +214,165 @@ func (s *Server) Start() {
 			MaxStreamBuffer:  s.config.MaxStreamBuffer,
 			Sniffer:          s.config.Sniffer,
 			WebPort:          s.config.WebPort,
+			SnifferMaxPorts:  s.config.SnifferMaxPorts,
+			SnifferRetention: time.Duration(s.config.SnifferRetention) * time.Second,
 			SnifferLog:       s.config.SnifferLog,
+			MSSClamp:         s.config.MSSClamp,
+			ReadDeadline:     time.Duration(s.config.ReadDeadline) * time.Second,
+			WriteDeadline:    time.Duration(s.config.WriteDeadline) * time.Second,
+			QueueThreshold:   time.Duration(s.config.QueueThreshold) * time.Millisecond,
+			HandshakeDelay:   time.Duration(s.config.HandshakeDelay) * time.Millisecond,
+			HTTPPorts:        s.config.HTTPPorts,
+			HTTPHosts:        s.config.HTTPHosts,
+			HeartbeatMisses:  s.config.HeartbeatMisses,
+			ChannelSizeMax:   s.config.ChannelSizeMax,
+			GeoIPDB:          s.config.GeoIPDB,
+			GeoIPTargets:     s.config.GeoIPTargets,
+			GeoIPAllow:       s.config.GeoIPAllow,
+			GeoIPDeny:        s.config.GeoIPDeny,
+			GeoIPLog:         s.config.GeoIPLog,
+			BanAfter:         s.config.BanAfter,
+			BanTime:          time.Duration(s.config.BanTime) * time.Second,
+			LowLatencyPorts:  s.config.LowLatencyPorts,
+			ProxyProtocol:    s.config.ProxyProtocolPorts,
+			SessionIdle:      time.Duration(s.config.SessionIdleTimeout) * time.Second,
+			SessionIdleMin:   s.config.SessionIdleMin,
+			ProbeTimeout:     time.Duration(s.config.ProbeTimeout) * time.Millisecond,
+			OrderedStreams:   s.config.OrderedStreams,
+			ProxyTLVs:        s.config.ProxyProtocolTLVs,
+			MaxStreams:       s.config.MuxMaxStreams,
+			SessionStreams:   s.config.MuxSessionStreams,
+			Backpressure:     s.config.TunnelBackpressure,
+			MaxConns:         s.config.MaxConnections,
+			Encryption:       s.config.Encryption,
+			SessionTTL:       time.Duration(s.config.SessionTTL) * time.Second,
+			SessionPinning:   s.config.SessionPinning,
+			RejectHTTPPorts:  s.config.RejectHTTPPorts,
+			RejectRetryAfter: s.config.RejectRetryAfter,
+			MaxPortMappings:  s.config.MaxPortMappings,
+			PortWeights:      s.config.PortWeights,
+			MaxLifetime:      time.Duration(s.config.MaxLifetime) * time.Second,
+			LifetimePorts:    s.config.LifetimePorts,
+			PrefacePorts:     s.config.PrefacePorts,
+			PrefaceAccept:    s.config.PrefaceAccept,
+		}
+
+		tcpMuxServer, err := transport.NewTcpMuxServer(s.ctx, tcpMuxConfig, s.logger)
+		if err != nil {
+			s.cancel()
+			return err
 		}
+		run = tcpMuxServer.Start
+		errs = tcpMuxServer.Errors()
+		go s.rotateOnSignal(tcpMuxServer)
 
-		tcpMuxServer := transport.NewTcpMuxServer(s.ctx, tcpMuxConfig, s.logger)
-		go tcpMuxServer.Start()
+	} else if s.config.Transport == config.TCPSINGLE {
+		tcpSingleConfig := &transport.TcpSingleConfig{
+			BindAddr:         s.config.BindAddr,
+			Nodelay:          s.config.Nodelay,
+			LocalNodelay:     *s.config.LocalNodelay,
+			KeepAlive:        keepAlive,
+			Heartbeat:        time.Duration(s.config.Heartbeat) * time.Second,
+			Token:            s.config.Token,
+			MaxTokenLength:   s.config.MaxTokenLength,
+			ChannelSize:      s.config.ChannelSize,
+			Ports:            s.config.Ports,
+			MuxVersion:       s.config.MuxVersion,
+			MaxFrameSize:     s.config.MaxFrameSize,
+			MaxReceiveBuffer: s.config.MaxReceiveBuffer,
+			MaxStreamBuffer:  s.config.MaxStreamBuffer,
+			Sniffer:          s.config.Sniffer,
+			WebPort:          s.config.WebPort,
+			SnifferMaxPorts:  s.config.SnifferMaxPorts,
+			SnifferRetention: time.Duration(s.config.SnifferRetention) * time.Second,
+			SnifferLog:       s.config.SnifferLog,
+			MSSClamp:         s.config.MSSClamp,
+			ReadDeadline:     time.Duration(s.config.ReadDeadline) * time.Second,
+			WriteDeadline:    time.Duration(s.config.WriteDeadline) * time.Second,
+			QueueThreshold:   time.Duration(s.config.QueueThreshold) * time.Millisecond,
+			HandshakeDelay:   time.Duration(s.config.HandshakeDelay) * time.Millisecond,
+			HeartbeatMisses:  s.config.HeartbeatMisses,
+			ChannelSizeMax:   s.config.ChannelSizeMax,
+			BanAfter:         s.config.BanAfter,
+			BanTime:          time.Duration(s.config.BanTime) * time.Second,
+			ProxyProtocol:    s.config.ProxyProtocolPorts,
+			ProbeTimeout:     time.Duration(s.config.ProbeTimeout) * time.Millisecond,
+			ProxyTLVs:        s.config.ProxyProtocolTLVs,
+			MaxConns:         s.config.MaxConnections,
+			SessionTTL:       time.Duration(s.config.SessionTTL) * time.Second,
+			SessionPinning:   s.config.SessionPinning,
+			RejectHTTPPorts:  s.config.RejectHTTPPorts,
+			RejectRetryAfter: s.config.RejectRetryAfter,
+			MaxPortMappings:  s.config.MaxPortMappings,
+			MaxLifetime:      time.Duration(s.config.MaxLifetime) * time.Second,
+			LifetimePorts:    s.config.LifetimePorts,
+			PrefacePorts:     s.config.PrefacePorts,
+			GeoIPDB:          s.config.GeoIPDB,
+			GeoIPTargets:     s.config.GeoIPTargets,
+			GeoIPAllow:       s.config.GeoIPAllow,
+			GeoIPDeny:        s.config.GeoIPDeny,
+			GeoIPLog:         s.config.GeoIPLog,
+			MaxHandshakes:    s.config.MaxHandshakes,
+		}
+
+		tcpSingleServer, err := transport.NewTcpSingleServer(s.ctx, tcpSingleConfig, s.logger)
+		if err != nil {
+			s.cancel()
+			return err
+		}
+		run = tcpSingleServer.Start
+		errs = tcpSingleServer.Errors()
 
 	} else if s.config.Transport == config.WS || s.config.Transport == config.WSS {
 		wsConfig := &transport.WsConfig{
-			BindAddr:    s.config.BindAddr,
-			Nodelay:     s.config.Nodelay,
-			KeepAlive:   time.Duration(s.config.Keepalive) * time.Second,
-			Heartbeat:   time.Duration(s.config.Heartbeat) * time.Second,
-			Token:       s.config.Token,
-			ChannelSize: s.config.ChannelSize,
-			Ports:       s.config.Ports,
-			Sniffer:     s.config.Sniffer,
-			WebPort:     s.config.WebPort,
-			SnifferLog:  s.config.SnifferLog,
-			Mode:        s.config.Transport,
-			TLSCertFile: s.config.TLSCertFile,
-			TLSKeyFile:  s.config.TLSKeyFile,
+			BindAddr:         s.config.BindAddr,
+			Nodelay:          s.config.Nodelay,
+			LocalNodelay:     *s.config.LocalNodelay,
+			KeepAlive:        keepAlive,
+			Heartbeat:        time.Duration(s.config.Heartbeat) * time.Second,
+			Token:            s.config.Token,
+			MaxTokenLength:   s.config.MaxTokenLength,
+			ChannelSize:      s.config.ChannelSize,
+			Ports:            s.config.Ports,
+			Sniffer:          s.config.Sniffer,
+			WebPort:          s.config.WebPort,
+			SnifferMaxPorts:  s.config.SnifferMaxPorts,
+			SnifferRetention: time.Duration(s.config.SnifferRetention) * time.Second,
+			SnifferLog:       s.config.SnifferLog,
+			Mode:             s.config.Transport,
+			TLSCertFile:      s.config.TLSCertFile,
+			TLSKeyFile:       s.config.TLSKeyFile,
+			TLSPSK:           s.config.TLSPSK,
+			MSSClamp:         s.config.MSSClamp,
+			QueueThreshold:   time.Duration(s.config.QueueThreshold) * time.Millisecond,
+			HeartbeatMisses:  s.config.HeartbeatMisses,
+			ChannelSizeMax:   s.config.ChannelSizeMax,
+			RejectDuplicate:  s.config.RejectDuplicate,
+			BanAfter:         s.config.BanAfter,
+			BanTime:          time.Duration(s.config.BanTime) * time.Second,
+			AuthLogInterval:  time.Duration(s.config.AuthLogInterval) * time.Second,
+			MaxHandshakes:    s.config.MaxHandshakes,
+			ProbeTimeout:     time.Duration(s.config.ProbeTimeout) * time.Millisecond,
+			Backpressure:     s.config.TunnelBackpressure,
+			MaxConns:         s.config.MaxConnections,
+			RejectHTTPPorts:  s.config.RejectHTTPPorts,
+			RejectRetryAfter: s.config.RejectRetryAfter,
+			MaxPortMappings:  s.config.MaxPortMappings,
 		}
 
 		wsServer := transport.NewWSServer(s.ctx, wsConfig, s.logger)
-		go wsServer.Start()
+		run = wsServer.Start
+		errs = wsServer.Errors()
 
 	} else if s.config.Transport == config.WSMUX || s.config.Transport == config.WSSMUX {
 		wsMuxConfig := &transport.WsMuxConfig{
 			BindAddr:         s.config.BindAddr,
 			Nodelay:          s.config.Nodelay,
-			KeepAlive:        time.Duration(s.config.Keepalive) * time.Second,
+			LocalNodelay:     *s.config.LocalNodelay,
+			KeepAlive:        keepAlive,
 			Heartbeat:        time.Duration(s.config.Heartbeat) * time.Second,
 			Token:            s.config.Token,
+			MaxTokenLength:   s.config.MaxTokenLength,
 			ChannelSize:      s.config.ChannelSize,
 			Ports:            s.config.Ports,
 			MuxCon:           s.config.MuxCon,
@@ -115,60 +382,148 @@ func (s *Server) Start() {
 			MaxStreamBuffer:  s.config.MaxStreamBuffer,
 			Sniffer:          s.config.Sniffer,
 			WebPort:          s.config.WebPort,
+			SnifferMaxPorts:  s.config.SnifferMaxPorts,
+			SnifferRetention: time.Duration(s.config.SnifferRetention) * time.Second,
 			SnifferLog:       s.config.SnifferLog,
 			Mode:             s.config.Transport,
 			TLSCertFile:      s.config.TLSCertFile,
 			TLSKeyFile:       s.config.TLSKeyFile,
+			TLSPSK:           s.config.TLSPSK,
+			MSSClamp:         s.config.MSSClamp,
+			ReadDeadline:     time.Duration(s.config.ReadDeadline) * time.Second,
+			WriteDeadline:    time.Duration(s.config.WriteDeadline) * time.Second,
+			QueueThreshold:   time.Duration(s.config.QueueThreshold) * time.Millisecond,
+			HeartbeatMisses:  s.config.HeartbeatMisses,
+			ChannelSizeMax:   s.config.ChannelSizeMax,
+			RejectDuplicate:  s.config.RejectDuplicate,
+			BanAfter:         s.config.BanAfter,
+			BanTime:          time.Duration(s.config.BanTime) * time.Second,
+			AuthLogInterval:  time.Duration(s.config.AuthLogInterval) * time.Second,
+			ProxyProtocol:    s.config.ProxyProtocolPorts,
+			SessionIdle:      time.Duration(s.config.SessionIdleTimeout) * time.Second,
+			SessionIdleMin:   s.config.SessionIdleMin,
+			MaxHandshakes:    s.config.MaxHandshakes,
+			ProbeTimeout:     time.Duration(s.config.ProbeTimeout) * time.Millisecond,
+			OrderedStreams:   s.config.OrderedStreams,
+			ProxyTLVs:        s.config.ProxyProtocolTLVs,
+			MaxStreams:       s.config.MuxMaxStreams,
+			SessionStreams:   s.config.MuxSessionStreams,
+			Backpressure:     s.config.TunnelBackpressure,
+			ControlGrace:     time.Duration(s.config.ControlGrace) * time.Second,
+			MaxConns:         s.config.MaxConnections,
+			RejectHTTPPorts:  s.config.RejectHTTPPorts,
+			RejectRetryAfter: s.config.RejectRetryAfter,
+			MaxPortMappings:  s.config.MaxPortMappings,
+			PortWeights:      s.config.PortWeights,
+			MaxLifetime:      time.Duration(s.config.MaxLifetime) * time.Second,
+			LifetimePorts:    s.config.LifetimePorts,
+			PrefacePorts:     s.config.PrefacePorts,
 		}
 
-		wsMuxServer := transport.NewWSMuxServer(s.ctx, wsMuxConfig, s.logger)
-		go wsMuxServer.Start()
+		wsMuxServer, err := transport.NewWSMuxServer(s.ctx, wsMuxConfig, s.logger)
+		if err != nil {
+			s.cancel()
+			return err
+		}
+		run = wsMuxServer.Start
+		errs = wsMuxServer.Errors()
+		go s.rotateOnSignal(wsMuxServer)
 
 	} else if s.config.Transport == config.QUIC {
 		quicConfig := &transport.QuicConfig{
-			BindAddr:    s.config.BindAddr,
-			Nodelay:     s.config.Nodelay,
-			KeepAlive:   time.Duration(s.config.Keepalive) * time.Second,
-			Heartbeat:   time.Duration(s.config.Heartbeat) * time.Second,
-			Token:       s.config.Token,
-			MuxCon:      s.config.MuxCon,
-			ChannelSize: s.config.ChannelSize,
-			Ports:       s.config.Ports,
-			Sniffer:     s.config.Sniffer,
-			WebPort:     s.config.WebPort,
-			SnifferLog:  s.config.SnifferLog,
-			TLSCertFile: s.config.TLSCertFile,
-			TLSKeyFile:  s.config.TLSKeyFile,
+			BindAddr:         s.config.BindAddr,
+			Nodelay:          s.config.Nodelay,
+			LocalNodelay:     *s.config.LocalNodelay,
+			KeepAlive:        keepAlive,
+			Heartbeat:        time.Duration(s.config.Heartbeat) * time.Second,
+			Token:            s.config.Token,
+			MaxTokenLength:   s.config.MaxTokenLength,
+			MuxCon:           s.config.MuxCon,
+			ChannelSize:      s.config.ChannelSize,
+			Ports:            s.config.Ports,
+			Sniffer:          s.config.Sniffer,
+			WebPort:          s.config.WebPort,
+			SnifferMaxPorts:  s.config.SnifferMaxPorts,
+			SnifferRetention: time.Duration(s.config.SnifferRetention) * time.Second,
+			SnifferLog:       s.config.SnifferLog,
+			TLSCertFile:      s.config.TLSCertFile,
+			TLSKeyFile:       s.config.TLSKeyFile,
+			MSSClamp:         s.config.MSSClamp,
+			MaxHandshakes:    s.config.MaxHandshakes,
+			ProbeTimeout:     time.Duration(s.config.ProbeTimeout) * time.Millisecond,
+			MaxPortMappings:  s.config.MaxPortMappings,
 		}
 
 		quicServer := transport.NewQuicServer(s.ctx, quicConfig, s.logger)
-		go quicServer.TunnelListener()
+		run = quicServer.TunnelListener
+		errs = quicServer.Errors()
 
 	} else if s.config.Transport == config.UDP {
 		udpConfig := &transport.UdpConfig{
-			BindAddr:    s.config.BindAddr,
-			Heartbeat:   time.Duration(s.config.Heartbeat) * time.Second,
-			Token:       s.config.Token,
-			ChannelSize: s.config.ChannelSize,
-			Ports:       s.config.Ports,
-			Sniffer:     s.config.Sniffer,
-			WebPort:     s.config.WebPort,
-			SnifferLog:  s.config.SnifferLog,
+			BindAddr:         s.config.BindAddr,
+			Heartbeat:        time.Duration(s.config.Heartbeat) * time.Second,
+			Token:            s.config.Token,
+			MaxTokenLength:   s.config.MaxTokenLength,
+			ChannelSize:      s.config.ChannelSize,
+			Ports:            s.config.Ports,
+			Sniffer:          s.config.Sniffer,
+			WebPort:          s.config.WebPort,
+			SnifferMaxPorts:  s.config.SnifferMaxPorts,
+			SnifferRetention: time.Duration(s.config.SnifferRetention) * time.Second,
+			SnifferLog:       s.config.SnifferLog,
+			MaxPortMappings:  s.config.MaxPortMappings,
 		}
 
 		udpServer := transport.NewUDPServer(s.ctx, udpConfig, s.logger)
-		go udpServer.Start()
+		run = udpServer.Start
+		errs = udpServer.Errors()
 
 	} else {
-		s.logger.Fatal("invalid transport type: ", s.config.Transport)
+		s.cancel()
+		return fmt.Errorf("invalid transport type: %s", s.config.Transport)
 	}
 
-	<-s.ctx.Done()
+	// On a reload the tunnel starts once the running instance released it
+	if utils.WaitCutover(s.ctx) {
+		go run()
+	}
+
+	select {
+	case <-s.ctx.Done():
+	case err := <-errs:
+		s.cancel()
+		return fmt.Errorf("stopping the server: %w", err)
+	}
 
 	s.logger.Info("all workers stopped successfully")
 
 	// supress other logs
 	s.logger.SetLevel(logrus.FatalLevel)
+
+	return nil
+}
+
+// sessionRotator is implemented by the mux transports that can replace their
+// sessions without dropping forwarded connections.
+type sessionRotator interface {
+	RotateSessions()
+}
+
+// rotateOnSignal rotates the mux sessions each time SIGUSR1 is received.
+func (s *Server) rotateOnSignal(rotator sessionRotator) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGUSR1)
+	defer signal.Stop(sigChan)
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-sigChan:
+			s.logger.Info("SIGUSR1 received, rotating mux sessions")
+			rotator.RotateSessions()
+		}
+	}
 }
 
 // Stop shuts down the server gracefully
@@ -177,3 +532,43 @@ func (s *Server) Stop() {
 		s.cancel()
 	}
 }
+
+// transportInfo describes the transport and its key settings for the web monitor.
+func (s *Server) transportInfo() web.TransportInfo {
+	info := web.TransportInfo{
+		Transport:  string(s.config.Transport),
+		Parameters: []string{fmt.Sprintf("channel_size %d", s.config.ChannelSize), fmt.Sprintf("heartbeat %ds", s.config.Heartbeat)},
+	}
+
+	switch s.config.Transport {
+	case config.TCPMUX, config.TCPSINGLE, config.WSMUX, config.WSSMUX:
+		info.Parameters = append(info.Parameters,
+			fmt.Sprintf("mux_con %d", s.config.MuxCon),
+			fmt.Sprintf("mux_version %d", s.config.MuxVersion),
+			fmt.Sprintf("mux_framesize %d", s.config.MaxFrameSize),
+			fmt.Sprintf("mux_recievebuffer %d", s.config.MaxReceiveBuffer),
+			fmt.Sprintf("mux_streambuffer %d", s.config.MaxStreamBuffer),
+		)
+	case config.QUIC:
+		info.Parameters = append(info.Parameters, fmt.Sprintf("mux_con %d", s.config.MuxCon))
+	}
+
+	features := []struct {
+		name    string
+		enabled bool
+	}{
+		{"nodelay", s.config.Nodelay},
+		{"encryption", s.config.Encryption && (s.config.Transport == config.TCP || s.config.Transport == config.TCPMUX)},
+		{"tls", s.config.Transport == config.WSS || s.config.Transport == config.WSSMUX || s.config.Transport == config.QUIC},
+		{"tls_psk", s.config.TLSPSK && (s.config.Transport == config.WSS || s.config.Transport == config.WSSMUX)},
+		{"accept_udp", s.config.AcceptUDP && s.config.Transport == config.TCP},
+		{"sniffer", s.config.Sniffer},
+	}
+	for _, feature := range features {
+		if feature.enabled {
+			info.Features = append(info.Features, feature.name)
+		}
+	}
+
+	return info
+}
@@ -1,7 +1,9 @@
 package transport
 
 import (
+	"context"
 	"encoding/binary"
+	"errors"
 	"io"
 	"net"
 	"sync"
@@ -17,16 +19,16 @@ const BufferSize = 16 * 1024
 func (s *TcpTransport) udpListener(localAddr string, remoteAddr string) {
 	localUDPAddr, err := net.ResolveUDPAddr("udp", localAddr)
 	if err != nil {
-		s.logger.Fatalf("failed to resolve local address: %v", err)
+		s.startErrs.report(s.logger, "resolve", localAddr, err)
+		return
 	}
 
 	listener, err := net.ListenUDP("udp", localUDPAddr)
 	if err != nil {
-		s.logger.Fatalf("failed to listen on local UDP port: %v", err)
+		s.startErrs.report(s.logger, "listen on", localAddr, err)
+		return
 	}
 
-	defer listener.Close()
-
 	s.logger.Infof("UDP listener started successfully, listening on address: %s", listener.LocalAddr().String())
 
 	// Track active connections
@@ -52,6 +54,9 @@ func (s *TcpTransport) udpListener(localAddr string, remoteAddr string) {
 			default:
 				n, addr, err := listener.ReadFromUDP(buf)
 				if err != nil {
+					if errors.Is(err, net.ErrClosed) {
+						return
+					}
 					s.logger.Errorf("failed to read from UDP listener: %v", err)
 					continue
 				}
@@ -123,6 +128,11 @@ func (s *TcpTransport) udpListener(localAddr string, remoteAddr string) {
 	}()
 
 	<-s.ctx.Done()
+
+	// Closing the listener stops the reader, the flow handlers end with the
+	// context and remove their flows once both directions are done
+	listener.Close()
+	s.logger.Debugf("UDP listener on %s closed", listener.LocalAddr().String())
 }
 
 func (s *TcpTransport) handleUDPLoop(udpChan chan *LocalAcceptUDPConn, activeConnections *map[string]*LocalAcceptUDPConn, mu *sync.Mutex) {
@@ -137,7 +147,9 @@ func (s *TcpTransport) handleUDPLoop(udpChan chan *LocalAcceptUDPConn, activeCon
 				case <-s.ctx.Done():
 					return
 
-				case tunnelConn := <-s.tunnelChannel:
+				case tunnelConnection := <-s.tunnelChannel:
+					tunnelConn := tunnelConnection.take()
+
 					// Send the target addr over the connection
 					if err := utils.SendBinaryTransportString(tunnelConn, localConn.remoteAddr, utils.SG_UDP); err != nil {
 						s.logger.Errorf("%v", err)
@@ -146,7 +158,7 @@ func (s *TcpTransport) handleUDPLoop(udpChan chan *LocalAcceptUDPConn, activeCon
 					}
 
 					// Handle data exchange between connections
-					go UDPConnectionHandler(localConn, tunnelConn, s.logger, s.usageMonitor, localConn.listener.LocalAddr().(*net.UDPAddr).Port, s.config.Sniffer, s.rtt, activeConnections, mu)
+					go UDPConnectionHandler(s.ctx, localConn, tunnelConn, s.logger, s.usageMonitor, localConn.listener.LocalAddr().(*net.UDPAddr).Port, s.config.Sniffer, s.rtt, activeConnections, mu)
 
 					s.logger.Debugf("initiate new handler for connection %s with timestamp %d", localConn.clientAddr.String(), localConn.timeCreated)
 					break loop
@@ -156,7 +168,7 @@ func (s *TcpTransport) handleUDPLoop(udpChan chan *LocalAcceptUDPConn, activeCon
 	}
 }
 
-func UDPConnectionHandler(udp *LocalAcceptUDPConn, tcp net.Conn, logger *logrus.Logger, usage *web.Usage, remotePort int, sniffer bool, rtt int64, activeConnections *map[string]*LocalAcceptUDPConn, mu *sync.Mutex) {
+func UDPConnectionHandler(ctx context.Context, udp *LocalAcceptUDPConn, tcp net.Conn, logger *logrus.Logger, usage *web.Usage, remotePort int, sniffer bool, rtt int64, activeConnections *map[string]*LocalAcceptUDPConn, mu *sync.Mutex) {
 	done := make(chan struct{})
 
 	if rtt == 0 {
@@ -166,8 +178,11 @@ func UDPConnectionHandler(udp *LocalAcceptUDPConn, tcp net.Conn, logger *logrus.
 		rtt = 100
 	}
 
+	utils.OpenConnection()
+	defer utils.CloseConnection()
+
 	go func() {
-		udpToTCP(tcp, udp, logger, usage, remotePort, sniffer)
+		udpToTCP(ctx, tcp, udp, logger, usage, remotePort, sniffer)
 		tcp.Close()
 		done <- struct{}{}
 	}()
@@ -186,7 +201,7 @@ func UDPConnectionHandler(udp *LocalAcceptUDPConn, tcp net.Conn, logger *logrus.
 	mu.Unlock()
 }
 
-func udpToTCP(tcp net.Conn, udp *LocalAcceptUDPConn, logger *logrus.Logger, usage *web.Usage, remotePort int, sniffer bool) {
+func udpToTCP(ctx context.Context, tcp net.Conn, udp *LocalAcceptUDPConn, logger *logrus.Logger, usage *web.Usage, remotePort int, sniffer bool) {
 	// Create a header (2 bytes) to hold the size of the data
 	header := make([]byte, 2)
 
@@ -223,11 +238,16 @@ func udpToTCP(tcp net.Conn, udp *LocalAcceptUDPConn, logger *logrus.Logger, usag
 			}
 
 			logger.Tracef("received %d bytes, forwarded %d bytes from UDP to TCP", packetSize, totalWritten-2)
+			utils.CountTraffic(true, packetSize)
 
 			if sniffer {
 				usage.AddOrUpdatePort(remotePort, uint64(totalWritten))
 			}
 
+		case <-ctx.Done(): // The transport stopped or restarts, closing the tcp connection ends tcpToUDP as well
+			logger.Debugf("closing UDP connection with timestamp %d and address %s", udp.timeCreated, udp.clientAddr.String())
+			return
+
 		case <-time.After(inactivityTimeout): // Timeout after 30 seconds of inactivity
 			logger.Debugf("connection with timestamp %d and address %s idle for 60 seconds, closing", udp.timeCreated, udp.clientAddr.String())
 			return
@@ -315,6 +335,7 @@ func tcpToUDP(tcp net.Conn, udp *LocalAcceptUDPConn, logger *logrus.Logger, usag
 			}
 
 			logger.Tracef("read %d bytes from TCP, forwarded %d bytes to UDP", packetSize, totalWritten)
+			utils.CountTraffic(false, totalWritten)
 		}
 	}
 }
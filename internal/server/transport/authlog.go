@@ -0,0 +1,74 @@
+package transport
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// authLogMaxIPs caps the distinct IPs remembered per interval, more are still counted as attempts
+const authLogMaxIPs = 4096
+
+// authLog reports unauthorized requests. With an interval it logs one summary
+// per interval instead of a warning per request, so probing cannot flood the logs.
+type authLog struct {
+	mu       sync.Mutex
+	interval time.Duration
+	attempts int
+	ips      map[string]struct{}
+	logger   *logrus.Logger
+}
+
+// newAuthLog starts summarizing every interval until ctx is done, an interval
+// of 0 keeps a warning per request.
+func newAuthLog(ctx context.Context, interval time.Duration, logger *logrus.Logger) *authLog {
+	a := &authLog{
+		interval: interval,
+		ips:      make(map[string]struct{}),
+		logger:   logger,
+	}
+
+	if interval > 0 {
+		go a.summarize(ctx)
+	}
+
+	return a
+}
+
+// unauthorized records an unauthorized request from addr.
+func (a *authLog) unauthorized(addr string) {
+	if a.interval <= 0 {
+		a.logger.Warnf("unauthorized request from %s, closing connection", addr)
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.attempts++
+	if len(a.ips) < authLogMaxIPs {
+		a.ips[hostOf(addr)] = struct{}{}
+	}
+}
+
+func (a *authLog) summarize(ctx context.Context) {
+	ticker := time.NewTicker(a.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			a.mu.Lock()
+			if a.attempts > 0 {
+				a.logger.Warnf("%d unauthorized requests from %d IPs in the last %v", a.attempts, len(a.ips), a.interval)
+				a.attempts = 0
+				clear(a.ips)
+			}
+			a.mu.Unlock()
+		}
+	}
+}
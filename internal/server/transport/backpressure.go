@@ -0,0 +1,52 @@
+package transport
+
+import "time"
+
+// backpressureInterval bounds how often the client is told the tunnel channel is full
+const backpressureInterval = time.Second
+
+// backpressure tells the client over the control channel that the tunnel
+// channel is full, so it holds back new tunnel connections instead of dialing
+// into a channel that discards them. A nil backpressure never signals, older
+// clients would restart on the unknown signal.
+type backpressure struct {
+	full chan struct{}
+	last time.Time // last signal sent, only used by the control channel handler
+}
+
+func newBackpressure(enabled bool) *backpressure {
+	if !enabled {
+		return nil
+	}
+	return &backpressure{full: make(chan struct{}, 1)}
+}
+
+// discarded notes that a tunnel connection was discarded on a full channel.
+func (b *backpressure) discarded() {
+	if b == nil {
+		return
+	}
+
+	select {
+	case b.full <- struct{}{}:
+	default:
+	}
+}
+
+// signals returns the channel the control channel handler waits on, nil when
+// disabled so its select case never fires.
+func (b *backpressure) signals() <-chan struct{} {
+	if b == nil {
+		return nil
+	}
+	return b.full
+}
+
+// due reports whether the client should be signaled now, at most once per backpressureInterval.
+func (b *backpressure) due() bool {
+	if time.Since(b.last) < backpressureInterval {
+		return false
+	}
+	b.last = time.Now()
+	return true
+}
@@ -0,0 +1,115 @@
+package transport
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// banListPruneSize is the number of tracked addresses above which expired ones are dropped
+const banListPruneSize = 1024
+
+// banList blocks client IPs for a while after repeated failed handshakes. A
+// nil banList never blocks.
+type banList struct {
+	mu       sync.Mutex
+	limit    int           // failed handshakes before an IP is banned
+	duration time.Duration // how long a ban lasts, also the window failures are counted in
+	entries  map[string]*banEntry
+	logger   *logrus.Logger
+}
+
+type banEntry struct {
+	failures    int
+	first       time.Time // first failure of the current window
+	bannedUntil time.Time
+}
+
+// newBanList returns nil when limit is 0, which disables banning.
+func newBanList(limit int, duration time.Duration, logger *logrus.Logger) *banList {
+	if limit <= 0 {
+		return nil
+	}
+
+	return &banList{
+		limit:    limit,
+		duration: duration,
+		entries:  make(map[string]*banEntry),
+		logger:   logger,
+	}
+}
+
+// hostOf strips the port of a remote address, the address is kept if it has none.
+func hostOf(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// banned reports whether handshakes from the IP of addr are currently refused.
+func (b *banList) banned(addr string) bool {
+	if b == nil {
+		return false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	entry, ok := b.entries[hostOf(addr)]
+	return ok && time.Now().Before(entry.bannedUntil)
+}
+
+// fail counts a failed handshake from addr and bans its IP once the limit is reached.
+func (b *banList) fail(addr string) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	ip := hostOf(addr)
+
+	if len(b.entries) >= banListPruneSize {
+		b.prune(now)
+	}
+
+	entry, ok := b.entries[ip]
+	if !ok || now.Sub(entry.first) > b.duration {
+		entry = &banEntry{first: now}
+		b.entries[ip] = entry
+	}
+
+	entry.failures++
+	if entry.failures >= b.limit {
+		entry.bannedUntil = now.Add(b.duration)
+		entry.failures = 0
+		entry.first = now
+		b.logger.Warnf("banning %s for %v after %d failed handshakes", ip, b.duration, b.limit)
+	}
+}
+
+// succeed forgets the failures of the IP of addr.
+func (b *banList) succeed(addr string) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.entries, hostOf(addr))
+}
+
+// prune drops the entries whose ban and failure window are over. Caller must hold b.mu.
+func (b *banList) prune(now time.Time) {
+	for ip, entry := range b.entries {
+		if now.After(entry.bannedUntil) && now.Sub(entry.first) > b.duration {
+			delete(b.entries, ip)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package transport
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// channelLimitInterval is how often an idle channel limit is shrunk
+const channelLimitInterval = 30 * time.Second
+
+// channelLimit is the number of connections the local channel accepts before
+// discarding new ones. It doubles up to max when the channel fills up and
+// halves back towards min while the channel stays mostly empty. Go channels
+// cannot be resized, so the channel itself is allocated with max entries.
+// A nil channelLimit accepts every connection the channel has room for.
+type channelLimit struct {
+	min    int32
+	max    int32
+	limit  atomic.Int32
+	peak   atomic.Int32 // most queued connections since the last shrink check
+	logger *logrus.Logger
+}
+
+// newChannelLimit returns nil unless max is above size, which keeps the fixed size.
+func newChannelLimit(size int, max int, logger *logrus.Logger) *channelLimit {
+	if max <= size {
+		return nil
+	}
+
+	l := &channelLimit{min: int32(size), max: int32(max), logger: logger}
+	l.limit.Store(int32(size))
+	return l
+}
+
+// channelCapacity is the buffer size to allocate the channels with.
+func channelCapacity(size int, max int) int {
+	if max > size {
+		return max
+	}
+	return size
+}
+
+// allow reports whether a connection may be queued while queued connections
+// are already waiting, the limit is raised when it is reached.
+func (l *channelLimit) allow(queued int) bool {
+	if l == nil {
+		return true
+	}
+
+	for peak := l.peak.Load(); int32(queued) > peak; peak = l.peak.Load() {
+		if l.peak.CompareAndSwap(peak, int32(queued)) {
+			break
+		}
+	}
+
+	limit := l.limit.Load()
+	if int32(queued) < limit {
+		return true
+	}
+	if limit >= l.max {
+		return false
+	}
+
+	grown := min(limit*2, l.max)
+	if l.limit.CompareAndSwap(limit, grown) {
+		l.logger.Infof("local channel is full, raising its limit from %d to %d", limit, grown)
+	}
+	return true
+}
+
+// shrink halves the limit while fewer than a quarter of it was used, until ctx is done.
+func (l *channelLimit) shrink(ctx context.Context) {
+	if l == nil {
+		return
+	}
+
+	ticker := time.NewTicker(channelLimitInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			l.check()
+		}
+	}
+}
+
+// check halves the limit if fewer than a quarter of it was used since the last check.
+func (l *channelLimit) check() {
+	peak := l.peak.Swap(0)
+	limit := l.limit.Load()
+	if limit > l.min && peak < limit/4 {
+		shrunk := max(limit/2, l.min)
+		l.limit.Store(shrunk)
+		l.logger.Debugf("local channel is mostly idle, lowering its limit from %d to %d", limit, shrunk)
+	}
+}
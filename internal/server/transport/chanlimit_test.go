@@ -0,0 +1,105 @@
+package transport
+
+import (
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func quietLogger() *logrus.Logger {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	return logger
+}
+
+func TestChannelLimitFixedSize(t *testing.T) {
+	if l := newChannelLimit(8, 8, quietLogger()); l != nil {
+		t.Fatal("a max not above the size should keep the fixed size")
+	}
+
+	var l *channelLimit
+	if !l.allow(1000) {
+		t.Error("a nil limit should allow every connection")
+	}
+}
+
+func TestChannelLimitGrows(t *testing.T) {
+	l := newChannelLimit(4, 64, quietLogger())
+
+	for queued := 0; queued < 64; queued++ {
+		if !l.allow(queued) {
+			t.Fatalf("refused a connection with %d queued, below the max", queued)
+		}
+	}
+	if limit := l.limit.Load(); limit != 64 {
+		t.Fatalf("limit is %d after filling up, want 64", limit)
+	}
+	if l.allow(64) {
+		t.Error("allowed a connection beyond the max")
+	}
+}
+
+func TestChannelLimitShrinksUnderLoad(t *testing.T) {
+	l := newChannelLimit(4, 64, quietLogger())
+	for queued := 0; queued < 64; queued++ {
+		l.allow(queued)
+	}
+
+	// A quarter of the limit or more in use keeps it
+	l.check()
+	for i := 0; i < 3; i++ {
+		l.allow(16)
+		l.check()
+		if limit := l.limit.Load(); limit != 64 {
+			t.Fatalf("limit shrank to %d with 16 connections queued, want 64", limit)
+		}
+	}
+
+	// Less than a quarter halves it, once per check
+	l.allow(15)
+	l.check()
+	if limit := l.limit.Load(); limit != 32 {
+		t.Fatalf("limit is %d with 15 connections queued, want 32", limit)
+	}
+
+	// The load still in use stops it from shrinking further
+	l.allow(8)
+	l.check()
+	if limit := l.limit.Load(); limit != 32 {
+		t.Fatalf("limit shrank to %d with 8 connections queued, want 32", limit)
+	}
+
+	// Idle, it goes back down to the size and no further
+	for _, want := range []int32{16, 8, 4, 4} {
+		l.check()
+		if limit := l.limit.Load(); limit != want {
+			t.Fatalf("idle limit is %d, want %d", limit, want)
+		}
+	}
+}
+
+func TestChannelLimitConcurrentLoad(t *testing.T) {
+	l := newChannelLimit(4, 64, quietLogger())
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				l.allow(i % 48)
+			}
+		}()
+	}
+
+	for i := 0; i < 100; i++ {
+		l.check()
+	}
+	wg.Wait()
+
+	if limit := l.limit.Load(); limit < 4 || limit > 64 {
+		t.Errorf("limit %d is outside the size and max", limit)
+	}
+}
@@ -0,0 +1,98 @@
+package transport
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// rejectLinger bounds how long a rejected HTTP connection is kept open to
+// read the request, so the 503 is not lost to a reset on close.
+const rejectLinger = time.Second
+
+// connLimit caps the local connections in flight across all port mappings of
+// a transport, counted from accept until they are closed. Connections beyond
+// the cap are closed right at accept, before they cost goroutines or a slot in
+// the local channel. It outlives restarts, connections accepted before one
+// still release their slot. On HTTP ports a connection beyond the cap gets a
+// 503 response before it is closed, so well-behaved clients back off instead
+// of retrying right away. The same goes for connections refused while the
+// server is overloaded. A nil connLimit allows every connection and closes
+// the refused ones.
+type connLimit struct {
+	max        int64
+	active     atomic.Int64
+	httpPorts  []string // local ports answered with a 503, "port" or "start-end"
+	retryAfter int      // seconds in the Retry-After header, 0 leaves it out
+}
+
+// newConnLimit returns nil when max is 0 and there are no HTTP ports, a max
+// of 0 disables the cap.
+func newConnLimit(max int, httpPorts []string, retryAfter int) *connLimit {
+	if max <= 0 && len(httpPorts) == 0 {
+		return nil
+	}
+	return &connLimit{max: int64(max), httpPorts: httpPorts, retryAfter: retryAfter}
+}
+
+// track counts conn against the cap, ok is false when the cap is reached and
+// conn has to be closed. The returned connection releases its slot once closed.
+func (l *connLimit) track(conn *net.TCPConn) (net.Conn, bool) {
+	if l == nil || l.max <= 0 {
+		return conn, true
+	}
+
+	if l.active.Add(1) > l.max {
+		l.active.Add(-1)
+		return nil, false
+	}
+	return &limitedConn{TCPConn: conn, limit: l}, true
+}
+
+// limitedConn is a local connection holding a slot of a connLimit. It embeds
+// the TCP connection, so a reset is still passed on with SetLinger.
+type limitedConn struct {
+	*net.TCPConn
+	limit *connLimit
+	once  sync.Once
+}
+
+func (c *limitedConn) Close() error {
+	c.once.Do(func() {
+		c.limit.active.Add(-1)
+	})
+	return c.TCPConn.Close()
+}
+
+// reject closes a connection beyond the cap, on an HTTP port after a 503
+// response.
+func (l *connLimit) reject(conn *net.TCPConn) {
+	if l == nil || !portAllowed(conn.LocalAddr().(*net.TCPAddr).Port, l.httpPorts) {
+		conn.Close()
+		return
+	}
+
+	response := "HTTP/1.1 503 Service Unavailable\r\nContent-Type: text/plain\r\nContent-Length: 20\r\nConnection: close\r\n"
+	if l.retryAfter > 0 {
+		response += fmt.Sprintf("Retry-After: %d\r\n", l.retryAfter)
+	}
+	response += "\r\nService Unavailable\n"
+
+	// A fresh socket takes the response into its send buffer, the deadline only guards the accept loop
+	conn.SetWriteDeadline(time.Now().Add(rejectLinger))
+	if _, err := conn.Write([]byte(response)); err != nil {
+		conn.Close()
+		return
+	}
+	conn.CloseWrite()
+
+	// Closing with the request unread would reset the connection and could discard the response
+	go func() {
+		conn.SetReadDeadline(time.Now().Add(rejectLinger))
+		io.Copy(io.Discard, conn)
+		conn.Close()
+	}()
+}
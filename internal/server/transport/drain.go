@@ -0,0 +1,98 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+var errRestarting = errors.New("server is restarting")
+
+// portListeners gives the local listeners of every port their own context,
+// so a single port mapping can be drained while the others keep running.
+type portListeners struct {
+	mu      sync.Mutex
+	cancels map[int]context.CancelFunc
+}
+
+func newPortListeners() *portListeners {
+	return &portListeners{cancels: make(map[int]context.CancelFunc)}
+}
+
+// add returns the context the listener runs in, it is done when its port is
+// drained or when parent is done.
+func (p *portListeners) add(parent context.Context, listener net.Listener) context.Context {
+	tcpAddr, ok := listener.Addr().(*net.TCPAddr)
+	if !ok {
+		return parent
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(parent)
+	if previous, ok := p.cancels[tcpAddr.Port]; ok {
+		// Listeners on several addresses of the same port are drained together
+		p.cancels[tcpAddr.Port] = func() {
+			previous()
+			cancel()
+		}
+	} else {
+		p.cancels[tcpAddr.Port] = cancel
+	}
+
+	return ctx
+}
+
+// drain closes the listeners of port. Connections already accepted keep
+// running until they finish, the port stays closed until the next restart.
+func (p *portListeners) drain(port int) error {
+	p.mu.Lock()
+	cancel, ok := p.cancels[port]
+	delete(p.cancels, port)
+	p.mu.Unlock()
+
+	if !ok {
+		return fmt.Errorf("no listener on port %d", port)
+	}
+
+	cancel()
+	return nil
+}
+
+// closeAll closes the listeners of every port, a restart stops accepting this
+// way before it tears down the tunnel, so users are refused instead of being
+// accepted into a transport that is going away.
+func (p *portListeners) closeAll() {
+	p.mu.Lock()
+	cancels := p.cancels
+	p.cancels = make(map[int]context.CancelFunc)
+	p.mu.Unlock()
+
+	for _, cancel := range cancels {
+		cancel()
+	}
+}
+
+// rejectQueued closes the local connections still waiting in channels once
+// nothing serves them anymore, their users see a closed connection right away
+// instead of one that hangs. It returns how many were closed.
+func rejectQueued(channels ...chan LocalTCPConn) int {
+	rejected := 0
+	for _, channel := range channels {
+	loop:
+		for {
+			select {
+			case localConn := <-channel:
+				localConn.conn.Close()
+				localConn.trace.Fail(errRestarting)
+				rejected++
+			default:
+				break loop
+			}
+		}
+	}
+	return rejected
+}
@@ -0,0 +1,45 @@
+package transport
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+)
+
+// StartError is a failure of a transport to set up one of its listeners. The
+// transports report it on their Errors channel instead of exiting, the caller
+// decides whether the process goes on without that listener.
+type StartError struct {
+	Op   string // what failed, e.g. "listen on"
+	Addr string
+	Err  error
+}
+
+func (e *StartError) Error() string {
+	return fmt.Sprintf("failed to %s %s: %v", e.Op, e.Addr, e.Err)
+}
+
+func (e *StartError) Unwrap() error {
+	return e.Err
+}
+
+// startErrors carries the StartErrors of a transport across its restarts. A
+// full channel drops the error rather than blocking the transport, it is only
+// logged then.
+type startErrors chan error
+
+func newStartErrors() startErrors {
+	return make(startErrors, 16)
+}
+
+func (c startErrors) report(logger *logrus.Logger, op string, addr string, err error) {
+	c.send(logger, &StartError{Op: op, Addr: addr, Err: err})
+}
+
+func (c startErrors) send(logger *logrus.Logger, startErr *StartError) {
+	select {
+	case c <- startErr:
+	default:
+		logger.Error(startErr)
+	}
+}
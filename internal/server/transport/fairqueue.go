@@ -0,0 +1,191 @@
+package transport
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+)
+
+// fairQueue hands the local connections to the tunnel in weighted round robin
+// across their local ports instead of in arrival order, so under contention a
+// port gets tunnel connections or streams in proportion to its weight and a
+// flooded port cannot starve the others. It only takes the connections
+// waiting in the local channel when it needs to pick the next one, sorts them
+// into a queue per port and offers the pick on an unbuffered channel, so a
+// connection is only handed over once a handler is ready for it. The
+// connections it holds still count towards the backlog of the local channel.
+// A nil fairQueue leaves the local channel as is.
+type fairQueue struct {
+	weights []portWeight
+	out     chan LocalTCPConn
+	held    atomic.Int32 // connections taken from the local channel and not handed over yet
+	logger  *logrus.Logger
+}
+
+type portWeight struct {
+	start, end int
+	weight     int
+}
+
+// fairQueueState holds the queues of a run, a restart starts over.
+type fairQueueState struct {
+	queues  map[int][]LocalTCPConn
+	current map[int]int // smooth weighted round robin credit of the ports with queued connections
+	held    int
+}
+
+// newFairQueue parses "port=weight" and "start-end=weight" entries, ports
+// without one weigh 1. Invalid entries are logged and skipped, it returns nil
+// when there are none.
+func newFairQueue(entries []string, logger *logrus.Logger) *fairQueue {
+	var weights []portWeight
+	for _, entry := range entries {
+		ports, weight, ok := strings.Cut(entry, "=")
+		if !ok {
+			logger.Warnf("invalid port weight %q, expected port=weight", entry)
+			continue
+		}
+
+		w, err := strconv.Atoi(strings.TrimSpace(weight))
+		if err != nil || w < 1 {
+			logger.Warnf("invalid weight in port weight %q, expected a number of at least 1", entry)
+			continue
+		}
+
+		start, end, isRange := strings.Cut(strings.TrimSpace(ports), "-")
+		if !isRange {
+			end = start
+		}
+		startPort, err1 := strconv.Atoi(strings.TrimSpace(start))
+		endPort, err2 := strconv.Atoi(strings.TrimSpace(end))
+		if err1 != nil || err2 != nil || startPort < 1 || endPort > 65535 || endPort < startPort {
+			logger.Warnf("invalid ports in port weight %q, expected a port or start-end", entry)
+			continue
+		}
+
+		weights = append(weights, portWeight{start: startPort, end: endPort, weight: w})
+	}
+
+	if len(weights) == 0 {
+		return nil
+	}
+
+	logger.Infof("scheduling local connections by %d port weights", len(weights))
+	return &fairQueue{weights: weights, out: make(chan LocalTCPConn), logger: logger}
+}
+
+// next returns the channel the handlers take local connections from.
+func (q *fairQueue) next(localChannel chan LocalTCPConn) <-chan LocalTCPConn {
+	if q == nil {
+		return localChannel
+	}
+	return q.out
+}
+
+// queued returns the number of connections waiting to be handed over, those
+// in localChannel and those the queue holds.
+func (q *fairQueue) queued(localChannel chan LocalTCPConn) int {
+	if q == nil {
+		return len(localChannel)
+	}
+	return len(localChannel) + int(q.held.Load())
+}
+
+// weight returns the weight of port, the first matching entry wins.
+func (q *fairQueue) weight(port int) int {
+	for _, w := range q.weights {
+		if port >= w.start && port <= w.end {
+			return w.weight
+		}
+	}
+	return 1
+}
+
+// run schedules the connections of localChannel until ctx is done, then
+// closes the ones it still holds.
+func (q *fairQueue) run(ctx context.Context, localChannel chan LocalTCPConn) {
+	if q == nil {
+		return
+	}
+
+	state := &fairQueueState{queues: make(map[int][]LocalTCPConn), current: make(map[int]int)}
+
+	for {
+		// Wait for a connection while none is held
+		if state.held == 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case localConn := <-localChannel:
+				q.hold(state, localConn)
+			}
+		}
+
+		// Take the ones waiting meanwhile so the pick weighs every port
+		for drained := false; !drained; {
+			select {
+			case localConn := <-localChannel:
+				q.hold(state, localConn)
+			default:
+				drained = true
+			}
+		}
+
+		// The pick stands until a handler takes it, arrivals wait in the local channel
+		pending := q.pick(state)
+
+		select {
+		case <-ctx.Done():
+			for {
+				pending.conn.Close()
+				pending.trace.Fail(errRestarting)
+				q.held.Add(-1)
+				if state.held == 0 {
+					return
+				}
+				pending = q.pick(state)
+			}
+
+		case q.out <- pending:
+			q.held.Add(-1)
+		}
+	}
+}
+
+// hold queues localConn behind the other connections of its port.
+func (q *fairQueue) hold(state *fairQueueState, localConn LocalTCPConn) {
+	port := localConn.conn.LocalAddr().(*net.TCPAddr).Port
+	state.queues[port] = append(state.queues[port], localConn)
+	state.held++
+	q.held.Add(1)
+}
+
+// pick takes the next connection by smooth weighted round robin over the
+// ports with queued connections, at least one must be held.
+func (q *fairQueue) pick(state *fairQueueState) LocalTCPConn {
+	best, total := 0, 0
+	for port := range state.queues {
+		weight := q.weight(port)
+		state.current[port] += weight
+		total += weight
+		if best == 0 || state.current[port] > state.current[best] {
+			best = port
+		}
+	}
+	state.current[best] -= total
+
+	localConn := state.queues[best][0]
+	state.queues[best] = state.queues[best][1:]
+	if len(state.queues[best]) == 0 {
+		// An idle port starts over, it does not save up credit
+		delete(state.queues, best)
+		delete(state.current, best)
+	}
+	state.held--
+
+	return localConn
+}
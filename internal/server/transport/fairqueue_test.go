@@ -0,0 +1,103 @@
+package transport
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// portConn is a connection accepted on a local port.
+type portConn struct {
+	net.Conn
+	port   int
+	closed bool
+}
+
+func (c *portConn) LocalAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: c.port}
+}
+
+func (c *portConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+}
+
+func (c *portConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestFairQueueCountsHeldConnections(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	q := newFairQueue([]string{"22=4"}, logger)
+	localChannel := make(chan LocalTCPConn, 8)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		q.run(ctx, localChannel)
+		close(stopped)
+	}()
+
+	var conns []*portConn
+	for i := 0; i < 4; i++ {
+		c := &portConn{port: 8000}
+		if i%2 == 1 {
+			c.port = 22
+		}
+		conns = append(conns, c)
+		localChannel <- LocalTCPConn{conn: c}
+	}
+
+	// The queue takes the connections out of the channel, they are still waiting
+	if queued := waitHeld(q, localChannel, 4); queued != 4 {
+		t.Fatalf("queued is %d with no handler ready, want 4", queued)
+	}
+
+	if localConn := <-q.next(localChannel); localConn.conn.LocalAddr().(*net.TCPAddr).Port != 22 {
+		t.Errorf("picked port %d first, want the heavier port 22", localConn.conn.LocalAddr().(*net.TCPAddr).Port)
+	}
+	if queued := waitHeld(q, localChannel, 3); queued != 3 {
+		t.Errorf("queued is %d after a handler took one, want 3", queued)
+	}
+
+	cancel()
+	<-stopped
+
+	if queued := q.queued(localChannel); queued != 0 {
+		t.Errorf("queued is %d after the queue stopped, want 0", queued)
+	}
+	closed := 0
+	for _, c := range conns {
+		if c.closed {
+			closed++
+		}
+	}
+	if closed != 3 {
+		t.Errorf("closed %d connections on stop, want the 3 still held", closed)
+	}
+}
+
+// waitHeld waits for the queue to hold want connections and returns its backlog.
+func waitHeld(q *fairQueue, localChannel chan LocalTCPConn, want int32) int {
+	deadline := time.Now().Add(time.Second)
+	for q.held.Load() != want && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	return q.queued(localChannel)
+}
+
+func TestFairQueueNil(t *testing.T) {
+	var q *fairQueue
+	localChannel := make(chan LocalTCPConn, 2)
+	localChannel <- LocalTCPConn{}
+
+	if queued := q.queued(localChannel); queued != 1 {
+		t.Errorf("queued is %d without a fair queue, want the channel length 1", queued)
+	}
+}
@@ -0,0 +1,158 @@
+package transport
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/oschwald/maxminddb-golang"
+	"github.com/sirupsen/logrus"
+)
+
+// geoRouter picks the target of a local connection from the country of its
+// source address, admits tunnel and local connections by their country and
+// logs it. Lookups that fail or find no country admit the connection, a broken
+// database does not take the tunnel down. A nil geoRouter keeps every target
+// and admits every connection.
+type geoRouter struct {
+	db      *maxminddb.Reader
+	targets map[string]string // ISO country code to target host or host:port
+	allow   map[string]bool   // countries admitted, empty admits all but the denied ones
+	deny    map[string]bool   // countries refused
+	log     bool              // log the country of every connection
+}
+
+type geoRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+}
+
+// newGeoRouter loads the MaxMind database at path and parses the "CC=target"
+// rules and the allowed and denied countries, it returns nil when path is empty.
+func newGeoRouter(path string, rules []string, allow []string, deny []string, log bool, logger *logrus.Logger) (*geoRouter, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	// Read into memory instead of mmap, so the reader never has to be closed
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read GeoIP database: %w", err)
+	}
+	db, err := maxminddb.FromBytes(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load GeoIP database %s: %w", path, err)
+	}
+
+	r := &geoRouter{db: db, targets: make(map[string]string), allow: countrySet(allow), deny: countrySet(deny), log: log}
+	for _, rule := range rules {
+		country, target, ok := strings.Cut(rule, "=")
+		country = strings.ToUpper(strings.TrimSpace(country))
+		target = strings.TrimSpace(target)
+		if !ok || country == "" || target == "" {
+			return nil, fmt.Errorf("invalid geoip target format: %s", rule)
+		}
+		r.targets[country] = target
+	}
+
+	logger.Infof("GeoIP routing enabled with %s (%s), %d country rules, %d allowed and %d denied countries", path, db.Metadata.DatabaseType, len(r.targets), len(r.allow), len(r.deny))
+
+	return r, nil
+}
+
+// target returns the target for a connection from addr. A rule target without
+// a port keeps the port of fallback, which is used when the lookup fails or the
+// country has no rule.
+func (r *geoRouter) target(addr net.Addr, fallback string, logger *logrus.Logger) string {
+	if r == nil {
+		return fallback
+	}
+
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return fallback
+	}
+
+	country, err := r.country(tcpAddr.IP)
+	if err != nil {
+		logger.Debugf("GeoIP lookup for %s failed, forwarding to %s: %v", tcpAddr.IP, fallback, err)
+		return fallback
+	}
+
+	target, ok := r.targets[country]
+	if !ok {
+		return fallback
+	}
+
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		// The fallback is either "port" or "host:port"
+		port := fallback
+		if _, p, err := net.SplitHostPort(fallback); err == nil {
+			port = p
+		}
+		target = net.JoinHostPort(target, port)
+	}
+
+	logger.Tracef("GeoIP routing %s (%s) to %s", tcpAddr.IP, country, target)
+	return target
+}
+
+// admit reports whether a connection from addr to listener passes the country
+// policy, and logs its country when enabled.
+func (r *geoRouter) admit(addr net.Addr, listener net.Addr, logger *logrus.Logger) bool {
+	if r == nil || (len(r.allow) == 0 && len(r.deny) == 0 && !r.log) {
+		return true
+	}
+
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return true
+	}
+
+	country, err := r.country(tcpAddr.IP)
+	if err != nil {
+		logger.Debugf("GeoIP lookup for %s failed, admitting it: %v", tcpAddr.IP, err)
+		return true
+	}
+	if country == "" {
+		// Private and unassigned addresses have no country
+		return true
+	}
+
+	if r.deny[country] || (len(r.allow) > 0 && !r.allow[country]) {
+		if r.log {
+			logger.Infof("refused connection from %s (%s) to %s by the GeoIP policy", tcpAddr, country, listener)
+		} else {
+			logger.Debugf("refused connection from %s (%s) to %s by the GeoIP policy", tcpAddr, country, listener)
+		}
+		return false
+	}
+
+	if r.log {
+		logger.Infof("connection from %s (%s) to %s", tcpAddr, country, listener)
+	}
+	return true
+}
+
+// country returns the ISO code of the country of ip, empty when the database
+// has none for it.
+func (r *geoRouter) country(ip net.IP) (string, error) {
+	var record geoRecord
+	if err := r.db.Lookup(ip, &record); err != nil {
+		return "", err
+	}
+	return record.Country.ISOCode, nil
+}
+
+// countrySet parses ISO country codes, case does not matter.
+func countrySet(countries []string) map[string]bool {
+	set := make(map[string]bool, len(countries))
+	for _, country := range countries {
+		if country = strings.ToUpper(strings.TrimSpace(country)); country != "" {
+			set[country] = true
+		}
+	}
+	return set
+}
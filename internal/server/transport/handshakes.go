@@ -0,0 +1,101 @@
+package transport
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// handshakeLimit bounds the tunnel connections that are in their handshake at
+// once, so a connection flood cannot pile up buffers and goroutines before the
+// token is checked. A nil limit lets every handshake through.
+type handshakeLimit struct {
+	slots chan struct{}
+	held  sync.Map // net.Conn holding a slot, for the HTTP based listeners
+}
+
+func newHandshakeLimit(limit int) *handshakeLimit {
+	if limit <= 0 {
+		return nil
+	}
+	return &handshakeLimit{slots: make(chan struct{}, limit)}
+}
+
+// acquire reports whether a handshake may start, each successful acquire must be released.
+func (h *handshakeLimit) acquire() bool {
+	if h == nil {
+		return true
+	}
+
+	select {
+	case h.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (h *handshakeLimit) release() {
+	if h != nil {
+		<-h.slots
+	}
+}
+
+// connState tracks the handshakes of an HTTP server, to be called from its
+// ConnState hook. A new connection over the limit is closed right away, the
+// slot is freed once the request is upgraded, answered or the connection closed.
+func (h *handshakeLimit) connState(conn net.Conn, state http.ConnState) bool {
+	if h == nil {
+		return true
+	}
+
+	switch state {
+	case http.StateNew:
+		if !h.acquire() {
+			conn.Close()
+			return false
+		}
+		h.held.Store(conn, struct{}{})
+	case http.StateIdle, http.StateHijacked, http.StateClosed:
+		if _, ok := h.held.LoadAndDelete(conn); ok {
+			h.release()
+		}
+	}
+
+	return true
+}
+
+// probeConn holds a handshake read to the probe timeout until the first bytes
+// arrive, then to the full handshake deadline. Port scanners and health checks
+// that connect and send nothing are closed early that way.
+type probeConn struct {
+	net.Conn
+	deadline time.Time
+	started  bool
+}
+
+// handshakeDeadline sets the read deadline of a handshake on conn and returns
+// the conn to read the handshake from. A probe of 0 keeps the full timeout.
+func handshakeDeadline(conn net.Conn, timeout, probe time.Duration) (net.Conn, error) {
+	deadline := time.Now().Add(timeout)
+	if probe <= 0 || probe >= timeout {
+		return conn, conn.SetReadDeadline(deadline)
+	}
+
+	if err := conn.SetReadDeadline(time.Now().Add(probe)); err != nil {
+		return conn, err
+	}
+	return &probeConn{Conn: conn, deadline: deadline}, nil
+}
+
+func (c *probeConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 && !c.started {
+		c.started = true
+		if err := c.Conn.SetReadDeadline(c.deadline); err != nil {
+			return n, err
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,114 @@
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// maxHostRouteHead bounds the request line and headers read to find the Host
+	maxHostRouteHead = 16 * 1024
+
+	// hostRouteTimeout bounds waiting for the request head of a routed connection
+	hostRouteTimeout = 5 * time.Second
+)
+
+// hostRouter picks the target of plain HTTP/1.x connections from their Host
+// header. A nil hostRouter routes nothing.
+type hostRouter struct {
+	ports  []string          // "port" or "start-end" entries of the routed listener ports
+	routes map[string]string // host or "*.domain" wildcard to target address
+}
+
+// newHostRouter parses the "host=target" rules, it returns nil when no port or
+// no rule is configured.
+func newHostRouter(ports []string, rules []string, logger *logrus.Logger) (*hostRouter, error) {
+	if len(ports) == 0 || len(rules) == 0 {
+		return nil, nil
+	}
+
+	r := &hostRouter{ports: ports, routes: make(map[string]string)}
+	for _, rule := range rules {
+		host, target, ok := strings.Cut(rule, "=")
+		host = strings.ToLower(strings.TrimSpace(host))
+		target = strings.TrimSpace(target)
+		if !ok || host == "" || target == "" {
+			return nil, fmt.Errorf("invalid http host rule format: %s", rule)
+		}
+		r.routes[host] = target
+	}
+
+	logger.Infof("routing plain HTTP on ports %v by Host header with %d rules", ports, len(r.routes))
+
+	return r, nil
+}
+
+func (r *hostRouter) enabled(port int) bool {
+	return r != nil && portAllowed(port, r.ports)
+}
+
+// target returns the target of host, an exact match wins over a wildcard.
+func (r *hostRouter) target(host string) (string, bool) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	if target, ok := r.routes[host]; ok {
+		return target, true
+	}
+	for domain := host; strings.Contains(domain, "."); {
+		_, domain, _ = strings.Cut(domain, ".")
+		if target, ok := r.routes["*."+domain]; ok {
+			return target, true
+		}
+	}
+
+	return "", false
+}
+
+// route reads the request head of conn and returns the target for its Host
+// header, or fallback when the connection is not HTTP or the host has no rule.
+// The returned connection replays the bytes consumed while reading the head.
+func (r *hostRouter) route(conn net.Conn, fallback string, logger *logrus.Logger) (net.Conn, string) {
+	var head bytes.Buffer
+
+	conn.SetReadDeadline(time.Now().Add(hostRouteTimeout))
+	req, err := http.ReadRequest(bufio.NewReader(io.TeeReader(io.LimitReader(conn, maxHostRouteHead), &head)))
+	conn.SetReadDeadline(time.Time{})
+
+	routed := &replayConn{Conn: conn, reader: io.MultiReader(&head, conn)}
+
+	if err != nil {
+		logger.Debugf("failed to read HTTP request from %s, forwarding to %s: %v", conn.RemoteAddr().String(), fallback, err)
+		return routed, fallback
+	}
+
+	target, ok := r.target(req.Host)
+	if !ok {
+		logger.Debugf("no http host rule for %q, forwarding to %s", req.Host, fallback)
+		return routed, fallback
+	}
+
+	logger.Debugf("routing HTTP host %q from %s to %s", req.Host, conn.RemoteAddr().String(), target)
+	return routed, target
+}
+
+// replayConn reads from reader, which starts with the bytes already consumed
+// from Conn, instead of reading from Conn directly.
+type replayConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *replayConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
@@ -0,0 +1,81 @@
+package transport
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// connLifetime caps how long a forwarded connection stays open, whatever its
+// activity, for policies that require connections to be recycled or
+// reauthenticated periodically. Unlike the idle timeout it also closes busy
+// connections. A nil connLifetime leaves every connection open for as long as
+// it is used.
+type connLifetime struct {
+	max   time.Duration
+	ports []portLifetime
+}
+
+type portLifetime struct {
+	start, end int
+	max        time.Duration
+}
+
+// newConnLifetime parses "port=seconds" and "start-end=seconds" entries that
+// override max for their ports, 0 is unlimited. Invalid entries are logged and
+// skipped, it returns nil when no connection has a lifetime.
+func newConnLifetime(max time.Duration, entries []string, logger *logrus.Logger) *connLifetime {
+	var ports []portLifetime
+	limited := max > 0
+	for _, entry := range entries {
+		portsPart, seconds, ok := strings.Cut(entry, "=")
+		if !ok {
+			logger.Warnf("invalid port lifetime %q, expected port=seconds", entry)
+			continue
+		}
+
+		s, err := strconv.Atoi(strings.TrimSpace(seconds))
+		if err != nil || s < 0 {
+			logger.Warnf("invalid lifetime in port lifetime %q, expected a number of seconds", entry)
+			continue
+		}
+
+		start, end, isRange := strings.Cut(strings.TrimSpace(portsPart), "-")
+		if !isRange {
+			end = start
+		}
+		startPort, err1 := strconv.Atoi(strings.TrimSpace(start))
+		endPort, err2 := strconv.Atoi(strings.TrimSpace(end))
+		if err1 != nil || err2 != nil || startPort < 1 || endPort > 65535 || endPort < startPort {
+			logger.Warnf("invalid ports in port lifetime %q, expected a port or start-end", entry)
+			continue
+		}
+
+		ports = append(ports, portLifetime{start: startPort, end: endPort, max: time.Duration(s) * time.Second})
+		limited = limited || s > 0
+	}
+
+	if !limited {
+		return nil
+	}
+
+	logger.Infof("closing forwarded connections after %v, %d ports with their own lifetime", max, len(ports))
+	return &connLifetime{max: max, ports: ports}
+}
+
+// of returns the lifetime of the connections on port, the first matching
+// entry wins. 0 is unlimited.
+func (l *connLifetime) of(port int) time.Duration {
+	if l == nil {
+		return 0
+	}
+
+	for _, p := range l.ports {
+		if port >= p.start && port <= p.end {
+			return p.max
+		}
+	}
+	return l.max
+}
@@ -0,0 +1,30 @@
+package transport
+
+import "sync"
+
+// streamOrder lets one mux session at a time take a local connection and open
+// its stream, so streams are opened in the order the connections were accepted
+// instead of racing between sessions. A nil streamOrder lets the sessions run
+// concurrently.
+type streamOrder struct {
+	mu sync.Mutex
+}
+
+func newStreamOrder(enabled bool) *streamOrder {
+	if !enabled {
+		return nil
+	}
+	return &streamOrder{}
+}
+
+func (o *streamOrder) lock() {
+	if o != nil {
+		o.mu.Lock()
+	}
+}
+
+func (o *streamOrder) unlock() {
+	if o != nil {
+		o.mu.Unlock()
+	}
+}
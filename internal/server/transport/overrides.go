@@ -0,0 +1,54 @@
+package transport
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// targetOverrides steers the new connections of a port to another target at
+// runtime, e.g. to a maintenance backend. Connections already forwarded keep
+// their target and the listeners keep running.
+type targetOverrides struct {
+	mu      sync.RWMutex
+	targets map[int]string
+}
+
+func newTargetOverrides() *targetOverrides {
+	return &targetOverrides{targets: make(map[int]string)}
+}
+
+// set overrides the target of port with a "host:port" or port target, an
+// empty target goes back to the target of the port mapping.
+func (t *targetOverrides) set(port int, target string) error {
+	if target != "" {
+		if _, _, err := net.SplitHostPort(target); err != nil {
+			if p, err := strconv.Atoi(target); err != nil || p < 1 || p > 65535 {
+				return fmt.Errorf("invalid target %q, expected host:port or a port", target)
+			}
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if target == "" {
+		delete(t.targets, port)
+	} else {
+		t.targets[port] = target
+	}
+	return nil
+}
+
+// target returns the target for a new connection on port, remoteAddr when
+// the port is not overridden.
+func (t *targetOverrides) target(port int, remoteAddr string) string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if target, ok := t.targets[port]; ok {
+		return target
+	}
+	return remoteAddr
+}
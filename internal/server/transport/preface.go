@@ -0,0 +1,81 @@
+package transport
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"time"
+
+	"github.com/musix/backhaul/internal/utils"
+	"github.com/musix/backhaul/internal/web"
+	"github.com/sirupsen/logrus"
+)
+
+// prefaceTimeout bounds waiting for the preface of a connection from an upstream Backhaul
+const prefaceTimeout = 5 * time.Second
+
+// sendPreface writes a preface for local to the tunnel when its local port is
+// one of ports, so a Backhaul server behind the backend address learns the
+// user. A connection that came with a preface itself passes that one on, the
+// backend learns about the first hop of the chain.
+func sendPreface(tunnel io.Writer, local net.Conn, ports []string, transport string) error {
+	port := local.LocalAddr().(*net.TCPAddr).Port
+	if !portAllowed(port, ports) {
+		return nil
+	}
+
+	preface := utils.Preface{
+		Protocol:  utils.HandshakeVersion,
+		Transport: transport,
+		Source:    local.RemoteAddr().String(),
+		Local:     local.LocalAddr().String(),
+		Label:     web.PortLabel(port),
+	}
+	if chained, ok := local.(*prefaceConn); ok {
+		preface = chained.preface
+	}
+
+	_, err := tunnel.Write(preface.Bytes())
+	return err
+}
+
+// prefaceConn is a local connection whose preface was stripped, it reports the
+// user of the first hop as its remote address, so logs, GeoIP and PROXY
+// protocol headers see the user instead of the upstream tunnel client.
+type prefaceConn struct {
+	net.Conn
+	preface utils.Preface
+	source  net.Addr
+}
+
+func (c *prefaceConn) RemoteAddr() net.Addr {
+	return c.source
+}
+
+// readPreface strips the preface off a connection from an upstream Backhaul.
+// A connection without one is forwarded as it is, with the bytes read while
+// looking for it replayed, so a port can take both.
+func readPreface(conn net.Conn, logger *logrus.Logger) net.Conn {
+	conn.SetReadDeadline(time.Now().Add(prefaceTimeout))
+	preface, head, ok, err := utils.ReadPreface(conn)
+	conn.SetReadDeadline(time.Time{})
+
+	if !ok && head == nil {
+		// The signature was there, the rest of the stream cannot be told apart from the preface
+		logger.Warnf("invalid preface from %s, closing the connection: %v", conn.RemoteAddr().String(), err)
+		conn.Close()
+		return conn
+	}
+	if !ok {
+		return &replayConn{Conn: conn, reader: io.MultiReader(bytes.NewReader(head), conn)}
+	}
+
+	source, err := net.ResolveTCPAddr("tcp", preface.Source)
+	if err != nil {
+		logger.Warnf("invalid source %q in the preface from %s, keeping the connection address", preface.Source, conn.RemoteAddr().String())
+		return conn
+	}
+
+	logger.Debugf("preface from %s: user %s on %s of %s (protocol v%d)", conn.RemoteAddr().String(), preface.Source, preface.Local, preface.Transport, preface.Protocol)
+	return &prefaceConn{Conn: conn, preface: preface, source: source}
+}
@@ -4,7 +4,6 @@ import (
 	"context"
 	"crypto/tls"
 	"fmt"
-	"log"
 	"net"
 	"strconv"
 	"strings"
@@ -32,24 +31,33 @@ type QuicTransport struct {
 	usageMonitor   *web.Usage
 	restartMutex   sync.Mutex
 	coldStart      bool
+	handshakes     *handshakeLimit
+	startErrs      startErrors
 }
 
 type QuicConfig struct {
-	BindAddr     string
-	TunnelStatus string
-	SnifferLog   string
-	Token        string
-	Ports        []string
-	Nodelay      bool
-	Sniffer      bool
-	ChannelSize  int
-	MuxCon       int
-	WebPort      int
-	KeepAlive    time.Duration
-	Heartbeat    time.Duration // in seconds
-	TLSCertFile  string        // Path to the TLS certificate file
-	TLSKeyFile   string        // Path to the TLS key file
-
+	BindAddr         string
+	TunnelStatus     string
+	SnifferLog       string
+	Token            string
+	MaxTokenLength   int
+	Ports            []string
+	Nodelay          bool
+	LocalNodelay     bool // Nodelay of the sockets facing the users
+	Sniffer          bool
+	ChannelSize      int
+	MuxCon           int
+	WebPort          int
+	SnifferMaxPorts  int
+	SnifferRetention time.Duration
+	KeepAlive        time.Duration
+	Heartbeat        time.Duration // in seconds
+	TLSCertFile      string        // Path to the TLS certificate file
+	TLSKeyFile       string        // Path to the TLS key file
+	MSSClamp         int           // TCP_MAXSEG for local connections, 0 disables clamping
+	MaxHandshakes    int           // Tunnel connections in their handshake at once, more are closed right away, 0 disables the cap
+	ProbeTimeout     time.Duration // Close connections that open no stream for this long, 0 waits without a limit
+	MaxPortMappings  int           // Listeners the port mappings may open, a range counts every port, the rest are refused, 0 disables the cap
 }
 
 func NewQuicServer(parentCtx context.Context, config *QuicConfig, logger *logrus.Logger) *QuicTransport {
@@ -72,14 +80,27 @@ func NewQuicServer(parentCtx context.Context, config *QuicConfig, logger *logrus
 		getNewConnChan: make(chan struct{}, config.ChannelSize),
 		localChan:      make(chan LocalTCPConn, config.ChannelSize),
 		controlChannel: nil, // will be set when a control connection is established
-		usageMonitor:   web.NewDataStore(fmt.Sprintf(":%v", config.WebPort), ctx, config.SnifferLog, config.Sniffer, &config.TunnelStatus, logger),
+		usageMonitor:   web.NewDataStore(fmt.Sprintf(":%v", config.WebPort), ctx, config.SnifferLog, config.Sniffer, &config.TunnelStatus, logger, config.SnifferMaxPorts, config.SnifferRetention),
 		coldStart:      true,
+		handshakes:     newHandshakeLimit(config.MaxHandshakes),
+		startErrs:      newStartErrors(),
 	}
 
 	return server
 }
 
+// Errors reports the listeners the transport failed to set up, for as long as
+// it runs. A failed listener is not retried until the next restart.
+func (s *QuicTransport) Errors() <-chan error {
+	return s.startErrs
+}
+
 func (s *QuicTransport) Restart() {
+	// Nothing to restart once the tunnel is shutting down, e.g. for a config reload
+	if s.parentctx.Err() != nil {
+		return
+	}
+
 	if !s.restartMutex.TryLock() {
 		s.logger.Warn("server restart already in progress, skipping restart attempt")
 		return
@@ -87,6 +108,7 @@ func (s *QuicTransport) Restart() {
 	defer s.restartMutex.Unlock()
 
 	s.logger.Info("restarting server...")
+	utils.CountRestart()
 	if s.cancel != nil {
 		s.cancel()
 	}
@@ -96,7 +118,13 @@ func (s *QuicTransport) Restart() {
 	// 	s.controlChannel.Close()
 	// }
 
-	time.Sleep(2 * time.Second)
+	// Listen again as soon as the tunnel port is released
+	utils.WaitReleased("udp", []string{s.config.BindAddr}, restartRelease)
+
+	// Nothing serves the connections still queued anymore
+	if rejected := rejectQueued(s.localChan); rejected > 0 {
+		s.logger.Infof("closed %d local connections queued during the restart", rejected)
+	}
 
 	ctx, cancel := context.WithCancel(s.parentctx)
 	s.ctx = ctx
@@ -107,10 +135,14 @@ func (s *QuicTransport) Restart() {
 	s.getNewConnChan = make(chan struct{}, s.config.ChannelSize)
 	s.localChan = make(chan LocalTCPConn, s.config.ChannelSize)
 	s.controlChannel = nil
-	s.usageMonitor = web.NewDataStore(fmt.Sprintf(":%v", s.config.WebPort), ctx, s.config.SnifferLog, s.config.Sniffer, &s.config.TunnelStatus, s.logger)
+	s.usageMonitor = web.NewDataStore(fmt.Sprintf(":%v", s.config.WebPort), ctx, s.config.SnifferLog, s.config.Sniffer, &s.config.TunnelStatus, s.logger, s.config.SnifferMaxPorts, s.config.SnifferRetention)
 	s.config.TunnelStatus = ""
 	s.coldStart = true
 
+	if s.parentctx.Err() != nil {
+		return
+	}
+
 	go s.TunnelListener()
 
 }
@@ -215,13 +247,19 @@ func (s *QuicTransport) keepalive() {
 }
 
 func (s *QuicTransport) portConfigReader() {
-	for _, portMapping := range s.config.Ports {
+	ports, _, err := limitPortMappings(s.config.Ports, s.config.MaxPortMappings, 0)
+	if err != nil {
+		s.startErrs.send(s.logger, err)
+	}
+
+	for _, portMapping := range ports {
 		var localAddr string
 		parts := strings.Split(portMapping, "=")
 		if len(parts) < 2 {
 			port, err := strconv.Atoi(parts[0])
 			if err != nil {
-				s.logger.Fatalf("invalid port mapping format: %s", portMapping)
+				s.startErrs.report(s.logger, "parse port mapping", portMapping, fmt.Errorf("invalid port mapping format: %s", portMapping))
+				continue
 			}
 			localAddr = fmt.Sprintf(":%d", port)
 			parts = append(parts, strconv.Itoa(port))
@@ -238,8 +276,17 @@ func (s *QuicTransport) portConfigReader() {
 }
 
 func (s *QuicTransport) channelHandshake(qConn quic.Connection) {
-	// Set a read deadline for the token response
-	stream, err := qConn.AcceptStream(context.Background())
+	// The handshake slot is freed once the token is exchanged, not when the control channel ends
+	handshakeDone := sync.OnceFunc(s.handshakes.release)
+	defer handshakeDone()
+
+	// Connections that open no stream within the probe timeout are closed
+	streamCtx, streamCancel := context.Background(), context.CancelFunc(func() {})
+	if s.config.ProbeTimeout > 0 {
+		streamCtx, streamCancel = context.WithTimeout(streamCtx, s.config.ProbeTimeout)
+	}
+	stream, err := qConn.AcceptStream(streamCtx)
+	streamCancel()
 	if err != nil {
 		s.logger.Error("failed to open stream for channel handshake: ", err)
 		qConn.CloseWithError(1, "failed to open stream")
@@ -267,8 +314,8 @@ func (s *QuicTransport) channelHandshake(qConn quic.Connection) {
 	// Resetting the deadline (removes any existing deadline)
 	stream.SetReadDeadline(time.Time{})
 
-	if msg != s.config.Token {
-		s.logger.Warnf("invalid security token received: %s, exptected: %s", msg, s.config.Token)
+	if !utils.ValidToken(msg, s.config.Token, s.config.MaxTokenLength) {
+		s.logger.Warnf("invalid security token received from %s", qConn.RemoteAddr().String())
 		stream.Close()
 		qConn.CloseWithError(1, "close on invalid token")
 		return
@@ -288,6 +335,7 @@ func (s *QuicTransport) channelHandshake(qConn quic.Connection) {
 	stream.Close()
 
 	s.logger.Info("QUIC control channel successfully established.")
+	utils.MarkReady(s.ctx)
 
 	// call the functions
 	if s.coldStart {
@@ -299,17 +347,17 @@ func (s *QuicTransport) channelHandshake(qConn quic.Connection) {
 	s.config.TunnelStatus = "Connected (QUIC)"
 }
 
-func (s *QuicTransport) generateTLSConfig() *tls.Config {
+func (s *QuicTransport) generateTLSConfig() (*tls.Config, error) {
 	// You should replace this with proper certificate and key files
 	cert, err := tls.LoadX509KeyPair(s.config.TLSCertFile, s.config.TLSKeyFile)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
 	return &tls.Config{
 		Certificates: []tls.Certificate{cert},
 		NextProtos:   []string{"h3"},
-	}
+	}, nil
 }
 
 func (s *QuicTransport) TunnelListener() {
@@ -322,19 +370,28 @@ func (s *QuicTransport) TunnelListener() {
 	// Create a UDP connection
 	udpAddr, err := net.ResolveUDPAddr("udp", s.config.BindAddr)
 	if err != nil {
-		s.logger.Fatalf("failed to resolve UDP address: %v", err)
+		s.startErrs.report(s.logger, "resolve", s.config.BindAddr, err)
+		return
 	}
 
 	udpConn, err := net.ListenUDP("udp", udpAddr)
 	if err != nil {
-		s.logger.Fatalf("failed to listen on UDP: %v", err)
+		s.startErrs.report(s.logger, "listen on", s.config.BindAddr, err)
+		return
 	}
 	defer udpConn.Close()
 
+	tlsConfig, err := s.generateTLSConfig()
+	if err != nil {
+		s.startErrs.report(s.logger, "load the TLS certificate for", s.config.BindAddr, err)
+		return
+	}
+
 	// Create a QUIC listener
-	listener, err := quic.Listen(udpConn, s.generateTLSConfig(), s.quicConfig)
+	listener, err := quic.Listen(udpConn, tlsConfig, s.quicConfig)
 	if err != nil {
-		s.logger.Fatalf("failed to create QUIC listener: %v", err)
+		s.startErrs.report(s.logger, "create the QUIC listener on", s.config.BindAddr, err)
+		return
 	}
 
 	s.logger.Infof("listening for QUIC connections on %s...", s.config.BindAddr)
@@ -363,6 +420,12 @@ func (s *QuicTransport) acceptTunCon(listener *quic.Listener) {
 				continue
 			}
 
+			// An accept filter registered through the library can refuse the connection
+			if !utils.AcceptAllowed(utils.AcceptedConn{Tunnel: true, Transport: "quic", RemoteAddr: conn.RemoteAddr(), LocalAddr: conn.LocalAddr()}, s.logger) {
+				conn.CloseWithError(1, "rejected")
+				continue
+			}
+
 			// Drop all suspicious packets from other address rather than server
 			if s.controlChannel != nil && s.controlChannel.RemoteAddr().(*net.UDPAddr).IP.String() != conn.RemoteAddr().(*net.UDPAddr).IP.String() {
 				s.logger.Debugf("suspicious packet from %v. expected address: %v. discarding packet...", conn.RemoteAddr().(*net.UDPAddr).IP.String(), s.controlChannel.RemoteAddr().(*net.UDPAddr).IP.String())
@@ -373,6 +436,11 @@ func (s *QuicTransport) acceptTunCon(listener *quic.Listener) {
 			// try to establish a new channel
 			if s.controlChannel == nil {
 				s.logger.Info("control channel not found, attempting to establish a new session")
+				if !s.handshakes.acquire() {
+					s.logger.Debugf("too many handshakes in progress, closing connection from %s", conn.RemoteAddr().String())
+					conn.CloseWithError(1, "too many handshakes")
+					continue
+				}
 				go s.channelHandshake(conn)
 				continue
 			}
@@ -389,9 +457,15 @@ func (s *QuicTransport) acceptTunCon(listener *quic.Listener) {
 }
 
 func (s *QuicTransport) localListener(localAddr string, remoteAddr string) {
-	listener, err := net.Listen("tcp", localAddr)
+	// A missing capability only skips this mapping, the other listeners keep working
+	if err := utils.CheckBindPermission(localAddr); err != nil {
+		s.logger.Errorf("skipping listener on %s: %v", localAddr, err)
+		return
+	}
+
+	listener, err := utils.Listen(s.ctx, &net.ListenConfig{Control: utils.MSSControl(s.config.MSSClamp, s.logger), KeepAlive: localKeepAlive(s.config.KeepAlive)}, localAddr)
 	if err != nil {
-		s.logger.Fatalf("failed to start listener on %s: %v", localAddr, err)
+		s.startErrs.report(s.logger, "listen on", localAddr, err)
 		return
 	}
 
@@ -418,6 +492,9 @@ func (s *QuicTransport) acceptLocalCon(listener net.Listener, remoteAddr string)
 				continue
 			}
 
+			utils.SetCongestionControl(conn)
+			utils.SetSocketBuffers(conn)
+
 			// discard any non-tcp connection
 			tcpConn, ok := conn.(*net.TCPConn)
 			if !ok {
@@ -426,17 +503,25 @@ func (s *QuicTransport) acceptLocalCon(listener net.Listener, remoteAddr string)
 				continue
 			}
 
+			// An accept filter registered through the library can refuse the connection
+			if !utils.AcceptAllowed(utils.AcceptedConn{Tunnel: false, Transport: "quic", RemoteAddr: tcpConn.RemoteAddr(), LocalAddr: tcpConn.LocalAddr()}, s.logger) {
+				tcpConn.Close()
+				continue
+			}
+
 			// trying to disable tcpnodelay
-			if !s.config.Nodelay {
-				if err := tcpConn.SetNoDelay(s.config.Nodelay); err != nil {
+			if !s.config.LocalNodelay {
+				if err := tcpConn.SetNoDelay(s.config.LocalNodelay); err != nil {
 					s.logger.Warnf("failed to set TCP_NODELAY for %s: %v", tcpConn.RemoteAddr().String(), err)
 				} else {
 					s.logger.Tracef("TCP_NODELAY disabled for %s", tcpConn.RemoteAddr().String())
 				}
 			}
 
-			tcpConn.SetKeepAlive(true)
-			tcpConn.SetKeepAlivePeriod(s.config.KeepAlive)
+			if s.config.KeepAlive >= 0 {
+				tcpConn.SetKeepAlive(true)
+				tcpConn.SetKeepAlivePeriod(s.config.KeepAlive)
+			}
 
 			select {
 			case s.localChan <- LocalTCPConn{conn: conn, remoteAddr: remoteAddr}:
@@ -503,7 +588,7 @@ func (s *QuicTransport) handleSession(session quic.Connection, next chan struct{
 
 			// Handle data exchange between connections
 			go func() {
-				utils.QConnectionHandler(incomingConn.conn, stream, s.logger, s.usageMonitor, incomingConn.conn.LocalAddr().(*net.TCPAddr).Port, s.config.Sniffer)
+				utils.QConnectionHandler(incomingConn.conn, stream, s.logger, s.usageMonitor, incomingConn.conn.LocalAddr().(*net.TCPAddr).Port, s.config.Sniffer, true)
 				done <- struct{}{}
 			}()
 
@@ -0,0 +1,154 @@
+package transport
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// sessionRegistry recognizes a reconnecting client by the ID it sends in the
+// handshake, whatever address it comes from, and resumes its session instead
+// of starting a fresh one. A session is forgotten ttl after its control
+// channel dropped. With pinning the ID is bound to the IP its session started
+// from, a handshake with that ID from another IP is refused until the session
+// is forgotten, so a leaked token alone does not take over a known client.
+// Clients with handshake version 3 get a single-use resumption token in every
+// handshake answer, presenting it on the next handshake proves the client held
+// the last control channel of the session, so it resumes right away, without
+// the handshake delay, and from any IP when the tunnel is encrypted, a token
+// sent in the clear could be lifted off the path. A token expires with its
+// session. A nil sessionRegistry accepts every client without a session.
+type sessionRegistry struct {
+	mu       sync.Mutex
+	ttl      time.Duration
+	pin      bool
+	sessions map[string]*clientSession
+	active   string // ID of the client holding the control channel, never expired
+}
+
+type clientSession struct {
+	ip         string
+	started    time.Time
+	released   time.Time // last time its control channel dropped
+	reconnects int
+	resume     string // resumption token issued in the last handshake answer
+}
+
+func newSessionRegistry(ttl time.Duration, pin bool) *sessionRegistry {
+	if ttl <= 0 {
+		return nil
+	}
+	return &sessionRegistry{ttl: ttl, pin: pin, sessions: make(map[string]*clientSession)}
+}
+
+// redeem uses up the resumption token of the session of id, it reports whether
+// token was the one issued last.
+func (r *sessionRegistry) redeem(id string, token string) bool {
+	if r == nil || id == "" || token == "" {
+		return false
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.expire()
+
+	session, ok := r.sessions[id]
+	if !ok || session.resume == "" {
+		return false
+	}
+
+	valid := subtle.ConstantTimeCompare([]byte(token), []byte(session.resume)) == 1
+	session.resume = ""
+	return valid
+}
+
+// issue returns a new resumption token for the session of id, empty without
+// a session.
+func (r *sessionRegistry) issue(id string) string {
+	if r == nil || id == "" {
+		return ""
+	}
+
+	var buf [16]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return ""
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	session, ok := r.sessions[id]
+	if !ok {
+		return ""
+	}
+	session.resume = hex.EncodeToString(buf[:])
+	return session.resume
+}
+
+// resume starts or resumes the session of a client that passed the token
+// check, it returns false when pinning refuses the client. A client that
+// redeemed a resumption token over an encrypted tunnel is not pinned.
+func (r *sessionRegistry) resume(id string, addr net.Addr, redeemed bool, logger *logrus.Logger) bool {
+	if r == nil || id == "" {
+		return true
+	}
+
+	ip := addr.String()
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.expire()
+
+	session, ok := r.sessions[id]
+	if !ok {
+		r.sessions[id] = &clientSession{ip: ip, started: time.Now()}
+		r.active = id
+		logger.Infof("client %s started a session from %s", id, ip)
+		return true
+	}
+
+	if r.pin && session.ip != ip && !redeemed {
+		logger.Warnf("refusing client %s from %s, its session is pinned to %s", id, ip, session.ip)
+		return false
+	}
+
+	session.ip = ip
+	session.reconnects++
+	r.active = id
+	logger.Infof("client %s resumed its session from %s, started %v ago, reconnect %d, resumption token %v", id, ip, time.Since(session.started).Round(time.Second), session.reconnects, redeemed)
+	return true
+}
+
+// release notes that the control channel of the active client dropped, its
+// session expires ttl from now unless the client comes back.
+func (r *sessionRegistry) release() {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if session, ok := r.sessions[r.active]; ok {
+		session.released = time.Now()
+	}
+	r.active = ""
+}
+
+func (r *sessionRegistry) expire() {
+	for id, session := range r.sessions {
+		if id != r.active && time.Since(session.released) > r.ttl {
+			delete(r.sessions, id)
+		}
+	}
+}
@@ -1,21 +1,77 @@
 package transport
 
 import (
+	"errors"
+	"fmt"
+	"io"
 	"net"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
 
 	"github.com/gorilla/websocket"
+	"github.com/musix/backhaul/internal/utils"
+	"github.com/musix/backhaul/internal/web"
+	"github.com/sirupsen/logrus"
 )
 
+var errLocalChannelFull = errors.New("local channel is full")
+
+// restartRelease bounds waiting for the old tunnel listener to be closed on a restart
+const restartRelease = 2 * time.Second
+
 type TunnelChannel struct { // for websocket
 	conn *websocket.Conn
 	ping chan struct{}
 	mu   *sync.Mutex
 }
 
+type TunnelTCPConn struct { // for tcp pool connections
+	conn net.Conn
+	ping chan struct{}
+	mu   *sync.Mutex
+}
+
+// take stops the probes of an idle pool connection and waits for one in
+// flight, the connection is the caller's afterwards. A probe that failed
+// closed it, the first write on it fails then.
+func (t TunnelTCPConn) take() net.Conn {
+	close(t.ping)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.conn
+}
+
+// controlIP is the IP of the client holding the control channel, the accept
+// loops read it while a handshake sets it and a restart clears it.
+type controlIP struct {
+	ip atomic.Value // string
+}
+
+func (c *controlIP) set(conn net.Conn) {
+	ip := ""
+	if conn != nil {
+		if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+			ip = addr.IP.String()
+		}
+	}
+	c.ip.Store(ip)
+}
+
+// get returns the IP, empty without a control channel
+func (c *controlIP) get() string {
+	ip, _ := c.ip.Load().(string)
+	return ip
+}
+
 type LocalTCPConn struct {
 	conn       net.Conn
 	remoteAddr string
+	trace      *utils.ConnTrace // nil when tracing is disabled
+	queuedAt   time.Time        // when the connection entered the local channel
 }
 
 type LocalAcceptUDPConn struct {
@@ -43,3 +99,286 @@ type TunnelUDPConn struct {
 	ping        chan struct{}
 	mu          *sync.Mutex //mutex for ping chanel
 }
+
+// heartbeatAcks counts the heartbeats the client has not acknowledged yet. A
+// client that never acknowledged one is not checked, older clients do not echo
+// heartbeats back.
+type heartbeatAcks struct {
+	acked   bool
+	pending int
+}
+
+func (h *heartbeatAcks) sent() {
+	h.pending++
+}
+
+func (h *heartbeatAcks) received() {
+	h.acked = true
+	h.pending = 0
+	web.PublishEvent("heartbeat", web.HeartbeatEvent{Acked: true})
+}
+
+// missed reports whether the last limit heartbeats were not acknowledged
+// within their interval, a limit of 0 disables the check.
+func (h *heartbeatAcks) missed(limit int) bool {
+	if h.acked && h.pending > 0 {
+		web.PublishEvent("heartbeat", web.HeartbeatEvent{Acked: false, Missed: h.pending})
+		utils.StatsdCount("heartbeat.missed", 1)
+	}
+	return limit > 0 && h.acked && h.pending >= limit
+}
+
+// setNoDelay turns Nagle's algorithm off on a TCP connection.
+func setNoDelay(conn net.Conn) {
+	if tcpConn, ok := utils.TCPConn(conn); ok {
+		tcpConn.SetNoDelay(true)
+	}
+}
+
+// sendProxyHeader writes a PROXY protocol v2 header with the IP and port of the
+// user and the custom tlvs to the tunnel when the local port is one of ports.
+// The client forwards it to the backend ahead of the data of the user.
+func sendProxyHeader(tunnel io.Writer, local net.Conn, ports []string, tlvs []proxyTLV) error {
+	port := local.LocalAddr().(*net.TCPAddr).Port
+	if !portAllowed(port, ports) {
+		return nil
+	}
+
+	_, err := tunnel.Write(utils.ProxyHeader(local.RemoteAddr(), local.LocalAddr(), expandProxyTLVs(tlvs, port)...))
+	return err
+}
+
+// proxyTLV is a custom TLV of the PROXY protocol header, its value may hold
+// {label} and {port}, which are filled in per connection.
+type proxyTLV struct {
+	typ   byte
+	value string
+}
+
+// newProxyTLVs parses "type=value" entries, the type in decimal or 0x hex.
+// {transport} in a value is replaced with transport right away, invalid
+// entries are logged and skipped.
+func newProxyTLVs(entries []string, transport string, logger *logrus.Logger) []proxyTLV {
+	var tlvs []proxyTLV
+	for _, entry := range entries {
+		typ, value, ok := strings.Cut(entry, "=")
+		if !ok {
+			logger.Warnf("invalid proxy protocol tlv %q, expected type=value", entry)
+			continue
+		}
+
+		t, err := strconv.ParseUint(strings.TrimSpace(typ), 0, 8)
+		if err != nil || t == 0 {
+			logger.Warnf("invalid proxy protocol tlv type %q, expected 1 to 255, e.g. 0xE0", typ)
+			continue
+		}
+
+		tlvs = append(tlvs, proxyTLV{typ: byte(t), value: strings.ReplaceAll(value, "{transport}", transport)})
+	}
+	return tlvs
+}
+
+// expandProxyTLVs fills in the label and the port of the connection on port,
+// TLVs left empty are not sent.
+func expandProxyTLVs(tlvs []proxyTLV, port int) []utils.ProxyTLV {
+	var expanded []utils.ProxyTLV
+	for _, tlv := range tlvs {
+		value := strings.NewReplacer("{label}", web.PortLabel(port), "{port}", strconv.Itoa(port)).Replace(tlv.value)
+		if value == "" || len(value) > 65535 {
+			continue
+		}
+		expanded = append(expanded, utils.ProxyTLV{Type: tlv.typ, Value: []byte(value)})
+	}
+	return expanded
+}
+
+// portAllowed reports whether port falls into one of the "port" or "start-end"
+// entries of the policy.
+func portAllowed(port int, policy []string) bool {
+	for _, entry := range policy {
+		entry = strings.TrimSpace(entry)
+
+		start, end, isRange := strings.Cut(entry, "-")
+		if !isRange {
+			end = start
+		}
+
+		startPort, err := strconv.Atoi(strings.TrimSpace(start))
+		if err != nil {
+			continue
+		}
+		endPort, err := strconv.Atoi(strings.TrimSpace(end))
+		if err != nil {
+			continue
+		}
+
+		if port >= startPort && port <= endPort {
+			return true
+		}
+	}
+
+	return false
+}
+
+// splitLabel cuts a "#label" suffix off a port mapping. The label names the
+// mapping in metrics, connection logs and the web interface and may only hold
+// letters, digits, '-', '_' and '.'.
+func splitLabel(mapping string) (string, string, error) {
+	mapping, label, found := strings.Cut(mapping, "#")
+	if !found {
+		return mapping, "", nil
+	}
+
+	label = strings.TrimSpace(label)
+	if label == "" {
+		return mapping, "", fmt.Errorf("empty label")
+	}
+	for _, r := range label {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '-' && r != '_' && r != '.' {
+			return mapping, "", fmt.Errorf("invalid character %q in label %q", r, label)
+		}
+	}
+
+	return mapping, label, nil
+}
+
+// labelPorts attaches label to the local ports of mapping, a single port or a
+// "start-end" range with an optional bind IP and protocol suffix. Invalid
+// ports are left to the mapping parser to report.
+func labelPorts(mapping string, label string) {
+	startPort, endPort, ok := localPorts(mapping)
+	if !ok {
+		return
+	}
+
+	for port := startPort; port <= endPort; port++ {
+		web.SetPortLabel(port, label)
+	}
+}
+
+// localPorts returns the local ports of mapping, ok is false when they are
+// not a valid port or range.
+func localPorts(mapping string) (int, int, bool) {
+	local, _, _ := strings.Cut(mapping, "=")
+	local, _, _ = strings.Cut(local, "/")
+	if i := strings.LastIndex(local, ":"); i >= 0 {
+		local = local[i+1:]
+	}
+
+	start, end, isRange := strings.Cut(strings.TrimSpace(local), "-")
+	if !isRange {
+		end = start
+	}
+
+	startPort, err := strconv.Atoi(strings.TrimSpace(start))
+	if err != nil {
+		return 0, 0, false
+	}
+	endPort, err := strconv.Atoi(strings.TrimSpace(end))
+	if err != nil || endPort > 65535 {
+		return 0, 0, false
+	}
+
+	return startPort, endPort, true
+}
+
+// limitPortMappings keeps the leading mappings that open at most max
+// listeners on top of the used ones, a port range opens one per port. The
+// mappings past the limit are dropped with an error naming the first of them,
+// so a huge range cannot exhaust the file descriptors. A max of 0 keeps every
+// mapping.
+func limitPortMappings(mappings []string, max int, used int) ([]string, int, *StartError) {
+	if max <= 0 {
+		return mappings, used, nil
+	}
+
+	for i, mapping := range mappings {
+		listeners := 1
+		if mapping, _, err := splitLabel(mapping); err == nil {
+			if startPort, endPort, ok := localPorts(mapping); ok && endPort > startPort {
+				listeners = endPort - startPort + 1
+			}
+		}
+
+		if used+listeners > max {
+			err := fmt.Errorf("exceeds max_port_mappings of %d listeners, %d more port mappings follow it", max, len(mappings)-i-1)
+			return mappings[:i], used, &StartError{Op: "open port mapping", Addr: mapping, Err: err}
+		}
+		used += listeners
+	}
+
+	return mappings, used, nil
+}
+
+// localKeepAlive is the keep-alive period of the listeners of local
+// connections, the Go default unless keep-alive is disabled by a negative
+// keep-alive period of the tunnel.
+func localKeepAlive(tunnelKeepAlive time.Duration) time.Duration {
+	if tunnelKeepAlive < 0 {
+		return -1
+	}
+	return 0
+}
+
+// bindAddrs splits a comma separated bind_addr into the tunnel listen addresses.
+func bindAddrs(bindAddr string) []string {
+	var addrs []string
+	for _, addr := range strings.Split(bindAddr, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+
+	return addrs
+}
+
+// dropTracker remembers the client of the control channel dropped last, so a
+// handshake from the same client right after the restart can be held back and
+// rapid reconnections of a restarting client coalesce into one handshake.
+type dropTracker struct {
+	mu sync.Mutex
+	ip string
+	at time.Time // end of the restart that followed the drop
+}
+
+// record remembers the client of a control channel being dropped.
+func (d *dropTracker) record(addr net.Addr) {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.ip = tcpAddr.IP.String()
+	d.at = time.Time{}
+}
+
+// settle marks the end of the teardown of the dropped control channel.
+func (d *dropTracker) settle() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.ip != "" {
+		d.at = time.Now()
+	}
+}
+
+// delay returns how long a handshake from addr has to wait for the window
+// following the teardown to pass, it is 0 for other clients.
+func (d *dropTracker) delay(addr net.Addr, window time.Duration) time.Duration {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok || window <= 0 {
+		return 0
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.at.IsZero() || d.ip != tcpAddr.IP.String() {
+		return 0
+	}
+
+	return window - time.Since(d.at)
+}
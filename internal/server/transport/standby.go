@@ -0,0 +1,39 @@
+package transport
+
+import (
+	"context"
+
+	"github.com/gorilla/websocket"
+)
+
+// controlRead is a message or the read error of a control channel connection.
+type controlRead struct {
+	conn *websocket.Conn
+	msg  byte
+	err  error
+}
+
+// readControl forwards the messages of a control channel connection to reads
+// until it fails or ctx is done. Reads of the control channel and of the
+// standby one share reads, conn tells them apart.
+func readControl(ctx context.Context, conn *websocket.Conn, reads chan<- controlRead) {
+	for {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			select {
+			case reads <- controlRead{conn: conn, err: err}:
+			case <-ctx.Done():
+			}
+			return
+		}
+		if len(msg) == 0 {
+			continue
+		}
+
+		select {
+		case reads <- controlRead{conn: conn, msg: msg[0]}:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -2,6 +2,7 @@ package transport
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"runtime"
@@ -22,31 +23,96 @@ type TcpTransport struct {
 	ctx            context.Context
 	cancel         context.CancelFunc
 	logger         *logrus.Logger
-	tunnelChannel  chan net.Conn
+	tunnelChannel  chan TunnelTCPConn
 	localChannel   chan LocalTCPConn
 	reqNewConnChan chan struct{}
 	controlChannel net.Conn
+	controlIP      controlIP // IP of the control channel for the accept loop
 	restartMutex   sync.Mutex
+	lastDrop       dropTracker // client of the last dropped control channel
 	usageMonitor   *web.Usage
-	rtt            int64 // in ms, for UDP
+	queueStats     *web.QueueStats
+	listeners      *portListeners
+	targets        *targetOverrides
+	proxyTLVs      []proxyTLV
+	localLimit     *channelLimit
+	fairQueue      *fairQueue
+	bans           *banList
+	sessions       *sessionRegistry
+	rtt            int64    // in ms, for UDP
+	clientPorts    []string // port mappings requested by the client during the handshake
+	hostRouter     *hostRouter
+	geoRouter      *geoRouter
+	startErrs      startErrors
+	connLimit      *connLimit
+	lifetime       *connLifetime
+	backpressure   *backpressure
 }
 
 type TcpConfig struct {
-	BindAddr     string
-	Token        string
-	SnifferLog   string
-	TunnelStatus string
-	Ports        []string
-	Nodelay      bool
-	Sniffer      bool
-	KeepAlive    time.Duration
-	Heartbeat    time.Duration // in seconds
-	ChannelSize  int
-	WebPort      int
-	AcceptUDP    bool
+	BindAddr         string
+	Token            string
+	MaxTokenLength   int
+	SnifferLog       string
+	TunnelStatus     string
+	Ports            []string
+	Nodelay          bool
+	LocalNodelay     bool // Nodelay of the sockets facing the users
+	Sniffer          bool
+	KeepAlive        time.Duration
+	Heartbeat        time.Duration // in seconds
+	ChannelSize      int
+	WebPort          int
+	SnifferMaxPorts  int
+	SnifferRetention time.Duration
+	AcceptUDP        bool
+	PoolKeepalive    time.Duration // Interval of the probes the client has to answer on idle pool connections, 0 disables them
+	ClientPorts      []string      // Local ports the client is allowed to register mappings on
+	MSSClamp         int           // TCP_MAXSEG for local connections, 0 disables clamping
+	ReadDeadline     time.Duration // Bound on a single read in the copy loop, 0 disables it
+	WriteDeadline    time.Duration // Bound on a single write in the copy loop, 0 disables it
+	QueueThreshold   time.Duration // Warn when a connection waits longer in the local channel, 0 disables it
+	HandshakeDelay   time.Duration // Delay for a handshake from the client whose control channel was just dropped
+	ProbeTimeout     time.Duration // Close handshakes that send nothing for this long, 0 waits the full handshake timeout
+	HTTPPorts        []string      // Local ports whose plain HTTP connections are routed by Host header
+	HTTPHosts        []string      // "host=target" rules for HTTPPorts, other hosts use the port mapping target
+	HeartbeatMisses  int           // Unacknowledged heartbeats in a row before restarting, 0 disables the check
+	ChannelSizeMax   int           // Ceiling the local channel limit grows to when it fills up, 0 keeps ChannelSize fixed
+	GeoIPDB          string        // MaxMind database used to pick the target by source country, empty disables it
+	GeoIPTargets     []string      // "CC=host" or "CC=host:port" rules, other countries use the port mapping target
+	GeoIPAllow       []string      // Countries admitted on the tunnel and local listeners, empty admits all but the denied ones
+	GeoIPDeny        []string      // Countries refused on the tunnel and local listeners, failed lookups are admitted
+	GeoIPLog         bool          // Log the country of every tunnel and local connection
+	BanAfter         int           // Failed handshakes before the client IP is banned, 0 disables banning
+	BanTime          time.Duration // How long a ban lasts, failures are counted within the same window
+	SessionTTL       time.Duration // How long the session of a client is kept after its control channel dropped, 0 disables sessions
+	SessionPinning   bool          // Refuse a known client ID from another IP than its session started from
+	LowLatencyPorts  []string      // Local ports whose connections skip Nagle on both sockets even without Nodelay
+	ProxyProtocol    []string      // Local ports whose backends get a PROXY protocol v2 header with the user IP and port
+	ProxyTLVs        []string      // Custom TLVs of the PROXY protocol header as "type=value", with {label}, {port} and {transport} filled in
+	PrefacePorts     []string      // Local ports whose backends are Backhaul servers that get a preface with the user and the transport
+	PrefaceAccept    []string      // Local ports that strip the preface of an upstream Backhaul and take its user as the source
+	Backpressure     bool          // Tell the client to hold back tunnel connections while the tunnel channel is full
+	MaxConns         int           // Local connections in flight across all ports, more are closed at accept, 0 disables the cap
+	RejectHTTPPorts  []string      // Local ports answered with an HTTP 503 beyond MaxConns instead of a bare close
+	RejectRetryAfter int           // Seconds in the Retry-After header of that 503, 0 leaves the header out
+	Encryption       bool          // Encrypt tunnel connections with keys derived from the token, the client has to enable it as well
+	MaxPortMappings  int           // Listeners the port mappings may open, a range counts every port, the rest are refused, 0 disables the cap
+	PortWeights      []string      // "port=weight" or "start-end=weight", local connections are handed out in weighted round robin across ports, others weigh 1
+	MaxLifetime      time.Duration // Forwarded connections are closed after this long whatever their activity, 0 is unlimited
+	LifetimePorts    []string      // "port=seconds" or "start-end=seconds", overrides MaxLifetime for these local ports
 }
 
-func NewTCPServer(parentCtx context.Context, config *TcpConfig, logger *logrus.Logger) *TcpTransport {
+func NewTCPServer(parentCtx context.Context, config *TcpConfig, logger *logrus.Logger) (*TcpTransport, error) {
+	hostRouter, err := newHostRouter(config.HTTPPorts, config.HTTPHosts, logger)
+	if err != nil {
+		return nil, err
+	}
+	geoRouter, err := newGeoRouter(config.GeoIPDB, config.GeoIPTargets, config.GeoIPAllow, config.GeoIPDeny, config.GeoIPLog, logger)
+	if err != nil {
+		return nil, err
+	}
+
 	// Create a derived context from the parent context
 	ctx, cancel := context.WithCancel(parentCtx)
 
@@ -57,15 +123,39 @@ func NewTCPServer(parentCtx context.Context, config *TcpConfig, logger *logrus.L
 		ctx:            ctx,
 		cancel:         cancel,
 		logger:         logger,
-		tunnelChannel:  make(chan net.Conn, config.ChannelSize),
-		localChannel:   make(chan LocalTCPConn, config.ChannelSize),
-		reqNewConnChan: make(chan struct{}, config.ChannelSize),
+		tunnelChannel:  make(chan TunnelTCPConn, channelCapacity(config.ChannelSize, config.ChannelSizeMax)),
+		localChannel:   make(chan LocalTCPConn, channelCapacity(config.ChannelSize, config.ChannelSizeMax)),
+		reqNewConnChan: make(chan struct{}, channelCapacity(config.ChannelSize, config.ChannelSizeMax)),
 		controlChannel: nil, // will be set when a control connection is established
-		usageMonitor:   web.NewDataStore(fmt.Sprintf(":%v", config.WebPort), ctx, config.SnifferLog, config.Sniffer, &config.TunnelStatus, logger),
+		usageMonitor:   web.NewDataStore(fmt.Sprintf(":%v", config.WebPort), ctx, config.SnifferLog, config.Sniffer, &config.TunnelStatus, logger, config.SnifferMaxPorts, config.SnifferRetention),
+		queueStats:     web.NewQueueStats(config.QueueThreshold, logger),
+		localLimit:     newChannelLimit(config.ChannelSize, config.ChannelSizeMax, logger),
+		fairQueue:      newFairQueue(config.PortWeights, logger),
+		bans:           newBanList(config.BanAfter, config.BanTime, logger),
+		sessions:       newSessionRegistry(config.SessionTTL, config.SessionPinning),
 		rtt:            0,
+		hostRouter:     hostRouter,
+		geoRouter:      geoRouter,
+		startErrs:      newStartErrors(),
+		connLimit:      newConnLimit(config.MaxConns, config.RejectHTTPPorts, config.RejectRetryAfter),
+		lifetime:       newConnLifetime(config.MaxLifetime, config.LifetimePorts, logger),
+		backpressure:   newBackpressure(config.Backpressure),
 	}
 
-	return server
+	server.usageMonitor.SetQueueStats(server.queueStats)
+	server.targets = newTargetOverrides()
+	server.proxyTLVs = newProxyTLVs(config.ProxyTLVs, "tcp", logger)
+	server.listeners = newPortListeners()
+	server.usageMonitor.SetDrainer(server.listeners.drain)
+	server.usageMonitor.SetTargeter(server.targets.set)
+
+	return server, nil
+}
+
+// Errors reports the listeners the transport failed to set up, for as long as
+// it runs. A failed listener is not retried until the next restart.
+func (s *TcpTransport) Errors() <-chan error {
+	return s.startErrs
 }
 
 func (s *TcpTransport) Start() {
@@ -76,6 +166,8 @@ func (s *TcpTransport) Start() {
 	}
 
 	go s.tunnelListener()
+	go s.localLimit.shrink(s.ctx)
+	go s.fairQueue.run(s.ctx, s.localChannel)
 
 	s.channelHandshake()
 
@@ -88,6 +180,7 @@ func (s *TcpTransport) Start() {
 		}
 
 		go s.parsePortMappings()
+		go s.parseClientPortMappings()
 		go s.channelHandler()
 
 		s.logger.Infof("starting %d handle loops on each CPU thread", numCPU)
@@ -98,6 +191,11 @@ func (s *TcpTransport) Start() {
 	}
 }
 func (s *TcpTransport) Restart() {
+	// Nothing to restart once the tunnel is shutting down, e.g. for a config reload
+	if s.parentctx.Err() != nil {
+		return
+	}
+
 	if !s.restartMutex.TryLock() {
 		s.logger.Warn("server restart already in progress, skipping restart attempt")
 		return
@@ -105,37 +203,62 @@ func (s *TcpTransport) Restart() {
 	defer s.restartMutex.Unlock()
 
 	s.logger.Info("restarting server...")
+	utils.CountRestart()
 
 	// for removing timeout logs
 	level := s.logger.Level
 	s.logger.SetLevel(logrus.FatalLevel)
 
+	// Stop accepting first, users are refused rather than failing mid setup
+	s.listeners.closeAll()
+
 	if s.cancel != nil {
 		s.cancel()
 	}
 
 	// Close open connection
 	if s.controlChannel != nil {
+		s.lastDrop.record(s.controlChannel.RemoteAddr())
+		s.sessions.release()
 		s.controlChannel.Close()
 	}
 
-	time.Sleep(2 * time.Second)
+	// Listen again as soon as the tunnel port is released
+	utils.WaitReleased("tcp", bindAddrs(s.config.BindAddr), restartRelease)
+
+	// Nothing serves the connections still queued anymore
+	rejected := rejectQueued(s.localChannel)
 
 	ctx, cancel := context.WithCancel(s.parentctx)
 	s.ctx = ctx
 	s.cancel = cancel
 
 	// Re-initialize variables
-	s.tunnelChannel = make(chan net.Conn, s.config.ChannelSize)
-	s.localChannel = make(chan LocalTCPConn, s.config.ChannelSize)
-	s.reqNewConnChan = make(chan struct{}, s.config.ChannelSize)
-	s.usageMonitor = web.NewDataStore(fmt.Sprintf(":%v", s.config.WebPort), ctx, s.config.SnifferLog, s.config.Sniffer, &s.config.TunnelStatus, s.logger)
+	s.tunnelChannel = make(chan TunnelTCPConn, channelCapacity(s.config.ChannelSize, s.config.ChannelSizeMax))
+	s.localChannel = make(chan LocalTCPConn, channelCapacity(s.config.ChannelSize, s.config.ChannelSizeMax))
+	s.reqNewConnChan = make(chan struct{}, channelCapacity(s.config.ChannelSize, s.config.ChannelSizeMax))
+	s.usageMonitor = web.NewDataStore(fmt.Sprintf(":%v", s.config.WebPort), ctx, s.config.SnifferLog, s.config.Sniffer, &s.config.TunnelStatus, s.logger, s.config.SnifferMaxPorts, s.config.SnifferRetention)
+	s.usageMonitor.SetQueueStats(s.queueStats)
+	s.listeners = newPortListeners()
+	s.usageMonitor.SetDrainer(s.listeners.drain)
+	s.usageMonitor.SetTargeter(s.targets.set)
 	s.config.TunnelStatus = ""
 	s.controlChannel = nil
+	s.controlIP.set(nil)
 
 	// set the log level again
 	s.logger.SetLevel(level)
 
+	if rejected > 0 {
+		s.logger.Infof("closed %d local connections queued during the restart", rejected)
+	}
+
+	s.lastDrop.settle()
+
+	if s.parentctx.Err() != nil {
+		return
+	}
+
 	go s.Start()
 }
 
@@ -144,16 +267,25 @@ func (s *TcpTransport) channelHandshake() {
 		select {
 		case <-s.ctx.Done():
 			return
-		case conn := <-s.tunnelChannel:
-			// Set a read deadline for the token response
-			if err := conn.SetReadDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		case tunnelConn := <-s.tunnelChannel:
+			conn := tunnelConn.conn
+
+			if s.bans.banned(conn.RemoteAddr().String()) {
+				s.logger.Debugf("refusing handshake from banned %s", conn.RemoteAddr().String())
+				conn.Close()
+				continue
+			}
+
+			// Set a read deadline for the token response, a shorter one for the first bytes with a probe timeout
+			handshake, err := handshakeDeadline(conn, 2*time.Second, s.config.ProbeTimeout)
+			if err != nil {
 				s.logger.Errorf("failed to set read deadline: %v", err)
 				conn.Close()
 				continue
 			}
 
-			msg, transport, err := utils.ReceiveBinaryTransportString(conn)
-			if transport != utils.SG_Chan {
+			hello, err := utils.ReceiveHandshake(handshake)
+			if hello.Signal != utils.SG_Chan && hello.Signal != utils.SG_Ports {
 				s.logger.Errorf("invalid signal received for channel, Discarding connection")
 				conn.Close()
 				continue
@@ -170,22 +302,59 @@ func (s *TcpTransport) channelHandshake() {
 			// Resetting the deadline (removes any existing deadline)
 			conn.SetReadDeadline(time.Time{})
 
-			if msg != s.config.Token {
-				s.logger.Warnf("invalid security token received: %s", msg)
+			if !utils.ValidToken(hello.Token, s.config.Token, s.config.MaxTokenLength) {
+				s.logger.Warnf("invalid security token received from %s", conn.RemoteAddr().String())
+				s.bans.fail(conn.RemoteAddr().String())
 				conn.Close()
 				continue
 			}
+			s.bans.succeed(conn.RemoteAddr().String())
+
+			// The resumption token of the last handshake answer proves the client held the last control channel of its session
+			redeemed := s.sessions.redeem(hello.ClientID, hello.Resume)
 
-			err = utils.SendBinaryTransportString(conn, s.config.Token, utils.SG_Chan)
+			// Hold back a client reconnecting right after its control channel was dropped, unless it resumes with a token
+			if wait := s.lastDrop.delay(conn.RemoteAddr(), s.config.HandshakeDelay); wait > 0 && !redeemed {
+				s.logger.Debugf("delaying handshake from %s by %v", conn.RemoteAddr().String(), wait)
+				time.Sleep(wait)
+			}
+
+			// A returning client resumes its session, with pinning only from the IP it started on or with a token when the tunnel is encrypted
+			if !s.sessions.resume(hello.ClientID, conn.RemoteAddr(), redeemed && s.config.Encryption, s.logger) {
+				conn.Close()
+				continue
+			}
+
+			// Answer in the framing of the client, or the newest one this server speaks
+			version := min(hello.Version, utils.HandshakeVersion)
+			err = utils.SendHandshake(conn, utils.Handshake{Token: s.config.Token, Signal: utils.SG_Chan, Version: version, Resume: s.sessions.issue(hello.ClientID)})
 			if err != nil {
 				s.logger.Errorf("failed to send security token: %v", err)
 				conn.Close()
 				continue
 			}
+			web.SetNegotiated("handshake", fmt.Sprintf("v%d", version))
+
+			// The client may follow the token with the port mappings it wants exposed
+			s.clientPorts = nil
+			if hello.Signal == utils.SG_Ports {
+				conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+				mappings, err := utils.ReceiveBinaryString(conn)
+				if err != nil {
+					s.logger.Errorf("failed to receive client port mappings: %v", err)
+					conn.Close()
+					continue
+				}
+				conn.SetReadDeadline(time.Time{})
+
+				s.clientPorts = strings.Split(mappings, ",")
+			}
 
 			s.controlChannel = conn
+			s.controlIP.set(conn)
 
 			s.logger.Info("control channel successfully established.")
+			utils.MarkReady(s.ctx)
 			return
 		}
 	}
@@ -195,6 +364,9 @@ func (s *TcpTransport) channelHandler() {
 	ticker := time.NewTicker(s.config.Heartbeat)
 	defer ticker.Stop()
 
+	// Heartbeats echoed back by the client
+	var acks heartbeatAcks
+
 	// Channel to receive the message or error
 	messageChan := make(chan byte, 1)
 
@@ -232,6 +404,17 @@ func (s *TcpTransport) channelHandler() {
 			_ = utils.SendBinaryByte(s.controlChannel, utils.SG_Closed)
 			return
 
+		case <-s.backpressure.signals():
+			if !s.backpressure.due() {
+				continue
+			}
+			if err := utils.SendBinaryByte(s.controlChannel, utils.SG_Busy); err != nil {
+				s.logger.Error("failed to send tunnel channel full signal. ", err)
+				go s.Restart()
+				return
+			}
+			s.logger.Debug("tunnel channel is full, signaled the client to hold back new tunnel connections")
+
 		case <-s.reqNewConnChan:
 			err := utils.SendBinaryByte(s.controlChannel, utils.SG_Chan)
 			if err != nil {
@@ -241,12 +424,19 @@ func (s *TcpTransport) channelHandler() {
 			}
 
 		case <-ticker.C:
+			if acks.missed(s.config.HeartbeatMisses) {
+				s.logger.Errorf("client did not acknowledge the last %d heartbeats, attempting to restart server...", acks.pending)
+				go s.Restart()
+				return
+			}
+
 			err := utils.SendBinaryByte(s.controlChannel, utils.SG_HB)
 			if err != nil {
 				s.logger.Error("failed to send heartbeat signal")
 				go s.Restart()
 				return
 			}
+			acks.sent()
 			s.logger.Trace("heartbeat signal sent successfully")
 
 		case message, ok := <-messageChan:
@@ -260,6 +450,10 @@ func (s *TcpTransport) channelHandler() {
 				go s.Restart()
 				return
 
+			} else if message == utils.SG_HB {
+				acks.received()
+				s.logger.Trace("heartbeat acknowledgment received")
+
 			} else if message == utils.SG_RTT {
 				measureRTT := time.Since(rtt)
 				s.rtt = measureRTT.Milliseconds()
@@ -269,18 +463,22 @@ func (s *TcpTransport) channelHandler() {
 	}
 }
 
+// tunnelListener listens on every bind address, the control channel and the
+// tunnel connections may arrive on any of them.
 func (s *TcpTransport) tunnelListener() {
-	listener, err := net.Listen("tcp", s.config.BindAddr)
-	if err != nil {
-		s.logger.Fatalf("failed to start listener on %s: %v", s.config.BindAddr, err)
-		return
-	}
+	for _, addr := range bindAddrs(s.config.BindAddr) {
+		listener, err := utils.Listen(s.ctx, &net.ListenConfig{}, addr)
+		if err != nil {
+			s.startErrs.report(s.logger, "listen on", addr, err)
+			return
+		}
 
-	defer listener.Close()
+		defer listener.Close()
 
-	s.logger.Infof("server started successfully, listening on address: %s", listener.Addr().String())
+		s.logger.Infof("server started successfully, listening on address: %s", listener.Addr().String())
 
-	go s.acceptTunnelConn(listener)
+		go s.acceptTunnelConn(listener)
+	}
 
 	<-s.ctx.Done()
 }
@@ -298,6 +496,9 @@ func (s *TcpTransport) acceptTunnelConn(listener net.Listener) {
 				continue
 			}
 
+			utils.SetCongestionControl(conn)
+			utils.SetSocketBuffers(conn)
+
 			//discard any non tcp connection
 			tcpConn, ok := conn.(*net.TCPConn)
 			if !ok {
@@ -306,9 +507,21 @@ func (s *TcpTransport) acceptTunnelConn(listener net.Listener) {
 				continue
 			}
 
+			// The country policy applies before the handshake
+			if !s.geoRouter.admit(tcpConn.RemoteAddr(), listener.Addr(), s.logger) {
+				tcpConn.Close()
+				continue
+			}
+
+			// An accept filter registered through the library can refuse the connection
+			if !utils.AcceptAllowed(utils.AcceptedConn{Tunnel: true, Transport: "tcp", RemoteAddr: tcpConn.RemoteAddr(), LocalAddr: tcpConn.LocalAddr()}, s.logger) {
+				tcpConn.Close()
+				continue
+			}
+
 			// Drop all suspicious packets from other address rather than server
-			if s.controlChannel != nil && s.controlChannel.RemoteAddr().(*net.TCPAddr).IP.String() != tcpConn.RemoteAddr().(*net.TCPAddr).IP.String() {
-				s.logger.Debugf("suspicious packet from %v. expected address: %v. discarding packet...", tcpConn.RemoteAddr().(*net.TCPAddr).IP.String(), s.controlChannel.RemoteAddr().(*net.TCPAddr).IP.String())
+			if ip := s.controlIP.get(); ip != "" && ip != tcpConn.RemoteAddr().(*net.TCPAddr).IP.String() {
+				s.logger.Debugf("suspicious packet from %v. expected address: %v. discarding packet...", tcpConn.RemoteAddr().(*net.TCPAddr).IP.String(), ip)
 				tcpConn.Close()
 				continue
 			}
@@ -322,20 +535,35 @@ func (s *TcpTransport) acceptTunnelConn(listener net.Listener) {
 				}
 			}
 
-			// Set keep-alive settings
-			if err := tcpConn.SetKeepAlive(true); err != nil {
-				s.logger.Warnf("failed to enable TCP keep-alive for %s: %v", tcpConn.RemoteAddr().String(), err)
+			// Set keep-alive settings, a negative period disables keep-alive
+			if err := tcpConn.SetKeepAliveConfig(utils.KeepAliveConfig(s.config.KeepAlive)); err != nil {
+				s.logger.Warnf("failed to set TCP keep-alive for %s: %v", tcpConn.RemoteAddr().String(), err)
+			} else if s.config.KeepAlive < 0 {
+				s.logger.Tracef("TCP keep-alive disabled for %s", tcpConn.RemoteAddr().String())
 			} else {
 				s.logger.Tracef("TCP keep-alive enabled for %s", tcpConn.RemoteAddr().String())
 			}
-			if err := tcpConn.SetKeepAlivePeriod(s.config.KeepAlive); err != nil {
-				s.logger.Warnf("failed to set TCP keep-alive period for %s: %v", tcpConn.RemoteAddr().String(), err)
+
+			// The key exchange runs on the first read or write, the accept loop never waits for it
+			if s.config.Encryption {
+				conn = utils.EncryptConn(conn, s.config.Token, false)
+			}
+
+			tunnelConn := TunnelTCPConn{
+				conn: conn,
+				ping: make(chan struct{}),
+				mu:   &sync.Mutex{},
 			}
 
 			select {
-			case s.tunnelChannel <- conn:
+			case s.tunnelChannel <- tunnelConn:
+				// Only idle pool connections are probed, not the control channel candidate
+				if s.controlIP.get() != "" && s.config.PoolKeepalive > 0 {
+					go s.keepAlive(&tunnelConn)
+				}
 			default: // The channel is full, do nothing
 				s.logger.Warnf("tunnel listener channel is full, discarding TCP connection from %s", conn.LocalAddr().String())
+				s.backpressure.discarded()
 				conn.Close()
 			}
 		}
@@ -343,9 +571,30 @@ func (s *TcpTransport) acceptTunnelConn(listener net.Listener) {
 }
 
 func (s *TcpTransport) parsePortMappings() {
-	for _, portMapping := range s.config.Ports {
+	ports, _, err := limitPortMappings(s.config.Ports, s.config.MaxPortMappings, 0)
+	if err != nil {
+		s.startErrs.send(s.logger, err)
+	}
+
+	for _, portMapping := range ports {
+		// A "#label" suffix names the mapping in metrics, logs and the web interface
+		portMapping, label, err := splitLabel(portMapping)
+		if err != nil {
+			s.startErrs.report(s.logger, "parse port mapping", portMapping, err)
+			continue
+		}
+		labelPorts(portMapping, label)
+
 		parts := strings.Split(portMapping, "=")
 
+		// A "/tcp" or "/udp" suffix on the local side limits the mapping to one protocol
+		localPart, protocol, err := splitProtocol(parts[0])
+		if err != nil {
+			s.startErrs.report(s.logger, "parse port mapping", portMapping, err)
+			continue
+		}
+		parts[0] = localPart
+
 		var localAddr, remoteAddr string
 
 		// Check if only a single port or a port range is provided (no "=" present)
@@ -357,32 +606,36 @@ func (s *TcpTransport) parsePortMappings() {
 			if strings.Contains(localPortOrRange, "-") {
 				rangeParts := strings.Split(localPortOrRange, "-")
 				if len(rangeParts) != 2 {
-					s.logger.Fatalf("invalid port range format: %s", localPortOrRange)
+					s.startErrs.report(s.logger, "parse port mapping", portMapping, fmt.Errorf("invalid port range format: %s", localPortOrRange))
+					continue
 				}
 
 				// Parse and validate start and end ports
 				startPort, err := strconv.Atoi(strings.TrimSpace(rangeParts[0]))
 				if err != nil || startPort < 1 || startPort > 65535 {
-					s.logger.Fatalf("invalid start port in range: %s", rangeParts[0])
+					s.startErrs.report(s.logger, "parse port mapping", portMapping, fmt.Errorf("invalid start port in range: %s", rangeParts[0]))
+					continue
 				}
 
 				endPort, err := strconv.Atoi(strings.TrimSpace(rangeParts[1]))
 				if err != nil || endPort < 1 || endPort > 65535 || endPort < startPort {
-					s.logger.Fatalf("invalid end port in range: %s", rangeParts[1])
+					s.startErrs.report(s.logger, "parse port mapping", portMapping, fmt.Errorf("invalid end port in range: %s", rangeParts[1]))
+					continue
 				}
 
 				// Create listeners for all ports in the range
 				for port := startPort; port <= endPort; port++ {
 					localAddr = fmt.Sprintf(":%d", port)
-					go s.startListeners(localAddr, strconv.Itoa(port)) // Use port as the remoteAddr
-					time.Sleep(1 * time.Millisecond)                   // for wide port ranges
+					go s.startListeners(localAddr, strconv.Itoa(port), protocol) // Use port as the remoteAddr
+					time.Sleep(1 * time.Millisecond)                             // for wide port ranges
 				}
 				continue
 			} else {
 				// Handle single port case
 				port, err := strconv.Atoi(localPortOrRange)
 				if err != nil || port < 1 || port > 65535 {
-					s.logger.Fatalf("invalid port format: %s", localPortOrRange)
+					s.startErrs.report(s.logger, "parse port mapping", portMapping, fmt.Errorf("invalid port format: %s", localPortOrRange))
+					continue
 				}
 				localAddr = fmt.Sprintf(":%d", port)
 			}
@@ -395,24 +648,27 @@ func (s *TcpTransport) parsePortMappings() {
 			if strings.Contains(localPortOrRange, "-") {
 				rangeParts := strings.Split(localPortOrRange, "-")
 				if len(rangeParts) != 2 {
-					s.logger.Fatalf("invalid port range format: %s", localPortOrRange)
+					s.startErrs.report(s.logger, "parse port mapping", portMapping, fmt.Errorf("invalid port range format: %s", localPortOrRange))
+					continue
 				}
 
 				// Parse and validate start and end ports
 				startPort, err := strconv.Atoi(strings.TrimSpace(rangeParts[0]))
 				if err != nil || startPort < 1 || startPort > 65535 {
-					s.logger.Fatalf("invalid start port in range: %s", rangeParts[0])
+					s.startErrs.report(s.logger, "parse port mapping", portMapping, fmt.Errorf("invalid start port in range: %s", rangeParts[0]))
+					continue
 				}
 
 				endPort, err := strconv.Atoi(strings.TrimSpace(rangeParts[1]))
 				if err != nil || endPort < 1 || endPort > 65535 || endPort < startPort {
-					s.logger.Fatalf("invalid end port in range: %s", rangeParts[1])
+					s.startErrs.report(s.logger, "parse port mapping", portMapping, fmt.Errorf("invalid end port in range: %s", rangeParts[1]))
+					continue
 				}
 
 				// Create listeners for all ports in the range
 				for port := startPort; port <= endPort; port++ {
 					localAddr = fmt.Sprintf(":%d", port)
-					go s.startListeners(localAddr, remoteAddr)
+					go s.startListeners(localAddr, remoteAddr, protocol)
 					time.Sleep(1 * time.Millisecond) // for wide port ranges
 				}
 				continue
@@ -426,19 +682,97 @@ func (s *TcpTransport) parsePortMappings() {
 				}
 			}
 		} else {
-			s.logger.Fatalf("invalid port mapping format: %s", portMapping)
+			s.startErrs.report(s.logger, "parse port mapping", portMapping, fmt.Errorf("invalid port mapping format: %s", portMapping))
+			continue
 		}
 		// Start listeners for single port
-		go s.startListeners(localAddr, remoteAddr)
+		go s.startListeners(localAddr, remoteAddr, protocol)
 	}
 }
 
-func (s *TcpTransport) startListeners(localAddr, remoteAddr string) {
+func (s *TcpTransport) parseClientPortMappings() {
+	if len(s.clientPorts) == 0 {
+		return
+	}
+
+	if len(s.config.ClientPorts) == 0 {
+		s.logger.Warnf("client requested %d port mappings but client_ports is not configured, ignoring them", len(s.clientPorts))
+		return
+	}
+
+	// The client mappings share max_port_mappings with the configured ones
+	_, used, _ := limitPortMappings(s.config.Ports, s.config.MaxPortMappings, 0)
+	clientPorts, _, err := limitPortMappings(s.clientPorts, s.config.MaxPortMappings, used)
+	if err != nil {
+		s.logger.Error(err)
+	}
+
+	for _, portMapping := range clientPorts {
+		portMapping, label, err := splitLabel(portMapping)
+		if err != nil {
+			s.logger.Errorf("invalid client port mapping %s: %v", portMapping, err)
+			continue
+		}
+
+		parts := strings.Split(portMapping, "=")
+		if len(parts) > 2 {
+			s.logger.Errorf("invalid client port mapping format: %s", portMapping)
+			continue
+		}
+
+		localPort := strings.TrimSpace(parts[0])
+		remoteAddr := localPort // If no remote addr is provided, use the local port as the remote port
+		if len(parts) == 2 {
+			remoteAddr = strings.TrimSpace(parts[1])
+		}
+
+		port, err := strconv.Atoi(localPort)
+		if err != nil || port < 1 || port > 65535 {
+			s.logger.Errorf("invalid port in client port mapping: %s", portMapping)
+			continue
+		}
+
+		if !portAllowed(port, s.config.ClientPorts) {
+			s.logger.Warnf("client port mapping %s is not allowed by client_ports, ignoring it", portMapping)
+			continue
+		}
+
+		web.SetPortLabel(port, label)
+		go s.clientListener(fmt.Sprintf(":%d", port), remoteAddr)
+	}
+}
+
+// splitProtocol cuts a "/tcp" or "/udp" suffix off the local side of a port
+// mapping, the protocol is empty when there is none.
+func splitProtocol(local string) (string, string, error) {
+	local, protocol, found := strings.Cut(strings.TrimSpace(local), "/")
+	if !found {
+		return local, "", nil
+	}
+
+	protocol = strings.ToLower(strings.TrimSpace(protocol))
+	if protocol != "tcp" && protocol != "udp" {
+		return "", "", fmt.Errorf("unknown protocol %q, expected tcp or udp", protocol)
+	}
+	return strings.TrimSpace(local), protocol, nil
+}
+
+// startListeners listens on localAddr for protocol, or for TCP and for UDP
+// when accept_udp is set if the mapping names no protocol.
+func (s *TcpTransport) startListeners(localAddr, remoteAddr, protocol string) {
+	// A missing capability only skips this mapping, the other listeners keep working
+	if err := utils.CheckBindPermission(localAddr); err != nil {
+		s.logger.Errorf("skipping listener on %s: %v", localAddr, err)
+		return
+	}
+
 	// Start TCP listener
-	go s.localListener(localAddr, remoteAddr)
+	if protocol != "udp" {
+		go s.localListener(localAddr, remoteAddr)
+	}
 
 	// Start UDP listener if configured
-	if s.config.AcceptUDP {
+	if protocol == "udp" || (protocol == "" && s.config.AcceptUDP) {
 		go s.udpListener(localAddr, remoteAddr)
 	}
 
@@ -446,19 +780,47 @@ func (s *TcpTransport) startListeners(localAddr, remoteAddr string) {
 }
 
 func (s *TcpTransport) localListener(localAddr string, remoteAddr string) {
-	listener, err := net.Listen("tcp", localAddr)
+	listener, err := utils.Listen(s.ctx, &net.ListenConfig{Control: utils.MSSControl(s.config.MSSClamp, s.logger), KeepAlive: localKeepAlive(s.config.KeepAlive)}, localAddr)
 	if err != nil {
-		s.logger.Fatalf("failed to listen on %s: %v", localAddr, err)
+		s.startErrs.report(s.logger, "listen on", localAddr, err)
 		return
 	}
 
 	defer listener.Close()
 
+	// The port is drained on its own, other listeners keep running
+	ctx := s.listeners.add(s.ctx, listener)
+
 	s.logger.Infof("listener started successfully, listening on address: %s", listener.Addr().String())
 
 	go s.acceptLocalConn(listener, remoteAddr)
 
-	<-s.ctx.Done()
+	<-ctx.Done()
+}
+
+// clientListener is like localListener but for client requested mappings, a failure
+// to listen must not take the whole server down.
+func (s *TcpTransport) clientListener(localAddr string, remoteAddr string) {
+	if err := utils.CheckBindPermission(localAddr); err != nil {
+		s.logger.Errorf("failed to listen on %s for client port mapping: %v", localAddr, err)
+		return
+	}
+
+	listener, err := utils.Listen(s.ctx, &net.ListenConfig{Control: utils.MSSControl(s.config.MSSClamp, s.logger), KeepAlive: localKeepAlive(s.config.KeepAlive)}, localAddr)
+	if err != nil {
+		s.logger.Errorf("failed to listen on %s for client port mapping: %v", localAddr, err)
+		return
+	}
+
+	defer listener.Close()
+
+	ctx := s.listeners.add(s.ctx, listener)
+
+	s.logger.Infof("client port mapping started successfully, listening on address: %s, forwarding to %s", listener.Addr().String(), remoteAddr)
+
+	go s.acceptLocalConn(listener, remoteAddr)
+
+	<-ctx.Done()
 }
 
 func (s *TcpTransport) acceptLocalConn(listener net.Listener, remoteAddr string) {
@@ -470,11 +832,17 @@ func (s *TcpTransport) acceptLocalConn(listener net.Listener, remoteAddr string)
 		default:
 			s.logger.Debugf("waiting for accept incoming connection on %s", listener.Addr().String())
 			conn, err := listener.Accept()
+			if errors.Is(err, net.ErrClosed) {
+				return // the port was drained or the transport stopped
+			}
 			if err != nil {
 				s.logger.Debugf("failed to accept connection on %s: %v", listener.Addr().String(), err)
 				continue
 			}
 
+			utils.SetCongestionControl(conn)
+			utils.SetSocketBuffers(conn)
+
 			// discard any non-tcp connection
 			tcpConn, ok := conn.(*net.TCPConn)
 			if !ok {
@@ -483,49 +851,114 @@ func (s *TcpTransport) acceptLocalConn(listener net.Listener, remoteAddr string)
 				continue
 			}
 
+			// The country policy applies before the connection is queued
+			if !s.geoRouter.admit(tcpConn.RemoteAddr(), listener.Addr(), s.logger) {
+				tcpConn.Close()
+				continue
+			}
+
+			// An accept filter registered through the library can refuse the connection
+			if !utils.AcceptAllowed(utils.AcceptedConn{Tunnel: false, Transport: "tcp", RemoteAddr: tcpConn.RemoteAddr(), LocalAddr: tcpConn.LocalAddr()}, s.logger) {
+				tcpConn.Close()
+				continue
+			}
+
+			// Under overload new connections are refused, the ones in flight keep going
+			if utils.Overloaded() {
+				s.logger.Debugf("overloaded, closing connection from %s", tcpConn.RemoteAddr().String())
+				s.connLimit.reject(tcpConn)
+				s.backpressure.discarded()
+				continue
+			}
+
+			// Beyond the cap on connections in flight the connection is closed before it costs anything
+			if conn, ok = s.connLimit.track(tcpConn); !ok {
+				s.logger.Debugf("%d local connections in flight, closing connection from %s", s.config.MaxConns, tcpConn.RemoteAddr().String())
+				s.connLimit.reject(tcpConn)
+				continue
+			}
+
 			// trying to disable tcpnodelay
-			if !s.config.Nodelay {
-				if err := tcpConn.SetNoDelay(s.config.Nodelay); err != nil {
+			if !s.config.LocalNodelay {
+				if err := tcpConn.SetNoDelay(s.config.LocalNodelay); err != nil {
 					s.logger.Warnf("failed to set TCP_NODELAY for %s: %v", tcpConn.RemoteAddr().String(), err)
 				} else {
 					s.logger.Tracef("TCP_NODELAY disabled for %s", tcpConn.RemoteAddr().String())
 				}
 			}
 
-			select {
-			case s.localChannel <- LocalTCPConn{conn: conn, remoteAddr: remoteAddr}:
-
-				select {
-				case s.reqNewConnChan <- struct{}{}:
-					// Successfully requested a new connection
-				default:
-					// The channel is full, do nothing
-					s.logger.Warn("channel is full, cannot request a new connection")
-				}
+			// The nearest backend for the source, host rules may still override it
+			remoteAddr := s.geoRouter.target(tcpConn.RemoteAddr(), remoteAddr, s.logger)
 
-				s.logger.Debugf("accepted incoming TCP connection from %s", tcpConn.RemoteAddr().String())
+			port := tcpConn.LocalAddr().(*net.TCPAddr).Port
 
-			default: // channel is full, discard the connection
-				s.logger.Warnf("channel with listener %s is full, discarding TCP connection from %s", listener.Addr().String(), tcpConn.LocalAddr().String())
-				conn.Close()
+			// Reading the preface or the Host header must not hold up the accept loop
+			if portAllowed(port, s.config.PrefaceAccept) || s.hostRouter.enabled(port) {
+				go func() {
+					if portAllowed(port, s.config.PrefaceAccept) {
+						conn = readPreface(conn, s.logger)
+					}
+					if s.hostRouter.enabled(port) {
+						conn, remoteAddr = s.hostRouter.route(conn, remoteAddr, s.logger)
+					}
+					s.queueLocalConn(listener, conn, remoteAddr)
+				}()
+				continue
 			}
+
+			s.queueLocalConn(listener, conn, remoteAddr)
 		}
 	}
 }
 
+func (s *TcpTransport) queueLocalConn(listener net.Listener, conn net.Conn, remoteAddr string) {
+	// A target override of the port wins over the mapping and the routing rules
+	remoteAddr = s.targets.target(conn.LocalAddr().(*net.TCPAddr).Port, remoteAddr)
+
+	localConn := LocalTCPConn{conn: conn, remoteAddr: remoteAddr, trace: utils.StartConnTrace(s.ctx, conn.LocalAddr().(*net.TCPAddr).Port, remoteAddr), queuedAt: time.Now()}
+
+	// The connections held by the fair queue are still queued. A nil channel is
+	// never ready, the connection is discarded as on a full channel
+	localChannel := s.localChannel
+	if queued := s.fairQueue.queued(localChannel); queued >= cap(localChannel) || !s.localLimit.allow(queued) {
+		localChannel = nil
+	}
+
+	select {
+	case localChannel <- localConn:
+
+		select {
+		case s.reqNewConnChan <- struct{}{}:
+			// Successfully requested a new connection
+		default:
+			// The channel is full, do nothing
+			s.logger.Warn("channel is full, cannot request a new connection")
+		}
+
+		s.logger.Debugf("accepted incoming TCP connection from %s", conn.RemoteAddr().String())
+
+	default: // channel is full, discard the connection
+		s.logger.Warnf("channel with listener %s is full, discarding TCP connection from %s", listener.Addr().String(), conn.LocalAddr().String())
+		conn.Close()
+		localConn.trace.Fail(errLocalChannelFull)
+	}
+}
+
 func (s *TcpTransport) handleLoop() {
 	for {
 		select {
 		case <-s.ctx.Done():
 			return
-		case localConn := <-s.localChannel:
+		case localConn := <-s.fairQueue.next(s.localChannel):
 		loop:
 			for {
 				select {
 				case <-s.ctx.Done():
 					return
 
-				case tunnelConn := <-s.tunnelChannel:
+				case tunnelConnection := <-s.tunnelChannel:
+					tunnelConn := tunnelConnection.take()
+
 					// Send the target addr over the connection
 					if err := utils.SendBinaryTransportString(tunnelConn, localConn.remoteAddr, utils.SG_TCP); err != nil {
 						s.logger.Errorf("%v", err)
@@ -533,8 +966,31 @@ func (s *TcpTransport) handleLoop() {
 						continue loop
 					}
 
+					if err := sendPreface(tunnelConn, localConn.conn, s.config.PrefacePorts, "tcp"); err != nil {
+						s.logger.Errorf("failed to send preface: %v", err)
+						tunnelConn.Close()
+						continue loop
+					}
+
+					if err := sendProxyHeader(tunnelConn, localConn.conn, s.config.ProxyProtocol, s.proxyTLVs); err != nil {
+						s.logger.Errorf("failed to send PROXY protocol header: %v", err)
+						tunnelConn.Close()
+						continue loop
+					}
+
+					localConn.trace.Event("tunnel connection assigned")
+
+					// Interactive traffic, e.g. SSH, should not wait for small writes to be coalesced
+					if (!s.config.Nodelay || !s.config.LocalNodelay) && portAllowed(localConn.conn.LocalAddr().(*net.TCPAddr).Port, s.config.LowLatencyPorts) {
+						setNoDelay(tunnelConn)
+						setNoDelay(localConn.conn)
+					}
+
+					// The connection waits in the queue until a tunnel connection is available
+					s.queueStats.Observe(time.Since(localConn.queuedAt))
+
 					// Handle data exchange between connections
-					go utils.TCPConnectionHandler(localConn.conn, tunnelConn, s.logger, s.usageMonitor, localConn.conn.LocalAddr().(*net.TCPAddr).Port, s.config.Sniffer)
+					go utils.TCPConnectionHandler(localConn.conn, tunnelConn, s.logger, s.usageMonitor, localConn.conn.LocalAddr().(*net.TCPAddr).Port, localConn.remoteAddr, s.config.Sniffer, localConn.trace, utils.OpDeadlines{Read: s.config.ReadDeadline, Write: s.config.WriteDeadline, Lifetime: s.lifetime.of(localConn.conn.LocalAddr().(*net.TCPAddr).Port)})
 					break loop
 
 				}
@@ -542,3 +998,71 @@ func (s *TcpTransport) handleLoop() {
 		}
 	}
 }
+
+// poolProbeTimeout is how long the client has at most to answer a probe
+const poolProbeTimeout = 3 * time.Second
+
+// keepAlive probes an idle pool connection every PoolKeepalive until the
+// handle loop takes it. The client has to answer every probe, a half-open
+// connection still takes writes but stays silent, it is closed then for the
+// client to replace it.
+func (s *TcpTransport) keepAlive(conn *TunnelTCPConn) {
+	ticker := time.NewTicker(s.config.PoolKeepalive)
+	defer ticker.Stop()
+
+	timeout := min(poolProbeTimeout, s.config.PoolKeepalive)
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			conn.conn.Close()
+			return
+		case <-conn.ping:
+			s.logger.Trace("ping channel closed")
+			return
+		case <-ticker.C:
+			// The handle loop holds the lock once it took the connection
+			if !conn.mu.TryLock() {
+				s.logger.Trace("write operation in progress, stopping pingSender")
+				return
+			}
+
+			// It may have been taken between the tick and the lock
+			select {
+			case <-conn.ping:
+				conn.mu.Unlock()
+				return
+			default:
+			}
+
+			if err := s.probe(conn.conn, timeout); err != nil {
+				s.logger.Debugf("idle pool connection %s did not answer the probe, replacing it: %v", conn.conn.RemoteAddr().String(), err)
+				conn.conn.Close()
+				conn.mu.Unlock()
+				return
+			}
+			conn.mu.Unlock()
+			s.logger.Trace("probe answered on the pool connection")
+		}
+	}
+}
+
+// probe pings a pool connection and waits up to timeout for the client to
+// answer it, clients answer pings that carry a payload.
+func (s *TcpTransport) probe(conn net.Conn, timeout time.Duration) error {
+	if err := utils.SendBinaryTransportString(conn, "probe", utils.SG_Ping); err != nil {
+		return err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	_, transport, err := utils.ReceiveBinaryTransportString(conn)
+	if err != nil {
+		return err
+	}
+	if transport != utils.SG_Ping {
+		return fmt.Errorf("unexpected signal %d in reply to the probe", transport)
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/musix/backhaul/internal/web"
+)
+
+// freePort returns a port nothing listens on for TCP or UDP right now.
+func freePort(t *testing.T) int {
+	t.Helper()
+
+	for i := 0; i < 10; i++ {
+		listener, err := net.Listen("tcp", ":0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		port := listener.Addr().(*net.TCPAddr).Port
+		listener.Close()
+
+		if conn, err := net.ListenPacket("udp", fmt.Sprintf(":%d", port)); err == nil {
+			conn.Close()
+			return port
+		}
+	}
+	t.Fatal("no free port")
+	return 0
+}
+
+// bound reports whether something listens on port for network.
+func bound(network string, port int) bool {
+	addr := fmt.Sprintf(":%d", port)
+	if network == "udp" {
+		conn, err := net.ListenPacket(network, addr)
+		if err != nil {
+			return true
+		}
+		conn.Close()
+		return false
+	}
+
+	listener, err := net.Listen(network, addr)
+	if err != nil {
+		return true
+	}
+	listener.Close()
+	return false
+}
+
+func waitBound(t *testing.T, network string, port int) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !bound(network, port) {
+		if time.Now().After(deadline) {
+			t.Fatalf("nothing listens on %s port %d", network, port)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestParsePortMappings(t *testing.T) {
+	tcpPort, udpPort, bothPort := freePort(t), freePort(t), freePort(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	config := &TcpConfig{
+		Ports: []string{
+			fmt.Sprintf("%d/tcp=127.0.0.1:9#web", tcpPort),
+			fmt.Sprintf("%d/udp=127.0.0.1:9 # dns", udpPort),
+			fmt.Sprintf("%d=127.0.0.1:9", bothPort),
+			"7000/sctp=127.0.0.1:9",
+			"7001=127.0.0.1:9#bad label",
+		},
+		AcceptUDP: true,
+	}
+	server, err := NewTCPServer(ctx, config, quietLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server.parsePortMappings()
+
+	waitBound(t, "tcp", tcpPort)
+	waitBound(t, "udp", udpPort)
+	waitBound(t, "tcp", bothPort)
+	waitBound(t, "udp", bothPort)
+
+	if bound("udp", tcpPort) {
+		t.Errorf("a /tcp mapping listens for UDP on port %d", tcpPort)
+	}
+	if bound("tcp", udpPort) {
+		t.Errorf("a /udp mapping listens for TCP on port %d", udpPort)
+	}
+
+	if label := web.PortLabel(tcpPort); label != "web" {
+		t.Errorf("port %d has label %q, want %q", tcpPort, label, "web")
+	}
+	if label := web.PortLabel(udpPort); label != "dns" {
+		t.Errorf("port %d has label %q, want %q", udpPort, label, "dns")
+	}
+	if label := web.PortLabel(bothPort); label != "" {
+		t.Errorf("port %d has label %q, want none", bothPort, label)
+	}
+
+	// The invalid protocol and label are reported, not listened on
+	for _, mapping := range []string{"7000/sctp=127.0.0.1:9", "7001=127.0.0.1:9"} {
+		select {
+		case err := <-server.Errors():
+			var startErr *StartError
+			if !errors.As(err, &startErr) || startErr.Addr != mapping {
+				t.Errorf("reported %v, want a parse error of %s", err, mapping)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("no error reported for %s", mapping)
+		}
+	}
+}
+
+func TestSplitProtocol(t *testing.T) {
+	tests := []struct {
+		local    string
+		want     string
+		protocol string
+		err      bool
+	}{
+		{"8080", "8080", "", false},
+		{"8080/tcp", "8080", "tcp", false},
+		{" 8080 / UDP ", "8080", "udp", false},
+		{"127.0.0.1:8080/udp", "127.0.0.1:8080", "udp", false},
+		{"1000-2000/tcp", "1000-2000", "tcp", false},
+		{"8080/sctp", "", "", true},
+	}
+
+	for _, tt := range tests {
+		local, protocol, err := splitProtocol(tt.local)
+		if (err != nil) != tt.err || local != tt.want || protocol != tt.protocol {
+			t.Errorf("splitProtocol(%q) = %q, %q, %v, want %q, %q, error %v", tt.local, local, protocol, err, tt.want, tt.protocol, tt.err)
+		}
+	}
+}
+
+func TestSplitLabel(t *testing.T) {
+	tests := []struct {
+		mapping string
+		want    string
+		label   string
+		err     bool
+	}{
+		{"8080=127.0.0.1:80", "8080=127.0.0.1:80", "", false},
+		{"8080=127.0.0.1:80#web", "8080=127.0.0.1:80", "web", false},
+		{"8080/udp=127.0.0.1:53 # dns-1.a_b", "8080/udp=127.0.0.1:53 ", "dns-1.a_b", false},
+		{"8080=127.0.0.1:80#", "", "", true},
+		{"8080=127.0.0.1:80#a b", "", "", true},
+		{"8080=127.0.0.1:80#a/b", "", "", true},
+	}
+
+	for _, tt := range tests {
+		mapping, label, err := splitLabel(tt.mapping)
+		if (err != nil) != tt.err || (!tt.err && (mapping != tt.want || label != tt.label)) {
+			t.Errorf("splitLabel(%q) = %q, %q, %v, want %q, %q, error %v", tt.mapping, mapping, label, err, tt.want, tt.label, tt.err)
+		}
+	}
+}
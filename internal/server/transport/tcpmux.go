@@ -2,6 +2,7 @@ package transport
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"runtime"
@@ -28,12 +29,32 @@ type TcpMuxTransport struct {
 	tunnelChannel    chan *smux.Session
 	handshakeChannel chan net.Conn
 	localChannel     chan LocalTCPConn
+	retryChannel     chan LocalTCPConn // local connections put back after a failed stream, served first
 	reqNewConnChan   chan struct{}
 	controlChannel   net.Conn
+	controlIP        controlIP // IP of the control channel for the accept loop
 	usageMonitor     *web.Usage
+	queueStats       *web.QueueStats
+	listeners        *portListeners
+	targets          *targetOverrides
+	proxyTLVs        []proxyTLV
+	localLimit       *channelLimit
+	fairQueue        *fairQueue
+	bans             *banList
+	sessions         *sessionRegistry
 	restartMutex     sync.Mutex
+	lastDrop         dropTracker // client of the last dropped control channel
 	streamCounter    int32
 	sessionCounter   int32
+	rotateMutex      sync.Mutex
+	rotateChan       chan struct{} // closed to rotate the active mux sessions
+	streamOrder      *streamOrder
+	hostRouter       *hostRouter
+	geoRouter        *geoRouter
+	startErrs        startErrors
+	connLimit        *connLimit
+	lifetime         *connLifetime
+	backpressure     *backpressure
 }
 
 type TcpMuxConfig struct {
@@ -41,8 +62,10 @@ type TcpMuxConfig struct {
 	TunnelStatus     string
 	SnifferLog       string
 	Token            string
+	MaxTokenLength   int
 	Ports            []string
 	Nodelay          bool
+	LocalNodelay     bool // Nodelay of the sockets facing the users
 	Sniffer          bool
 	ChannelSize      int
 	MuxCon           int
@@ -51,12 +74,60 @@ type TcpMuxConfig struct {
 	MaxReceiveBuffer int
 	MaxStreamBuffer  int
 	WebPort          int
+	SnifferMaxPorts  int
+	SnifferRetention time.Duration
 	KeepAlive        time.Duration
 	Heartbeat        time.Duration // in seconds
-
+	MSSClamp         int           // TCP_MAXSEG for local connections, 0 disables clamping
+	ReadDeadline     time.Duration // Bound on a single read in the copy loop, 0 disables it
+	WriteDeadline    time.Duration // Bound on a single write in the copy loop, 0 disables it
+	QueueThreshold   time.Duration // Warn when a connection waits longer in the local channel, 0 disables it
+	HandshakeDelay   time.Duration // Delay for a handshake from the client whose control channel was just dropped
+	ProbeTimeout     time.Duration // Close handshakes that send nothing for this long, 0 waits the full handshake timeout
+	HTTPPorts        []string      // Local ports whose plain HTTP connections are routed by Host header
+	HTTPHosts        []string      // "host=target" rules for HTTPPorts, other hosts use the port mapping target
+	HeartbeatMisses  int           // Unacknowledged heartbeats in a row before restarting, 0 disables the check
+	ChannelSizeMax   int           // Ceiling the local channel limit grows to when it fills up, 0 keeps ChannelSize fixed
+	GeoIPDB          string        // MaxMind database used to pick the target by source country, empty disables it
+	GeoIPTargets     []string      // "CC=host" or "CC=host:port" rules, other countries use the port mapping target
+	GeoIPAllow       []string      // Countries admitted on the tunnel and local listeners, empty admits all but the denied ones
+	GeoIPDeny        []string      // Countries refused on the tunnel and local listeners, failed lookups are admitted
+	GeoIPLog         bool          // Log the country of every tunnel and local connection
+	BanAfter         int           // Failed handshakes before the client IP is banned, 0 disables banning
+	BanTime          time.Duration // How long a ban lasts, failures are counted within the same window
+	SessionTTL       time.Duration // How long the session of a client is kept after its control channel dropped, 0 disables sessions
+	SessionPinning   bool          // Refuse a known client ID from another IP than its session started from
+	LowLatencyPorts  []string      // Local ports whose connections skip Nagle, the shared tunnel connections then skip it too
+	ProxyProtocol    []string      // Local ports whose backends get a PROXY protocol v2 header with the user IP and port
+	ProxyTLVs        []string      // Custom TLVs of the PROXY protocol header as "type=value", with {label}, {port} and {transport} filled in
+	PrefacePorts     []string      // Local ports whose backends are Backhaul servers that get a preface with the user and the transport
+	PrefaceAccept    []string      // Local ports that strip the preface of an upstream Backhaul and take its user as the source
+	SessionIdle      time.Duration // Close mux sessions without streams for this long, 0 keeps them open
+	SessionIdleMin   int           // Sessions kept open however idle they are
+	OrderedStreams   bool          // Take local connections and open their streams one session at a time, in accept order
+	MaxStreams       int           // Streams alive at once on one session, at least MuxCon
+	SessionStreams   int           // Streams opened on a session before it is rotated, 0 never rotates it
+	Backpressure     bool          // Tell the client to hold back tunnel connections while the tunnel channel is full
+	MaxConns         int           // Local connections in flight across all ports, more are closed at accept, 0 disables the cap
+	RejectHTTPPorts  []string      // Local ports answered with an HTTP 503 beyond MaxConns instead of a bare close
+	RejectRetryAfter int           // Seconds in the Retry-After header of that 503, 0 leaves the header out
+	Encryption       bool          // Encrypt tunnel connections with keys derived from the token, the client has to enable it as well
+	MaxPortMappings  int           // Listeners the port mappings may open, a range counts every port, the rest are refused, 0 disables the cap
+	PortWeights      []string      // "port=weight" or "start-end=weight", local connections are handed out in weighted round robin across ports, others weigh 1
+	MaxLifetime      time.Duration // Forwarded connections are closed after this long whatever their activity, 0 is unlimited
+	LifetimePorts    []string      // "port=seconds" or "start-end=seconds", overrides MaxLifetime for these local ports
 }
 
-func NewTcpMuxServer(parentCtx context.Context, config *TcpMuxConfig, logger *logrus.Logger) *TcpMuxTransport {
+func NewTcpMuxServer(parentCtx context.Context, config *TcpMuxConfig, logger *logrus.Logger) (*TcpMuxTransport, error) {
+	hostRouter, err := newHostRouter(config.HTTPPorts, config.HTTPHosts, logger)
+	if err != nil {
+		return nil, err
+	}
+	geoRouter, err := newGeoRouter(config.GeoIPDB, config.GeoIPTargets, config.GeoIPAllow, config.GeoIPDeny, config.GeoIPLog, logger)
+	if err != nil {
+		return nil, err
+	}
+
 	// Create a derived context from the parent context
 	ctx, cancel := context.WithCancel(parentCtx)
 
@@ -75,17 +146,50 @@ func NewTcpMuxServer(parentCtx context.Context, config *TcpMuxConfig, logger *lo
 		ctx:              ctx,
 		cancel:           cancel,
 		logger:           logger,
-		tunnelChannel:    make(chan *smux.Session, config.ChannelSize),
+		tunnelChannel:    make(chan *smux.Session, channelCapacity(config.ChannelSize, config.ChannelSizeMax)),
 		handshakeChannel: make(chan net.Conn),
-		localChannel:     make(chan LocalTCPConn, config.ChannelSize),
-		reqNewConnChan:   make(chan struct{}, config.ChannelSize),
+		localChannel:     make(chan LocalTCPConn, channelCapacity(config.ChannelSize, config.ChannelSizeMax)),
+		retryChannel:     make(chan LocalTCPConn, channelCapacity(config.ChannelSize, config.ChannelSizeMax)),
+		reqNewConnChan:   make(chan struct{}, channelCapacity(config.ChannelSize, config.ChannelSizeMax)),
 		controlChannel:   nil, // will be set when a control connection is established
 		streamCounter:    0,
 		sessionCounter:   0,
-		usageMonitor:     web.NewDataStore(fmt.Sprintf(":%v", config.WebPort), ctx, config.SnifferLog, config.Sniffer, &config.TunnelStatus, logger),
+		rotateChan:       make(chan struct{}),
+		streamOrder:      newStreamOrder(config.OrderedStreams),
+		usageMonitor:     web.NewDataStore(fmt.Sprintf(":%v", config.WebPort), ctx, config.SnifferLog, config.Sniffer, &config.TunnelStatus, logger, config.SnifferMaxPorts, config.SnifferRetention),
+		queueStats:       web.NewQueueStats(config.QueueThreshold, logger),
+		localLimit:       newChannelLimit(config.ChannelSize, config.ChannelSizeMax, logger),
+		fairQueue:        newFairQueue(config.PortWeights, logger),
+		bans:             newBanList(config.BanAfter, config.BanTime, logger),
+		sessions:         newSessionRegistry(config.SessionTTL, config.SessionPinning),
+		hostRouter:       hostRouter,
+		geoRouter:        geoRouter,
+		startErrs:        newStartErrors(),
+		connLimit:        newConnLimit(config.MaxConns, config.RejectHTTPPorts, config.RejectRetryAfter),
+		lifetime:         newConnLifetime(config.MaxLifetime, config.LifetimePorts, logger),
+		backpressure:     newBackpressure(config.Backpressure),
+	}
+
+	server.usageMonitor.SetQueueStats(server.queueStats)
+	server.targets = newTargetOverrides()
+	server.proxyTLVs = newProxyTLVs(config.ProxyTLVs, "tcpmux", logger)
+	server.listeners = newPortListeners()
+	server.usageMonitor.SetDrainer(server.listeners.drain)
+	server.usageMonitor.SetTargeter(server.targets.set)
+
+	// The session would fail on every connection with an invalid configuration
+	if err := smux.VerifyConfig(server.smuxConfig); err != nil {
+		cancel()
+		return nil, fmt.Errorf("invalid mux configuration: %w", err)
 	}
 
-	return server
+	return server, nil
+}
+
+// Errors reports the listeners the transport failed to set up, for as long as
+// it runs. A failed listener is not retried until the next restart.
+func (s *TcpMuxTransport) Errors() <-chan error {
+	return s.startErrs
 }
 
 func (s *TcpMuxTransport) Start() {
@@ -95,6 +199,8 @@ func (s *TcpMuxTransport) Start() {
 	s.config.TunnelStatus = "Disconnected (TCPMux)"
 
 	go s.tunnelListener()
+	go s.localLimit.shrink(s.ctx)
+	go s.fairQueue.run(s.ctx, s.localChannel)
 
 	s.channelHandshake()
 
@@ -119,6 +225,11 @@ func (s *TcpMuxTransport) Start() {
 
 }
 func (s *TcpMuxTransport) Restart() {
+	// Nothing to restart once the tunnel is shutting down, e.g. for a config reload
+	if s.parentctx.Err() != nil {
+		return
+	}
+
 	if !s.restartMutex.TryLock() {
 		s.logger.Warn("server restart already in progress, skipping restart attempt")
 		return
@@ -126,6 +237,11 @@ func (s *TcpMuxTransport) Restart() {
 	defer s.restartMutex.Unlock()
 
 	s.logger.Info("restarting server...")
+	utils.CountRestart()
+
+	// Stop accepting first, users are refused rather than failing mid setup
+	s.listeners.closeAll()
+
 	if s.cancel != nil {
 		s.cancel()
 	}
@@ -136,22 +252,34 @@ func (s *TcpMuxTransport) Restart() {
 
 	// Close any open connections in the tunnel channel.
 	if s.controlChannel != nil {
+		s.lastDrop.record(s.controlChannel.RemoteAddr())
+		s.sessions.release()
 		s.controlChannel.Close()
 	}
 
-	time.Sleep(2 * time.Second)
+	// Listen again as soon as the tunnel port is released
+	utils.WaitReleased("tcp", bindAddrs(s.config.BindAddr), restartRelease)
+
+	// Nothing serves the connections still queued anymore
+	rejected := rejectQueued(s.localChannel, s.retryChannel)
 
 	ctx, cancel := context.WithCancel(s.parentctx)
 	s.ctx = ctx
 	s.cancel = cancel
 
 	// Re-initialize variables
-	s.tunnelChannel = make(chan *smux.Session, s.config.ChannelSize)
-	s.localChannel = make(chan LocalTCPConn, s.config.ChannelSize)
-	s.reqNewConnChan = make(chan struct{}, s.config.ChannelSize)
+	s.tunnelChannel = make(chan *smux.Session, channelCapacity(s.config.ChannelSize, s.config.ChannelSizeMax))
+	s.localChannel = make(chan LocalTCPConn, channelCapacity(s.config.ChannelSize, s.config.ChannelSizeMax))
+	s.retryChannel = make(chan LocalTCPConn, channelCapacity(s.config.ChannelSize, s.config.ChannelSizeMax))
+	s.reqNewConnChan = make(chan struct{}, channelCapacity(s.config.ChannelSize, s.config.ChannelSizeMax))
 	s.handshakeChannel = make(chan net.Conn)
 	s.controlChannel = nil
-	s.usageMonitor = web.NewDataStore(fmt.Sprintf(":%v", s.config.WebPort), ctx, s.config.SnifferLog, s.config.Sniffer, &s.config.TunnelStatus, s.logger)
+	s.controlIP.set(nil)
+	s.usageMonitor = web.NewDataStore(fmt.Sprintf(":%v", s.config.WebPort), ctx, s.config.SnifferLog, s.config.Sniffer, &s.config.TunnelStatus, s.logger, s.config.SnifferMaxPorts, s.config.SnifferRetention)
+	s.usageMonitor.SetQueueStats(s.queueStats)
+	s.listeners = newPortListeners()
+	s.usageMonitor.SetDrainer(s.listeners.drain)
+	s.usageMonitor.SetTargeter(s.targets.set)
 	s.config.TunnelStatus = ""
 	s.streamCounter = 0
 	s.sessionCounter = 0
@@ -159,6 +287,16 @@ func (s *TcpMuxTransport) Restart() {
 	// set the log level again
 	s.logger.SetLevel(level)
 
+	if rejected > 0 {
+		s.logger.Infof("closed %d local connections queued during the restart", rejected)
+	}
+
+	s.lastDrop.settle()
+
+	if s.parentctx.Err() != nil {
+		return
+	}
+
 	go s.Start()
 }
 
@@ -168,14 +306,21 @@ func (s *TcpMuxTransport) channelHandshake() {
 		case <-s.ctx.Done():
 			return
 		case conn := <-s.handshakeChannel:
-			// Set a read deadline for the token response
-			if err := conn.SetReadDeadline(time.Now().Add(2 * time.Second)); err != nil {
+			if s.bans.banned(conn.RemoteAddr().String()) {
+				s.logger.Debugf("refusing handshake from banned %s", conn.RemoteAddr().String())
+				conn.Close()
+				continue
+			}
+
+			// Set a read deadline for the token response, a shorter one for the first bytes with a probe timeout
+			handshake, err := handshakeDeadline(conn, 2*time.Second, s.config.ProbeTimeout)
+			if err != nil {
 				s.logger.Errorf("failed to set read deadline: %v", err)
 				conn.Close()
 				continue
 			}
-			msg, transport, err := utils.ReceiveBinaryTransportString(conn)
-			if transport != utils.SG_Chan {
+			hello, err := utils.ReceiveHandshake(handshake)
+			if hello.Signal != utils.SG_Chan {
 				s.logger.Errorf("invalid signal received for channel, Discarding connection")
 				conn.Close()
 				continue
@@ -192,22 +337,44 @@ func (s *TcpMuxTransport) channelHandshake() {
 			// Resetting the deadline (removes any existing deadline)
 			conn.SetReadDeadline(time.Time{})
 
-			if msg != s.config.Token {
-				s.logger.Warnf("invalid security token received: %s", msg)
+			if !utils.ValidToken(hello.Token, s.config.Token, s.config.MaxTokenLength) {
+				s.logger.Warnf("invalid security token received from %s", conn.RemoteAddr().String())
+				s.bans.fail(conn.RemoteAddr().String())
 				conn.Close()
 				continue
 			}
+			s.bans.succeed(conn.RemoteAddr().String())
 
-			err = utils.SendBinaryTransportString(conn, s.config.Token, utils.SG_Chan)
+			// The resumption token of the last handshake answer proves the client held the last control channel of its session
+			redeemed := s.sessions.redeem(hello.ClientID, hello.Resume)
+
+			// Hold back a client reconnecting right after its control channel was dropped, unless it resumes with a token
+			if wait := s.lastDrop.delay(conn.RemoteAddr(), s.config.HandshakeDelay); wait > 0 && !redeemed {
+				s.logger.Debugf("delaying handshake from %s by %v", conn.RemoteAddr().String(), wait)
+				time.Sleep(wait)
+			}
+
+			// A returning client resumes its session, with pinning only from the IP it started on or with a token when the tunnel is encrypted
+			if !s.sessions.resume(hello.ClientID, conn.RemoteAddr(), redeemed && s.config.Encryption, s.logger) {
+				conn.Close()
+				continue
+			}
+
+			// Answer in the framing of the client, or the newest one this server speaks
+			version := min(hello.Version, utils.HandshakeVersion)
+			err = utils.SendHandshake(conn, utils.Handshake{Token: s.config.Token, Signal: utils.MuxSignal(s.config.MuxVersion), Version: version, Resume: s.sessions.issue(hello.ClientID)})
 			if err != nil {
 				s.logger.Errorf("failed to send security token: %v", err)
 				conn.Close()
 				continue
 			}
+			web.SetNegotiated("handshake", fmt.Sprintf("v%d", version))
 
 			s.controlChannel = conn
+			s.controlIP.set(conn)
 
 			s.logger.Info("control channel successfully established.")
+			utils.MarkReady(s.ctx)
 
 			return
 		}
@@ -218,19 +385,35 @@ func (s *TcpMuxTransport) channelHandler() {
 	ticker := time.NewTicker(s.config.Heartbeat)
 	defer ticker.Stop()
 
+	// Heartbeats echoed back by the client
+	var acks heartbeatAcks
+
 	// Channel to receive the message or error
 	messageChan := make(chan byte, 1)
 
 	go func() {
-		message, err := utils.ReceiveBinaryByte(s.controlChannel)
-		if err != nil {
-			if s.cancel != nil {
-				s.logger.Error("failed to read from channel connection. ", err)
-				go s.Restart()
+		for {
+			select {
+			case <-s.ctx.Done():
+				return
+			default:
+				message, err := utils.ReceiveBinaryByte(s.controlChannel)
+				if err != nil {
+					if s.cancel != nil {
+						s.logger.Error("failed to read from channel connection. ", err)
+						go s.Restart()
+					}
+					return
+				}
+
+				// A client with another mux version tells it right before it drops the channel
+				if version := utils.SignaledMuxVersion(message); version != 0 {
+					s.logger.Error(utils.MuxVersionMismatch("client "+s.controlChannel.RemoteAddr().String(), version, s.config.MuxVersion))
+					continue
+				}
+				messageChan <- message
 			}
-			return
 		}
-		messageChan <- message
 	}()
 
 	for {
@@ -239,6 +422,17 @@ func (s *TcpMuxTransport) channelHandler() {
 			_ = utils.SendBinaryByte(s.controlChannel, utils.SG_Closed)
 			return
 
+		case <-s.backpressure.signals():
+			if !s.backpressure.due() {
+				continue
+			}
+			if err := utils.SendBinaryByte(s.controlChannel, utils.SG_Busy); err != nil {
+				s.logger.Error("failed to send tunnel channel full signal. ", err)
+				go s.Restart()
+				return
+			}
+			s.logger.Debug("tunnel channel is full, signaled the client to hold back new tunnel connections")
+
 		case <-s.reqNewConnChan:
 			err := utils.SendBinaryByte(s.controlChannel, utils.SG_Chan)
 			if err != nil {
@@ -248,12 +442,19 @@ func (s *TcpMuxTransport) channelHandler() {
 			}
 
 		case <-ticker.C:
+			if acks.missed(s.config.HeartbeatMisses) {
+				s.logger.Errorf("client did not acknowledge the last %d heartbeats, attempting to restart server...", acks.pending)
+				go s.Restart()
+				return
+			}
+
 			err := utils.SendBinaryByte(s.controlChannel, utils.SG_HB)
 			if err != nil {
 				s.logger.Error("failed to send heartbeat signal")
 				go s.Restart()
 				return
 			}
+			acks.sent()
 			s.logger.Trace("heartbeat signal sent successfully")
 
 		case message, ok := <-messageChan:
@@ -266,23 +467,31 @@ func (s *TcpMuxTransport) channelHandler() {
 				s.logger.Warn("control channel has been closed by the client")
 				go s.Restart()
 				return
+
+			} else if message == utils.SG_HB {
+				acks.received()
+				s.logger.Trace("heartbeat acknowledgment received")
 			}
 		}
 	}
 }
 
+// tunnelListener listens on every bind address, the control channel and the
+// tunnel connections may arrive on any of them.
 func (s *TcpMuxTransport) tunnelListener() {
-	listener, err := net.Listen("tcp", s.config.BindAddr)
-	if err != nil {
-		s.logger.Fatalf("failed to start listener on %s: %v", s.config.BindAddr, err)
-		return
-	}
+	for _, addr := range bindAddrs(s.config.BindAddr) {
+		listener, err := utils.Listen(s.ctx, &net.ListenConfig{}, addr)
+		if err != nil {
+			s.startErrs.report(s.logger, "listen on", addr, err)
+			return
+		}
 
-	defer listener.Close()
+		defer listener.Close()
 
-	s.logger.Infof("server started successfully, listening on address: %s", listener.Addr().String())
+		s.logger.Infof("server started successfully, listening on address: %s", listener.Addr().String())
 
-	go s.acceptTunnelConn(listener)
+		go s.acceptTunnelConn(listener)
+	}
 
 	<-s.ctx.Done()
 }
@@ -300,6 +509,9 @@ func (s *TcpMuxTransport) acceptTunnelConn(listener net.Listener) {
 				continue
 			}
 
+			utils.SetCongestionControl(conn)
+			utils.SetSocketBuffers(conn)
+
 			//discard any non tcp connection
 			tcpConn, ok := conn.(*net.TCPConn)
 			if !ok {
@@ -308,15 +520,27 @@ func (s *TcpMuxTransport) acceptTunnelConn(listener net.Listener) {
 				continue
 			}
 
+			// The country policy applies before the handshake
+			if !s.geoRouter.admit(tcpConn.RemoteAddr(), listener.Addr(), s.logger) {
+				tcpConn.Close()
+				continue
+			}
+
+			// An accept filter registered through the library can refuse the connection
+			if !utils.AcceptAllowed(utils.AcceptedConn{Tunnel: true, Transport: "tcpmux", RemoteAddr: tcpConn.RemoteAddr(), LocalAddr: tcpConn.LocalAddr()}, s.logger) {
+				tcpConn.Close()
+				continue
+			}
+
 			// Drop all suspicious packets from other address rather than server
-			if s.controlChannel != nil && s.controlChannel.RemoteAddr().(*net.TCPAddr).IP.String() != tcpConn.RemoteAddr().(*net.TCPAddr).IP.String() {
-				s.logger.Debugf("suspicious packet from %v. expected address: %v. discarding packet...", tcpConn.RemoteAddr().(*net.TCPAddr).IP.String(), s.controlChannel.RemoteAddr().(*net.TCPAddr).IP.String())
+			if ip := s.controlIP.get(); ip != "" && ip != tcpConn.RemoteAddr().(*net.TCPAddr).IP.String() {
+				s.logger.Debugf("suspicious packet from %v. expected address: %v. discarding packet...", tcpConn.RemoteAddr().(*net.TCPAddr).IP.String(), ip)
 				tcpConn.Close()
 				continue
 			}
 
-			// trying to set tcpnodelay
-			if !s.config.Nodelay {
+			// trying to set tcpnodelay, streams of every port share the connection so low latency ports need it disabled
+			if !s.config.Nodelay && len(s.config.LowLatencyPorts) == 0 {
 				if err := tcpConn.SetNoDelay(s.config.Nodelay); err != nil {
 					s.logger.Warnf("failed to set TCP_NODELAY for %s: %v", tcpConn.RemoteAddr().String(), err)
 				} else {
@@ -324,18 +548,22 @@ func (s *TcpMuxTransport) acceptTunnelConn(listener net.Listener) {
 				}
 			}
 
-			// Set keep-alive settings
-			if err := tcpConn.SetKeepAlive(true); err != nil {
-				s.logger.Warnf("failed to enable TCP keep-alive for %s: %v", tcpConn.RemoteAddr().String(), err)
+			// Set keep-alive settings, a negative period disables keep-alive
+			if err := tcpConn.SetKeepAliveConfig(utils.KeepAliveConfig(s.config.KeepAlive)); err != nil {
+				s.logger.Warnf("failed to set TCP keep-alive for %s: %v", tcpConn.RemoteAddr().String(), err)
+			} else if s.config.KeepAlive < 0 {
+				s.logger.Tracef("TCP keep-alive disabled for %s", tcpConn.RemoteAddr().String())
 			} else {
 				s.logger.Tracef("TCP keep-alive enabled for %s", tcpConn.RemoteAddr().String())
 			}
-			if err := tcpConn.SetKeepAlivePeriod(s.config.KeepAlive); err != nil {
-				s.logger.Warnf("failed to set TCP keep-alive period for %s: %v", tcpConn.RemoteAddr().String(), err)
+
+			// The key exchange runs on the first read or write, the accept loop never waits for it
+			if s.config.Encryption {
+				conn = utils.EncryptConn(conn, s.config.Token, false)
 			}
 
 			// try to establish a new channel
-			if s.controlChannel == nil {
+			if s.controlIP.get() == "" {
 				s.logger.Info("control channel not found, attempting to establish a new session")
 				select {
 				case s.handshakeChannel <- conn: // ok
@@ -352,11 +580,14 @@ func (s *TcpMuxTransport) acceptTunnelConn(listener net.Listener) {
 				conn.Close()
 				continue
 			}
+			utils.LogMuxSession(session, s.smuxConfig, s.logger)
+			go utils.WatchMuxMismatch(session, s.smuxConfig.Version, s.logger)
 
 			select {
 			case s.tunnelChannel <- session: // ok
 			default:
 				s.logger.Warnf("tunnel listener channel is full, discarding TCP connection from %s", conn.LocalAddr().String())
+				s.backpressure.discarded()
 				session.Close()
 			}
 		}
@@ -365,7 +596,20 @@ func (s *TcpMuxTransport) acceptTunnelConn(listener net.Listener) {
 }
 
 func (s *TcpMuxTransport) parsePortMappings() {
-	for _, portMapping := range s.config.Ports {
+	ports, _, err := limitPortMappings(s.config.Ports, s.config.MaxPortMappings, 0)
+	if err != nil {
+		s.startErrs.send(s.logger, err)
+	}
+
+	for _, portMapping := range ports {
+		// A "#label" suffix names the mapping in metrics, logs and the web interface
+		portMapping, label, err := splitLabel(portMapping)
+		if err != nil {
+			s.startErrs.report(s.logger, "parse port mapping", portMapping, err)
+			continue
+		}
+		labelPorts(portMapping, label)
+
 		parts := strings.Split(portMapping, "=")
 
 		var localAddr, remoteAddr string
@@ -379,18 +623,21 @@ func (s *TcpMuxTransport) parsePortMappings() {
 			if strings.Contains(localPortOrRange, "-") {
 				rangeParts := strings.Split(localPortOrRange, "-")
 				if len(rangeParts) != 2 {
-					s.logger.Fatalf("invalid port range format: %s", localPortOrRange)
+					s.startErrs.report(s.logger, "parse port mapping", portMapping, fmt.Errorf("invalid port range format: %s", localPortOrRange))
+					continue
 				}
 
 				// Parse and validate start and end ports
 				startPort, err := strconv.Atoi(strings.TrimSpace(rangeParts[0]))
 				if err != nil || startPort < 1 || startPort > 65535 {
-					s.logger.Fatalf("invalid start port in range: %s", rangeParts[0])
+					s.startErrs.report(s.logger, "parse port mapping", portMapping, fmt.Errorf("invalid start port in range: %s", rangeParts[0]))
+					continue
 				}
 
 				endPort, err := strconv.Atoi(strings.TrimSpace(rangeParts[1]))
 				if err != nil || endPort < 1 || endPort > 65535 || endPort < startPort {
-					s.logger.Fatalf("invalid end port in range: %s", rangeParts[1])
+					s.startErrs.report(s.logger, "parse port mapping", portMapping, fmt.Errorf("invalid end port in range: %s", rangeParts[1]))
+					continue
 				}
 
 				// Create listeners for all ports in the range
@@ -404,7 +651,8 @@ func (s *TcpMuxTransport) parsePortMappings() {
 				// Handle single port case
 				port, err := strconv.Atoi(localPortOrRange)
 				if err != nil || port < 1 || port > 65535 {
-					s.logger.Fatalf("invalid port format: %s", localPortOrRange)
+					s.startErrs.report(s.logger, "parse port mapping", portMapping, fmt.Errorf("invalid port format: %s", localPortOrRange))
+					continue
 				}
 				localAddr = fmt.Sprintf(":%d", port)
 			}
@@ -417,18 +665,21 @@ func (s *TcpMuxTransport) parsePortMappings() {
 			if strings.Contains(localPortOrRange, "-") {
 				rangeParts := strings.Split(localPortOrRange, "-")
 				if len(rangeParts) != 2 {
-					s.logger.Fatalf("invalid port range format: %s", localPortOrRange)
+					s.startErrs.report(s.logger, "parse port mapping", portMapping, fmt.Errorf("invalid port range format: %s", localPortOrRange))
+					continue
 				}
 
 				// Parse and validate start and end ports
 				startPort, err := strconv.Atoi(strings.TrimSpace(rangeParts[0]))
 				if err != nil || startPort < 1 || startPort > 65535 {
-					s.logger.Fatalf("invalid start port in range: %s", rangeParts[0])
+					s.startErrs.report(s.logger, "parse port mapping", portMapping, fmt.Errorf("invalid start port in range: %s", rangeParts[0]))
+					continue
 				}
 
 				endPort, err := strconv.Atoi(strings.TrimSpace(rangeParts[1]))
 				if err != nil || endPort < 1 || endPort > 65535 || endPort < startPort {
-					s.logger.Fatalf("invalid end port in range: %s", rangeParts[1])
+					s.startErrs.report(s.logger, "parse port mapping", portMapping, fmt.Errorf("invalid end port in range: %s", rangeParts[1]))
+					continue
 				}
 
 				// Create listeners for all ports in the range
@@ -448,7 +699,8 @@ func (s *TcpMuxTransport) parsePortMappings() {
 				}
 			}
 		} else {
-			s.logger.Fatalf("invalid port mapping format: %s", portMapping)
+			s.startErrs.report(s.logger, "parse port mapping", portMapping, fmt.Errorf("invalid port mapping format: %s", portMapping))
+			continue
 		}
 		// Start listeners for single port
 		go s.localListener(localAddr, remoteAddr)
@@ -456,19 +708,28 @@ func (s *TcpMuxTransport) parsePortMappings() {
 }
 
 func (s *TcpMuxTransport) localListener(localAddr string, remoteAddr string) {
-	listener, err := net.Listen("tcp", localAddr)
+	// A missing capability only skips this mapping, the other listeners keep working
+	if err := utils.CheckBindPermission(localAddr); err != nil {
+		s.logger.Errorf("skipping listener on %s: %v", localAddr, err)
+		return
+	}
+
+	listener, err := utils.Listen(s.ctx, &net.ListenConfig{Control: utils.MSSControl(s.config.MSSClamp, s.logger), KeepAlive: localKeepAlive(s.config.KeepAlive)}, localAddr)
 	if err != nil {
-		s.logger.Fatalf("failed to start listener on %s: %v", localAddr, err)
+		s.startErrs.report(s.logger, "listen on", localAddr, err)
 		return
 	}
 
 	defer listener.Close()
 
+	// The port is drained on its own, other listeners keep running
+	ctx := s.listeners.add(s.ctx, listener)
+
 	s.logger.Infof("listener started successfully, listening on address: %s", listener.Addr().String())
 
 	go s.acceptLocalConn(listener, remoteAddr)
 
-	<-s.ctx.Done()
+	<-ctx.Done()
 }
 
 func (s *TcpMuxTransport) acceptLocalConn(listener net.Listener, remoteAddr string) {
@@ -479,11 +740,17 @@ func (s *TcpMuxTransport) acceptLocalConn(listener net.Listener, remoteAddr stri
 
 		default:
 			conn, err := listener.Accept()
+			if errors.Is(err, net.ErrClosed) {
+				return // the port was drained or the transport stopped
+			}
 			if err != nil {
 				s.logger.Debugf("failed to accept connection on %s: %v", listener.Addr().String(), err)
 				continue
 			}
 
+			utils.SetCongestionControl(conn)
+			utils.SetSocketBuffers(conn)
+
 			// discard any non-tcp connection
 			tcpConn, ok := conn.(*net.TCPConn)
 			if !ok {
@@ -492,29 +759,91 @@ func (s *TcpMuxTransport) acceptLocalConn(listener net.Listener, remoteAddr stri
 				continue
 			}
 
+			// The country policy applies before the connection is queued
+			if !s.geoRouter.admit(tcpConn.RemoteAddr(), listener.Addr(), s.logger) {
+				tcpConn.Close()
+				continue
+			}
+
+			// An accept filter registered through the library can refuse the connection
+			if !utils.AcceptAllowed(utils.AcceptedConn{Tunnel: false, Transport: "tcpmux", RemoteAddr: tcpConn.RemoteAddr(), LocalAddr: tcpConn.LocalAddr()}, s.logger) {
+				tcpConn.Close()
+				continue
+			}
+
+			// Under overload new connections are refused, the ones in flight keep going
+			if utils.Overloaded() {
+				s.logger.Debugf("overloaded, closing connection from %s", tcpConn.RemoteAddr().String())
+				s.connLimit.reject(tcpConn)
+				s.backpressure.discarded()
+				continue
+			}
+
+			// Beyond the cap on connections in flight the connection is closed before it costs anything
+			if conn, ok = s.connLimit.track(tcpConn); !ok {
+				s.logger.Debugf("%d local connections in flight, closing connection from %s", s.config.MaxConns, tcpConn.RemoteAddr().String())
+				s.connLimit.reject(tcpConn)
+				continue
+			}
+
 			// trying to disable tcpnodelay
-			if !s.config.Nodelay {
-				if err := tcpConn.SetNoDelay(s.config.Nodelay); err != nil {
+			if !s.config.LocalNodelay {
+				if err := tcpConn.SetNoDelay(s.config.LocalNodelay); err != nil {
 					s.logger.Warnf("failed to set TCP_NODELAY for %s: %v", tcpConn.RemoteAddr().String(), err)
 				} else {
 					s.logger.Tracef("TCP_NODELAY disabled for %s", tcpConn.RemoteAddr().String())
 				}
 			}
 
-			select {
-			case s.localChannel <- LocalTCPConn{conn: conn, remoteAddr: remoteAddr}:
-				s.logger.Debugf("accepted incoming TCP connection from %s", tcpConn.RemoteAddr().String())
-
-			default: // channel is full, discard the connection
-				s.logger.Warnf("local listener channel is full, discarding TCP connection from %s", tcpConn.LocalAddr().String())
-				conn.Close()
+			// The nearest backend for the source, host rules may still override it
+			remoteAddr := s.geoRouter.target(tcpConn.RemoteAddr(), remoteAddr, s.logger)
+
+			port := tcpConn.LocalAddr().(*net.TCPAddr).Port
+
+			// Reading the preface or the Host header must not hold up the accept loop
+			if portAllowed(port, s.config.PrefaceAccept) || s.hostRouter.enabled(port) {
+				go func() {
+					if portAllowed(port, s.config.PrefaceAccept) {
+						conn = readPreface(conn, s.logger)
+					}
+					if s.hostRouter.enabled(port) {
+						conn, remoteAddr = s.hostRouter.route(conn, remoteAddr, s.logger)
+					}
+					s.queueLocalConn(conn, remoteAddr)
+				}()
+				continue
 			}
 
+			s.queueLocalConn(conn, remoteAddr)
 		}
 	}
 
 }
 
+func (s *TcpMuxTransport) queueLocalConn(conn net.Conn, remoteAddr string) {
+	// A target override of the port wins over the mapping and the routing rules
+	remoteAddr = s.targets.target(conn.LocalAddr().(*net.TCPAddr).Port, remoteAddr)
+
+	localConn := LocalTCPConn{conn: conn, remoteAddr: remoteAddr, trace: utils.StartConnTrace(s.ctx, conn.LocalAddr().(*net.TCPAddr).Port, remoteAddr), queuedAt: time.Now()}
+
+	// The connections held by the fair queue are still queued. A nil channel is
+	// never ready, the connection is discarded as on a full channel
+	localChannel := s.localChannel
+	if queued := s.fairQueue.queued(localChannel); queued >= cap(localChannel) || !s.localLimit.allow(queued) {
+		localChannel = nil
+	}
+
+	select {
+	case localChannel <- localConn:
+		s.logger.Debugf("accepted incoming TCP connection from %s", conn.RemoteAddr().String())
+
+	default: // channel is full, discard the connection
+		s.logger.Warnf("local listener channel is full, discarding TCP connection from %s", conn.LocalAddr().String())
+		conn.Close()
+		localConn.trace.Fail(errLocalChannelFull)
+	}
+}
+
 func (s *TcpMuxTransport) handleLoop() {
 	next := make(chan struct{})
 
@@ -534,11 +863,34 @@ func (s *TcpMuxTransport) handleLoop() {
 }
 
 func (s *TcpMuxTransport) handleSession(session *smux.Session, next chan struct{}) {
-	done := make(chan struct{}, s.config.MuxCon)
+	done := make(chan struct{}, s.config.MaxStreams)
+	rotate := s.rotateSignal()
+
+	// End of the last stream, a session stays idle once its streams are done
+	var lastActive atomic.Int64
+	lastActive.Store(time.Now().UnixNano())
+
+	var idleCheck <-chan time.Time
+	if s.config.SessionIdle > 0 {
+		ticker := time.NewTicker(s.config.SessionIdle / 2)
+		defer ticker.Stop()
+		idleCheck = ticker.C
+	}
+
+	// Streams opened on this session, for SessionStreams
+	opened := 0
 
 	for {
 		if atomic.LoadInt32(&s.streamCounter) >= atomic.LoadInt32(&s.sessionCounter)*int32(s.config.MuxCon) {
-			next <- struct{}{}
+			if s.config.MaxStreams > s.config.MuxCon {
+				// A session allowed more streams keeps serving while the next one is set up
+				select {
+				case next <- struct{}{}:
+				default:
+				}
+			} else {
+				next <- struct{}{}
+			}
 
 			// Attempt to request a new connection
 			select {
@@ -552,37 +904,200 @@ func (s *TcpMuxTransport) handleSession(session *smux.Session, next chan struct{
 		// +1 for Muxed connections counter
 		done <- struct{}{}
 
+		// With ordered streams one session at a time takes a connection and opens its stream
+		s.streamOrder.lock()
+
+		// Connections put back after a failed stream have waited longest, they
+		// are served before the newer ones in the local channel
+		var incomingConn LocalTCPConn
 		select {
-		case <-s.ctx.Done():
-			session.Close()
-			return
+		case incomingConn = <-s.retryChannel:
+		default:
+			select {
+			case <-s.ctx.Done():
+				s.streamOrder.unlock()
+				session.Close()
+				return
 
-		case incomingConn := <-s.localChannel:
-			// +1 for stream counter
-			atomic.AddInt32(&s.streamCounter, 1)
+			case <-rotate:
+				s.streamOrder.unlock()
+				<-done // release the slot reserved for this iteration
+				s.rotateSession(session, next, done)
+				return
 
-			stream, err := session.OpenStream()
-			if err != nil {
-				s.handleSessionError(session, &incomingConn, next, done, err)
+			case <-idleCheck:
+				s.streamOrder.unlock()
+				<-done // release the slot reserved for this iteration
+				if len(done) > 0 || time.Since(time.Unix(0, lastActive.Load())) < s.config.SessionIdle || !s.reapSession() {
+					continue
+				}
+
+				s.logger.Debugf("closing mux session idle for %v", s.config.SessionIdle)
+
+				// Notify to start a new session, unless it was already notified
+				select {
+				case next <- struct{}{}:
+				default:
+				}
+
+				session.Close()
 				return
+
+			case incomingConn = <-s.retryChannel:
+			case incomingConn = <-s.fairQueue.next(s.localChannel):
 			}
+		}
 
-			// Send the target port over the tunnel connection
-			if err := utils.SendBinaryString(stream, incomingConn.remoteAddr); err != nil {
-				s.handleSessionError(session, &incomingConn, next, done, err)
-				return
+		s.queueStats.Observe(time.Since(incomingConn.queuedAt))
+
+		// +1 for stream counter
+		atomic.AddInt32(&s.streamCounter, 1)
+
+		stream, err := session.OpenStream()
+		if errors.Is(err, smux.ErrGoAway) {
+			// Only this session is exhausted, its open streams keep running
+			// while the connection is retried on another session
+			s.logger.Warn("mux session has no stream ids left, moving to another session")
+			s.streamOrder.unlock()
+			atomic.AddInt32(&s.streamCounter, -1)
+			<-done
+			s.retryChannel <- incomingConn
+			s.rotateSession(session, next, done)
+			return
+		}
+		if err != nil {
+			s.streamOrder.unlock()
+			s.handleSessionError(session, &incomingConn, next, done, err)
+			return
+		}
+
+		// Send the target port over the tunnel connection
+		if err := utils.SendBinaryString(stream, incomingConn.remoteAddr); err != nil {
+			s.streamOrder.unlock()
+			s.handleSessionError(session, &incomingConn, next, done, err)
+			return
+		}
+
+		if err := sendPreface(stream, incomingConn.conn, s.config.PrefacePorts, "tcpmux"); err != nil {
+			s.streamOrder.unlock()
+			s.handleSessionError(session, &incomingConn, next, done, err)
+			return
+		}
+
+		if err := sendProxyHeader(stream, incomingConn.conn, s.config.ProxyProtocol, s.proxyTLVs); err != nil {
+			s.streamOrder.unlock()
+			s.handleSessionError(session, &incomingConn, next, done, err)
+			return
+		}
+
+		s.streamOrder.unlock()
+
+		incomingConn.trace.Event("stream opened")
+
+		if !s.config.LocalNodelay && portAllowed(incomingConn.conn.LocalAddr().(*net.TCPAddr).Port, s.config.LowLatencyPorts) {
+			setNoDelay(incomingConn.conn)
+		}
+
+		// Handle data exchange between connections
+		go func() {
+			utils.TCPConnectionHandler(incomingConn.conn, stream, s.logger, s.usageMonitor, incomingConn.conn.LocalAddr().(*net.TCPAddr).Port, incomingConn.remoteAddr, s.config.Sniffer, incomingConn.trace, utils.OpDeadlines{Read: s.config.ReadDeadline, Write: s.config.WriteDeadline, Lifetime: s.lifetime.of(incomingConn.conn.LocalAddr().(*net.TCPAddr).Port)})
+			atomic.AddInt32(&s.streamCounter, -1)
+			lastActive.Store(time.Now().UnixNano())
+			<-done // read signal from the channel
+		}()
+
+		opened++
+		if s.config.SessionStreams > 0 && opened >= s.config.SessionStreams {
+			s.logger.Debugf("mux session opened %d streams, rotating it", opened)
+			s.rotateSession(session, next, done)
+			return
+		}
+	}
+}
+
+// reapSession counts an idle session out unless that leaves fewer than
+// SessionIdleMin, sessions waiting in the tunnel channel included.
+func (s *TcpMuxTransport) reapSession() bool {
+	for {
+		sessions := atomic.LoadInt32(&s.sessionCounter)
+		if int(sessions)+len(s.tunnelChannel) <= s.config.SessionIdleMin {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&s.sessionCounter, sessions, sessions-1) {
+			return true
+		}
+	}
+}
+
+// RotateSessions stops opening streams on the active mux sessions and replaces
+// them with fresh ones. Streams already open keep running until they finish.
+func (s *TcpMuxTransport) RotateSessions() {
+	s.rotateMutex.Lock()
+	close(s.rotateChan)
+	s.rotateChan = make(chan struct{})
+	s.rotateMutex.Unlock()
+
+	// Idle sessions waiting in the tunnel channel are replaced as well
+	for {
+		select {
+		case session := <-s.tunnelChannel:
+			session.Close()
+
+			select {
+			case s.reqNewConnChan <- struct{}{}:
+			default:
+				s.logger.Warn("request new connection channel is full")
 			}
 
-			// Handle data exchange between connections
-			go func() {
-				utils.TCPConnectionHandler(stream, incomingConn.conn, s.logger, s.usageMonitor, incomingConn.conn.LocalAddr().(*net.TCPAddr).Port, s.config.Sniffer)
-				atomic.AddInt32(&s.streamCounter, -1)
-				<-done // read signal from the channel
-			}()
+		default:
+			return
 		}
 	}
 }
 
+func (s *TcpMuxTransport) rotateSignal() chan struct{} {
+	s.rotateMutex.Lock()
+	defer s.rotateMutex.Unlock()
+
+	return s.rotateChan
+}
+
+// rotateSession hands the local connections over to a fresh session and closes
+// the old one once its forwarded connections are done.
+func (s *TcpMuxTransport) rotateSession(session *smux.Session, next chan struct{}, done chan struct{}) {
+	s.logger.Infof("rotating mux session, draining %d active streams", len(done))
+
+	atomic.AddInt32(&s.sessionCounter, -1)
+
+	// Notify to start a new session, unless it was already notified
+	select {
+	case next <- struct{}{}:
+	default:
+	}
+
+	// Attempt to request a new connection
+	select {
+	case s.reqNewConnChan <- struct{}{}:
+	default:
+		s.logger.Warn("request new connection channel is full")
+	}
+
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+
+	for len(done) > 0 {
+		select {
+		case <-s.ctx.Done():
+			session.Close()
+			return
+		case <-ticker.C:
+		}
+	}
+
+	session.Close()
+	s.logger.Debug("drained mux session closed")
+}
+
 func (s *TcpMuxTransport) handleSessionError(session *smux.Session, incomingConn *LocalTCPConn, next chan struct{}, done chan struct{}, err error) {
 	s.logger.Errorf("failed to handle session: %v", err)
 
@@ -590,8 +1105,8 @@ func (s *TcpMuxTransport) handleSessionError(session *smux.Session, incomingConn
 	atomic.AddInt32(&s.streamCounter, -1)
 	atomic.AddInt32(&s.sessionCounter, -1)
 
-	// Put connection back to local channel
-	s.localChannel <- *incomingConn
+	// Put connection back, ahead of the local channel
+	s.retryChannel <- *incomingConn
 
 	// Notify to start a new session
 	next <- struct{}{}
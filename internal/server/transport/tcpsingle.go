@@ -0,0 +1,803 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/musix/backhaul/internal/utils"
+	"github.com/musix/backhaul/internal/web"
+
+	"github.com/sirupsen/logrus"
+	"github.com/xtaci/smux"
+)
+
+// TcpSingleTransport carries the control channel and all tunneled connections
+// over one smux session on a single TCP connection. The first stream opened on
+// the session is reserved for control signals.
+type TcpSingleTransport struct {
+	config         *TcpSingleConfig
+	smuxConfig     *smux.Config
+	parentctx      context.Context
+	ctx            context.Context
+	cancel         context.CancelFunc
+	logger         *logrus.Logger
+	localChannel   chan LocalTCPConn
+	session        *smux.Session
+	controlChannel net.Conn // reserved control stream of the session
+	usageMonitor   *web.Usage
+	queueStats     *web.QueueStats
+	listeners      *portListeners
+	targets        *targetOverrides
+	proxyTLVs      []proxyTLV
+	localLimit     *channelLimit
+	bans           *banList
+	sessions       *sessionRegistry
+	restartMutex   sync.Mutex
+	lastDrop       dropTracker // client of the last dropped control channel
+	startErrs      startErrors
+	connLimit      *connLimit
+	lifetime       *connLifetime
+	geoRouter      *geoRouter
+	handshakes     *handshakeLimit
+}
+
+type TcpSingleConfig struct {
+	BindAddr         string
+	TunnelStatus     string
+	SnifferLog       string
+	Token            string
+	MaxTokenLength   int
+	Ports            []string
+	Nodelay          bool
+	LocalNodelay     bool // Nodelay of the sockets facing the users
+	Sniffer          bool
+	ChannelSize      int
+	MuxVersion       int
+	MaxFrameSize     int
+	MaxReceiveBuffer int
+	MaxStreamBuffer  int
+	WebPort          int
+	SnifferMaxPorts  int
+	SnifferRetention time.Duration
+	KeepAlive        time.Duration
+	Heartbeat        time.Duration // in seconds
+	MSSClamp         int           // TCP_MAXSEG for local connections, 0 disables clamping
+	ReadDeadline     time.Duration // Bound on a single read in the copy loop, 0 disables it
+	WriteDeadline    time.Duration // Bound on a single write in the copy loop, 0 disables it
+	QueueThreshold   time.Duration // Warn when a connection waits longer in the local channel, 0 disables it
+	HandshakeDelay   time.Duration // Delay for a handshake from the client whose control channel was just dropped
+	ProbeTimeout     time.Duration // Close handshakes that send nothing for this long, 0 waits the full handshake timeout
+	HeartbeatMisses  int           // Unacknowledged heartbeats in a row before restarting, 0 disables the check
+	ChannelSizeMax   int           // Ceiling the local channel limit grows to when it fills up, 0 keeps ChannelSize fixed
+	BanAfter         int           // Failed handshakes before the client IP is banned, 0 disables banning
+	BanTime          time.Duration // How long a ban lasts, failures are counted within the same window
+	SessionTTL       time.Duration // How long the session of a client is kept after its control channel dropped, 0 disables sessions
+	SessionPinning   bool          // Refuse a known client ID from another IP than its session started from
+	ProxyProtocol    []string      // Local ports whose backends get a PROXY protocol v2 header with the user IP and port
+	ProxyTLVs        []string      // Custom TLVs of the PROXY protocol header as "type=value", with {label}, {port} and {transport} filled in
+	PrefacePorts     []string      // Local ports whose backends are Backhaul servers that get a preface with the user and the transport
+	MaxConns         int           // Local connections in flight across all ports, more are closed at accept, 0 disables the cap
+	RejectHTTPPorts  []string      // Local ports answered with an HTTP 503 beyond MaxConns instead of a bare close
+	RejectRetryAfter int           // Seconds in the Retry-After header of that 503, 0 leaves the header out
+	MaxPortMappings  int           // Listeners the port mappings may open, a range counts every port, the rest are refused, 0 disables the cap
+	MaxLifetime      time.Duration // Forwarded connections are closed after this long whatever their activity, 0 is unlimited
+	LifetimePorts    []string      // "port=seconds" or "start-end=seconds", overrides MaxLifetime for these local ports
+	GeoIPDB          string        // MaxMind database used to pick the target by source country, empty disables it
+	GeoIPTargets     []string      // "CC=host" or "CC=host:port" rules, other countries use the port mapping target
+	GeoIPAllow       []string      // Countries admitted on the tunnel and local listeners, empty admits every country
+	GeoIPDeny        []string      // Countries refused on the tunnel and local listeners
+	GeoIPLog         bool          // Log the country of every tunnel and local connection
+	MaxHandshakes    int           // Tunnel connections in their handshake at once, more are closed right away, 0 disables the cap
+}
+
+func NewTcpSingleServer(parentCtx context.Context, config *TcpSingleConfig, logger *logrus.Logger) (*TcpSingleTransport, error) {
+	geoRouter, err := newGeoRouter(config.GeoIPDB, config.GeoIPTargets, config.GeoIPAllow, config.GeoIPDeny, config.GeoIPLog, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create a derived context from the parent context
+	ctx, cancel := context.WithCancel(parentCtx)
+
+	// Initialize the TcpSingleTransport struct
+	server := &TcpSingleTransport{
+		smuxConfig: &smux.Config{
+			Version:           config.MuxVersion,
+			KeepAliveInterval: 20 * time.Second,
+			KeepAliveTimeout:  40 * time.Second,
+			MaxFrameSize:      config.MaxFrameSize,
+			MaxReceiveBuffer:  config.MaxReceiveBuffer,
+			MaxStreamBuffer:   config.MaxStreamBuffer,
+		},
+		config:         config,
+		parentctx:      parentCtx,
+		ctx:            ctx,
+		cancel:         cancel,
+		logger:         logger,
+		localChannel:   make(chan LocalTCPConn, channelCapacity(config.ChannelSize, config.ChannelSizeMax)),
+		session:        nil, // will be set when the client connects
+		controlChannel: nil,
+		usageMonitor:   web.NewDataStore(fmt.Sprintf(":%v", config.WebPort), ctx, config.SnifferLog, config.Sniffer, &config.TunnelStatus, logger, config.SnifferMaxPorts, config.SnifferRetention),
+		queueStats:     web.NewQueueStats(config.QueueThreshold, logger),
+		localLimit:     newChannelLimit(config.ChannelSize, config.ChannelSizeMax, logger),
+		bans:           newBanList(config.BanAfter, config.BanTime, logger),
+		sessions:       newSessionRegistry(config.SessionTTL, config.SessionPinning),
+		startErrs:      newStartErrors(),
+		connLimit:      newConnLimit(config.MaxConns, config.RejectHTTPPorts, config.RejectRetryAfter),
+		lifetime:       newConnLifetime(config.MaxLifetime, config.LifetimePorts, logger),
+		geoRouter:      geoRouter,
+		handshakes:     newHandshakeLimit(config.MaxHandshakes),
+	}
+
+	server.usageMonitor.SetQueueStats(server.queueStats)
+	server.targets = newTargetOverrides()
+	server.proxyTLVs = newProxyTLVs(config.ProxyTLVs, "tcpsingle", logger)
+	server.listeners = newPortListeners()
+	server.usageMonitor.SetDrainer(server.listeners.drain)
+	server.usageMonitor.SetTargeter(server.targets.set)
+
+	// The session would fail on every connection with an invalid configuration
+	if err := smux.VerifyConfig(server.smuxConfig); err != nil {
+		cancel()
+		return nil, fmt.Errorf("invalid mux configuration: %w", err)
+	}
+
+	return server, nil
+}
+
+// Errors reports the listeners the transport failed to set up, for as long as
+// it runs. A failed listener is not retried until the next restart.
+func (s *TcpSingleTransport) Errors() <-chan error {
+	return s.startErrs
+}
+
+func (s *TcpSingleTransport) Start() {
+	if s.config.WebPort > 0 {
+		go s.usageMonitor.Monitor()
+	}
+	s.config.TunnelStatus = "Disconnected (TCPSingle)"
+
+	go s.localLimit.shrink(s.ctx)
+
+	s.tunnelListener()
+
+	if s.session != nil {
+		s.config.TunnelStatus = "Connected (TCPSingle)"
+
+		numCPU := runtime.NumCPU()
+		if numCPU > 4 {
+			numCPU = 4 // Max allowed handler is 4
+		}
+
+		go s.parsePortMappings()
+		go s.channelHandler()
+
+		s.logger.Infof("starting %d handle loops on each CPU thread", numCPU)
+
+		for i := 0; i < numCPU; i++ {
+			go s.handleLoop()
+		}
+	}
+}
+
+func (s *TcpSingleTransport) Restart() {
+	// Nothing to restart once the tunnel is shutting down, e.g. for a config reload
+	if s.parentctx.Err() != nil {
+		return
+	}
+
+	if !s.restartMutex.TryLock() {
+		s.logger.Warn("server restart already in progress, skipping restart attempt")
+		return
+	}
+	defer s.restartMutex.Unlock()
+
+	s.logger.Info("restarting server...")
+	utils.CountRestart()
+
+	// Stop accepting first, users are refused rather than failing mid setup
+	s.listeners.closeAll()
+
+	if s.cancel != nil {
+		s.cancel()
+	}
+
+	// for removing timeout logs
+	level := s.logger.Level
+	s.logger.SetLevel(logrus.FatalLevel)
+
+	// Closing the session closes the control stream and every tunneled stream
+	if s.session != nil {
+		s.lastDrop.record(s.session.RemoteAddr())
+		s.sessions.release()
+		s.session.Close()
+	}
+
+	// Listen again as soon as the tunnel port is released
+	utils.WaitReleased("tcp", []string{s.config.BindAddr}, restartRelease)
+
+	// Nothing serves the connections still queued anymore
+	rejected := rejectQueued(s.localChannel)
+
+	ctx, cancel := context.WithCancel(s.parentctx)
+	s.ctx = ctx
+	s.cancel = cancel
+
+	// Re-initialize variables
+	s.localChannel = make(chan LocalTCPConn, channelCapacity(s.config.ChannelSize, s.config.ChannelSizeMax))
+	s.session = nil
+	s.controlChannel = nil
+	s.usageMonitor = web.NewDataStore(fmt.Sprintf(":%v", s.config.WebPort), ctx, s.config.SnifferLog, s.config.Sniffer, &s.config.TunnelStatus, s.logger, s.config.SnifferMaxPorts, s.config.SnifferRetention)
+	s.usageMonitor.SetQueueStats(s.queueStats)
+	s.listeners = newPortListeners()
+	s.usageMonitor.SetDrainer(s.listeners.drain)
+	s.usageMonitor.SetTargeter(s.targets.set)
+	s.config.TunnelStatus = ""
+
+	// set the log level again
+	s.logger.SetLevel(level)
+
+	if rejected > 0 {
+		s.logger.Infof("closed %d local connections queued during the restart", rejected)
+	}
+
+	s.lastDrop.settle()
+
+	if s.parentctx.Err() != nil {
+		return
+	}
+
+	go s.Start()
+}
+
+// tunnelListener accepts the single tunnel connection and returns once the
+// session is established. Handshakes run next to the accept loop, so a silent
+// connection cannot hold up the others, the first one to succeed takes the
+// tunnel. Later connections are refused until the next restart.
+func (s *TcpSingleTransport) tunnelListener() {
+	listener, err := utils.Listen(s.ctx, &net.ListenConfig{}, s.config.BindAddr)
+	if err != nil {
+		s.startErrs.report(s.logger, "listen on", s.config.BindAddr, err)
+		return
+	}
+
+	s.logger.Infof("server started successfully, listening on address: %s", listener.Addr().String())
+
+	// The listener belongs to this run, close it together with its context
+	ctx := s.ctx
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	claimed := &atomic.Bool{}
+	established := make(chan struct{})
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				s.logger.Debugf("failed to accept tunnel connection on %s: %v", listener.Addr().String(), err)
+				continue
+			}
+
+			utils.SetCongestionControl(conn)
+			utils.SetSocketBuffers(conn)
+
+			if claimed.Load() {
+				s.logger.Warnf("tunnel session already established, discarding connection from %s", conn.RemoteAddr().String())
+				conn.Close()
+				continue
+			}
+
+			// The country policy applies before the handshake
+			if !s.geoRouter.admit(conn.RemoteAddr(), listener.Addr(), s.logger) {
+				conn.Close()
+				continue
+			}
+
+			if !s.handshakes.acquire() {
+				s.logger.Debugf("too many handshakes in progress, closing connection from %s", conn.RemoteAddr().String())
+				conn.Close()
+				continue
+			}
+
+			go func() {
+				defer s.handshakes.release()
+				if s.channelHandshake(ctx, conn, claimed) {
+					close(established)
+				}
+			}()
+		}
+	}()
+
+	select {
+	case <-established:
+	case <-ctx.Done():
+	}
+}
+
+// channelHandshake checks the token of a tunnel connection and sets up its
+// session, it reports whether the connection took the tunnel. Only the first
+// handshake of a run to get there claims it.
+func (s *TcpSingleTransport) channelHandshake(ctx context.Context, conn net.Conn, claimed *atomic.Bool) bool {
+	if s.bans.banned(conn.RemoteAddr().String()) {
+		s.logger.Debugf("refusing handshake from banned %s", conn.RemoteAddr().String())
+		conn.Close()
+		return false
+	}
+
+	//discard any non tcp connection
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		s.logger.Warnf("disarded non-TCP tunnel connection from %s", conn.RemoteAddr().String())
+		conn.Close()
+		return false
+	}
+
+	// An accept filter registered through the library can refuse the connection
+	if !utils.AcceptAllowed(utils.AcceptedConn{Tunnel: true, Transport: "tcpsingle", RemoteAddr: tcpConn.RemoteAddr(), LocalAddr: tcpConn.LocalAddr()}, s.logger) {
+		tcpConn.Close()
+		return false
+	}
+
+	// trying to set tcpnodelay
+	if !s.config.Nodelay {
+		if err := tcpConn.SetNoDelay(s.config.Nodelay); err != nil {
+			s.logger.Warnf("failed to set TCP_NODELAY for %s: %v", tcpConn.RemoteAddr().String(), err)
+		} else {
+			s.logger.Tracef("TCP_NODELAY disabled for %s", tcpConn.RemoteAddr().String())
+		}
+	}
+
+	// Set keep-alive settings, a negative period disables keep-alive
+	if err := tcpConn.SetKeepAliveConfig(utils.KeepAliveConfig(s.config.KeepAlive)); err != nil {
+		s.logger.Warnf("failed to set TCP keep-alive for %s: %v", tcpConn.RemoteAddr().String(), err)
+	} else if s.config.KeepAlive < 0 {
+		s.logger.Tracef("TCP keep-alive disabled for %s", tcpConn.RemoteAddr().String())
+	} else {
+		s.logger.Tracef("TCP keep-alive enabled for %s", tcpConn.RemoteAddr().String())
+	}
+
+	// Set a read deadline for the token response, a shorter one for the first bytes with a probe timeout
+	handshake, err := handshakeDeadline(conn, 2*time.Second, s.config.ProbeTimeout)
+	if err != nil {
+		s.logger.Errorf("failed to set read deadline: %v", err)
+		conn.Close()
+		return false
+	}
+
+	hello, err := utils.ReceiveHandshake(handshake)
+	if err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			s.logger.Warn("timeout while waiting for control channel signal")
+		} else {
+			s.logger.Errorf("failed to receive control channel signal: %v", err)
+		}
+		conn.Close() // Close connection on error or timeout
+		return false
+	} else if hello.Signal != utils.SG_Chan {
+		s.logger.Errorf("invalid signal received for channel, Discarding connection")
+		conn.Close()
+		return false
+	}
+
+	// Resetting the deadline (removes any existing deadline)
+	conn.SetReadDeadline(time.Time{})
+
+	if !utils.ValidToken(hello.Token, s.config.Token, s.config.MaxTokenLength) {
+		s.logger.Warnf("invalid security token received from %s", conn.RemoteAddr().String())
+		s.bans.fail(conn.RemoteAddr().String())
+		conn.Close()
+		return false
+	}
+	s.bans.succeed(conn.RemoteAddr().String())
+
+	// The resumption token of the last handshake answer proves the client held the last control channel of its session
+	redeemed := s.sessions.redeem(hello.ClientID, hello.Resume)
+
+	// Hold back a client reconnecting right after its control channel was dropped, unless it resumes with a token
+	if wait := s.lastDrop.delay(conn.RemoteAddr(), s.config.HandshakeDelay); wait > 0 && !redeemed {
+		s.logger.Debugf("delaying handshake from %s by %v", conn.RemoteAddr().String(), wait)
+		time.Sleep(wait)
+	}
+
+	// A returning client resumes its session, with pinning only from the IP it started on, the token travels in the clear
+	if !s.sessions.resume(hello.ClientID, conn.RemoteAddr(), false, s.logger) {
+		conn.Close()
+		return false
+	}
+
+	// Answer in the framing of the client, or the newest one this server speaks
+	version := min(hello.Version, utils.HandshakeVersion)
+	if err := utils.SendHandshake(conn, utils.Handshake{Token: s.config.Token, Signal: utils.MuxSignal(s.config.MuxVersion), Version: version, Resume: s.sessions.issue(hello.ClientID)}); err != nil {
+		s.logger.Errorf("failed to send security token: %v", err)
+		conn.Close()
+		return false
+	}
+	web.SetNegotiated("handshake", fmt.Sprintf("v%d", version))
+
+	// SMUX client, the server opens the streams
+	session, err := smux.Client(conn, s.smuxConfig)
+	if err != nil {
+		s.logger.Errorf("failed to create mux session: %v", err)
+		conn.Close()
+		return false
+	}
+	utils.LogMuxSession(session, s.smuxConfig, s.logger)
+	go utils.WatchMuxMismatch(session, s.smuxConfig.Version, s.logger)
+
+	// The first stream is reserved for control signals
+	controlStream, err := session.OpenStream()
+	if err != nil {
+		s.logger.Errorf("failed to open control stream: %v", err)
+		session.Close()
+		return false
+	}
+
+	// Another handshake may have won meanwhile, or the run ended
+	if ctx.Err() != nil || !claimed.CompareAndSwap(false, true) {
+		s.logger.Warnf("tunnel session already established, discarding connection from %s", conn.RemoteAddr().String())
+		session.Close()
+		return false
+	}
+
+	s.session = session
+	s.controlChannel = controlStream
+
+	s.logger.Info("control channel successfully established.")
+	utils.MarkReady(s.ctx)
+
+	return true
+}
+
+func (s *TcpSingleTransport) channelHandler() {
+	ticker := time.NewTicker(s.config.Heartbeat)
+	defer ticker.Stop()
+
+	// Heartbeats echoed back by the client
+	var acks heartbeatAcks
+
+	// Channel to receive the message or error
+	messageChan := make(chan byte, 1)
+
+	go func() {
+		for {
+			select {
+			case <-s.ctx.Done():
+				return
+			default:
+				message, err := utils.ReceiveBinaryByte(s.controlChannel)
+				if err != nil {
+					if s.cancel != nil {
+						s.logger.Error("failed to read from channel connection. ", err)
+						go s.Restart()
+					}
+					return
+				}
+				messageChan <- message
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			_ = utils.SendBinaryByte(s.controlChannel, utils.SG_Closed)
+			return
+
+		case <-ticker.C:
+			if acks.missed(s.config.HeartbeatMisses) {
+				s.logger.Errorf("client did not acknowledge the last %d heartbeats, attempting to restart server...", acks.pending)
+				go s.Restart()
+				return
+			}
+
+			err := utils.SendBinaryByte(s.controlChannel, utils.SG_HB)
+			if err != nil {
+				s.logger.Error("failed to send heartbeat signal")
+				go s.Restart()
+				return
+			}
+			acks.sent()
+			s.logger.Trace("heartbeat signal sent successfully")
+
+		case message := <-messageChan:
+			if message == utils.SG_Closed {
+				s.logger.Warn("control channel has been closed by the client")
+				go s.Restart()
+				return
+
+			} else if message == utils.SG_HB {
+				acks.received()
+				s.logger.Trace("heartbeat acknowledgment received")
+			}
+		}
+	}
+}
+
+func (s *TcpSingleTransport) parsePortMappings() {
+	ports, _, err := limitPortMappings(s.config.Ports, s.config.MaxPortMappings, 0)
+	if err != nil {
+		s.startErrs.send(s.logger, err)
+	}
+
+	for _, portMapping := range ports {
+		// A "#label" suffix names the mapping in metrics, logs and the web interface
+		portMapping, label, err := splitLabel(portMapping)
+		if err != nil {
+			s.startErrs.report(s.logger, "parse port mapping", portMapping, err)
+			continue
+		}
+		labelPorts(portMapping, label)
+
+		parts := strings.Split(portMapping, "=")
+
+		var localAddr, remoteAddr string
+
+		// Check if only a single port or a port range is provided (no "=" present)
+		if len(parts) == 1 {
+			localPortOrRange := strings.TrimSpace(parts[0])
+			remoteAddr = localPortOrRange // If no remote addr is provided, use the local port as the remote port
+
+			// Check if it's a port range
+			if strings.Contains(localPortOrRange, "-") {
+				rangeParts := strings.Split(localPortOrRange, "-")
+				if len(rangeParts) != 2 {
+					s.startErrs.report(s.logger, "parse port mapping", portMapping, fmt.Errorf("invalid port range format: %s", localPortOrRange))
+					continue
+				}
+
+				// Parse and validate start and end ports
+				startPort, err := strconv.Atoi(strings.TrimSpace(rangeParts[0]))
+				if err != nil || startPort < 1 || startPort > 65535 {
+					s.startErrs.report(s.logger, "parse port mapping", portMapping, fmt.Errorf("invalid start port in range: %s", rangeParts[0]))
+					continue
+				}
+
+				endPort, err := strconv.Atoi(strings.TrimSpace(rangeParts[1]))
+				if err != nil || endPort < 1 || endPort > 65535 || endPort < startPort {
+					s.startErrs.report(s.logger, "parse port mapping", portMapping, fmt.Errorf("invalid end port in range: %s", rangeParts[1]))
+					continue
+				}
+
+				// Create listeners for all ports in the range
+				for port := startPort; port <= endPort; port++ {
+					localAddr = fmt.Sprintf(":%d", port)
+					go s.localListener(localAddr, strconv.Itoa(port)) // Use port as the remoteAddr
+					time.Sleep(1 * time.Millisecond)                  // for wide port ranges
+				}
+				continue
+			} else {
+				// Handle single port case
+				port, err := strconv.Atoi(localPortOrRange)
+				if err != nil || port < 1 || port > 65535 {
+					s.startErrs.report(s.logger, "parse port mapping", portMapping, fmt.Errorf("invalid port format: %s", localPortOrRange))
+					continue
+				}
+				localAddr = fmt.Sprintf(":%d", port)
+			}
+		} else if len(parts) == 2 {
+			// Handle "local=remote" format
+			localPortOrRange := strings.TrimSpace(parts[0])
+			remoteAddr = strings.TrimSpace(parts[1])
+
+			// Check if local port is a range
+			if strings.Contains(localPortOrRange, "-") {
+				rangeParts := strings.Split(localPortOrRange, "-")
+				if len(rangeParts) != 2 {
+					s.startErrs.report(s.logger, "parse port mapping", portMapping, fmt.Errorf("invalid port range format: %s", localPortOrRange))
+					continue
+				}
+
+				// Parse and validate start and end ports
+				startPort, err := strconv.Atoi(strings.TrimSpace(rangeParts[0]))
+				if err != nil || startPort < 1 || startPort > 65535 {
+					s.startErrs.report(s.logger, "parse port mapping", portMapping, fmt.Errorf("invalid start port in range: %s", rangeParts[0]))
+					continue
+				}
+
+				endPort, err := strconv.Atoi(strings.TrimSpace(rangeParts[1]))
+				if err != nil || endPort < 1 || endPort > 65535 || endPort < startPort {
+					s.startErrs.report(s.logger, "parse port mapping", portMapping, fmt.Errorf("invalid end port in range: %s", rangeParts[1]))
+					continue
+				}
+
+				// Create listeners for all ports in the range
+				for port := startPort; port <= endPort; port++ {
+					localAddr = fmt.Sprintf(":%d", port)
+					go s.localListener(localAddr, remoteAddr)
+					time.Sleep(1 * time.Millisecond) // for wide port ranges
+				}
+				continue
+			} else {
+				// Handle single local port case
+				port, err := strconv.Atoi(localPortOrRange)
+				if err == nil && port > 1 && port < 65535 { // format port=remoteAddress
+					localAddr = fmt.Sprintf(":%d", port)
+				} else {
+					localAddr = localPortOrRange // format ip:port=remoteAddress
+				}
+			}
+		} else {
+			s.startErrs.report(s.logger, "parse port mapping", portMapping, fmt.Errorf("invalid port mapping format: %s", portMapping))
+			continue
+		}
+		// Start listeners for single port
+		go s.localListener(localAddr, remoteAddr)
+	}
+}
+
+func (s *TcpSingleTransport) localListener(localAddr string, remoteAddr string) {
+	// A missing capability only skips this mapping, the other listeners keep working
+	if err := utils.CheckBindPermission(localAddr); err != nil {
+		s.logger.Errorf("skipping listener on %s: %v", localAddr, err)
+		return
+	}
+
+	listener, err := utils.Listen(s.ctx, &net.ListenConfig{Control: utils.MSSControl(s.config.MSSClamp, s.logger), KeepAlive: localKeepAlive(s.config.KeepAlive)}, localAddr)
+	if err != nil {
+		s.startErrs.report(s.logger, "listen on", localAddr, err)
+		return
+	}
+
+	defer listener.Close()
+
+	// The port is drained on its own, other listeners keep running
+	ctx := s.listeners.add(s.ctx, listener)
+
+	s.logger.Infof("listener started successfully, listening on address: %s", listener.Addr().String())
+
+	go s.acceptLocalConn(listener, remoteAddr)
+
+	<-ctx.Done()
+}
+
+func (s *TcpSingleTransport) acceptLocalConn(listener net.Listener, remoteAddr string) {
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+
+		default:
+			conn, err := listener.Accept()
+			if errors.Is(err, net.ErrClosed) {
+				return // the port was drained or the transport stopped
+			}
+			if err != nil {
+				s.logger.Debugf("failed to accept connection on %s: %v", listener.Addr().String(), err)
+				continue
+			}
+
+			utils.SetCongestionControl(conn)
+			utils.SetSocketBuffers(conn)
+
+			// discard any non-tcp connection
+			tcpConn, ok := conn.(*net.TCPConn)
+			if !ok {
+				s.logger.Warnf("disarded non-TCP connection from %s", conn.RemoteAddr().String())
+				conn.Close()
+				continue
+			}
+
+			// The country policy applies before the connection is queued
+			if !s.geoRouter.admit(tcpConn.RemoteAddr(), listener.Addr(), s.logger) {
+				tcpConn.Close()
+				continue
+			}
+
+			// An accept filter registered through the library can refuse the connection
+			if !utils.AcceptAllowed(utils.AcceptedConn{Tunnel: false, Transport: "tcpsingle", RemoteAddr: tcpConn.RemoteAddr(), LocalAddr: tcpConn.LocalAddr()}, s.logger) {
+				tcpConn.Close()
+				continue
+			}
+
+			// Under overload new connections are refused, the ones in flight keep going
+			if utils.Overloaded() {
+				s.logger.Debugf("overloaded, closing connection from %s", tcpConn.RemoteAddr().String())
+				s.connLimit.reject(tcpConn)
+				continue
+			}
+
+			// Beyond the cap on connections in flight the connection is closed before it costs anything
+			if conn, ok = s.connLimit.track(tcpConn); !ok {
+				s.logger.Debugf("%d local connections in flight, closing connection from %s", s.config.MaxConns, tcpConn.RemoteAddr().String())
+				s.connLimit.reject(tcpConn)
+				continue
+			}
+
+			// trying to disable tcpnodelay
+			if !s.config.LocalNodelay {
+				if err := tcpConn.SetNoDelay(s.config.LocalNodelay); err != nil {
+					s.logger.Warnf("failed to set TCP_NODELAY for %s: %v", tcpConn.RemoteAddr().String(), err)
+				} else {
+					s.logger.Tracef("TCP_NODELAY disabled for %s", tcpConn.RemoteAddr().String())
+				}
+			}
+
+			// The nearest backend for the source, a target override of the port applies to new connections only
+			target := s.targets.target(tcpConn.LocalAddr().(*net.TCPAddr).Port, s.geoRouter.target(tcpConn.RemoteAddr(), remoteAddr, s.logger))
+			localConn := LocalTCPConn{conn: conn, remoteAddr: target, trace: utils.StartConnTrace(s.ctx, tcpConn.LocalAddr().(*net.TCPAddr).Port, target), queuedAt: time.Now()}
+
+			// A nil channel is never ready, the connection is discarded as on a full channel
+			localChannel := s.localChannel
+			if !s.localLimit.allow(len(localChannel)) {
+				localChannel = nil
+			}
+
+			select {
+			case localChannel <- localConn:
+				s.logger.Debugf("accepted incoming TCP connection from %s", tcpConn.RemoteAddr().String())
+
+			default: // channel is full, discard the connection
+				s.logger.Warnf("local listener channel is full, discarding TCP connection from %s", tcpConn.LocalAddr().String())
+				conn.Close()
+				localConn.trace.Fail(errLocalChannelFull)
+			}
+
+		}
+	}
+
+}
+
+func (s *TcpSingleTransport) handleLoop() {
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+
+		case localConn := <-s.localChannel:
+			s.queueStats.Observe(time.Since(localConn.queuedAt))
+
+			stream, err := s.session.OpenStream()
+			if err != nil {
+				s.logger.Errorf("failed to open mux stream: %v", err)
+				localConn.conn.Close()
+				localConn.trace.Fail(err)
+				go s.Restart()
+				return
+			}
+
+			// Send the target port over the stream
+			if err := utils.SendBinaryString(stream, localConn.remoteAddr); err != nil {
+				s.logger.Errorf("failed to send target address: %v", err)
+				stream.Close()
+				localConn.conn.Close()
+				localConn.trace.Fail(err)
+				continue
+			}
+
+			if err := sendPreface(stream, localConn.conn, s.config.PrefacePorts, "tcpsingle"); err != nil {
+				s.logger.Errorf("failed to send preface: %v", err)
+				stream.Close()
+				localConn.conn.Close()
+				localConn.trace.Fail(err)
+				continue
+			}
+
+			if err := sendProxyHeader(stream, localConn.conn, s.config.ProxyProtocol, s.proxyTLVs); err != nil {
+				s.logger.Errorf("failed to send PROXY protocol header: %v", err)
+				stream.Close()
+				localConn.conn.Close()
+				localConn.trace.Fail(err)
+				continue
+			}
+
+			localConn.trace.Event("stream opened")
+
+			// Handle data exchange between connections
+			go utils.TCPConnectionHandler(localConn.conn, stream, s.logger, s.usageMonitor, localConn.conn.LocalAddr().(*net.TCPAddr).Port, localConn.remoteAddr, s.config.Sniffer, localConn.trace, utils.OpDeadlines{Read: s.config.ReadDeadline, Write: s.config.WriteDeadline, Lifetime: s.lifetime.of(localConn.conn.LocalAddr().(*net.TCPAddr).Port)})
+		}
+	}
+}
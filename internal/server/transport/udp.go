@@ -28,18 +28,23 @@ type UdpTransport struct {
 	restartMutex      sync.Mutex
 	usageMonitor      *web.Usage
 	rtt               int64 // for Fun!
+	startErrs         startErrors
 }
 
 type UdpConfig struct {
-	BindAddr     string
-	Token        string
-	SnifferLog   string
-	TunnelStatus string
-	Ports        []string
-	Sniffer      bool
-	Heartbeat    time.Duration // in seconds, for udp conn and control channel
-	ChannelSize  int
-	WebPort      int
+	BindAddr         string
+	Token            string
+	MaxTokenLength   int
+	SnifferLog       string
+	TunnelStatus     string
+	Ports            []string
+	Sniffer          bool
+	Heartbeat        time.Duration // in seconds, for udp conn and control channel
+	ChannelSize      int
+	WebPort          int
+	SnifferMaxPorts  int
+	SnifferRetention time.Duration
+	MaxPortMappings  int // Listeners the port mappings may open, a range counts every port, the rest are refused, 0 disables the cap
 }
 
 func NewUDPServer(parentCtx context.Context, config *UdpConfig, logger *logrus.Logger) *UdpTransport {
@@ -58,12 +63,19 @@ func NewUDPServer(parentCtx context.Context, config *UdpConfig, logger *logrus.L
 		activeMu:          sync.Mutex{},
 		reqNewConnChan:    make(chan struct{}, config.ChannelSize),
 		controlChannel:    nil, // will be set when a control connection is established
-		usageMonitor:      web.NewDataStore(fmt.Sprintf(":%v", config.WebPort), ctx, config.SnifferLog, config.Sniffer, &config.TunnelStatus, logger),
+		usageMonitor:      web.NewDataStore(fmt.Sprintf(":%v", config.WebPort), ctx, config.SnifferLog, config.Sniffer, &config.TunnelStatus, logger, config.SnifferMaxPorts, config.SnifferRetention),
 		rtt:               0,
+		startErrs:         newStartErrors(),
 	}
 
 	return server
 }
+
+// Errors reports the listeners the transport failed to set up, for as long as
+// it runs. A failed listener is not retried until the next restart.
+func (s *UdpTransport) Errors() <-chan error {
+	return s.startErrs
+}
 func (s *UdpTransport) Start() {
 	s.config.TunnelStatus = "Disconnected (UDP)"
 
@@ -75,6 +87,11 @@ func (s *UdpTransport) Start() {
 }
 
 func (s *UdpTransport) Restart() {
+	// Nothing to restart once the tunnel is shutting down, e.g. for a config reload
+	if s.parentctx.Err() != nil {
+		return
+	}
+
 	if !s.restartMutex.TryLock() {
 		s.logger.Warn("server restart already in progress, skipping restart attempt")
 		return
@@ -82,6 +99,7 @@ func (s *UdpTransport) Restart() {
 	defer s.restartMutex.Unlock()
 
 	s.logger.Info("restarting server...")
+	utils.CountRestart()
 
 	// for removing timeout logs
 	level := s.logger.Level
@@ -96,7 +114,9 @@ func (s *UdpTransport) Restart() {
 		s.controlChannel.Close()
 	}
 
-	time.Sleep(2 * time.Second)
+	// Listen again as soon as the tunnel port is released
+	utils.WaitReleased("tcp", []string{s.config.BindAddr}, restartRelease)
+	utils.WaitReleased("udp", []string{s.config.BindAddr}, restartRelease)
 
 	ctx, cancel := context.WithCancel(s.parentctx)
 	s.ctx = ctx
@@ -105,7 +125,7 @@ func (s *UdpTransport) Restart() {
 	// Re-initialize variables
 	s.tunnelChannel = make(chan *TunnelUDPConn, s.config.ChannelSize)
 	s.reqNewConnChan = make(chan struct{}, s.config.ChannelSize)
-	s.usageMonitor = web.NewDataStore(fmt.Sprintf(":%v", s.config.WebPort), ctx, s.config.SnifferLog, s.config.Sniffer, &s.config.TunnelStatus, s.logger)
+	s.usageMonitor = web.NewDataStore(fmt.Sprintf(":%v", s.config.WebPort), ctx, s.config.SnifferLog, s.config.Sniffer, &s.config.TunnelStatus, s.logger, s.config.SnifferMaxPorts, s.config.SnifferRetention)
 	s.config.TunnelStatus = ""
 	s.controlChannel = nil
 	s.activeConnections = map[string]*TunnelUDPConn{}
@@ -114,13 +134,17 @@ func (s *UdpTransport) Restart() {
 	// set the log level again
 	s.logger.SetLevel(level)
 
+	if s.parentctx.Err() != nil {
+		return
+	}
+
 	go s.Start()
 }
 
 func (s *UdpTransport) channelHandshake() {
 	listener, err := net.Listen("tcp", s.config.BindAddr)
 	if err != nil {
-		s.logger.Fatalf("failed to start listener on %s: %v", s.config.BindAddr, err)
+		s.startErrs.report(s.logger, "listen on", s.config.BindAddr, err)
 		return
 	}
 
@@ -140,6 +164,12 @@ loop:
 				continue
 			}
 
+			// An accept filter registered through the library can refuse the connection
+			if !utils.AcceptAllowed(utils.AcceptedConn{Tunnel: true, Transport: "udp", RemoteAddr: conn.RemoteAddr(), LocalAddr: conn.LocalAddr()}, s.logger) {
+				conn.Close()
+				continue
+			}
+
 			// Set a read deadline for the token response
 			if err := conn.SetReadDeadline(time.Now().Add(2 * time.Second)); err != nil {
 				s.logger.Errorf("failed to set read deadline: %v", err)
@@ -147,8 +177,8 @@ loop:
 				continue
 			}
 
-			msg, transport, err := utils.ReceiveBinaryTransportString(conn)
-			if transport != utils.SG_Chan {
+			hello, err := utils.ReceiveHandshake(conn)
+			if hello.Signal != utils.SG_Chan {
 				s.logger.Errorf("invalid signal received for channel, Discarding connection")
 				conn.Close()
 				continue
@@ -166,22 +196,26 @@ loop:
 			// Resetting the deadline (removes any existing deadline)
 			conn.SetReadDeadline(time.Time{})
 
-			if msg != s.config.Token {
-				s.logger.Warnf("invalid security token received: %s", msg)
+			if !utils.ValidToken(hello.Token, s.config.Token, s.config.MaxTokenLength) {
+				s.logger.Warnf("invalid security token received from %s", conn.RemoteAddr().String())
 				conn.Close()
 				continue
 			}
 
-			err = utils.SendBinaryTransportString(conn, s.config.Token, utils.SG_Chan)
+			// Answer in the framing of the client, or the newest one this server speaks
+			version := min(hello.Version, utils.HandshakeVersion)
+			err = utils.SendHandshake(conn, utils.Handshake{Token: s.config.Token, Signal: utils.SG_Chan, Version: version})
 			if err != nil {
 				s.logger.Errorf("failed to send security token: %v", err)
 				conn.Close()
 				continue
 			}
+			web.SetNegotiated("handshake", fmt.Sprintf("v%d", version))
 
 			s.controlChannel = conn
 
 			s.logger.Info("control channel successfully established.")
+			utils.MarkReady(s.ctx)
 
 			break loop
 		}
@@ -275,12 +309,14 @@ func (s *UdpTransport) channelHandler() {
 func (s *UdpTransport) tunnelListener() {
 	tunnelUDPAddr, err := net.ResolveUDPAddr("udp", s.config.BindAddr)
 	if err != nil {
-		s.logger.Fatalf("failed to resolve tunnel address: %v", err)
+		s.startErrs.report(s.logger, "resolve", s.config.BindAddr, err)
+		return
 	}
 
 	listener, err := net.ListenUDP("udp", tunnelUDPAddr)
 	if err != nil {
-		s.logger.Fatalf("failed to listen on tunnel UDP port: %v", err)
+		s.startErrs.report(s.logger, "listen on", s.config.BindAddr, err)
+		return
 	}
 
 	defer listener.Close()
@@ -327,7 +363,7 @@ func (s *UdpTransport) acceptTunnelConn(listener *net.UDPConn) {
 
 			s.activeMu.Unlock()
 
-			if string(buf[:n]) != s.config.Token { // For new connections, validate the token
+			if !utils.ValidToken(string(buf[:n]), s.config.Token, s.config.MaxTokenLength) { // For new connections, validate the token
 				s.logger.Errorf("invalid token received from %s", addr.String())
 				continue
 			}
@@ -366,7 +402,20 @@ func (s *UdpTransport) acceptTunnelConn(listener *net.UDPConn) {
 }
 
 func (s *UdpTransport) parsePortMappings() {
-	for _, portMapping := range s.config.Ports {
+	ports, _, err := limitPortMappings(s.config.Ports, s.config.MaxPortMappings, 0)
+	if err != nil {
+		s.startErrs.send(s.logger, err)
+	}
+
+	for _, portMapping := range ports {
+		// A "#label" suffix names the mapping in metrics, logs and the web interface
+		portMapping, label, err := splitLabel(portMapping)
+		if err != nil {
+			s.startErrs.report(s.logger, "parse port mapping", portMapping, err)
+			continue
+		}
+		labelPorts(portMapping, label)
+
 		parts := strings.Split(portMapping, "=")
 
 		var localAddr, remoteAddr string
@@ -380,18 +429,21 @@ func (s *UdpTransport) parsePortMappings() {
 			if strings.Contains(localPortOrRange, "-") {
 				rangeParts := strings.Split(localPortOrRange, "-")
 				if len(rangeParts) != 2 {
-					s.logger.Fatalf("invalid port range format: %s", localPortOrRange)
+					s.startErrs.report(s.logger, "parse port mapping", portMapping, fmt.Errorf("invalid port range format: %s", localPortOrRange))
+					continue
 				}
 
 				// Parse and validate start and end ports
 				startPort, err := strconv.Atoi(strings.TrimSpace(rangeParts[0]))
 				if err != nil || startPort < 1 || startPort > 65535 {
-					s.logger.Fatalf("invalid start port in range: %s", rangeParts[0])
+					s.startErrs.report(s.logger, "parse port mapping", portMapping, fmt.Errorf("invalid start port in range: %s", rangeParts[0]))
+					continue
 				}
 
 				endPort, err := strconv.Atoi(strings.TrimSpace(rangeParts[1]))
 				if err != nil || endPort < 1 || endPort > 65535 || endPort < startPort {
-					s.logger.Fatalf("invalid end port in range: %s", rangeParts[1])
+					s.startErrs.report(s.logger, "parse port mapping", portMapping, fmt.Errorf("invalid end port in range: %s", rangeParts[1]))
+					continue
 				}
 
 				// Create listeners for all ports in the range
@@ -405,7 +457,8 @@ func (s *UdpTransport) parsePortMappings() {
 				// Handle single port case
 				port, err := strconv.Atoi(localPortOrRange)
 				if err != nil || port < 1 || port > 65535 {
-					s.logger.Fatalf("invalid port format: %s", localPortOrRange)
+					s.startErrs.report(s.logger, "parse port mapping", portMapping, fmt.Errorf("invalid port format: %s", localPortOrRange))
+					continue
 				}
 				localAddr = fmt.Sprintf(":%d", port)
 			}
@@ -418,18 +471,21 @@ func (s *UdpTransport) parsePortMappings() {
 			if strings.Contains(localPortOrRange, "-") {
 				rangeParts := strings.Split(localPortOrRange, "-")
 				if len(rangeParts) != 2 {
-					s.logger.Fatalf("invalid port range format: %s", localPortOrRange)
+					s.startErrs.report(s.logger, "parse port mapping", portMapping, fmt.Errorf("invalid port range format: %s", localPortOrRange))
+					continue
 				}
 
 				// Parse and validate start and end ports
 				startPort, err := strconv.Atoi(strings.TrimSpace(rangeParts[0]))
 				if err != nil || startPort < 1 || startPort > 65535 {
-					s.logger.Fatalf("invalid start port in range: %s", rangeParts[0])
+					s.startErrs.report(s.logger, "parse port mapping", portMapping, fmt.Errorf("invalid start port in range: %s", rangeParts[0]))
+					continue
 				}
 
 				endPort, err := strconv.Atoi(strings.TrimSpace(rangeParts[1]))
 				if err != nil || endPort < 1 || endPort > 65535 || endPort < startPort {
-					s.logger.Fatalf("invalid end port in range: %s", rangeParts[1])
+					s.startErrs.report(s.logger, "parse port mapping", portMapping, fmt.Errorf("invalid end port in range: %s", rangeParts[1]))
+					continue
 				}
 
 				// Create listeners for all ports in the range
@@ -449,7 +505,8 @@ func (s *UdpTransport) parsePortMappings() {
 				}
 			}
 		} else {
-			s.logger.Fatalf("invalid port mapping format: %s", portMapping)
+			s.startErrs.report(s.logger, "parse port mapping", portMapping, fmt.Errorf("invalid port mapping format: %s", portMapping))
+			continue
 		}
 		// Start listeners for single port
 		go s.localListener(localAddr, remoteAddr)
@@ -457,14 +514,22 @@ func (s *UdpTransport) parsePortMappings() {
 }
 
 func (s *UdpTransport) localListener(localAddr, remoteAddr string) {
+	// A missing capability only skips this mapping, the other listeners keep working
+	if err := utils.CheckBindPermission(localAddr); err != nil {
+		s.logger.Errorf("skipping listener on %s: %v", localAddr, err)
+		return
+	}
+
 	localUDPAddr, err := net.ResolveUDPAddr("udp", localAddr)
 	if err != nil {
-		s.logger.Fatalf("failed to resolve local address: %v", err)
+		s.startErrs.report(s.logger, "resolve", localAddr, err)
+		return
 	}
 
 	listener, err := net.ListenUDP("udp", localUDPAddr)
 	if err != nil {
-		s.logger.Fatalf("failed to listen on local UDP port: %v", err)
+		s.startErrs.report(s.logger, "listen on", localAddr, err)
+		return
 	}
 
 	defer listener.Close()
@@ -598,6 +663,9 @@ func (s *UdpTransport) handleLoop(udpChan chan *LocalUDPConn, activeConnections
 func (s *UdpTransport) udpCopy(udpLocal *LocalUDPConn, udpTunnel *TunnelUDPConn, activeConnections *map[string]*LocalUDPConn, mu *sync.Mutex) {
 	done := make(chan struct{})
 
+	utils.OpenConnection()
+	defer utils.CloseConnection()
+
 	// Handle data from local to tunnel
 	go func() {
 		defer close(done)
@@ -650,6 +718,7 @@ func (s *UdpTransport) udpLocalCopy(from *LocalUDPConn, to *TunnelUDPConn) {
 			if s.config.Sniffer {
 				s.usageMonitor.AddOrUpdatePort(from.listener.LocalAddr().(*net.UDPAddr).Port, uint64(totalWritten))
 			}
+			utils.CountTraffic(true, totalWritten)
 
 			s.logger.Debugf("forwarded %d bytes from local connection %s to tunnel", packetSize, from.addr.String())
 
@@ -686,6 +755,7 @@ func (s *UdpTransport) udpTunnelCopy(from *TunnelUDPConn, to *LocalUDPConn) {
 			if s.config.Sniffer {
 				s.usageMonitor.AddOrUpdatePort(to.listener.LocalAddr().(*net.UDPAddr).Port, uint64(totalWritten))
 			}
+			utils.CountTraffic(false, totalWritten)
 
 			s.logger.Debugf("forwarded %d bytes from local connection %s to tunnel", packetSize, from.addr.String())
 
@@ -2,6 +2,8 @@ package transport
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
@@ -29,26 +31,56 @@ type WsTransport struct {
 	localChannel   chan LocalTCPConn
 	reqNewConnChan chan struct{}
 	controlChannel *websocket.Conn
+	standbyChannel chan *websocket.Conn // standby control channels handed to the channel handler
 	restartMutex   sync.Mutex
 	usageMonitor   *web.Usage
+	queueStats     *web.QueueStats
+	listeners      *portListeners
+	targets        *targetOverrides
+	localLimit     *channelLimit
+	bans           *banList
+	authLog        *authLog
+	handshakes     *handshakeLimit
+	startErrs      startErrors
+	connLimit      *connLimit
+	backpressure   *backpressure
 }
 
 type WsConfig struct {
-	BindAddr     string
-	SnifferLog   string
-	TLSCertFile  string // Path to the TLS certificate file
-	TLSKeyFile   string // Path to the TLS key file
-	TunnelStatus string
-	Token        string
-	Ports        []string
-	Nodelay      bool
-	Sniffer      bool
-	KeepAlive    time.Duration
-	Heartbeat    time.Duration // in seconds
-	ChannelSize  int
-	WebPort      int
-	Mode         config.TransportType // ws or wss
-
+	BindAddr         string
+	SnifferLog       string
+	TLSCertFile      string // Path to the TLS certificate file
+	TLSKeyFile       string // Path to the TLS key file
+	TLSPSK           bool   // Derive the TLS certificate from the token instead of cert files
+	TunnelStatus     string
+	Token            string
+	MaxTokenLength   int
+	Ports            []string
+	Nodelay          bool
+	LocalNodelay     bool // Nodelay of the sockets facing the users
+	Sniffer          bool
+	KeepAlive        time.Duration
+	Heartbeat        time.Duration // in seconds
+	ChannelSize      int
+	WebPort          int
+	SnifferMaxPorts  int
+	SnifferRetention time.Duration
+	Mode             config.TransportType // ws or wss
+	MSSClamp         int                  // TCP_MAXSEG for local connections, 0 disables clamping
+	QueueThreshold   time.Duration        // Warn when a connection waits longer in the local channel, 0 disables it
+	HeartbeatMisses  int                  // Unacknowledged heartbeats in a row before restarting, 0 disables the check
+	ChannelSizeMax   int                  // Ceiling the local channel limit grows to when it fills up, 0 keeps ChannelSize fixed
+	RejectDuplicate  bool                 // Refuse a second control channel instead of restarting for it
+	BanAfter         int                  // Failed handshakes before the client IP is banned, 0 disables banning
+	BanTime          time.Duration        // How long a ban lasts, failures are counted within the same window
+	AuthLogInterval  time.Duration        // Summarize unauthorized requests once per interval, 0 logs each of them
+	MaxHandshakes    int                  // Tunnel connections in their handshake at once, more are closed right away, 0 disables the cap
+	ProbeTimeout     time.Duration        // Close connections without a complete request header for this long, 0 disables it
+	Backpressure     bool                 // Tell the client to hold back tunnel connections while the tunnel channel is full
+	MaxConns         int                  // Local connections in flight across all ports, more are closed at accept, 0 disables the cap
+	RejectHTTPPorts  []string             // Local ports answered with an HTTP 503 beyond MaxConns instead of a bare close
+	RejectRetryAfter int                  // Seconds in the Retry-After header of that 503, 0 leaves the header out
+	MaxPortMappings  int                  // Listeners the port mappings may open, a range counts every port, the rest are refused, 0 disables the cap
 }
 
 func NewWSServer(parentCtx context.Context, config *WsConfig, logger *logrus.Logger) *WsTransport {
@@ -62,16 +94,37 @@ func NewWSServer(parentCtx context.Context, config *WsConfig, logger *logrus.Log
 		ctx:            ctx,
 		cancel:         cancel,
 		logger:         logger,
-		tunnelChannel:  make(chan TunnelChannel, config.ChannelSize),
-		localChannel:   make(chan LocalTCPConn, config.ChannelSize),
-		reqNewConnChan: make(chan struct{}, config.ChannelSize),
+		tunnelChannel:  make(chan TunnelChannel, channelCapacity(config.ChannelSize, config.ChannelSizeMax)),
+		localChannel:   make(chan LocalTCPConn, channelCapacity(config.ChannelSize, config.ChannelSizeMax)),
+		reqNewConnChan: make(chan struct{}, channelCapacity(config.ChannelSize, config.ChannelSizeMax)),
 		controlChannel: nil, // will be set when a control connection is established
-		usageMonitor:   web.NewDataStore(fmt.Sprintf(":%v", config.WebPort), ctx, config.SnifferLog, config.Sniffer, &config.TunnelStatus, logger),
+		standbyChannel: make(chan *websocket.Conn, 1),
+		usageMonitor:   web.NewDataStore(fmt.Sprintf(":%v", config.WebPort), ctx, config.SnifferLog, config.Sniffer, &config.TunnelStatus, logger, config.SnifferMaxPorts, config.SnifferRetention),
+		queueStats:     web.NewQueueStats(config.QueueThreshold, logger),
+		localLimit:     newChannelLimit(config.ChannelSize, config.ChannelSizeMax, logger),
+		bans:           newBanList(config.BanAfter, config.BanTime, logger),
+		authLog:        newAuthLog(parentCtx, config.AuthLogInterval, logger),
+		handshakes:     newHandshakeLimit(config.MaxHandshakes),
+		startErrs:      newStartErrors(),
+		connLimit:      newConnLimit(config.MaxConns, config.RejectHTTPPorts, config.RejectRetryAfter),
+		backpressure:   newBackpressure(config.Backpressure),
 	}
 
+	server.usageMonitor.SetQueueStats(server.queueStats)
+	server.targets = newTargetOverrides()
+	server.listeners = newPortListeners()
+	server.usageMonitor.SetDrainer(server.listeners.drain)
+	server.usageMonitor.SetTargeter(server.targets.set)
+
 	return server
 }
 
+// Errors reports the listeners the transport failed to set up, for as long as
+// it runs. A failed listener is not retried until the next restart.
+func (s *WsTransport) Errors() <-chan error {
+	return s.startErrs
+}
+
 func (s *WsTransport) Start() {
 	// for  webui
 	if s.config.WebPort > 0 {
@@ -81,9 +134,15 @@ func (s *WsTransport) Start() {
 	s.config.TunnelStatus = fmt.Sprintf("Disconnected (%s)", s.config.Mode)
 
 	go s.tunnelListener()
+	go s.localLimit.shrink(s.ctx)
 
 }
 func (s *WsTransport) Restart() {
+	// Nothing to restart once the tunnel is shutting down, e.g. for a config reload
+	if s.parentctx.Err() != nil {
+		return
+	}
+
 	if !s.restartMutex.TryLock() {
 		s.logger.Warn("server restart already in progress, skipping restart attempt")
 		return
@@ -91,10 +150,14 @@ func (s *WsTransport) Restart() {
 	defer s.restartMutex.Unlock()
 
 	s.logger.Info("restarting server...")
+	utils.CountRestart()
 
 	level := s.logger.Level
 	s.logger.SetLevel(logrus.FatalLevel)
 
+	// Stop accepting first, users are refused rather than failing mid setup
+	s.listeners.closeAll()
+
 	if s.cancel != nil {
 		s.cancel()
 	}
@@ -104,23 +167,40 @@ func (s *WsTransport) Restart() {
 		s.controlChannel.Close()
 	}
 
-	time.Sleep(2 * time.Second)
+	// Listen again as soon as the tunnel port is released
+	utils.WaitReleased("tcp", []string{s.config.BindAddr}, restartRelease)
+
+	// Nothing serves the connections still queued anymore
+	rejected := rejectQueued(s.localChannel)
 
 	ctx, cancel := context.WithCancel(s.parentctx)
 	s.ctx = ctx
 	s.cancel = cancel
 
 	// Re-initialize variables
-	s.tunnelChannel = make(chan TunnelChannel, s.config.ChannelSize)
-	s.localChannel = make(chan LocalTCPConn, s.config.ChannelSize)
-	s.reqNewConnChan = make(chan struct{}, s.config.ChannelSize)
+	s.tunnelChannel = make(chan TunnelChannel, channelCapacity(s.config.ChannelSize, s.config.ChannelSizeMax))
+	s.localChannel = make(chan LocalTCPConn, channelCapacity(s.config.ChannelSize, s.config.ChannelSizeMax))
+	s.reqNewConnChan = make(chan struct{}, channelCapacity(s.config.ChannelSize, s.config.ChannelSizeMax))
 	s.controlChannel = nil
-	s.usageMonitor = web.NewDataStore(fmt.Sprintf(":%v", s.config.WebPort), ctx, s.config.SnifferLog, s.config.Sniffer, &s.config.TunnelStatus, s.logger)
+	s.standbyChannel = make(chan *websocket.Conn, 1)
+	s.usageMonitor = web.NewDataStore(fmt.Sprintf(":%v", s.config.WebPort), ctx, s.config.SnifferLog, s.config.Sniffer, &s.config.TunnelStatus, s.logger, s.config.SnifferMaxPorts, s.config.SnifferRetention)
+	s.usageMonitor.SetQueueStats(s.queueStats)
+	s.listeners = newPortListeners()
+	s.usageMonitor.SetDrainer(s.listeners.drain)
+	s.usageMonitor.SetTargeter(s.targets.set)
 	s.config.TunnelStatus = ""
 
 	// set the log level again
 	s.logger.SetLevel(level)
 
+	if rejected > 0 {
+		s.logger.Infof("closed %d local connections queued during the restart", rejected)
+	}
+
+	if s.parentctx.Err() != nil {
+		return
+	}
+
 	go s.Start()
 }
 
@@ -128,73 +208,136 @@ func (s *WsTransport) channelHandler() {
 	ticker := time.NewTicker(s.config.Heartbeat)
 	defer ticker.Stop()
 
-	// Channel to receive the message or error
-	messageChan := make(chan byte, 10)
+	// Heartbeats echoed back by the client
+	var acks heartbeatAcks
 
-	// Separate goroutine to continuously listen for messages
-	go func() {
-		for {
-			select {
-			case <-s.ctx.Done():
-				return
+	// Messages and read errors of the control channel and of the standby one
+	reads := make(chan controlRead, 10)
+	go readControl(s.ctx, s.controlChannel, reads)
 
-			default:
-				_, msg, err := s.controlChannel.ReadMessage()
-				// Exit if there's an error
-				if err != nil {
-					if s.cancel != nil {
-						s.logger.Error("failed to read from channel connection. ", err)
-						go s.Restart()
-					}
-					return
-				}
-				messageChan <- msg[0]
-			}
+	// Standby control channel of the client, held until the control channel fails
+	var standby *websocket.Conn
+	defer func() {
+		if standby != nil {
+			standby.Close()
 		}
 	}()
 
+	// failover makes the standby the control channel, false when there is none
+	failover := func(err error) bool {
+		if standby == nil {
+			return false
+		}
+
+		s.logger.Warnf("control channel failed, switching over to the standby control channel: %v", err)
+		s.controlChannel.Close()
+		s.controlChannel = standby
+		standby = nil
+		acks = heartbeatAcks{}
+		return true
+	}
+
+	// send writes a signal to the control channel, once more after a failover
+	send := func(signal byte) error {
+		err := s.controlChannel.WriteMessage(websocket.BinaryMessage, []byte{signal})
+		if err != nil && failover(err) {
+			if err = s.controlChannel.WriteMessage(websocket.BinaryMessage, []byte{utils.SG_Swap}); err == nil {
+				err = s.controlChannel.WriteMessage(websocket.BinaryMessage, []byte{signal})
+			}
+		}
+		return err
+	}
+
 	for {
 		select {
 		case <-s.ctx.Done():
 			_ = s.controlChannel.WriteMessage(websocket.BinaryMessage, []byte{utils.SG_Closed})
 			return
+
+		case conn := <-s.standbyChannel:
+			if standby != nil {
+				standby.Close()
+			}
+			standby = conn
+			go readControl(s.ctx, conn, reads)
+			s.logger.Debugf("holding standby control channel from %s", conn.RemoteAddr().String())
+
+		case <-s.backpressure.signals():
+			if !s.backpressure.due() {
+				continue
+			}
+			if err := send(utils.SG_Busy); err != nil {
+				s.logger.Error("failed to send tunnel channel full signal. ", err)
+				go s.Restart()
+				return
+			}
+			s.logger.Debug("tunnel channel is full, signaled the client to hold back new tunnel connections")
+
 		case <-s.reqNewConnChan:
-			err := s.controlChannel.WriteMessage(websocket.BinaryMessage, []byte{utils.SG_Chan})
-			if err != nil {
+			if err := send(utils.SG_Chan); err != nil {
 				s.logger.Error("failed to send request new connection signal. ", err)
 				go s.Restart()
 				return
 			}
 
 		case <-ticker.C:
-			err := s.controlChannel.WriteMessage(websocket.BinaryMessage, []byte{utils.SG_HB})
-			if err != nil {
+			if acks.missed(s.config.HeartbeatMisses) {
+				s.logger.Errorf("client did not acknowledge the last %d heartbeats, attempting to restart server...", acks.pending)
+				go s.Restart()
+				return
+			}
+
+			if err := send(utils.SG_HB); err != nil {
 				s.logger.Errorf("failed to send heartbeat signal. Error: %v.", err)
 				go s.Restart()
 				return
 			}
+			acks.sent()
 			s.logger.Debug("heartbeat signal sent successfully")
 
-		case msg, ok := <-messageChan:
-			if !ok {
-				s.logger.Error("channel closed, likely due to an error in WebSocket read")
+		case read := <-reads:
+			if standby != nil && read.conn == standby {
+				if read.err != nil {
+					s.logger.Debugf("standby control channel closed: %v", read.err)
+					standby.Close()
+					standby = nil
+					continue
+				}
+
+				// The client switched over first
+				failover(errors.New("the client switched over"))
+			} else if read.conn != s.controlChannel {
+				continue // a control channel that was switched away from
+			}
+
+			if read.err != nil {
+				if failover(read.err) {
+					_ = s.controlChannel.WriteMessage(websocket.BinaryMessage, []byte{utils.SG_Swap})
+					continue
+				}
+				s.logger.Error("failed to read from channel connection. ", read.err)
+				go s.Restart()
 				return
 			}
-			switch msg {
+
+			switch read.msg {
 			case utils.SG_HB:
+				acks.received()
 				s.logger.Trace("heartbeat signal received successfully")
 
+			case utils.SG_Swap:
+				s.logger.Trace("client switched over to the standby control channel")
+
 			case utils.SG_Closed:
 				s.logger.Warn("control channel has been closed by the client")
 				s.Restart()
 				return
 
 			default:
-				s.logger.Errorf("unexpected response from channel: %v", msg)
+				s.logger.Errorf("unexpected response from channel: %v", read.msg)
 				go s.Restart()
 				return
 			}
-
 		}
 	}
 }
@@ -212,18 +355,61 @@ func (s *WsTransport) tunnelListener() {
 
 	// Create an HTTP server
 	server := &http.Server{
-		Addr:        addr,
-		IdleTimeout: -1,
+		Addr:              addr,
+		IdleTimeout:       -1,
+		ReadHeaderTimeout: s.config.ProbeTimeout, // 0 waits for the request header without a limit
+		ConnState: func(conn net.Conn, state http.ConnState) {
+			if !s.handshakes.connState(conn, state) {
+				s.logger.Debugf("too many handshakes in progress, closing connection from %s", conn.RemoteAddr().String())
+				return
+			}
+			// An accept filter registered through the library can refuse the connection
+			if state == http.StateNew && !utils.AcceptAllowed(utils.AcceptedConn{Tunnel: true, Transport: "ws", RemoteAddr: conn.RemoteAddr(), LocalAddr: conn.LocalAddr()}, s.logger) {
+				conn.Close()
+				return
+			}
+			if state == http.StateNew {
+				utils.SetCongestionControl(conn)
+				utils.SetSocketBuffers(conn)
+				if tcpConn, ok := conn.(*net.TCPConn); ok && s.config.KeepAlive < 0 {
+					tcpConn.SetKeepAlive(false)
+				}
+			}
+		},
 		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			s.logger.Tracef("received http request from %s", r.RemoteAddr)
 
+			if s.bans.banned(r.RemoteAddr) {
+				s.logger.Debugf("refusing request from banned %s", r.RemoteAddr)
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+
 			// Read the "Authorization" header
 			authHeader := r.Header.Get("Authorization")
-			if authHeader != fmt.Sprintf("Bearer %v", s.config.Token) {
-				s.logger.Warnf("unauthorized request from %s, closing connection", r.RemoteAddr)
+			token, ok := strings.CutPrefix(authHeader, "Bearer ")
+			if !ok || !utils.ValidToken(token, s.config.Token, s.config.MaxTokenLength) {
+				s.authLog.unauthorized(r.RemoteAddr)
+				s.bans.fail(r.RemoteAddr)
 				http.Error(w, "unauthorized", http.StatusUnauthorized) // Send 401 Unauthorized response
 				return
 			}
+			if r.URL.Path == "/channel" {
+				s.bans.succeed(r.RemoteAddr)
+			}
+
+			// Another client with the same token would take over the tunnel, answered before upgrading so the client can tell
+			if controlChannel := s.controlChannel; r.URL.Path == "/channel" && controlChannel != nil && s.config.RejectDuplicate {
+				s.logger.Warnf("rejecting duplicate control channel from %s, a client is already connected from %s", r.RemoteAddr, controlChannel.RemoteAddr().String())
+				http.Error(w, "control channel already established", http.StatusConflict)
+				return
+			}
+
+			// A standby control channel is only held next to an established one
+			if r.URL.Path == "/standby" && s.controlChannel == nil {
+				http.Error(w, "no control channel established", http.StatusConflict)
+				return
+			}
 
 			conn, err := upgrader.Upgrade(w, r, nil)
 			if err != nil {
@@ -231,6 +417,16 @@ func (s *WsTransport) tunnelListener() {
 				return
 			}
 
+			if r.URL.Path == "/standby" {
+				select {
+				case s.standbyChannel <- conn:
+				default:
+					s.logger.Warnf("standby control channel from %s is already pending, closing it", r.RemoteAddr)
+					conn.Close()
+				}
+				return
+			}
+
 			if r.URL.Path == "/channel" {
 				if s.controlChannel != nil {
 					s.logger.Warn("new control channel requested.")
@@ -243,6 +439,7 @@ func (s *WsTransport) tunnelListener() {
 				s.controlChannel = conn
 
 				s.logger.Info("control channel established successfully")
+				utils.MarkReady(s.ctx)
 
 				numCPU := runtime.NumCPU()
 				if numCPU > 4 {
@@ -272,20 +469,27 @@ func (s *WsTransport) tunnelListener() {
 					s.logger.Debugf("websocket connection accepted from %s", conn.RemoteAddr().String())
 				default:
 					s.logger.Warnf("websocket tunnel channel is full, closing connection from %s", conn.RemoteAddr().String())
+					s.backpressure.discarded()
 					conn.Close()
 				}
 			}
 		}),
 	}
 
+	listener, err := utils.Listen(s.ctx, &net.ListenConfig{}, addr)
+	if err != nil {
+		s.startErrs.report(s.logger, "listen on", addr, err)
+		return
+	}
+
 	if s.config.Mode == config.WS {
 		go func() {
 			s.logger.Infof("ws server starting, listening on %s", addr)
 			if s.controlChannel == nil {
 				s.logger.Info("waiting for ws control channel connection")
 			}
-			if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-				s.logger.Fatalf("failed to listen on %s: %v", addr, err)
+			if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+				s.startErrs.report(s.logger, "listen on", addr, err)
 			}
 		}()
 	} else {
@@ -294,8 +498,19 @@ func (s *WsTransport) tunnelListener() {
 			if s.controlChannel == nil {
 				s.logger.Info("waiting for wss control channel connection")
 			}
-			if err := server.ListenAndServeTLS(s.config.TLSCertFile, s.config.TLSKeyFile); err != nil && err != http.ErrServerClosed {
-				s.logger.Fatalf("failed to listen on %s: %v", addr, err)
+			certFile, keyFile := s.config.TLSCertFile, s.config.TLSKeyFile
+			if s.config.TLSPSK {
+				cert, err := utils.PSKCertificate(s.config.Token)
+				if err != nil {
+					s.startErrs.report(s.logger, "generate the tls-psk certificate for", addr, err)
+					return
+				}
+				server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+				certFile, keyFile = "", "" // certificate is already loaded in TLSConfig
+				s.logger.Info("tls-psk mode enabled, using token derived certificate")
+			}
+			if err := server.ServeTLS(listener, certFile, keyFile); err != nil && err != http.ErrServerClosed {
+				s.startErrs.report(s.logger, "listen on", addr, err)
 			}
 		}()
 	}
@@ -315,7 +530,20 @@ func (s *WsTransport) tunnelListener() {
 }
 
 func (s *WsTransport) parsePortMappings() {
-	for _, portMapping := range s.config.Ports {
+	ports, _, err := limitPortMappings(s.config.Ports, s.config.MaxPortMappings, 0)
+	if err != nil {
+		s.startErrs.send(s.logger, err)
+	}
+
+	for _, portMapping := range ports {
+		// A "#label" suffix names the mapping in metrics, logs and the web interface
+		portMapping, label, err := splitLabel(portMapping)
+		if err != nil {
+			s.startErrs.report(s.logger, "parse port mapping", portMapping, err)
+			continue
+		}
+		labelPorts(portMapping, label)
+
 		parts := strings.Split(portMapping, "=")
 
 		var localAddr, remoteAddr string
@@ -329,18 +557,21 @@ func (s *WsTransport) parsePortMappings() {
 			if strings.Contains(localPortOrRange, "-") {
 				rangeParts := strings.Split(localPortOrRange, "-")
 				if len(rangeParts) != 2 {
-					s.logger.Fatalf("invalid port range format: %s", localPortOrRange)
+					s.startErrs.report(s.logger, "parse port mapping", portMapping, fmt.Errorf("invalid port range format: %s", localPortOrRange))
+					continue
 				}
 
 				// Parse and validate start and end ports
 				startPort, err := strconv.Atoi(strings.TrimSpace(rangeParts[0]))
 				if err != nil || startPort < 1 || startPort > 65535 {
-					s.logger.Fatalf("invalid start port in range: %s", rangeParts[0])
+					s.startErrs.report(s.logger, "parse port mapping", portMapping, fmt.Errorf("invalid start port in range: %s", rangeParts[0]))
+					continue
 				}
 
 				endPort, err := strconv.Atoi(strings.TrimSpace(rangeParts[1]))
 				if err != nil || endPort < 1 || endPort > 65535 || endPort < startPort {
-					s.logger.Fatalf("invalid end port in range: %s", rangeParts[1])
+					s.startErrs.report(s.logger, "parse port mapping", portMapping, fmt.Errorf("invalid end port in range: %s", rangeParts[1]))
+					continue
 				}
 
 				// Create listeners for all ports in the range
@@ -354,7 +585,8 @@ func (s *WsTransport) parsePortMappings() {
 				// Handle single port case
 				port, err := strconv.Atoi(localPortOrRange)
 				if err != nil || port < 1 || port > 65535 {
-					s.logger.Fatalf("invalid port format: %s", localPortOrRange)
+					s.startErrs.report(s.logger, "parse port mapping", portMapping, fmt.Errorf("invalid port format: %s", localPortOrRange))
+					continue
 				}
 				localAddr = fmt.Sprintf(":%d", port)
 			}
@@ -367,18 +599,21 @@ func (s *WsTransport) parsePortMappings() {
 			if strings.Contains(localPortOrRange, "-") {
 				rangeParts := strings.Split(localPortOrRange, "-")
 				if len(rangeParts) != 2 {
-					s.logger.Fatalf("invalid port range format: %s", localPortOrRange)
+					s.startErrs.report(s.logger, "parse port mapping", portMapping, fmt.Errorf("invalid port range format: %s", localPortOrRange))
+					continue
 				}
 
 				// Parse and validate start and end ports
 				startPort, err := strconv.Atoi(strings.TrimSpace(rangeParts[0]))
 				if err != nil || startPort < 1 || startPort > 65535 {
-					s.logger.Fatalf("invalid start port in range: %s", rangeParts[0])
+					s.startErrs.report(s.logger, "parse port mapping", portMapping, fmt.Errorf("invalid start port in range: %s", rangeParts[0]))
+					continue
 				}
 
 				endPort, err := strconv.Atoi(strings.TrimSpace(rangeParts[1]))
 				if err != nil || endPort < 1 || endPort > 65535 || endPort < startPort {
-					s.logger.Fatalf("invalid end port in range: %s", rangeParts[1])
+					s.startErrs.report(s.logger, "parse port mapping", portMapping, fmt.Errorf("invalid end port in range: %s", rangeParts[1]))
+					continue
 				}
 
 				// Create listeners for all ports in the range
@@ -398,7 +633,8 @@ func (s *WsTransport) parsePortMappings() {
 				}
 			}
 		} else {
-			s.logger.Fatalf("invalid port mapping format: %s", portMapping)
+			s.startErrs.report(s.logger, "parse port mapping", portMapping, fmt.Errorf("invalid port mapping format: %s", portMapping))
+			continue
 		}
 		// Start listeners for single port
 		go s.localListener(localAddr, remoteAddr)
@@ -406,20 +642,29 @@ func (s *WsTransport) parsePortMappings() {
 }
 
 func (s *WsTransport) localListener(localAddr string, remoteAddr string) {
-	portListener, err := net.Listen("tcp", localAddr)
+	// A missing capability only skips this mapping, the other listeners keep working
+	if err := utils.CheckBindPermission(localAddr); err != nil {
+		s.logger.Errorf("skipping listener on %s: %v", localAddr, err)
+		return
+	}
+
+	portListener, err := utils.Listen(s.ctx, &net.ListenConfig{Control: utils.MSSControl(s.config.MSSClamp, s.logger), KeepAlive: localKeepAlive(s.config.KeepAlive)}, localAddr)
 	if err != nil {
-		s.logger.Fatalf("failed to start listener on %s: %v", localAddr, err)
+		s.startErrs.report(s.logger, "listen on", localAddr, err)
 		return
 	}
 
 	//close local listener after context cancellation
 	defer portListener.Close()
 
+	// The port is drained on its own, other listeners keep running
+	ctx := s.listeners.add(s.ctx, portListener)
+
 	s.logger.Infof("listener started successfully, listening on address: %s", portListener.Addr().String())
 
 	go s.acceptLocalConn(portListener, remoteAddr)
 
-	<-s.ctx.Done()
+	<-ctx.Done()
 }
 
 func (s *WsTransport) acceptLocalConn(listener net.Listener, remoteAddr string) {
@@ -431,11 +676,17 @@ func (s *WsTransport) acceptLocalConn(listener net.Listener, remoteAddr string)
 		default:
 			s.logger.Debugf("waiting to accept incoming connection on %s", listener.Addr().String())
 			conn, err := listener.Accept()
+			if errors.Is(err, net.ErrClosed) {
+				return // the port was drained or the transport stopped
+			}
 			if err != nil {
 				s.logger.Debugf("failed to accept connection on %s: %v", listener.Addr().String(), err)
 				continue
 			}
 
+			utils.SetCongestionControl(conn)
+			utils.SetSocketBuffers(conn)
+
 			// discard any non-tcp connection
 			tcpConn, ok := conn.(*net.TCPConn)
 			if !ok {
@@ -444,17 +695,47 @@ func (s *WsTransport) acceptLocalConn(listener net.Listener, remoteAddr string)
 				continue
 			}
 
+			// An accept filter registered through the library can refuse the connection
+			if !utils.AcceptAllowed(utils.AcceptedConn{Tunnel: false, Transport: "ws", RemoteAddr: tcpConn.RemoteAddr(), LocalAddr: tcpConn.LocalAddr()}, s.logger) {
+				tcpConn.Close()
+				continue
+			}
+
+			// Under overload new connections are refused, the ones in flight keep going
+			if utils.Overloaded() {
+				s.logger.Debugf("overloaded, closing connection from %s", tcpConn.RemoteAddr().String())
+				s.connLimit.reject(tcpConn)
+				s.backpressure.discarded()
+				continue
+			}
+
+			// Beyond the cap on connections in flight the connection is closed before it costs anything
+			if conn, ok = s.connLimit.track(tcpConn); !ok {
+				s.logger.Debugf("%d local connections in flight, closing connection from %s", s.config.MaxConns, tcpConn.RemoteAddr().String())
+				s.connLimit.reject(tcpConn)
+				continue
+			}
+
 			// trying to enable tcpnodelay
-			if !s.config.Nodelay {
-				if err := tcpConn.SetNoDelay(s.config.Nodelay); err != nil {
+			if !s.config.LocalNodelay {
+				if err := tcpConn.SetNoDelay(s.config.LocalNodelay); err != nil {
 					s.logger.Warnf("failed to set TCP_NODELAY for %s: %v", tcpConn.RemoteAddr().String(), err)
 				} else {
 					s.logger.Tracef("TCP_NODELAY disabled for %s", tcpConn.RemoteAddr().String())
 				}
 			}
 
+			// A target override of the port applies to new connections only
+			target := s.targets.target(tcpConn.LocalAddr().(*net.TCPAddr).Port, remoteAddr)
+
+			// A nil channel is never ready, the connection is discarded as on a full channel
+			localChannel := s.localChannel
+			if !s.localLimit.allow(len(localChannel)) {
+				localChannel = nil
+			}
+
 			select {
-			case s.localChannel <- LocalTCPConn{conn: conn, remoteAddr: remoteAddr}:
+			case localChannel <- LocalTCPConn{conn: conn, remoteAddr: target, queuedAt: time.Now()}:
 
 				select {
 				case s.reqNewConnChan <- struct{}{}:
@@ -493,8 +774,11 @@ func (s *WsTransport) handleLoop() {
 						tunnelConnection.conn.Close()
 						continue loop
 					}
+					// The connection waits in the queue until a tunnel connection is available
+					s.queueStats.Observe(time.Since(localConn.queuedAt))
+
 					// Handle data exchange between connections
-					go utils.WSConnectionHandler(tunnelConnection.conn, localConn.conn, s.logger, s.usageMonitor, localConn.conn.LocalAddr().(*net.TCPAddr).Port, s.config.Sniffer)
+					go utils.WSConnectionHandler(tunnelConnection.conn, localConn.conn, s.logger, s.usageMonitor, localConn.conn.LocalAddr().(*net.TCPAddr).Port, s.config.Sniffer, true)
 					break loop
 				}
 			}
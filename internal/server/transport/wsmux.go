@@ -2,6 +2,8 @@ package transport
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
@@ -30,23 +32,46 @@ type WsMuxTransport struct {
 	logger         *logrus.Logger
 	tunnelChannel  chan *smux.Session
 	localChannel   chan LocalTCPConn
+	retryChannel   chan LocalTCPConn // local connections put back after a failed stream, served first
 	reqNewConnChan chan struct{}
 	controlChannel *websocket.Conn
+	standbyChannel chan *websocket.Conn // standby control channels handed to the channel handler
+	resumeChannel  chan *websocket.Conn // reconnected control channels handed to the channel handler
+	resuming       atomic.Bool          // the channel handler waits for the client to reconnect the control channel
 	usageMonitor   *web.Usage
+	queueStats     *web.QueueStats
+	listeners      *portListeners
+	targets        *targetOverrides
+	proxyTLVs      []proxyTLV
+	localLimit     *channelLimit
+	fairQueue      *fairQueue
+	bans           *banList
+	authLog        *authLog
+	handshakes     *handshakeLimit
 	restartMutex   sync.Mutex
 	streamCounter  int32
 	sessionCounter int32
+	rotateMutex    sync.Mutex
+	rotateChan     chan struct{} // closed to rotate the active mux sessions
+	streamOrder    *streamOrder
+	startErrs      startErrors
+	connLimit      *connLimit
+	lifetime       *connLifetime
+	backpressure   *backpressure
 }
 
 type WsMuxConfig struct {
 	BindAddr         string
 	Token            string
+	MaxTokenLength   int
 	SnifferLog       string
 	TLSCertFile      string // Path to the TLS certificate file
 	TLSKeyFile       string // Path to the TLS key file
+	TLSPSK           bool   // Derive the TLS certificate from the token instead of cert files
 	TunnelStatus     string
 	Ports            []string
 	Nodelay          bool
+	LocalNodelay     bool // Nodelay of the sockets facing the users
 	Sniffer          bool
 	KeepAlive        time.Duration
 	Heartbeat        time.Duration // in seconds
@@ -57,11 +82,41 @@ type WsMuxConfig struct {
 	MaxReceiveBuffer int
 	MaxStreamBuffer  int
 	WebPort          int
+	SnifferMaxPorts  int
+	SnifferRetention time.Duration
 	Mode             config.TransportType // ws or wss
-
+	MSSClamp         int                  // TCP_MAXSEG for local connections, 0 disables clamping
+	ReadDeadline     time.Duration        // Bound on a single read in the copy loop, 0 disables it
+	WriteDeadline    time.Duration        // Bound on a single write in the copy loop, 0 disables it
+	QueueThreshold   time.Duration        // Warn when a connection waits longer in the local channel, 0 disables it
+	HeartbeatMisses  int                  // Unacknowledged heartbeats in a row before restarting, 0 disables the check
+	ChannelSizeMax   int                  // Ceiling the local channel limit grows to when it fills up, 0 keeps ChannelSize fixed
+	RejectDuplicate  bool                 // Refuse a second control channel instead of restarting for it
+	BanAfter         int                  // Failed handshakes before the client IP is banned, 0 disables banning
+	BanTime          time.Duration        // How long a ban lasts, failures are counted within the same window
+	AuthLogInterval  time.Duration        // Summarize unauthorized requests once per interval, 0 logs each of them
+	MaxHandshakes    int                  // Tunnel connections in their handshake at once, more are closed right away, 0 disables the cap
+	ProbeTimeout     time.Duration        // Close connections without a complete request header for this long, 0 disables it
+	ProxyProtocol    []string             // Local ports whose backends get a PROXY protocol v2 header with the user IP and port
+	ProxyTLVs        []string             // Custom TLVs of the PROXY protocol header as "type=value", with {label}, {port} and {transport} filled in
+	PrefacePorts     []string             // Local ports whose backends are Backhaul servers that get a preface with the user and the transport
+	SessionIdle      time.Duration        // Close mux sessions without streams for this long, 0 keeps them open
+	SessionIdleMin   int                  // Sessions kept open however idle they are
+	OrderedStreams   bool                 // Take local connections and open their streams one session at a time, in accept order
+	MaxStreams       int                  // Streams alive at once on one session, at least MuxCon
+	SessionStreams   int                  // Streams opened on a session before it is rotated, 0 never rotates it
+	Backpressure     bool                 // Tell the client to hold back tunnel connections while the tunnel channel is full
+	ControlGrace     time.Duration        // Keep the mux sessions while the client reconnects a failed control channel for this long, 0 restarts right away
+	MaxConns         int                  // Local connections in flight across all ports, more are closed at accept, 0 disables the cap
+	RejectHTTPPorts  []string             // Local ports answered with an HTTP 503 beyond MaxConns instead of a bare close
+	RejectRetryAfter int                  // Seconds in the Retry-After header of that 503, 0 leaves the header out
+	MaxPortMappings  int                  // Listeners the port mappings may open, a range counts every port, the rest are refused, 0 disables the cap
+	PortWeights      []string             // "port=weight" or "start-end=weight", local connections are handed out in weighted round robin across ports, others weigh 1
+	MaxLifetime      time.Duration        // Forwarded connections are closed after this long whatever their activity, 0 is unlimited
+	LifetimePorts    []string             // "port=seconds" or "start-end=seconds", overrides MaxLifetime for these local ports
 }
 
-func NewWSMuxServer(parentCtx context.Context, config *WsMuxConfig, logger *logrus.Logger) *WsMuxTransport {
+func NewWSMuxServer(parentCtx context.Context, config *WsMuxConfig, logger *logrus.Logger) (*WsMuxTransport, error) {
 	// Create a derived context from the parent context
 	ctx, cancel := context.WithCancel(parentCtx)
 
@@ -80,16 +135,50 @@ func NewWSMuxServer(parentCtx context.Context, config *WsMuxConfig, logger *logr
 		ctx:            ctx,
 		cancel:         cancel,
 		logger:         logger,
-		tunnelChannel:  make(chan *smux.Session, config.ChannelSize),
-		localChannel:   make(chan LocalTCPConn, config.ChannelSize),
-		reqNewConnChan: make(chan struct{}, config.ChannelSize),
+		tunnelChannel:  make(chan *smux.Session, channelCapacity(config.ChannelSize, config.ChannelSizeMax)),
+		localChannel:   make(chan LocalTCPConn, channelCapacity(config.ChannelSize, config.ChannelSizeMax)),
+		retryChannel:   make(chan LocalTCPConn, channelCapacity(config.ChannelSize, config.ChannelSizeMax)),
+		reqNewConnChan: make(chan struct{}, channelCapacity(config.ChannelSize, config.ChannelSizeMax)),
 		streamCounter:  0,
 		sessionCounter: 0,
+		rotateChan:     make(chan struct{}),
+		streamOrder:    newStreamOrder(config.OrderedStreams),
 		controlChannel: nil, // will be set when a control connection is established
-		usageMonitor:   web.NewDataStore(fmt.Sprintf(":%v", config.WebPort), ctx, config.SnifferLog, config.Sniffer, &config.TunnelStatus, logger),
+		standbyChannel: make(chan *websocket.Conn, 1),
+		resumeChannel:  make(chan *websocket.Conn, 1),
+		usageMonitor:   web.NewDataStore(fmt.Sprintf(":%v", config.WebPort), ctx, config.SnifferLog, config.Sniffer, &config.TunnelStatus, logger, config.SnifferMaxPorts, config.SnifferRetention),
+		queueStats:     web.NewQueueStats(config.QueueThreshold, logger),
+		localLimit:     newChannelLimit(config.ChannelSize, config.ChannelSizeMax, logger),
+		fairQueue:      newFairQueue(config.PortWeights, logger),
+		bans:           newBanList(config.BanAfter, config.BanTime, logger),
+		authLog:        newAuthLog(parentCtx, config.AuthLogInterval, logger),
+		handshakes:     newHandshakeLimit(config.MaxHandshakes),
+		startErrs:      newStartErrors(),
+		connLimit:      newConnLimit(config.MaxConns, config.RejectHTTPPorts, config.RejectRetryAfter),
+		lifetime:       newConnLifetime(config.MaxLifetime, config.LifetimePorts, logger),
+		backpressure:   newBackpressure(config.Backpressure),
+	}
+
+	server.usageMonitor.SetQueueStats(server.queueStats)
+	server.targets = newTargetOverrides()
+	server.proxyTLVs = newProxyTLVs(config.ProxyTLVs, string(config.Mode), logger)
+	server.listeners = newPortListeners()
+	server.usageMonitor.SetDrainer(server.listeners.drain)
+	server.usageMonitor.SetTargeter(server.targets.set)
+
+	// The session would fail on every connection with an invalid configuration
+	if err := smux.VerifyConfig(server.smuxConfig); err != nil {
+		cancel()
+		return nil, fmt.Errorf("invalid mux configuration: %w", err)
 	}
 
-	return server
+	return server, nil
+}
+
+// Errors reports the listeners the transport failed to set up, for as long as
+// it runs. A failed listener is not retried until the next restart.
+func (s *WsMuxTransport) Errors() <-chan error {
+	return s.startErrs
 }
 
 func (s *WsMuxTransport) Start() {
@@ -101,10 +190,17 @@ func (s *WsMuxTransport) Start() {
 	s.config.TunnelStatus = fmt.Sprintf("Disconnected (%s)", s.config.Mode)
 
 	go s.tunnelListener()
+	go s.localLimit.shrink(s.ctx)
+	go s.fairQueue.run(s.ctx, s.localChannel)
 
 }
 
 func (s *WsMuxTransport) Restart() {
+	// Nothing to restart once the tunnel is shutting down, e.g. for a config reload
+	if s.parentctx.Err() != nil {
+		return
+	}
+
 	if !s.restartMutex.TryLock() {
 		s.logger.Warn("server restart already in progress, skipping restart attempt")
 		return
@@ -112,11 +208,15 @@ func (s *WsMuxTransport) Restart() {
 	defer s.restartMutex.Unlock()
 
 	s.logger.Info("restarting server...")
+	utils.CountRestart()
 
 	// for removing timeout logs
 	level := s.logger.Level
 	s.logger.SetLevel(logrus.FatalLevel)
 
+	// Stop accepting first, users are refused rather than failing mid setup
+	s.listeners.closeAll()
+
 	if s.cancel != nil {
 		s.cancel()
 	}
@@ -126,18 +226,29 @@ func (s *WsMuxTransport) Restart() {
 		s.controlChannel.Close()
 	}
 
-	time.Sleep(2 * time.Second)
+	// Listen again as soon as the tunnel port is released
+	utils.WaitReleased("tcp", []string{s.config.BindAddr}, restartRelease)
+
+	// Nothing serves the connections still queued anymore
+	rejected := rejectQueued(s.localChannel, s.retryChannel)
 
 	ctx, cancel := context.WithCancel(s.parentctx)
 	s.ctx = ctx
 	s.cancel = cancel
 
 	// Re-initialize variables
-	s.tunnelChannel = make(chan *smux.Session, s.config.ChannelSize)
-	s.localChannel = make(chan LocalTCPConn, s.config.ChannelSize)
-	s.reqNewConnChan = make(chan struct{}, s.config.ChannelSize)
+	s.tunnelChannel = make(chan *smux.Session, channelCapacity(s.config.ChannelSize, s.config.ChannelSizeMax))
+	s.localChannel = make(chan LocalTCPConn, channelCapacity(s.config.ChannelSize, s.config.ChannelSizeMax))
+	s.retryChannel = make(chan LocalTCPConn, channelCapacity(s.config.ChannelSize, s.config.ChannelSizeMax))
+	s.reqNewConnChan = make(chan struct{}, channelCapacity(s.config.ChannelSize, s.config.ChannelSizeMax))
 	s.controlChannel = nil
-	s.usageMonitor = web.NewDataStore(fmt.Sprintf(":%v", s.config.WebPort), ctx, s.config.SnifferLog, s.config.Sniffer, &s.config.TunnelStatus, s.logger)
+	s.standbyChannel = make(chan *websocket.Conn, 1)
+	s.resumeChannel = make(chan *websocket.Conn, 1)
+	s.usageMonitor = web.NewDataStore(fmt.Sprintf(":%v", s.config.WebPort), ctx, s.config.SnifferLog, s.config.Sniffer, &s.config.TunnelStatus, s.logger, s.config.SnifferMaxPorts, s.config.SnifferRetention)
+	s.usageMonitor.SetQueueStats(s.queueStats)
+	s.listeners = newPortListeners()
+	s.usageMonitor.SetDrainer(s.listeners.drain)
+	s.usageMonitor.SetTargeter(s.targets.set)
 	s.config.TunnelStatus = ""
 	s.streamCounter = 0
 	s.sessionCounter = 0
@@ -145,6 +256,14 @@ func (s *WsMuxTransport) Restart() {
 	// set the log level again
 	s.logger.SetLevel(level)
 
+	if rejected > 0 {
+		s.logger.Infof("closed %d local connections queued during the restart", rejected)
+	}
+
+	if s.parentctx.Err() != nil {
+		return
+	}
+
 	go s.Start()
 }
 
@@ -152,73 +271,183 @@ func (s *WsMuxTransport) channelHandler() {
 	ticker := time.NewTicker(s.config.Heartbeat)
 	defer ticker.Stop()
 
-	// Channel to receive the message or error
-	messageChan := make(chan byte, 10)
+	// Heartbeats echoed back by the client
+	var acks heartbeatAcks
 
-	// Separate goroutine to continuously listen for messages
-	go func() {
-		for {
-			select {
-			case <-s.ctx.Done():
-				return
+	// Messages and read errors of the control channel and of the standby one
+	reads := make(chan controlRead, 10)
+	go readControl(s.ctx, s.controlChannel, reads)
 
-			default:
-				_, msg, err := s.controlChannel.ReadMessage()
-				// Exit if there's an error
-				if err != nil {
-					if s.cancel != nil {
-						s.logger.Error("failed to read from channel connection. ", err)
-						go s.Restart()
-					}
-					return
-				}
-				messageChan <- msg[0]
-			}
+	// Standby control channel of the client, held until the control channel fails
+	var standby *websocket.Conn
+	defer func() {
+		if standby != nil {
+			standby.Close()
 		}
 	}()
 
+	// failover makes the standby the control channel, false when there is none
+	failover := func(err error) bool {
+		if standby == nil {
+			return false
+		}
+
+		s.logger.Warnf("control channel failed, switching over to the standby control channel: %v", err)
+		s.controlChannel.Close()
+		s.controlChannel = standby
+		standby = nil
+		acks = heartbeatAcks{}
+		return true
+	}
+
+	// send writes a signal to the control channel, once more after a failover
+	send := func(signal byte) error {
+		err := s.controlChannel.WriteMessage(websocket.BinaryMessage, []byte{signal})
+		if err != nil && failover(err) {
+			if err = s.controlChannel.WriteMessage(websocket.BinaryMessage, []byte{utils.SG_Swap}); err == nil {
+				err = s.controlChannel.WriteMessage(websocket.BinaryMessage, []byte{signal})
+			}
+		}
+		return err
+	}
+
+	// reconnected switches over to a control channel the client reconnected
+	reconnected := func(conn *websocket.Conn) {
+		s.controlChannel.Close()
+		s.controlChannel = conn
+		acks = heartbeatAcks{}
+		go readControl(s.ctx, conn, reads)
+		s.config.TunnelStatus = fmt.Sprintf("Connected (%s)", s.config.Mode)
+		s.logger.Infof("control channel reconnected from %s, mux sessions kept", conn.RemoteAddr().String())
+	}
+
+	// resume waits up to ControlGrace for the client to reconnect the control
+	// channel while the mux sessions keep serving, false when it did not
+	resume := func(err error) bool {
+		if s.config.ControlGrace <= 0 {
+			return false
+		}
+
+		s.logger.Warnf("control channel failed, waiting %v for the client to reconnect it: %v", s.config.ControlGrace, err)
+		s.config.TunnelStatus = fmt.Sprintf("Reconnecting (%s)", s.config.Mode)
+		s.resuming.Store(true)
+		defer s.resuming.Store(false)
+
+		timeout := time.NewTimer(s.config.ControlGrace)
+		defer timeout.Stop()
+
+		select {
+		case <-s.ctx.Done():
+			return true // the handler returns on the next iteration
+		case conn := <-s.resumeChannel:
+			reconnected(conn)
+			return true
+		case <-timeout.C:
+			s.logger.Errorf("client did not reconnect the control channel within %v", s.config.ControlGrace)
+			return false
+		}
+	}
+
 	for {
 		select {
 		case <-s.ctx.Done():
 			_ = s.controlChannel.WriteMessage(websocket.BinaryMessage, []byte{utils.SG_Closed})
 			return
+
+		case conn := <-s.standbyChannel:
+			if standby != nil {
+				standby.Close()
+			}
+			standby = conn
+			go readControl(s.ctx, conn, reads)
+			s.logger.Debugf("holding standby control channel from %s", conn.RemoteAddr().String())
+
+		case conn := <-s.resumeChannel:
+			// The client noticed the failure first
+			reconnected(conn)
+
+		case <-s.backpressure.signals():
+			if !s.backpressure.due() {
+				continue
+			}
+			if err := send(utils.SG_Busy); err != nil && !resume(err) {
+				s.logger.Error("failed to send tunnel channel full signal. ", err)
+				go s.Restart()
+				return
+			}
+			s.logger.Debug("tunnel channel is full, signaled the client to hold back new tunnel connections")
+
 		case <-s.reqNewConnChan:
-			err := s.controlChannel.WriteMessage(websocket.BinaryMessage, []byte{utils.SG_Chan})
-			if err != nil {
+			if err := send(utils.SG_Chan); err != nil && !resume(err) {
 				s.logger.Error("failed to send request new connection signal. ", err)
 				go s.Restart()
 				return
 			}
 
 		case <-ticker.C:
-			err := s.controlChannel.WriteMessage(websocket.BinaryMessage, []byte{utils.SG_HB})
-			if err != nil {
+			if acks.missed(s.config.HeartbeatMisses) {
+				s.logger.Errorf("client did not acknowledge the last %d heartbeats, attempting to restart server...", acks.pending)
+				go s.Restart()
+				return
+			}
+
+			if err := send(utils.SG_HB); err != nil {
+				if resume(err) {
+					continue
+				}
 				s.logger.Errorf("failed to send heartbeat signal. Error: %v.", err)
 				go s.Restart()
 				return
 			}
+			acks.sent()
 			s.logger.Debug("heartbeat signal sent successfully")
 
-		case msg, ok := <-messageChan:
-			if !ok {
-				s.logger.Error("channel closed, likely due to an error in WebSocket read")
+		case read := <-reads:
+			if standby != nil && read.conn == standby {
+				if read.err != nil {
+					s.logger.Debugf("standby control channel closed: %v", read.err)
+					standby.Close()
+					standby = nil
+					continue
+				}
+
+				// The client switched over first
+				failover(errors.New("the client switched over"))
+			} else if read.conn != s.controlChannel {
+				continue // a control channel that was switched away from
+			}
+
+			if read.err != nil {
+				if failover(read.err) {
+					_ = s.controlChannel.WriteMessage(websocket.BinaryMessage, []byte{utils.SG_Swap})
+					continue
+				}
+				if resume(read.err) {
+					continue
+				}
+				s.logger.Error("failed to read from channel connection. ", read.err)
+				go s.Restart()
 				return
 			}
-			switch msg {
+
+			switch read.msg {
 			case utils.SG_HB:
+				acks.received()
 				s.logger.Trace("heartbeat signal received successfully")
 
+			case utils.SG_Swap:
+				s.logger.Trace("client switched over to the standby control channel")
+
 			case utils.SG_Closed:
 				s.logger.Warn("control channel has been closed by the client")
 				s.Restart()
 				return
 
 			default:
-				s.logger.Errorf("unexpected response from channel: %v", msg)
+				s.logger.Errorf("unexpected response from channel: %v", read.msg)
 				go s.Restart()
 				return
 			}
-
 		}
 	}
 }
@@ -236,18 +465,69 @@ func (s *WsMuxTransport) tunnelListener() {
 
 	// Create an HTTP server
 	server := &http.Server{
-		Addr:        addr,
-		IdleTimeout: -1,
+		Addr:              addr,
+		IdleTimeout:       -1,
+		ReadHeaderTimeout: s.config.ProbeTimeout, // 0 waits for the request header without a limit
+		ConnState: func(conn net.Conn, state http.ConnState) {
+			if !s.handshakes.connState(conn, state) {
+				s.logger.Debugf("too many handshakes in progress, closing connection from %s", conn.RemoteAddr().String())
+				return
+			}
+			// An accept filter registered through the library can refuse the connection
+			if state == http.StateNew && !utils.AcceptAllowed(utils.AcceptedConn{Tunnel: true, Transport: "wsmux", RemoteAddr: conn.RemoteAddr(), LocalAddr: conn.LocalAddr()}, s.logger) {
+				conn.Close()
+				return
+			}
+			if state == http.StateNew {
+				utils.SetCongestionControl(conn)
+				utils.SetSocketBuffers(conn)
+				if tcpConn, ok := conn.(*net.TCPConn); ok && s.config.KeepAlive < 0 {
+					tcpConn.SetKeepAlive(false)
+				}
+			}
+		},
 		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			s.logger.Tracef("received http request from %s", r.RemoteAddr)
 
+			if s.bans.banned(r.RemoteAddr) {
+				s.logger.Debugf("refusing request from banned %s", r.RemoteAddr)
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+
 			// Read the "Authorization" header
 			authHeader := r.Header.Get("Authorization")
-			if authHeader != fmt.Sprintf("Bearer %v", s.config.Token) {
-				s.logger.Warnf("unauthorized request from %s, closing connection", r.RemoteAddr)
+			token, ok := strings.CutPrefix(authHeader, "Bearer ")
+			if !ok || !utils.ValidToken(token, s.config.Token, s.config.MaxTokenLength) {
+				s.authLog.unauthorized(r.RemoteAddr)
+				s.bans.fail(r.RemoteAddr)
 				http.Error(w, "unauthorized", http.StatusUnauthorized) // Send 401 Unauthorized response
 				return
 			}
+			if r.URL.Path == "/channel" {
+				s.bans.succeed(r.RemoteAddr)
+			}
+
+			// Another client with the same token would take over the tunnel, answered before upgrading so the client can tell
+			if controlChannel := s.controlChannel; r.URL.Path == "/channel" && controlChannel != nil && s.config.RejectDuplicate && !s.resuming.Load() {
+				s.logger.Warnf("rejecting duplicate control channel from %s, a client is already connected from %s", r.RemoteAddr, controlChannel.RemoteAddr().String())
+				http.Error(w, "control channel already established", http.StatusConflict)
+				return
+			}
+
+			// Clients telling their mux version are refused on a mismatch, before their sessions fail on it
+			if version, err := strconv.Atoi(r.Header.Get(utils.MuxVersionHeader)); err == nil && r.URL.Path == "/channel" && version != s.config.MuxVersion {
+				s.logger.Error(utils.MuxVersionMismatch("client "+r.RemoteAddr, version, s.config.MuxVersion))
+				w.Header().Set(utils.MuxVersionHeader, strconv.Itoa(s.config.MuxVersion))
+				http.Error(w, "mux version mismatch", http.StatusPreconditionFailed)
+				return
+			}
+
+			// A standby control channel is only held next to an established one
+			if r.URL.Path == "/standby" && s.controlChannel == nil {
+				http.Error(w, "no control channel established", http.StatusConflict)
+				return
+			}
 
 			conn, err := upgrader.Upgrade(w, r, nil)
 			if err != nil {
@@ -255,7 +535,28 @@ func (s *WsMuxTransport) tunnelListener() {
 				return
 			}
 
+			if r.URL.Path == "/standby" {
+				select {
+				case s.standbyChannel <- conn:
+				default:
+					s.logger.Warnf("standby control channel from %s is already pending, closing it", r.RemoteAddr)
+					conn.Close()
+				}
+				return
+			}
+
 			if r.URL.Path == "/channel" {
+				// A reconnected control channel takes over without restarting, the mux sessions are kept
+				if s.controlChannel != nil && s.config.ControlGrace > 0 {
+					select {
+					case s.resumeChannel <- conn:
+					default:
+						s.logger.Warnf("reconnected control channel from %s is already pending, closing it", r.RemoteAddr)
+						conn.Close()
+					}
+					return
+				}
+
 				if s.controlChannel != nil {
 					s.logger.Warn("new control channel requested.")
 					s.controlChannel.Close()
@@ -267,6 +568,7 @@ func (s *WsMuxTransport) tunnelListener() {
 				s.controlChannel = conn
 
 				s.logger.Info("control channel established successfully")
+				utils.MarkReady(s.ctx)
 
 				numCPU := runtime.NumCPU()
 				if numCPU > 4 {
@@ -291,24 +593,34 @@ func (s *WsMuxTransport) tunnelListener() {
 					conn.Close()
 					return
 				}
+				utils.LogMuxSession(session, s.smuxConfig, s.logger)
+				go utils.WatchMuxMismatch(session, s.smuxConfig.Version, s.logger)
+
 				select {
 				case s.tunnelChannel <- session: // ok
 				default:
 					s.logger.Warnf("tunnel listener channel is full, discarding TCP connection from %s", conn.LocalAddr().String())
+					s.backpressure.discarded()
 					conn.Close()
 				}
 			}
 		}),
 	}
 
+	listener, err := utils.Listen(s.ctx, &net.ListenConfig{}, addr)
+	if err != nil {
+		s.startErrs.report(s.logger, "listen on", addr, err)
+		return
+	}
+
 	if s.config.Mode == config.WSMUX {
 		go func() {
 			s.logger.Infof("%s server starting, listening on %s", s.config.Mode, addr)
 			if s.controlChannel == nil {
 				s.logger.Infof("waiting for %s control channel connection", s.config.Mode)
 			}
-			if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-				s.logger.Fatalf("failed to listen on %s: %v", addr, err)
+			if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+				s.startErrs.report(s.logger, "listen on", addr, err)
 			}
 		}()
 	} else {
@@ -317,8 +629,19 @@ func (s *WsMuxTransport) tunnelListener() {
 			if s.controlChannel == nil {
 				s.logger.Infof("waiting for %s control channel connection", s.config.Mode)
 			}
-			if err := server.ListenAndServeTLS(s.config.TLSCertFile, s.config.TLSKeyFile); err != nil && err != http.ErrServerClosed {
-				s.logger.Fatalf("failed to listen on %s: %v", addr, err)
+			certFile, keyFile := s.config.TLSCertFile, s.config.TLSKeyFile
+			if s.config.TLSPSK {
+				cert, err := utils.PSKCertificate(s.config.Token)
+				if err != nil {
+					s.startErrs.report(s.logger, "generate the tls-psk certificate for", addr, err)
+					return
+				}
+				server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+				certFile, keyFile = "", "" // certificate is already loaded in TLSConfig
+				s.logger.Info("tls-psk mode enabled, using token derived certificate")
+			}
+			if err := server.ServeTLS(listener, certFile, keyFile); err != nil && err != http.ErrServerClosed {
+				s.startErrs.report(s.logger, "listen on", addr, err)
 			}
 		}()
 	}
@@ -338,7 +661,20 @@ func (s *WsMuxTransport) tunnelListener() {
 }
 
 func (s *WsMuxTransport) parsePortMappings() {
-	for _, portMapping := range s.config.Ports {
+	ports, _, err := limitPortMappings(s.config.Ports, s.config.MaxPortMappings, 0)
+	if err != nil {
+		s.startErrs.send(s.logger, err)
+	}
+
+	for _, portMapping := range ports {
+		// A "#label" suffix names the mapping in metrics, logs and the web interface
+		portMapping, label, err := splitLabel(portMapping)
+		if err != nil {
+			s.startErrs.report(s.logger, "parse port mapping", portMapping, err)
+			continue
+		}
+		labelPorts(portMapping, label)
+
 		parts := strings.Split(portMapping, "=")
 
 		var localAddr, remoteAddr string
@@ -352,18 +688,21 @@ func (s *WsMuxTransport) parsePortMappings() {
 			if strings.Contains(localPortOrRange, "-") {
 				rangeParts := strings.Split(localPortOrRange, "-")
 				if len(rangeParts) != 2 {
-					s.logger.Fatalf("invalid port range format: %s", localPortOrRange)
+					s.startErrs.report(s.logger, "parse port mapping", portMapping, fmt.Errorf("invalid port range format: %s", localPortOrRange))
+					continue
 				}
 
 				// Parse and validate start and end ports
 				startPort, err := strconv.Atoi(strings.TrimSpace(rangeParts[0]))
 				if err != nil || startPort < 1 || startPort > 65535 {
-					s.logger.Fatalf("invalid start port in range: %s", rangeParts[0])
+					s.startErrs.report(s.logger, "parse port mapping", portMapping, fmt.Errorf("invalid start port in range: %s", rangeParts[0]))
+					continue
 				}
 
 				endPort, err := strconv.Atoi(strings.TrimSpace(rangeParts[1]))
 				if err != nil || endPort < 1 || endPort > 65535 || endPort < startPort {
-					s.logger.Fatalf("invalid end port in range: %s", rangeParts[1])
+					s.startErrs.report(s.logger, "parse port mapping", portMapping, fmt.Errorf("invalid end port in range: %s", rangeParts[1]))
+					continue
 				}
 
 				// Create listeners for all ports in the range
@@ -377,7 +716,8 @@ func (s *WsMuxTransport) parsePortMappings() {
 				// Handle single port case
 				port, err := strconv.Atoi(localPortOrRange)
 				if err != nil || port < 1 || port > 65535 {
-					s.logger.Fatalf("invalid port format: %s", localPortOrRange)
+					s.startErrs.report(s.logger, "parse port mapping", portMapping, fmt.Errorf("invalid port format: %s", localPortOrRange))
+					continue
 				}
 				localAddr = fmt.Sprintf(":%d", port)
 			}
@@ -390,18 +730,21 @@ func (s *WsMuxTransport) parsePortMappings() {
 			if strings.Contains(localPortOrRange, "-") {
 				rangeParts := strings.Split(localPortOrRange, "-")
 				if len(rangeParts) != 2 {
-					s.logger.Fatalf("invalid port range format: %s", localPortOrRange)
+					s.startErrs.report(s.logger, "parse port mapping", portMapping, fmt.Errorf("invalid port range format: %s", localPortOrRange))
+					continue
 				}
 
 				// Parse and validate start and end ports
 				startPort, err := strconv.Atoi(strings.TrimSpace(rangeParts[0]))
 				if err != nil || startPort < 1 || startPort > 65535 {
-					s.logger.Fatalf("invalid start port in range: %s", rangeParts[0])
+					s.startErrs.report(s.logger, "parse port mapping", portMapping, fmt.Errorf("invalid start port in range: %s", rangeParts[0]))
+					continue
 				}
 
 				endPort, err := strconv.Atoi(strings.TrimSpace(rangeParts[1]))
 				if err != nil || endPort < 1 || endPort > 65535 || endPort < startPort {
-					s.logger.Fatalf("invalid end port in range: %s", rangeParts[1])
+					s.startErrs.report(s.logger, "parse port mapping", portMapping, fmt.Errorf("invalid end port in range: %s", rangeParts[1]))
+					continue
 				}
 
 				// Create listeners for all ports in the range
@@ -421,7 +764,8 @@ func (s *WsMuxTransport) parsePortMappings() {
 				}
 			}
 		} else {
-			s.logger.Fatalf("invalid port mapping format: %s", portMapping)
+			s.startErrs.report(s.logger, "parse port mapping", portMapping, fmt.Errorf("invalid port mapping format: %s", portMapping))
+			continue
 		}
 		// Start listeners for single port
 		go s.localListener(localAddr, remoteAddr)
@@ -429,20 +773,29 @@ func (s *WsMuxTransport) parsePortMappings() {
 }
 
 func (s *WsMuxTransport) localListener(localAddr string, remoteAddr string) {
-	listener, err := net.Listen("tcp", localAddr)
+	// A missing capability only skips this mapping, the other listeners keep working
+	if err := utils.CheckBindPermission(localAddr); err != nil {
+		s.logger.Errorf("skipping listener on %s: %v", localAddr, err)
+		return
+	}
+
+	listener, err := utils.Listen(s.ctx, &net.ListenConfig{Control: utils.MSSControl(s.config.MSSClamp, s.logger), KeepAlive: localKeepAlive(s.config.KeepAlive)}, localAddr)
 	if err != nil {
-		s.logger.Fatalf("failed to start listener on %s: %v", localAddr, err)
+		s.startErrs.report(s.logger, "listen on", localAddr, err)
 		return
 	}
 
 	//close local listener after context cancellation
 	defer listener.Close()
 
+	// The port is drained on its own, other listeners keep running
+	ctx := s.listeners.add(s.ctx, listener)
+
 	go s.acceptLocalConn(listener, remoteAddr)
 
 	s.logger.Infof("listener started successfully, listening on address: %s", listener.Addr().String())
 
-	<-s.ctx.Done()
+	<-ctx.Done()
 }
 
 func (s *WsMuxTransport) acceptLocalConn(listener net.Listener, remoteAddr string) {
@@ -453,11 +806,17 @@ func (s *WsMuxTransport) acceptLocalConn(listener net.Listener, remoteAddr strin
 
 		default:
 			conn, err := listener.Accept()
+			if errors.Is(err, net.ErrClosed) {
+				return // the port was drained or the transport stopped
+			}
 			if err != nil {
 				s.logger.Debugf("failed to accept connection on %s: %v", listener.Addr().String(), err)
 				continue
 			}
 
+			utils.SetCongestionControl(conn)
+			utils.SetSocketBuffers(conn)
+
 			// discard any non-tcp connection
 			tcpConn, ok := conn.(*net.TCPConn)
 			if !ok {
@@ -466,22 +825,55 @@ func (s *WsMuxTransport) acceptLocalConn(listener net.Listener, remoteAddr strin
 				continue
 			}
 
+			// An accept filter registered through the library can refuse the connection
+			if !utils.AcceptAllowed(utils.AcceptedConn{Tunnel: false, Transport: "wsmux", RemoteAddr: tcpConn.RemoteAddr(), LocalAddr: tcpConn.LocalAddr()}, s.logger) {
+				tcpConn.Close()
+				continue
+			}
+
+			// Under overload new connections are refused, the ones in flight keep going
+			if utils.Overloaded() {
+				s.logger.Debugf("overloaded, closing connection from %s", tcpConn.RemoteAddr().String())
+				s.connLimit.reject(tcpConn)
+				s.backpressure.discarded()
+				continue
+			}
+
+			// Beyond the cap on connections in flight the connection is closed before it costs anything
+			if conn, ok = s.connLimit.track(tcpConn); !ok {
+				s.logger.Debugf("%d local connections in flight, closing connection from %s", s.config.MaxConns, tcpConn.RemoteAddr().String())
+				s.connLimit.reject(tcpConn)
+				continue
+			}
+
 			// trying to enable tcpnodelay
-			if !s.config.Nodelay {
-				if err := tcpConn.SetNoDelay(s.config.Nodelay); err != nil {
+			if !s.config.LocalNodelay {
+				if err := tcpConn.SetNoDelay(s.config.LocalNodelay); err != nil {
 					s.logger.Warnf("failed to set TCP_NODELAY for %s: %v", tcpConn.RemoteAddr().String(), err)
 				} else {
 					s.logger.Tracef("TCP_NODELAY disabled for %s", tcpConn.RemoteAddr().String())
 				}
 			}
 
+			// A target override of the port applies to new connections only
+			target := s.targets.target(tcpConn.LocalAddr().(*net.TCPAddr).Port, remoteAddr)
+			localConn := LocalTCPConn{conn: conn, remoteAddr: target, trace: utils.StartConnTrace(s.ctx, tcpConn.LocalAddr().(*net.TCPAddr).Port, target), queuedAt: time.Now()}
+
+			// The connections held by the fair queue are still queued. A nil channel is
+			// never ready, the connection is discarded as on a full channel
+			localChannel := s.localChannel
+			if queued := s.fairQueue.queued(localChannel); queued >= cap(localChannel) || !s.localLimit.allow(queued) {
+				localChannel = nil
+			}
+
 			select {
-			case s.localChannel <- LocalTCPConn{conn: conn, remoteAddr: remoteAddr}:
+			case localChannel <- localConn:
 				s.logger.Debugf("accepted incoming TCP connection from %s", tcpConn.RemoteAddr().String())
 
 			default: // channel is full, discard the connection
 				s.logger.Warnf("local listener channel is full, discarding TCP connection from %s", tcpConn.LocalAddr().String())
 				conn.Close()
+				localConn.trace.Fail(errLocalChannelFull)
 			}
 		}
 	}
@@ -507,11 +899,34 @@ func (s *WsMuxTransport) handleLoop() {
 }
 
 func (s *WsMuxTransport) handleSession(session *smux.Session, next chan struct{}) {
-	done := make(chan struct{}, s.config.MuxCon)
+	done := make(chan struct{}, s.config.MaxStreams)
+	rotate := s.rotateSignal()
+
+	// End of the last stream, a session stays idle once its streams are done
+	var lastActive atomic.Int64
+	lastActive.Store(time.Now().UnixNano())
+
+	var idleCheck <-chan time.Time
+	if s.config.SessionIdle > 0 {
+		ticker := time.NewTicker(s.config.SessionIdle / 2)
+		defer ticker.Stop()
+		idleCheck = ticker.C
+	}
+
+	// Streams opened on this session, for SessionStreams
+	opened := 0
 
 	for {
 		if atomic.LoadInt32(&s.streamCounter) >= atomic.LoadInt32(&s.sessionCounter)*int32(s.config.MuxCon) {
-			next <- struct{}{}
+			if s.config.MaxStreams > s.config.MuxCon {
+				// A session allowed more streams keeps serving while the next one is set up
+				select {
+				case next <- struct{}{}:
+				default:
+				}
+			} else {
+				next <- struct{}{}
+			}
 
 			// Attempt to request a new connection
 			select {
@@ -525,37 +940,196 @@ func (s *WsMuxTransport) handleSession(session *smux.Session, next chan struct{}
 		// +1 for Muxed connections counter
 		done <- struct{}{}
 
+		// With ordered streams one session at a time takes a connection and opens its stream
+		s.streamOrder.lock()
+
+		// Connections put back after a failed stream have waited longest, they
+		// are served before the newer ones in the local channel
+		var incomingConn LocalTCPConn
 		select {
-		case <-s.ctx.Done():
-			session.Close()
-			return
+		case incomingConn = <-s.retryChannel:
+		default:
+			select {
+			case <-s.ctx.Done():
+				s.streamOrder.unlock()
+				session.Close()
+				return
 
-		case incomingConn := <-s.localChannel:
-			// +1 for stream counter
-			atomic.AddInt32(&s.streamCounter, 1)
+			case <-rotate:
+				s.streamOrder.unlock()
+				<-done // release the slot reserved for this iteration
+				s.rotateSession(session, next, done)
+				return
 
-			stream, err := session.OpenStream()
-			if err != nil {
-				s.handleSessionError(session, &incomingConn, next, done, err)
+			case <-idleCheck:
+				s.streamOrder.unlock()
+				<-done // release the slot reserved for this iteration
+				if len(done) > 0 || time.Since(time.Unix(0, lastActive.Load())) < s.config.SessionIdle || !s.reapSession() {
+					continue
+				}
+
+				s.logger.Debugf("closing mux session idle for %v", s.config.SessionIdle)
+
+				// Notify to start a new session, unless it was already notified
+				select {
+				case next <- struct{}{}:
+				default:
+				}
+
+				session.Close()
 				return
+
+			case incomingConn = <-s.retryChannel:
+			case incomingConn = <-s.fairQueue.next(s.localChannel):
 			}
+		}
 
-			// Send the target port over the tunnel connection
-			if err := utils.SendBinaryString(stream, incomingConn.remoteAddr); err != nil {
-				s.handleSessionError(session, &incomingConn, next, done, err)
-				return
+		s.queueStats.Observe(time.Since(incomingConn.queuedAt))
+
+		// +1 for stream counter
+		atomic.AddInt32(&s.streamCounter, 1)
+
+		stream, err := session.OpenStream()
+		if errors.Is(err, smux.ErrGoAway) {
+			// Only this session is exhausted, its open streams keep running
+			// while the connection is retried on another session
+			s.logger.Warn("mux session has no stream ids left, moving to another session")
+			s.streamOrder.unlock()
+			atomic.AddInt32(&s.streamCounter, -1)
+			<-done
+			s.retryChannel <- incomingConn
+			s.rotateSession(session, next, done)
+			return
+		}
+		if err != nil {
+			s.streamOrder.unlock()
+			s.handleSessionError(session, &incomingConn, next, done, err)
+			return
+		}
+
+		// Send the target port over the tunnel connection
+		if err := utils.SendBinaryString(stream, incomingConn.remoteAddr); err != nil {
+			s.streamOrder.unlock()
+			s.handleSessionError(session, &incomingConn, next, done, err)
+			return
+		}
+
+		if err := sendPreface(stream, incomingConn.conn, s.config.PrefacePorts, string(s.config.Mode)); err != nil {
+			s.streamOrder.unlock()
+			s.handleSessionError(session, &incomingConn, next, done, err)
+			return
+		}
+
+		if err := sendProxyHeader(stream, incomingConn.conn, s.config.ProxyProtocol, s.proxyTLVs); err != nil {
+			s.streamOrder.unlock()
+			s.handleSessionError(session, &incomingConn, next, done, err)
+			return
+		}
+
+		s.streamOrder.unlock()
+
+		incomingConn.trace.Event("stream opened")
+
+		// Handle data exchange between connections
+		go func() {
+			utils.TCPConnectionHandler(incomingConn.conn, stream, s.logger, s.usageMonitor, incomingConn.conn.LocalAddr().(*net.TCPAddr).Port, incomingConn.remoteAddr, s.config.Sniffer, incomingConn.trace, utils.OpDeadlines{Read: s.config.ReadDeadline, Write: s.config.WriteDeadline, Lifetime: s.lifetime.of(incomingConn.conn.LocalAddr().(*net.TCPAddr).Port)})
+			atomic.AddInt32(&s.streamCounter, -1)
+			lastActive.Store(time.Now().UnixNano())
+			<-done // read signal from the channel
+		}()
+
+		opened++
+		if s.config.SessionStreams > 0 && opened >= s.config.SessionStreams {
+			s.logger.Debugf("mux session opened %d streams, rotating it", opened)
+			s.rotateSession(session, next, done)
+			return
+		}
+	}
+}
+
+// reapSession counts an idle session out unless that leaves fewer than
+// SessionIdleMin, sessions waiting in the tunnel channel included.
+func (s *WsMuxTransport) reapSession() bool {
+	for {
+		sessions := atomic.LoadInt32(&s.sessionCounter)
+		if int(sessions)+len(s.tunnelChannel) <= s.config.SessionIdleMin {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&s.sessionCounter, sessions, sessions-1) {
+			return true
+		}
+	}
+}
+
+// RotateSessions stops opening streams on the active mux sessions and replaces
+// them with fresh ones. Streams already open keep running until they finish.
+func (s *WsMuxTransport) RotateSessions() {
+	s.rotateMutex.Lock()
+	close(s.rotateChan)
+	s.rotateChan = make(chan struct{})
+	s.rotateMutex.Unlock()
+
+	// Idle sessions waiting in the tunnel channel are replaced as well
+	for {
+		select {
+		case session := <-s.tunnelChannel:
+			session.Close()
+
+			select {
+			case s.reqNewConnChan <- struct{}{}:
+			default:
+				s.logger.Warn("request new connection channel is full")
 			}
 
-			// Handle data exchange between connections
-			go func() {
-				utils.TCPConnectionHandler(stream, incomingConn.conn, s.logger, s.usageMonitor, incomingConn.conn.LocalAddr().(*net.TCPAddr).Port, s.config.Sniffer)
-				atomic.AddInt32(&s.streamCounter, -1)
-				<-done // read signal from the channel
-			}()
+		default:
+			return
 		}
 	}
 }
 
+func (s *WsMuxTransport) rotateSignal() chan struct{} {
+	s.rotateMutex.Lock()
+	defer s.rotateMutex.Unlock()
+
+	return s.rotateChan
+}
+
+// rotateSession hands the local connections over to a fresh session and closes
+// the old one once its forwarded connections are done.
+func (s *WsMuxTransport) rotateSession(session *smux.Session, next chan struct{}, done chan struct{}) {
+	s.logger.Infof("rotating mux session, draining %d active streams", len(done))
+
+	atomic.AddInt32(&s.sessionCounter, -1)
+
+	// Notify to start a new session, unless it was already notified
+	select {
+	case next <- struct{}{}:
+	default:
+	}
+
+	// Attempt to request a new connection
+	select {
+	case s.reqNewConnChan <- struct{}{}:
+	default:
+		s.logger.Warn("request new connection channel is full")
+	}
+
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+
+	for len(done) > 0 {
+		select {
+		case <-s.ctx.Done():
+			session.Close()
+			return
+		case <-ticker.C:
+		}
+	}
+
+	session.Close()
+	s.logger.Debug("drained mux session closed")
+}
+
 func (s *WsMuxTransport) handleSessionError(session *smux.Session, incomingConn *LocalTCPConn, next chan struct{}, done chan struct{}, err error) {
 	s.logger.Errorf("failed to handle session: %v", err)
 
@@ -563,8 +1137,8 @@ func (s *WsMuxTransport) handleSessionError(session *smux.Session, incomingConn
 	atomic.AddInt32(&s.streamCounter, -1)
 	atomic.AddInt32(&s.sessionCounter, -1)
 
-	// Put connection back to local channel
-	s.localChannel <- *incomingConn
+	// Put connection back, ahead of the local channel
+	s.retryChannel <- *incomingConn
 
 	// Notify to start a new session
 	next <- struct{}{}
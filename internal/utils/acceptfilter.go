@@ -0,0 +1,64 @@
+package utils
+
+import (
+	"net"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+)
+
+// AcceptedConn describes a connection the server just accepted, before
+// anything is read from it or written to it.
+type AcceptedConn struct {
+	Tunnel     bool   // a tunnel connection from the client, otherwise a local connection on a forwarded port
+	Transport  string // transport of the server, like tcpmux
+	RemoteAddr net.Addr
+	LocalAddr  net.Addr
+}
+
+// AcceptFilter decides whether an accepted connection is let in, a rejected
+// connection is closed right away. It is called in the accept loop, so a slow
+// filter holds up the connections accepted after it.
+type AcceptFilter func(conn AcceptedConn) bool
+
+// activeAcceptFilter is nil until SetAcceptFilter is called, so every connection is accepted
+var activeAcceptFilter atomic.Pointer[AcceptFilter]
+
+// SetAcceptFilter registers filter to be called on every tunnel and local
+// connection the server accepts, for admission rules of your own (time of
+// day, allowlists, external lookups) when Backhaul runs as a library. It
+// applies to the transports started after and before the call, a nil filter
+// removes it.
+func SetAcceptFilter(filter AcceptFilter) {
+	if filter == nil {
+		activeAcceptFilter.Store(nil)
+		return
+	}
+	activeAcceptFilter.Store(&filter)
+}
+
+// AcceptAllowed reports whether the registered accept filter lets conn in, it
+// always does without a filter. A filter that panics rejects the connection.
+func AcceptAllowed(conn AcceptedConn, logger *logrus.Logger) (allowed bool) {
+	filter := activeAcceptFilter.Load()
+	if filter == nil {
+		return true
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Errorf("accept filter panicked on connection from %s, rejecting it: %v", conn.RemoteAddr, r)
+			allowed = false
+		}
+	}()
+
+	if !(*filter)(conn) {
+		kind := "local"
+		if conn.Tunnel {
+			kind = "tunnel"
+		}
+		logger.Debugf("accept filter rejected %s connection from %s on %s", kind, conn.RemoteAddr, conn.LocalAddr)
+		return false
+	}
+	return true
+}
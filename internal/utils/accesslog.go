@@ -0,0 +1,399 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// accessMaxHead bounds the request or response head kept while parsing, a
+// stream with a longer head is not HTTP or not worth logging and is ignored.
+const accessMaxHead = 16 * 1024
+
+type accessLog struct {
+	file  *logFile
+	ports map[int]bool
+}
+
+// activeAccessLog is nil until InitAccessLog succeeds, so the access log costs nothing when it is disabled
+var activeAccessLog atomic.Pointer[accessLog]
+
+// InitAccessLog appends a line in Common Log Format per HTTP request on the
+// given ports to path, or to stdout when path is "stdout", until ctx is done.
+// Requests and responses are parsed from the forwarded stream, the backend
+// needs no changes. The file is rotated to path.1 once it grows beyond maxSize
+// bytes, 0 disables the rotation.
+func InitAccessLog(ctx context.Context, path string, maxSize int64, ports []int, logger *logrus.Logger) {
+	file, err := openLogFile("access log", path, maxSize, logger)
+	if err != nil {
+		logger.Errorf("failed to open access log %s: %v", path, err)
+		return
+	}
+
+	l := &accessLog{file: file, ports: make(map[int]bool)}
+	for _, port := range ports {
+		l.ports[port] = true
+	}
+	activeAccessLog.Store(l)
+
+	logger.Infof("logging HTTP requests on ports %v to %s", ports, path)
+
+	go func() {
+		<-ctx.Done()
+		activeAccessLog.CompareAndSwap(l, nil)
+		file.close()
+	}()
+}
+
+// accessRequest is a request still waiting for its response
+type accessRequest struct {
+	time time.Time
+	line string
+	head bool // a HEAD request, its response has no body
+}
+
+// connAccess parses the HTTP requests and responses of a single connection.
+// A nil connAccess is valid and does nothing.
+type connAccess struct {
+	mu       sync.Mutex
+	log      *accessLog
+	host     string
+	pending  []accessRequest
+	current  *accessRequest // the request the response being read answers
+	status   int
+	request  httpStream
+	response httpStream
+}
+
+// startAccessLog returns the parser of a connection from source, it returns
+// nil when the access log is disabled or the port is not logged.
+func startAccessLog(port int, source string) *connAccess {
+	l := activeAccessLog.Load()
+	if l == nil || !l.ports[port] {
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(source)
+	if err != nil {
+		host = source
+	}
+
+	c := &connAccess{log: l, host: host}
+	c.request.onHead = c.requestHead
+	c.response.onHead = c.responseHead
+	c.response.onBody = c.responseDone
+	return c
+}
+
+func (c *connAccess) write(direction byte, data []byte) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if direction == recordUpstream {
+		c.request.feed(data)
+	} else {
+		c.response.feed(data)
+	}
+}
+
+// close logs the response that ends with the connection and the requests that
+// got no response, the latter with "-" as status.
+func (c *connAccess) close() {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.current != nil {
+		c.responseDone(c.response.body)
+	}
+	for i := range c.pending {
+		c.logEntry(&c.pending[i], "-", "-")
+	}
+	c.pending = nil
+}
+
+func (c *connAccess) requestHead(head []byte) (bodyFraming, int64) {
+	line, headers := splitHead(head)
+
+	fields := strings.Fields(line)
+	if len(fields) != 3 || !strings.HasPrefix(fields[2], "HTTP/") {
+		return bodyOpaque, 0
+	}
+
+	c.pending = append(c.pending, accessRequest{time: time.Now(), line: line, head: fields[0] == "HEAD"})
+	if fields[0] == "CONNECT" {
+		return bodyOpaque, 0
+	}
+
+	framing, length := messageFraming(headers)
+	if framing == bodyUntilClose {
+		// A request without a length has no body
+		return bodyNone, 0
+	}
+	return framing, length
+}
+
+func (c *connAccess) responseHead(head []byte) (bodyFraming, int64) {
+	line, headers := splitHead(head)
+
+	fields := strings.Fields(line)
+	if len(fields) < 2 || !strings.HasPrefix(fields[0], "HTTP/") {
+		return bodyOpaque, 0
+	}
+	status, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return bodyOpaque, 0
+	}
+
+	// Interim responses come before the final one of the same request
+	if status >= 100 && status < 200 && status != 101 {
+		return bodyNone, 0
+	}
+
+	request := accessRequest{time: time.Now(), line: "-"}
+	if len(c.pending) > 0 {
+		request = c.pending[0]
+		c.pending = c.pending[1:]
+	}
+	c.current = &request
+	c.status = status
+
+	// The connection is no longer HTTP after a protocol switch
+	if status == 101 || (strings.HasPrefix(request.line, "CONNECT ") && status < 300) {
+		c.responseDone(0)
+		return bodyOpaque, 0
+	}
+	if request.head || status == 204 || status == 304 {
+		return bodyNone, 0
+	}
+	return messageFraming(headers)
+}
+
+func (c *connAccess) responseDone(body int64) {
+	if c.current == nil {
+		return
+	}
+
+	size := "-"
+	if body > 0 {
+		size = strconv.FormatInt(body, 10)
+	}
+	c.logEntry(c.current, strconv.Itoa(c.status), size)
+	c.current = nil
+}
+
+func (c *connAccess) logEntry(request *accessRequest, status string, size string) {
+	line := fmt.Sprintf("%s - - [%s] %s %s %s\n", c.host, request.time.Format("02/Jan/2006:15:04:05 -0700"), strconv.Quote(request.line), status, size)
+	c.log.file.write([]byte(line))
+}
+
+// splitHead returns the first line of a message head and its header lines
+func splitHead(head []byte) (string, []string) {
+	lines := strings.Split(strings.TrimRight(string(head), "\r\n"), "\r\n")
+	return lines[0], lines[1:]
+}
+
+// messageFraming tells from the headers of a message how its body ends
+func messageFraming(headers []string) (bodyFraming, int64) {
+	length := int64(-1)
+	for _, header := range headers {
+		name, value, ok := strings.Cut(header, ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "transfer-encoding":
+			if strings.Contains(strings.ToLower(value), "chunked") {
+				return bodyChunked, 0
+			}
+		case "content-length":
+			if n, err := strconv.ParseInt(value, 10, 64); err == nil && n >= 0 {
+				length = n
+			}
+		}
+	}
+
+	switch {
+	case length == 0:
+		return bodyNone, 0
+	case length > 0:
+		return bodyLength, length
+	default:
+		return bodyUntilClose, 0
+	}
+}
+
+// bodyFraming is how the end of a message body is found
+type bodyFraming int
+
+const (
+	bodyNone bodyFraming = iota
+	bodyLength
+	bodyChunked
+	bodyUntilClose
+	bodyOpaque // the stream is not HTTP (anymore) and is no longer parsed
+)
+
+const (
+	streamHead = iota
+	streamBody
+	streamChunkSize
+	streamChunkData
+	streamChunkEnd
+	streamTrailer
+	streamUntilClose
+	streamOpaque
+)
+
+// httpStream splits one direction of a connection into HTTP messages. onHead
+// gets every message head and tells how its body is framed, onBody gets the
+// size of every body once it was read.
+type httpStream struct {
+	state     int
+	buf       []byte // the head or line read so far
+	remaining int64
+	body      int64
+	onHead    func(head []byte) (bodyFraming, int64)
+	onBody    func(body int64)
+}
+
+func (s *httpStream) feed(data []byte) {
+	for len(data) > 0 {
+		switch s.state {
+		case streamHead:
+			s.buf = append(s.buf, data...)
+			end := bytes.Index(s.buf, []byte("\r\n\r\n"))
+			if end < 0 {
+				if len(s.buf) > accessMaxHead {
+					s.state = streamOpaque
+					s.buf = nil
+				}
+				return
+			}
+
+			// What follows the head is left in data
+			data = data[len(data)-(len(s.buf)-end-4):]
+			head := s.buf[:end+4]
+			s.buf = nil
+			s.body = 0
+
+			framing, length := s.onHead(head)
+			switch framing {
+			case bodyNone:
+				s.done()
+			case bodyLength:
+				s.state = streamBody
+				s.remaining = length
+			case bodyChunked:
+				s.state = streamChunkSize
+			case bodyUntilClose:
+				s.state = streamUntilClose
+			case bodyOpaque:
+				s.state = streamOpaque
+			}
+
+		case streamBody, streamChunkData, streamChunkEnd:
+			n := int64(len(data))
+			if n > s.remaining {
+				n = s.remaining
+			}
+			data = data[n:]
+			s.remaining -= n
+			if s.state != streamChunkEnd {
+				s.body += n
+			}
+			if s.remaining > 0 {
+				return
+			}
+
+			switch s.state {
+			case streamBody:
+				s.done()
+			case streamChunkData:
+				// The CRLF after the chunk
+				s.state = streamChunkEnd
+				s.remaining = 2
+			case streamChunkEnd:
+				s.state = streamChunkSize
+			}
+
+		case streamChunkSize, streamTrailer:
+			line, rest, ok := s.readLine(data)
+			data = rest
+			if !ok {
+				continue
+			}
+
+			if s.state == streamTrailer {
+				if line == "" {
+					s.done()
+				}
+				continue
+			}
+
+			sizeField, _, _ := strings.Cut(line, ";")
+			size, err := strconv.ParseInt(strings.TrimSpace(sizeField), 16, 64)
+			if err != nil || size < 0 {
+				s.state = streamOpaque
+				return
+			}
+			if size == 0 {
+				s.state = streamTrailer
+			} else {
+				s.state = streamChunkData
+				s.remaining = size
+			}
+
+		case streamUntilClose:
+			s.body += int64(len(data))
+			return
+
+		default:
+			return
+		}
+	}
+}
+
+// readLine returns the next line without its line ending and the data after
+// it, ok is false while the line is incomplete.
+func (s *httpStream) readLine(data []byte) (string, []byte, bool) {
+	end := bytes.IndexByte(data, '\n')
+	if end < 0 {
+		s.buf = append(s.buf, data...)
+		if len(s.buf) > accessMaxHead {
+			s.state = streamOpaque
+			s.buf = nil
+		}
+		return "", nil, false
+	}
+
+	line := string(append(s.buf, data[:end]...))
+	s.buf = nil
+	return strings.TrimSuffix(line, "\r"), data[end+1:], true
+}
+
+// done ends the current message, the next one starts with a head.
+func (s *httpStream) done() {
+	if s.onBody != nil {
+		s.onBody(s.body)
+	}
+	s.state = streamHead
+	s.body = 0
+}
@@ -0,0 +1,96 @@
+package utils
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// minBucketBurst lets a full transferData read through without waiting twice
+const minBucketBurst = 32 * 1024
+
+// tokenBucket is a byte rate limit shared by every connection. A nil
+// tokenBucket is unlimited.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(kbps int) *tokenBucket {
+	if kbps <= 0 {
+		return nil
+	}
+
+	rate := float64(kbps) * 1024
+	// A tenth of a second worth of bytes, so idle periods cannot save up a large spike
+	burst := max(rate/10, minBucketBurst)
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// wait takes n bytes from the bucket and sleeps until the rate allows them.
+// The bucket goes into debt instead of blocking other callers, so concurrent
+// connections are served in the order they asked.
+func (b *tokenBucket) wait(n int) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*b.rate, b.burst)
+	b.last = now
+	b.tokens -= float64(n)
+	deficit := -b.tokens
+	b.mu.Unlock()
+
+	if deficit > 0 {
+		time.Sleep(time.Duration(deficit / b.rate * float64(time.Second)))
+	}
+}
+
+type bandwidthLimit struct {
+	upstream   *tokenBucket
+	downstream *tokenBucket
+}
+
+// activeBandwidthLimit is nil until InitBandwidthLimit is called, so the limit costs nothing when it is disabled
+var activeBandwidthLimit atomic.Pointer[bandwidthLimit]
+
+// InitBandwidthLimit caps the total rate of all forwarded TCP connections in
+// KB/s until ctx is done, upstream being the user to backend direction. A
+// direction with 0 is not limited.
+func InitBandwidthLimit(ctx context.Context, upstream int, downstream int, logger *logrus.Logger) {
+	if upstream <= 0 && downstream <= 0 {
+		return
+	}
+
+	l := &bandwidthLimit{upstream: newTokenBucket(upstream), downstream: newTokenBucket(downstream)}
+	activeBandwidthLimit.Store(l)
+
+	logger.Infof("tunnel bandwidth limited to %d KB/s upstream and %d KB/s downstream (0 is unlimited)", upstream, downstream)
+
+	go func() {
+		<-ctx.Done()
+		activeBandwidthLimit.CompareAndSwap(l, nil)
+	}()
+}
+
+// waitBandwidth holds back n bytes going in direction until the tunnel limit allows them
+func waitBandwidth(direction byte, n int) {
+	l := activeBandwidthLimit.Load()
+	if l == nil {
+		return
+	}
+
+	if direction == recordUpstream {
+		l.upstream.wait(n)
+	} else {
+		l.downstream.wait(n)
+	}
+}
@@ -0,0 +1,345 @@
+package utils
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Requests of the benchmark backend, the first byte of every connection
+const (
+	benchEcho     byte = 'e' // echo everything back
+	benchUpload   byte = 'u' // count the bytes received for a duration, then answer the count
+	benchDownload byte = 'd' // send as fast as possible for a duration, then close
+)
+
+const (
+	benchChunk       = 32 * 1024
+	benchConnections = 10  // connections timed for the setup time
+	benchPings       = 100 // round trips timed for the latency
+)
+
+// RunBenchBackend serves the synthetic backend of the benchmark on addr until
+// ctx is done. A port mapping of the tunnel has to point at it.
+func RunBenchBackend(ctx context.Context, addr string, logger *logrus.Logger) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	logger.Infof("benchmark backend listening on %s", listener.Addr().String())
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go serveBench(conn)
+	}
+}
+
+func serveBench(conn net.Conn) {
+	defer conn.Close()
+
+	request := make([]byte, 1)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return
+	}
+
+	switch request[0] {
+	case benchEcho:
+		io.Copy(conn, conn)
+
+	case benchUpload:
+		duration, err := readBenchDuration(conn)
+		if err != nil {
+			return
+		}
+
+		// Counting starts with the first byte, so the tunnel setup is left out
+		buf := make([]byte, benchChunk)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return
+		}
+		received := int64(n)
+
+		conn.SetReadDeadline(time.Now().Add(duration))
+		for {
+			n, err := conn.Read(buf)
+			received += int64(n)
+			if err != nil {
+				break
+			}
+		}
+
+		binary.Write(conn, binary.BigEndian, received)
+
+		// Closing with unread data would reset the connection and lose the count
+		conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+		io.Copy(io.Discard, conn)
+
+	case benchDownload:
+		duration, err := readBenchDuration(conn)
+		if err != nil {
+			return
+		}
+
+		buf := make([]byte, benchChunk)
+		for stop := time.Now().Add(duration); time.Now().Before(stop); {
+			if _, err := conn.Write(buf); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func readBenchDuration(conn net.Conn) (time.Duration, error) {
+	var ms uint32
+	if err := binary.Read(conn, binary.BigEndian, &ms); err != nil {
+		return 0, err
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+// BenchResult is what RunBenchmark measured through the tunnel.
+type BenchResult struct {
+	Setup    []time.Duration // connect until the first echoed byte, per connection
+	Latency  []time.Duration // round trip of a single byte on an open connection
+	Upload   float64         // bits per second from the user side to the backend
+	Download float64         // bits per second from the backend to the user side
+}
+
+// WaitBenchReady dials addr until the benchmark backend answers through the
+// tunnel or ctx is done.
+func WaitBenchReady(ctx context.Context, addr string) error {
+	for {
+		if _, err := benchSetup(addr); err == nil {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("benchmark backend did not answer through %s in time", addr)
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+}
+
+// RunBenchmark measures connection setup time, latency and throughput
+// through the local listener addr of a port mapping that points at
+// RunBenchBackend. Throughput is measured for duration in each direction.
+func RunBenchmark(addr string, duration time.Duration, logger *logrus.Logger) (*BenchResult, error) {
+	result := &BenchResult{}
+
+	logger.Infof("measuring connection setup time with %d connections", benchConnections)
+	for i := 0; i < benchConnections; i++ {
+		setup, err := benchSetup(addr)
+		if err != nil {
+			return nil, fmt.Errorf("connection setup: %w", err)
+		}
+		result.Setup = append(result.Setup, setup)
+	}
+
+	logger.Infof("measuring latency with %d round trips", benchPings)
+	latency, err := benchLatency(addr)
+	if err != nil {
+		return nil, fmt.Errorf("latency: %w", err)
+	}
+	result.Latency = latency
+
+	logger.Infof("measuring upload for %v", duration)
+	if result.Upload, err = benchUploadRate(addr, duration); err != nil {
+		return nil, fmt.Errorf("upload: %w", err)
+	}
+
+	logger.Infof("measuring download for %v", duration)
+	if result.Download, err = benchDownloadRate(addr, duration); err != nil {
+		return nil, fmt.Errorf("download: %w", err)
+	}
+
+	return result, nil
+}
+
+func benchDial(addr string, request byte, duration time.Duration) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	header := []byte{request}
+	if request != benchEcho {
+		header = binary.BigEndian.AppendUint32(header, uint32(duration.Milliseconds()))
+	}
+	if _, err := conn.Write(header); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// benchSetup times a new connection until its first byte came back from the backend.
+func benchSetup(addr string) (time.Duration, error) {
+	started := time.Now()
+	conn, err := benchDial(addr, benchEcho, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	if err := benchPing(conn); err != nil {
+		return 0, err
+	}
+	return time.Since(started), nil
+}
+
+func benchLatency(addr string) ([]time.Duration, error) {
+	conn, err := benchDial(addr, benchEcho, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// The first round trip waits for the backend connection
+	if err := benchPing(conn); err != nil {
+		return nil, err
+	}
+
+	latency := make([]time.Duration, 0, benchPings)
+	for i := 0; i < benchPings; i++ {
+		started := time.Now()
+		if err := benchPing(conn); err != nil {
+			return nil, err
+		}
+		latency = append(latency, time.Since(started))
+	}
+	return latency, nil
+}
+
+func benchPing(conn net.Conn) error {
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+
+	buf := []byte{0}
+	if _, err := conn.Write(buf); err != nil {
+		return err
+	}
+	_, err := io.ReadFull(conn, buf)
+	return err
+}
+
+func benchUploadRate(addr string, duration time.Duration) (float64, error) {
+	conn, err := benchDial(addr, benchUpload, duration)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	// The backend answers with what it received within duration
+	counted := make(chan error, 1)
+	var received int64
+	go func() {
+		conn.SetReadDeadline(time.Now().Add(duration + 30*time.Second))
+		counted <- binary.Read(conn, binary.BigEndian, &received)
+	}()
+
+	buf := make([]byte, benchChunk)
+	for {
+		select {
+		case err := <-counted:
+			if err != nil {
+				return 0, err
+			}
+			return float64(received) * 8 / duration.Seconds(), nil
+		default:
+		}
+
+		if _, err := conn.Write(buf); err != nil {
+			if err := <-counted; err != nil {
+				return 0, err
+			}
+			return float64(received) * 8 / duration.Seconds(), nil
+		}
+	}
+}
+
+func benchDownloadRate(addr string, duration time.Duration) (float64, error) {
+	conn, err := benchDial(addr, benchDownload, duration)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(duration + 30*time.Second))
+
+	// Timing starts with the first byte, so the tunnel setup is left out
+	buf := make([]byte, benchChunk)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return 0, err
+	}
+	started := time.Now()
+
+	received, err := io.CopyBuffer(io.Discard, conn, buf)
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		return 0, err
+	}
+	received += int64(n)
+
+	elapsed := time.Since(started)
+	if elapsed <= 0 {
+		return 0, errors.New("no data received")
+	}
+	return float64(received) * 8 / elapsed.Seconds(), nil
+}
+
+// LogBenchResult logs the summary of a benchmark of transport.
+func LogBenchResult(result *BenchResult, transport string, logger *logrus.Logger) {
+	logger.Infof("benchmark results for the %s transport:", transport)
+	logger.Infof("  connection setup: %s", benchSummary(result.Setup))
+	logger.Infof("  latency:          %s", benchSummary(result.Latency))
+	logger.Infof("  upload:           %s", formatBitRate(result.Upload))
+	logger.Infof("  download:         %s", formatBitRate(result.Download))
+}
+
+func benchSummary(samples []time.Duration) string {
+	sorted := append([]time.Duration(nil), samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	var total time.Duration
+	for _, sample := range sorted {
+		total += sample
+	}
+
+	return fmt.Sprintf("avg %v, min %v, p50 %v, max %v",
+		(total / time.Duration(len(sorted))).Round(time.Microsecond),
+		sorted[0].Round(time.Microsecond),
+		sorted[len(sorted)/2].Round(time.Microsecond),
+		sorted[len(sorted)-1].Round(time.Microsecond))
+}
+
+func formatBitRate(bits float64) string {
+	switch {
+	case bits >= 1e9:
+		return fmt.Sprintf("%.2f Gbit/s", bits/1e9)
+	case bits >= 1e6:
+		return fmt.Sprintf("%.2f Mbit/s", bits/1e6)
+	default:
+		return fmt.Sprintf("%.2f kbit/s", bits/1e3)
+	}
+}
@@ -0,0 +1,93 @@
+package utils
+
+import (
+	"context"
+	"net"
+	"os"
+	"runtime"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+)
+
+type congestionControl struct {
+	algorithm string
+	logger    *logrus.Logger
+}
+
+// activeCongestionControl is nil until InitCongestionControl succeeds, so sockets keep the system default
+var activeCongestionControl atomic.Pointer[congestionControl]
+
+// InitCongestionControl sets the TCP congestion control algorithm, e.g. bbr, of
+// dialed and accepted tunnel and local connections until ctx is done. It does
+// nothing on other systems than Linux or when the kernel lacks the algorithm.
+func InitCongestionControl(ctx context.Context, algorithm string, logger *logrus.Logger) {
+	if runtime.GOOS != "linux" {
+		logger.Warnf("congestion control %s is only supported on Linux, using the system default", algorithm)
+		return
+	}
+
+	// Loading a missing module needs CAP_NET_ADMIN, so only algorithms the kernel lists are used
+	if available, err := os.ReadFile("/proc/sys/net/ipv4/tcp_available_congestion_control"); err == nil && !slices.Contains(strings.Fields(string(available)), algorithm) {
+		logger.Warnf("congestion control %s is not available in this kernel (%s), using the system default", algorithm, strings.TrimSpace(string(available)))
+		return
+	}
+
+	cc := &congestionControl{algorithm: algorithm, logger: logger}
+	activeCongestionControl.Store(cc)
+
+	logger.Infof("using TCP congestion control %s", algorithm)
+
+	go func() {
+		<-ctx.Done()
+		activeCongestionControl.CompareAndSwap(cc, nil)
+	}()
+}
+
+// CongestionControl is a socket control function setting TCP_CONGESTION on
+// dialed sockets, it does nothing unless InitCongestionControl was called.
+func CongestionControl(network, address string, s syscall.RawConn) error {
+	cc := activeCongestionControl.Load()
+	if cc == nil {
+		return nil
+	}
+
+	err := s.Control(func(fd uintptr) {
+		cc.set(fd, address)
+	})
+	if err != nil {
+		cc.logger.Warnf("failed to access socket of %s for congestion control: %v", address, err)
+	}
+
+	return nil
+}
+
+// SetCongestionControl sets TCP_CONGESTION on an accepted connection, a TLS or
+// encrypted connection is unwrapped to its TCP connection.
+func SetCongestionControl(conn net.Conn) {
+	cc := activeCongestionControl.Load()
+	if cc == nil {
+		return
+	}
+
+	tcpConn, ok := TCPConn(conn)
+	if !ok {
+		return
+	}
+
+	raw, err := tcpConn.SyscallConn()
+	if err != nil {
+		cc.logger.Warnf("failed to access socket of %s for congestion control: %v", conn.RemoteAddr().String(), err)
+		return
+	}
+	CongestionControl("tcp", conn.RemoteAddr().String(), raw)
+}
+
+func (cc *congestionControl) set(fd uintptr, address string) {
+	if err := syscall.SetsockoptString(int(fd), syscall.IPPROTO_TCP, 0xd /* TCP_CONGESTION */, cc.algorithm); err != nil {
+		cc.logger.Warnf("failed to set TCP_CONGESTION to %s on %s: %v", cc.algorithm, address, err)
+	}
+}
@@ -0,0 +1,71 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ConnRecord is the JSON line written for every completed connection.
+type ConnRecord struct {
+	Time            time.Time `json:"time"`
+	Source          string    `json:"source"`
+	Port            int       `json:"port"`
+	Label           string    `json:"label,omitempty"`
+	Target          string    `json:"target"`
+	UpstreamBytes   int64     `json:"upstreamBytes"`
+	DownstreamBytes int64     `json:"downstreamBytes"`
+	DurationMs      int64     `json:"durationMs"`
+	Reason          string    `json:"reason,omitempty"`
+	Transport       string    `json:"transport"`
+}
+
+type connLog struct {
+	file      *logFile
+	transport string
+	logger    *logrus.Logger
+}
+
+// activeConnLog is nil until InitConnLog succeeds, so the log costs nothing when it is disabled
+var activeConnLog atomic.Pointer[connLog]
+
+// InitConnLog appends a JSON line per completed connection to path, or to
+// stdout when path is "stdout", until ctx is done. The file is rotated to
+// path.1 once it grows beyond maxSize bytes, 0 disables the rotation.
+func InitConnLog(ctx context.Context, path string, maxSize int64, transport string, logger *logrus.Logger) {
+	file, err := openLogFile("connection log", path, maxSize, logger)
+	if err != nil {
+		logger.Errorf("failed to open connection log %s: %v", path, err)
+		return
+	}
+
+	l := &connLog{file: file, transport: transport, logger: logger}
+	activeConnLog.Store(l)
+
+	logger.Infof("logging completed connections to %s", path)
+
+	go func() {
+		<-ctx.Done()
+		activeConnLog.CompareAndSwap(l, nil)
+		file.close()
+	}()
+}
+
+func logConnection(record ConnRecord) {
+	l := activeConnLog.Load()
+	if l == nil {
+		return
+	}
+
+	record.Transport = l.transport
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		l.logger.Errorf("error marshalling connection record: %v", err)
+		return
+	}
+	l.file.write(append(data, '\n'))
+}
@@ -0,0 +1,66 @@
+package utils
+
+import (
+	"context"
+	"sync"
+)
+
+// Cutover hands the tunnel from a running instance to the next one of a
+// reload. The next instance sets itself up while the running one keeps
+// serving, a configuration that fails to set up never interrupts it. Its
+// transport then waits at WaitCutover until the running instance stopped and
+// released the tunnel, a server takes a single control channel, so the two
+// cannot both hold one. Ready is closed once the control channel of the next
+// instance is up.
+type Cutover struct {
+	release <-chan struct{}
+	waiting chan struct{}
+	ready   chan struct{}
+	once    sync.Once
+}
+
+type cutoverKey struct{}
+
+// WithCutover returns the context of an instance whose transport starts once
+// release is closed.
+func WithCutover(ctx context.Context, release <-chan struct{}) (context.Context, *Cutover) {
+	c := &Cutover{release: release, waiting: make(chan struct{}), ready: make(chan struct{})}
+	return context.WithValue(ctx, cutoverKey{}, c), c
+}
+
+// Waiting is closed once the instance is set up and waits for the tunnel.
+func (c *Cutover) Waiting() <-chan struct{} {
+	return c.waiting
+}
+
+// Ready is closed once the control channel of the instance is up.
+func (c *Cutover) Ready() <-chan struct{} {
+	return c.ready
+}
+
+// WaitCutover blocks until the previous instance released the tunnel, it
+// reports false when ctx is done first. An instance started without
+// WithCutover does not wait.
+func WaitCutover(ctx context.Context) bool {
+	c, ok := ctx.Value(cutoverKey{}).(*Cutover)
+	if !ok {
+		return true
+	}
+
+	close(c.waiting)
+
+	select {
+	case <-c.release:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// MarkReady records that the control channel of the instance of ctx is up,
+// it is called on every reconnect and only the first one counts.
+func MarkReady(ctx context.Context) {
+	if c, ok := ctx.Value(cutoverKey{}).(*Cutover); ok {
+		c.once.Do(func() { close(c.ready) })
+	}
+}
@@ -0,0 +1,323 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// The plain TCP transports can encrypt their tunnel connections without the
+// cost of TLS and WebSocket. Both ends send an ephemeral X25519 public key and
+// derive the keys of the connection from the shared secret and the token, so
+// only an end knowing the token can read or forge its records, and a recorded
+// connection cannot be decrypted later even with the token. Each direction has
+// its own AES-256-GCM key with a counter as nonce.
+//
+// The exchange itself is not authenticated, whoever answers it in place of the
+// other end can check guesses of the token against the first record offline.
+// The token is stretched with argon2id and a salt the server sends with its
+// public key, like tls_psk, so each guess is slow. The server keeps its salt
+// and both ends keep the derived key, so only the first connection pays for it.
+
+const (
+	encryptionLabel     = "backhaul encryption v2"
+	encryptionMaxRecord = 16 * 1024 // plaintext bytes in one record
+	encryptionHeader    = 2         // length of the sealed record that follows
+	encryptionSaltSize  = 16
+)
+
+// encryptionKey is a token stretched with a salt.
+type encryptionKey struct {
+	token string
+	salt  []byte
+	key   []byte
+}
+
+// lastEncryptionKey is the key derived last, every connection of a tunnel uses the same one
+var lastEncryptionKey atomic.Pointer[encryptionKey]
+
+// deriveEncryptionKey stretches token with salt, a nil salt picks a new one
+// unless a key of token is kept already.
+func deriveEncryptionKey(token string, salt []byte) (*encryptionKey, error) {
+	if last := lastEncryptionKey.Load(); last != nil && last.token == token && (salt == nil || bytes.Equal(last.salt, salt)) {
+		return last, nil
+	}
+
+	if salt == nil {
+		salt = make([]byte, encryptionSaltSize)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+	}
+
+	k := &encryptionKey{
+		token: token,
+		salt:  salt,
+		key:   argon2.IDKey([]byte(token), append([]byte(encryptionLabel), salt...), pskTime, pskMemory, pskThreads, sha256.Size),
+	}
+	lastEncryptionKey.Store(k)
+	return k, nil
+}
+
+var errRecordAuth = errors.New("encrypted record failed authentication, the peer uses another token or no encryption")
+
+// EncryptedConn encrypts a tunnel connection. The key exchange runs on the
+// first Read or Write, like crypto/tls, so accepting a connection never waits
+// for the peer.
+type EncryptedConn struct {
+	net.Conn
+	client bool
+	token  string
+
+	handshakeMu   sync.Mutex
+	handshakeDone atomic.Bool
+	handshakeErr  error
+
+	readMu    sync.Mutex
+	reader    cipher.AEAD
+	readSeq   uint64
+	raw       []byte // sealed record read so far, kept across read timeouts
+	plaintext []byte // opened bytes not returned yet
+
+	writeMu  sync.Mutex
+	writer   cipher.AEAD
+	writeSeq uint64
+	record   []byte
+}
+
+// EncryptConn wraps conn, client tells which end of the tunnel conn is.
+func EncryptConn(conn net.Conn, token string, client bool) *EncryptedConn {
+	return &EncryptedConn{Conn: conn, client: client, token: token}
+}
+
+func (c *EncryptedConn) handshake() error {
+	if c.handshakeDone.Load() {
+		return c.handshakeErr
+	}
+
+	c.handshakeMu.Lock()
+	defer c.handshakeMu.Unlock()
+
+	if !c.handshakeDone.Load() {
+		// A failed or timed out exchange leaves the stream in an unknown
+		// state, the connection is closed rather than read again
+		if err := c.exchangeKeys(); err != nil {
+			c.Conn.Close()
+			c.handshakeErr = fmt.Errorf("%w: encryption key exchange failed: %v", net.ErrClosed, err)
+		}
+		c.handshakeDone.Store(true)
+	}
+	return c.handshakeErr
+}
+
+func (c *EncryptedConn) exchangeKeys() error {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	local := key.PublicKey().Bytes()
+	remote := make([]byte, len(local))
+
+	// The client speaks first, the server never sends anything to a peer that
+	// stays silent. The server answers with its salt ahead of its public key.
+	var psk *encryptionKey
+	if c.client {
+		if _, err := c.Conn.Write(local); err != nil {
+			return err
+		}
+
+		salt := make([]byte, encryptionSaltSize)
+		if _, err := io.ReadFull(c.Conn, salt); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(c.Conn, remote); err != nil {
+			return err
+		}
+		if psk, err = deriveEncryptionKey(c.token, salt); err != nil {
+			return err
+		}
+	} else {
+		if _, err := io.ReadFull(c.Conn, remote); err != nil {
+			return err
+		}
+		if psk, err = deriveEncryptionKey(c.token, nil); err != nil {
+			return err
+		}
+		if _, err := c.Conn.Write(append(slices.Clip(psk.salt), local...)); err != nil {
+			return err
+		}
+	}
+
+	peer, err := ecdh.X25519().NewPublicKey(remote)
+	if err != nil {
+		return err
+	}
+	shared, err := key.ECDH(peer)
+	if err != nil {
+		return err
+	}
+
+	clientKey, serverKey := local, remote
+	if !c.client {
+		clientKey, serverKey = remote, local
+	}
+
+	// HKDF with the token as salt, bound to both public keys
+	prk := hmacSum(psk.key, shared, clientKey, serverKey)
+	upstream, err := newRecordCipher(hmacSum(prk, []byte("client to server"), []byte{1}))
+	if err != nil {
+		return err
+	}
+	downstream, err := newRecordCipher(hmacSum(prk, []byte("server to client"), []byte{1}))
+	if err != nil {
+		return err
+	}
+
+	c.writer, c.reader = upstream, downstream
+	if !c.client {
+		c.writer, c.reader = downstream, upstream
+	}
+
+	c.raw = make([]byte, 0, encryptionHeader+encryptionMaxRecord+c.reader.Overhead())
+	c.record = make([]byte, 0, encryptionHeader+encryptionMaxRecord+c.writer.Overhead())
+	return nil
+}
+
+func (c *EncryptedConn) Read(b []byte) (int, error) {
+	if err := c.handshake(); err != nil {
+		return 0, err
+	}
+
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	for len(c.plaintext) == 0 {
+		if err := c.readRecord(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(b, c.plaintext)
+	c.plaintext = c.plaintext[n:]
+	return n, nil
+}
+
+func (c *EncryptedConn) readRecord() error {
+	if err := c.fill(encryptionHeader); err != nil {
+		return err
+	}
+
+	size := int(binary.BigEndian.Uint16(c.raw))
+	if size < c.reader.Overhead() || size > encryptionMaxRecord+c.reader.Overhead() {
+		return errRecordAuth
+	}
+	if err := c.fill(encryptionHeader + size); err != nil {
+		return err
+	}
+
+	// Opened in place, the bytes are returned before the next record is read
+	sealed := c.raw[encryptionHeader:]
+	plaintext, err := c.reader.Open(sealed[:0], recordNonce(c.readSeq), sealed, nil)
+	if err != nil {
+		return errRecordAuth
+	}
+	c.readSeq++
+	c.raw = c.raw[:0]
+	c.plaintext = plaintext
+	return nil
+}
+
+// fill reads until raw holds n bytes. A timeout keeps what was read, so a
+// read deadline does not break the record stream.
+func (c *EncryptedConn) fill(n int) error {
+	for len(c.raw) < n {
+		read, err := c.Conn.Read(c.raw[len(c.raw):n])
+		c.raw = c.raw[:len(c.raw)+read]
+		if err != nil {
+			if errors.Is(err, io.EOF) && len(c.raw) > 0 {
+				return io.ErrUnexpectedEOF
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *EncryptedConn) Write(b []byte) (int, error) {
+	if err := c.handshake(); err != nil {
+		return 0, err
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	written := 0
+	for len(b) > 0 {
+		n := min(len(b), encryptionMaxRecord)
+
+		record := c.writer.Seal(c.record[:encryptionHeader], recordNonce(c.writeSeq), b[:n], nil)
+		binary.BigEndian.PutUint16(record, uint16(len(record)-encryptionHeader))
+		c.writeSeq++
+
+		if _, err := c.Conn.Write(record); err != nil {
+			return written, err
+		}
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// NetConn returns the connection underneath, like tls.Conn, so socket options
+// reach the TCP connection through TCPConn.
+func (c *EncryptedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// CloseWrite half closes the connection underneath after the record being
+// written, so the peer reads every record before the end of stream.
+func (c *EncryptedConn) CloseWrite() error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if tcpConn, ok := TCPConn(c.Conn); ok {
+		return tcpConn.CloseWrite()
+	}
+	return nil
+}
+
+func newRecordCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func recordNonce(seq uint64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], seq)
+	return nonce
+}
+
+func hmacSum(key []byte, parts ...[]byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	for _, part := range parts {
+		mac.Write(part)
+	}
+	return mac.Sum(nil)
+}
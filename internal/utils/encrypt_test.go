@@ -0,0 +1,218 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+// encryptedPair returns both ends of an encrypted connection over a pipe.
+func encryptedPair(clientToken, serverToken string) (*EncryptedConn, *EncryptedConn) {
+	client, server := net.Pipe()
+	return EncryptConn(client, clientToken, true), EncryptConn(server, serverToken, false)
+}
+
+func TestEncryptedConnRoundTrip(t *testing.T) {
+	client, server := encryptedPair("secret", "secret")
+	defer client.Close()
+	defer server.Close()
+
+	// More than one record in each direction
+	upload := make([]byte, 3*encryptionMaxRecord+100)
+	download := make([]byte, encryptionMaxRecord+1)
+	rand.Read(upload)
+	rand.Read(download)
+
+	errs := make(chan error, 1)
+	go func() {
+		if _, err := client.Write(upload); err != nil {
+			errs <- err
+			return
+		}
+		received := make([]byte, len(download))
+		if _, err := io.ReadFull(client, received); err != nil {
+			errs <- err
+			return
+		}
+		if !bytes.Equal(received, download) {
+			errs <- errors.New("client received other bytes than the server sent")
+			return
+		}
+		errs <- nil
+	}()
+
+	received := make([]byte, len(upload))
+	if _, err := io.ReadFull(server, received); err != nil {
+		t.Fatalf("server read: %v", err)
+	}
+	if !bytes.Equal(received, upload) {
+		t.Fatal("server received other bytes than the client sent")
+	}
+	if _, err := server.Write(download); err != nil {
+		t.Fatalf("server write: %v", err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("client: %v", err)
+	}
+}
+
+func TestEncryptedConnWrongToken(t *testing.T) {
+	client, server := encryptedPair("secret", "other")
+	defer client.Close()
+	defer server.Close()
+
+	go client.Write([]byte("hello"))
+
+	buf := make([]byte, 16)
+	if _, err := server.Read(buf); !errors.Is(err, errRecordAuth) {
+		t.Errorf("read with another token returned %v, want %v", err, errRecordAuth)
+	}
+}
+
+// tamperConn flips a bit of the byte at offset of what is written through it.
+type tamperConn struct {
+	net.Conn
+	offset  int
+	written int
+}
+
+func (c *tamperConn) Write(b []byte) (int, error) {
+	if i := c.offset - c.written; i >= 0 && i < len(b) {
+		b = append([]byte(nil), b...)
+		b[i] ^= 0x01
+	}
+	c.written += len(b)
+	return c.Conn.Write(b)
+}
+
+func TestEncryptedConnTamperedRecord(t *testing.T) {
+	// The public key, the record length, then the sealed record
+	keySize := 32
+	tests := []struct {
+		name   string
+		offset int
+	}{
+		{"length", keySize + 1},
+		{"ciphertext", keySize + encryptionHeader + 2},
+		{"tag", keySize + encryptionHeader + 5 + 15},
+	}
+
+	for _, tt := range tests {
+		clientRaw, serverRaw := net.Pipe()
+		client := EncryptConn(&tamperConn{Conn: clientRaw, offset: tt.offset}, "secret", true)
+		server := EncryptConn(serverRaw, "secret", false)
+
+		go client.Write([]byte("hello"))
+
+		buf := make([]byte, 16)
+		if n, err := server.Read(buf); err == nil {
+			t.Errorf("%s: tampered record was accepted as %q", tt.name, buf[:n])
+		}
+
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestEncryptedConnReplayedRecord(t *testing.T) {
+	clientRaw, serverRaw := net.Pipe()
+	defer clientRaw.Close()
+
+	// Records are recorded as the client writes them
+	var recorded bytes.Buffer
+	client := EncryptConn(&recordConn{Conn: clientRaw, w: &recorded}, "secret", true)
+	server := EncryptConn(serverRaw, "secret", false)
+	defer server.Close()
+
+	go client.Write([]byte("pay once"))
+
+	buf := make([]byte, 16)
+	if _, err := server.Read(buf); err != nil {
+		t.Fatalf("first read: %v", err)
+	}
+
+	// The same record again, after the public key
+	record := recorded.Bytes()[32:]
+	go clientRaw.Write(record)
+
+	if n, err := server.Read(buf); !errors.Is(err, errRecordAuth) {
+		t.Errorf("replayed record read as %q with %v, want %v", buf[:n], err, errRecordAuth)
+	}
+}
+
+// recordConn copies what is written through it to w.
+type recordConn struct {
+	net.Conn
+	w io.Writer
+}
+
+func (c *recordConn) Write(b []byte) (int, error) {
+	c.w.Write(b)
+	return c.Conn.Write(b)
+}
+
+func TestEncryptedConnCloseWrite(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	clientRaw, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverRaw, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := EncryptConn(clientRaw, "secret", true)
+	server := EncryptConn(serverRaw, "secret", false)
+	defer client.Close()
+	defer server.Close()
+
+	if tcpConn, ok := TCPConn(client); !ok || tcpConn != clientRaw {
+		t.Fatal("TCPConn did not unwrap the encrypted connection")
+	}
+
+	go func() {
+		client.Write([]byte("last words"))
+		client.CloseWrite()
+	}()
+
+	// Every record arrives before the end of stream
+	received, err := io.ReadAll(server)
+	if err != nil {
+		t.Fatalf("read after the half close: %v", err)
+	}
+	if string(received) != "last words" {
+		t.Errorf("received %q, want %q", received, "last words")
+	}
+}
+
+func TestEncryptedConnFailedExchange(t *testing.T) {
+	clientRaw, serverRaw := net.Pipe()
+	client := EncryptConn(clientRaw, "secret", true)
+
+	// The peer hangs up before answering the key exchange
+	go func() {
+		buf := make([]byte, 32)
+		io.ReadFull(serverRaw, buf)
+		serverRaw.Close()
+	}()
+
+	buf := make([]byte, 16)
+	if _, err := client.Read(buf); err == nil {
+		t.Fatal("read succeeded without a key exchange")
+	}
+	if _, err := client.Write([]byte("hello")); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("write after the failed exchange returned %v, want %v", err, net.ErrClosed)
+	}
+	if _, err := clientRaw.Write([]byte("x")); !errors.Is(err, io.ErrClosedPipe) {
+		t.Errorf("the connection underneath is still open, write returned %v", err)
+	}
+}
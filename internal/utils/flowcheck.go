@@ -0,0 +1,48 @@
+package utils
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+)
+
+type flowCheck struct {
+	logger *logrus.Logger
+}
+
+// activeFlowCheck is nil until InitFlowCheck is called, so closed connections are not reconciled
+var activeFlowCheck atomic.Pointer[flowCheck]
+
+// InitFlowCheck reconciles the bytes read from each side of a forwarded
+// connection with the bytes written to the other side when it closes, until
+// ctx is done. A connection where they differ lost data inside the tunnel
+// process, e.g. to a failed write or a forwarding bug, and is logged with both
+// counts. Meant for debugging, it costs a comparison per connection.
+func InitFlowCheck(ctx context.Context, logger *logrus.Logger) {
+	fc := &flowCheck{logger: logger}
+	activeFlowCheck.Store(fc)
+
+	logger.Info("reconciling the bytes read and written of every forwarded connection")
+
+	go func() {
+		<-ctx.Done()
+		activeFlowCheck.CompareAndSwap(fc, nil)
+	}()
+}
+
+// checkFlow logs record when a direction wrote fewer bytes than it read,
+// upstreamRead and downstreamRead are the bytes read from the user and from
+// the backend.
+func checkFlow(record ConnRecord, upstreamRead int64, downstreamRead int64, logger *logrus.Logger) {
+	if activeFlowCheck.Load() == nil {
+		return
+	}
+	if upstreamRead == record.UpstreamBytes && downstreamRead == record.DownstreamBytes {
+		return
+	}
+
+	logger.Warnf("asymmetric data flow on port %d from %s to %s: upstream read %d and wrote %d bytes, downstream read %d and wrote %d bytes, reason=%q",
+		record.Port, record.Source, record.Target, upstreamRead, record.UpstreamBytes, downstreamRead, record.DownstreamBytes, record.Reason)
+	StatsdCount("flow_mismatches", 1, portTags(record.Port, record.Label)...)
+}
@@ -0,0 +1,456 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	handoffMaxListeners = 1024             // listening sockets passed in one handoff
+	handoffTimeout      = 10 * time.Second // for each step of the handoff
+	handoffUnclaimed    = 30 * time.Second // inherited and parked listeners no mapping took are closed after it
+)
+
+var handoffAck = []byte("ok")
+
+// handoff passes the listening sockets of a server to the next instance that
+// starts with the same handoff socket, so a binary upgrade never closes the
+// ports. Users connecting meanwhile wait in the accept queue instead of being
+// refused. Tunnel connections are not handed over, the client reconnects to
+// the new instance once the old one is gone. A reload in the same process
+// parks the listeners of the old instance the same way, see ParkListeners.
+type handoff struct {
+	mu        sync.Mutex
+	inherited map[string]net.Listener // listeners of the previous process by listen address
+	parked    map[string]net.Listener // listeners closed during a reload by listen address
+	parking   int                     // reloads in progress, listeners closed meanwhile are parked
+	gen       int                     // reloads started, listeners of earlier ones can be taken over
+	active    map[*handoffListener]struct{}
+	logger    atomic.Pointer[logrus.Logger]
+}
+
+// listeners tracks the listeners opened through Listen, for handing them over
+// to the next instance
+var listeners = &handoff{
+	inherited: make(map[string]net.Listener),
+	parked:    make(map[string]net.Listener),
+	active:    make(map[*handoffListener]struct{}),
+}
+
+func init() {
+	listeners.logger.Store(NewLogger("info"))
+}
+
+// handoffListener is a listener that is handed over to the next instance
+// until it is closed.
+type handoffListener struct {
+	net.Listener
+	addr  string
+	gen   int  // reloads started before it was opened
+	taken bool // the next instance of this process shares the socket
+	h     *handoff
+	once  sync.Once
+}
+
+// InitHandoff takes over the listening sockets of a previous instance serving
+// the unix socket path, then serves path itself until ctx is done. Once the
+// next instance took over the listeners of this one, they are closed here and
+// stop is called to shut this instance down. done is closed once path is not
+// served anymore, so the next instance of this process can serve it.
+func InitHandoff(ctx context.Context, path string, stop func(), logger *logrus.Logger) (done <-chan struct{}) {
+	h := listeners
+	h.logger.Store(logger)
+
+	if err := h.takeOver(path); err != nil {
+		logger.Errorf("failed to take over the listeners of the previous instance on %s: %v", path, err)
+	}
+
+	// The socket file of the previous instance is stale now
+	os.Remove(path)
+
+	closed := make(chan struct{})
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		logger.Errorf("failed to listen on handoff socket %s: %v", path, err)
+		close(closed)
+	} else {
+		logger.Infof("handing over the listeners to the next instance started with handoff socket %s", path)
+		go func() {
+			<-ctx.Done()
+			listener.Close()
+			close(closed)
+		}()
+		go h.serve(ctx, listener, stop)
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-time.After(handoffUnclaimed):
+		}
+		h.closeUnclaimed()
+	}()
+
+	return closed
+}
+
+// ParkListeners keeps the sockets of the listeners opened through Listen open
+// when they are closed, so the instance started next by a config reload takes
+// them over instead of listening anew. The listeners of the running instance
+// can be taken over while it stops. Users connecting meanwhile wait in the
+// accept queue instead of being refused. The parked listeners nothing took
+// over are closed after a while, once no other reload is in progress.
+func ParkListeners(logger *logrus.Logger) {
+	h := listeners
+	h.logger.Store(logger)
+
+	h.mu.Lock()
+	h.parking++
+	h.gen++
+	h.mu.Unlock()
+
+	time.AfterFunc(handoffUnclaimed, h.unpark)
+}
+
+// Listen listens for TCP connections on addr with lc. A listener taken over
+// from the previous instance, over the handoff socket or on a reload, is used
+// instead, and the listener is handed over to the next instance until it is
+// closed.
+func Listen(ctx context.Context, lc *net.ListenConfig, addr string) (net.Listener, error) {
+	h := listeners
+
+	listener := h.take(addr)
+	if listener == nil {
+		var err error
+		if listener, err = lc.Listen(ctx, "tcp", addr); err != nil {
+			return nil, err
+		}
+	}
+
+	h.mu.Lock()
+	l := &handoffListener{Listener: listener, addr: addr, gen: h.gen, h: h}
+	h.active[l] = struct{}{}
+	h.mu.Unlock()
+
+	return l, nil
+}
+
+// take returns the listener left on addr by the previous instance, or nil.
+func (h *handoff) take(addr string) net.Listener {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if listener, ok := h.parked[addr]; ok {
+		delete(h.parked, addr)
+		h.log().Debugf("took over the listener on %s from the previous instance", addr)
+		return listener
+	}
+
+	if listener, ok := h.inherited[addr]; ok {
+		delete(h.inherited, addr)
+		h.log().Debugf("took over the listener on %s from the previous instance", addr)
+		return listener
+	}
+
+	// The previous instance of this process may not have closed it yet
+	if h.parking > 0 {
+		for l := range h.active {
+			if l.addr != addr || l.gen >= h.gen || l.taken {
+				continue
+			}
+			listener, err := dupListener(l.Listener)
+			if err != nil {
+				h.log().Warnf("failed to take over the listener on %s: %v", addr, err)
+				return nil
+			}
+			l.taken = true
+			h.log().Debugf("took over the listener on %s from the previous instance", addr)
+			return listener
+		}
+	}
+
+	return nil
+}
+
+func (l *handoffListener) Close() error {
+	l.once.Do(func() {
+		l.h.mu.Lock()
+		defer l.h.mu.Unlock()
+
+		delete(l.h.active, l)
+
+		// A duplicate keeps the socket open, closing this one still ends Accept
+		if l.h.parking == 0 || l.taken {
+			return
+		}
+		if _, ok := l.h.parked[l.addr]; ok {
+			return
+		}
+		if listener, err := dupListener(l.Listener); err != nil {
+			l.h.log().Warnf("failed to keep the listener on %s open for the next instance: %v", l.addr, err)
+		} else {
+			l.h.parked[l.addr] = listener
+		}
+	})
+	return l.Listener.Close()
+}
+
+// WaitReleased waits until the addresses can be listened on again on network,
+// "tcp" or "udp", or timeout passed. An address whose socket is parked for the
+// next instance counts as released.
+func WaitReleased(network string, addrs []string, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for _, addr := range addrs {
+		for !released(network, addr) && time.Now().Before(deadline) {
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+}
+
+func released(network, addr string) bool {
+	if network == "udp" {
+		conn, err := net.ListenPacket(network, addr)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	}
+
+	listeners.mu.Lock()
+	_, parked := listeners.parked[addr]
+	listeners.mu.Unlock()
+	if parked {
+		return true
+	}
+
+	listener, err := net.Listen(network, addr)
+	if err != nil {
+		return false
+	}
+	listener.Close()
+	return true
+}
+
+// unpark ends a reload, the listeners parked and not taken over are closed once
+// no other reload is in progress.
+func (h *handoff) unpark() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.parking--; h.parking > 0 {
+		return
+	}
+
+	for addr, listener := range h.parked {
+		h.log().Infof("closing the listener on %s kept open for the reload, nothing uses it anymore", addr)
+		listener.Close()
+		delete(h.parked, addr)
+	}
+}
+
+func (h *handoff) log() *logrus.Logger {
+	return h.logger.Load()
+}
+
+// dupListener returns a listener on a duplicate of the socket of listener.
+func dupListener(listener net.Listener) (net.Listener, error) {
+	filer, ok := listener.(interface{ File() (*os.File, error) })
+	if !ok {
+		return nil, errors.New("listener cannot be duplicated")
+	}
+	file, err := filer.File()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return net.FileListener(file)
+}
+
+// takeOver receives the listeners of the instance serving path, if there is one.
+func (h *handoff) takeOver(path string) error {
+	conn, err := net.DialTimeout("unix", path, handoffTimeout)
+	if err != nil {
+		h.log().Debugf("no previous instance on handoff socket %s", path)
+		return nil
+	}
+	defer conn.Close()
+
+	unixConn := conn.(*net.UnixConn)
+	unixConn.SetDeadline(time.Now().Add(handoffTimeout))
+
+	buf := make([]byte, 64*1024)
+	oob := make([]byte, syscall.CmsgSpace(4*handoffMaxListeners))
+	n, oobn, _, _, err := unixConn.ReadMsgUnix(buf, oob)
+	if err != nil {
+		return err
+	}
+
+	var fds []int
+	messages, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return err
+	}
+	for _, message := range messages {
+		rights, err := syscall.ParseUnixRights(&message)
+		if err != nil {
+			return err
+		}
+		fds = append(fds, rights...)
+	}
+
+	var addrs []string
+	if err := json.Unmarshal(buf[:n], &addrs); err != nil || len(addrs) != len(fds) {
+		for _, fd := range fds {
+			syscall.Close(fd)
+		}
+		return errors.New("malformed handoff message")
+	}
+
+	taken := 0
+	for i, fd := range fds {
+		file := os.NewFile(uintptr(fd), addrs[i])
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			h.log().Warnf("failed to take over the listener on %s: %v", addrs[i], err)
+			continue
+		}
+		h.mu.Lock()
+		h.inherited[addrs[i]] = listener
+		h.mu.Unlock()
+		taken++
+	}
+
+	if _, err := conn.Write(handoffAck); err != nil {
+		return err
+	}
+
+	h.log().Infof("took over %d listeners from the previous instance", taken)
+	return nil
+}
+
+func (h *handoff) serve(ctx context.Context, listener *net.UnixListener, stop func()) {
+	for {
+		conn, err := listener.AcceptUnix()
+		if err != nil {
+			return
+		}
+
+		// The listeners stay with this process on a reload
+		if ctx.Err() != nil {
+			conn.Close()
+			return
+		}
+
+		if err := h.handOver(conn); err != nil {
+			h.log().Errorf("failed to hand over the listeners to the next instance: %v", err)
+			continue
+		}
+
+		// The socket file belongs to the next instance now
+		listener.SetUnlinkOnClose(false)
+
+		h.log().Info("the next instance took over the listeners, shutting down")
+		stop()
+		return
+	}
+}
+
+// handOver passes the open listeners over conn and closes them here once the
+// next instance confirmed it took them over.
+func (h *handoff) handOver(conn *net.UnixConn) error {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(handoffTimeout))
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var addrs []string
+	var files []*os.File
+	var fds []int
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+
+	add := func(addr string, listener net.Listener) {
+		filer, ok := listener.(interface{ File() (*os.File, error) })
+		if !ok {
+			return
+		}
+		file, err := filer.File()
+		if err != nil {
+			h.log().Warnf("failed to hand over the listener on %s: %v", addr, err)
+			return
+		}
+		addrs = append(addrs, addr)
+		files = append(files, file)
+		fds = append(fds, int(file.Fd()))
+	}
+
+	for l := range h.active {
+		add(l.addr, l.Listener)
+	}
+	for addr, listener := range h.inherited {
+		add(addr, listener)
+	}
+	for addr, listener := range h.parked {
+		add(addr, listener)
+	}
+	if len(fds) > handoffMaxListeners {
+		return errors.New("too many listeners to hand over")
+	}
+
+	message, err := json.Marshal(addrs)
+	if err != nil {
+		return err
+	}
+	if _, _, err := conn.WriteMsgUnix(message, syscall.UnixRights(fds...), nil); err != nil {
+		return err
+	}
+
+	ack := make([]byte, len(handoffAck))
+	if _, err := conn.Read(ack); err != nil || string(ack) != string(handoffAck) {
+		return errors.New("the next instance did not confirm the handoff")
+	}
+
+	// The next instance accepts on the sockets from now on
+	for l := range h.active {
+		l.Listener.Close()
+	}
+	for addr, listener := range h.inherited {
+		listener.Close()
+		delete(h.inherited, addr)
+	}
+	for addr, listener := range h.parked {
+		listener.Close()
+		delete(h.parked, addr)
+	}
+
+	return nil
+}
+
+// closeUnclaimed closes the listeners of the previous instance that no port
+// mapping of this one took over.
+func (h *handoff) closeUnclaimed() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for addr, listener := range h.inherited {
+		h.log().Infof("closing the listener on %s taken over from the previous instance, nothing uses it anymore", addr)
+		listener.Close()
+		delete(h.inherited, addr)
+	}
+}
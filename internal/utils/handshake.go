@@ -0,0 +1,131 @@
+package utils
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+// HandshakeVersion is the newest control channel handshake this build speaks.
+// Version 0 is the legacy frame of SendBinaryTransportString, every later
+// version starts with handshakeMagic and the version byte, so a server tells
+// the formats apart from the first byte and can branch on the version. The
+// server answers in the lower of its own and the client's version, a client
+// keeps using version 0 with servers that predate the versioned frame.
+//
+// Version 2 adds the client ID after the token. Version 3 adds the resumption
+// token after it, the server hands out a new one in every answer and the client
+// presents it on its next handshake.
+const HandshakeVersion byte = 3
+
+// handshakeMagic starts a versioned handshake frame. A legacy frame starts
+// with the high byte of the token length, it would take a token of 47616 bytes
+// or more to start with the same byte.
+const handshakeMagic byte = 0xBA
+
+// Handshake is a control channel handshake, the fields a version does not
+// carry are left empty.
+type Handshake struct {
+	Token    string
+	Signal   byte
+	Version  byte
+	ClientID string // stable ID of the client across its reconnects, from version 2
+	Resume   string // single-use resumption token of the session, from version 3
+}
+
+// SendHandshake sends h in the framing of h.Version.
+func SendHandshake(conn net.Conn, h Handshake) error {
+	if h.Version == 0 {
+		return SendBinaryTransportString(conn, h.Token, h.Signal)
+	}
+	if len(h.ClientID) > 255 {
+		return fmt.Errorf("client ID longer than 255 bytes")
+	}
+	if len(h.Resume) > 255 {
+		return fmt.Errorf("resumption token longer than 255 bytes")
+	}
+
+	// magic, version, 2-byte length, signal, token
+	buf := make([]byte, 5, 5+len(h.Token)+1+len(h.ClientID)+1+len(h.Resume))
+	buf[0] = handshakeMagic
+	buf[1] = h.Version
+	binary.BigEndian.PutUint16(buf[2:4], uint16(len(h.Token)))
+	buf[4] = h.Signal
+	buf = append(buf, h.Token...)
+
+	// 1-byte length, client ID
+	if h.Version >= 2 {
+		buf = append(buf, byte(len(h.ClientID)))
+		buf = append(buf, h.ClientID...)
+	}
+
+	// 1-byte length, resumption token
+	if h.Version >= 3 {
+		buf = append(buf, byte(len(h.Resume)))
+		buf = append(buf, h.Resume...)
+	}
+
+	if _, err := conn.Write(buf); err != nil {
+		return fmt.Errorf("failed to send handshake: %w", err)
+	}
+	return nil
+}
+
+// ReceiveHandshake reads a control channel handshake in either framing, the
+// version is 0 for the legacy frame.
+func ReceiveHandshake(conn net.Conn) (Handshake, error) {
+	var h Handshake
+
+	var header [3]byte
+	if _, err := io.ReadFull(conn, header[:1]); err != nil {
+		return h, fmt.Errorf("failed to read handshake from net.Conn: %w", err)
+	}
+
+	if header[0] == handshakeMagic {
+		if _, err := io.ReadFull(conn, header[:1]); err != nil {
+			return h, fmt.Errorf("failed to read handshake version from net.Conn: %w", err)
+		}
+		h.Version = header[0]
+
+		if _, err := io.ReadFull(conn, header[:]); err != nil {
+			return h, fmt.Errorf("failed to read handshake header from net.Conn: %w", err)
+		}
+	} else {
+		// The byte read is the high byte of the legacy length
+		if _, err := io.ReadFull(conn, header[1:]); err != nil {
+			return h, fmt.Errorf("failed to read handshake header from net.Conn: %w", err)
+		}
+	}
+	h.Signal = header[2]
+
+	token := make([]byte, binary.BigEndian.Uint16(header[:2]))
+	if _, err := io.ReadFull(conn, token); err != nil {
+		return h, fmt.Errorf("failed to read handshake token from net.Conn: %w", err)
+	}
+	h.Token = string(token)
+
+	if h.Version >= 2 {
+		if _, err := io.ReadFull(conn, header[:1]); err != nil {
+			return h, fmt.Errorf("failed to read handshake client ID from net.Conn: %w", err)
+		}
+		id := make([]byte, header[0])
+		if _, err := io.ReadFull(conn, id); err != nil {
+			return h, fmt.Errorf("failed to read handshake client ID from net.Conn: %w", err)
+		}
+		h.ClientID = string(id)
+	}
+
+	if h.Version >= 3 {
+		if _, err := io.ReadFull(conn, header[:1]); err != nil {
+			return h, fmt.Errorf("failed to read handshake resumption token from net.Conn: %w", err)
+		}
+		resume := make([]byte, header[0])
+		if _, err := io.ReadFull(conn, resume); err != nil {
+			return h, fmt.Errorf("failed to read handshake resumption token from net.Conn: %w", err)
+		}
+		h.Resume = string(resume)
+	}
+
+	return h, nil
+}
@@ -0,0 +1,121 @@
+package utils
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+// exchange runs send on one end of a pipe and returns the handshake received
+// on the other.
+func exchange(t *testing.T, send func(net.Conn) error) Handshake {
+	t.Helper()
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- send(client)
+	}()
+
+	h, err := ReceiveHandshake(server)
+	if err != nil {
+		t.Fatalf("ReceiveHandshake: %v", err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	return h
+}
+
+func TestHandshakeRoundTrip(t *testing.T) {
+	sent := Handshake{Token: "secret", Signal: SG_Ports, ClientID: "edge-1", Resume: "resume-token"}
+
+	tests := []struct {
+		version byte
+		want    Handshake
+	}{
+		{0, Handshake{Token: "secret", Signal: SG_Ports}},
+		{1, Handshake{Token: "secret", Signal: SG_Ports, Version: 1}},
+		{2, Handshake{Token: "secret", Signal: SG_Ports, Version: 2, ClientID: "edge-1"}},
+		{3, Handshake{Token: "secret", Signal: SG_Ports, Version: 3, ClientID: "edge-1", Resume: "resume-token"}},
+	}
+
+	for _, tt := range tests {
+		h := sent
+		h.Version = tt.version
+
+		got := exchange(t, func(conn net.Conn) error {
+			return SendHandshake(conn, h)
+		})
+		if got != tt.want {
+			t.Errorf("version %d: received %+v, want %+v", tt.version, got, tt.want)
+		}
+	}
+}
+
+func TestHandshakeEmptyFields(t *testing.T) {
+	got := exchange(t, func(conn net.Conn) error {
+		return SendHandshake(conn, Handshake{Token: "", Signal: SG_Chan, Version: HandshakeVersion})
+	})
+
+	want := Handshake{Signal: SG_Chan, Version: HandshakeVersion}
+	if got != want {
+		t.Errorf("received %+v, want %+v", got, want)
+	}
+}
+
+func TestHandshakeLegacyFrame(t *testing.T) {
+	got := exchange(t, func(conn net.Conn) error {
+		return SendBinaryTransportString(conn, "legacy", SG_Chan)
+	})
+
+	want := Handshake{Token: "legacy", Signal: SG_Chan}
+	if got != want {
+		t.Errorf("received %+v, want %+v", got, want)
+	}
+}
+
+func TestHandshakeLegacyLongToken(t *testing.T) {
+	// A legacy token of 256 bytes or more starts the frame with a non-zero byte
+	token := strings.Repeat("t", 300)
+
+	got := exchange(t, func(conn net.Conn) error {
+		return SendBinaryTransportString(conn, token, SG_Chan)
+	})
+
+	if got.Version != 0 || got.Token != token {
+		t.Errorf("received version %d and a %d byte token, want version 0 and %d bytes", got.Version, len(got.Token), len(token))
+	}
+}
+
+func TestHandshakeFieldTooLong(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	long := strings.Repeat("x", 256)
+	if err := SendHandshake(client, Handshake{Token: "t", Version: 2, ClientID: long}); err == nil {
+		t.Error("SendHandshake accepted a client ID of 256 bytes")
+	}
+	if err := SendHandshake(client, Handshake{Token: "t", Version: 3, Resume: long}); err == nil {
+		t.Error("SendHandshake accepted a resumption token of 256 bytes")
+	}
+}
+
+func TestHandshakeTruncated(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	go func() {
+		// Magic, version and half the header
+		client.Write([]byte{handshakeMagic, 3, 0})
+		client.Close()
+	}()
+
+	if _, err := ReceiveHandshake(server); err == nil {
+		t.Error("ReceiveHandshake accepted a truncated frame")
+	}
+}
@@ -0,0 +1,56 @@
+package utils
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+type keepAliveProbes struct {
+	interval time.Duration
+	count    int
+}
+
+// activeKeepAliveProbes is nil until InitKeepAliveProbes is called, so probes keep their usual timing
+var activeKeepAliveProbes atomic.Pointer[keepAliveProbes]
+
+// InitKeepAliveProbes sets the interval and the number of the keep-alive
+// probes of tunnel connections until ctx is done, a dead peer is detected
+// after the keep-alive period plus interval times count. A value of 0 keeps
+// the usual interval, the keep-alive period, or the system default count.
+func InitKeepAliveProbes(ctx context.Context, interval time.Duration, count int, logger *logrus.Logger) {
+	probes := &keepAliveProbes{interval: interval, count: count}
+	activeKeepAliveProbes.Store(probes)
+
+	logger.Infof("using TCP keep-alive probe interval %v and count %d, 0 keeps the default", interval, count)
+
+	go func() {
+		<-ctx.Done()
+		activeKeepAliveProbes.CompareAndSwap(probes, nil)
+	}()
+}
+
+// KeepAliveConfig returns the keep-alive settings of a tunnel connection with
+// the keep-alive period idle. Options a platform lacks are ignored there.
+func KeepAliveConfig(idle time.Duration) net.KeepAliveConfig {
+	if idle < 0 {
+		return net.KeepAliveConfig{Enable: false}
+	}
+
+	// Like SetKeepAlivePeriod, the period is also the probe interval by default
+	config := net.KeepAliveConfig{Enable: true, Idle: idle, Interval: idle, Count: -1}
+
+	if probes := activeKeepAliveProbes.Load(); probes != nil {
+		if probes.interval > 0 {
+			config.Interval = probes.interval
+		}
+		if probes.count > 0 {
+			config.Count = probes.count
+		}
+	}
+
+	return config
+}
@@ -0,0 +1,100 @@
+package utils
+
+import (
+	"os"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// logFile is a line based log that is rotated to path.1 once it grows beyond
+// maxSize bytes, it is shared by the connection log and the access log.
+type logFile struct {
+	mu      sync.Mutex
+	name    string // what the log is, for error messages
+	path    string
+	file    *os.File
+	size    int64
+	maxSize int64 // bytes, 0 disables rotation
+	logger  *logrus.Logger
+}
+
+// openLogFile opens path for appending, or uses stdout when path is "stdout".
+func openLogFile(name string, path string, maxSize int64, logger *logrus.Logger) (*logFile, error) {
+	l := &logFile{name: name, path: path, maxSize: maxSize, logger: logger}
+
+	if path == "stdout" {
+		l.file = os.Stdout
+		l.maxSize = 0
+		return l, nil
+	}
+
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *logFile) open() error {
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	l.file = file
+	l.size = info.Size()
+	return nil
+}
+
+// rotate moves the full log to path.1, the log is reopened even if that fails.
+func (l *logFile) rotate() error {
+	l.file.Close()
+	renameErr := os.Rename(l.path, l.path+".1")
+
+	if err := l.open(); err != nil {
+		l.file = nil
+		return err
+	}
+	return renameErr
+}
+
+func (l *logFile) write(data []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// The log was closed or could not be reopened
+	if l.file == nil {
+		return
+	}
+
+	if l.maxSize > 0 && l.size+int64(len(data)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			l.logger.Errorf("failed to rotate %s %s: %v", l.name, l.path, err)
+		}
+		if l.file == nil {
+			return
+		}
+	}
+
+	n, err := l.file.Write(data)
+	l.size += int64(n)
+	if err != nil {
+		l.logger.Errorf("failed to write %s %s: %v", l.name, l.path, err)
+	}
+}
+
+func (l *logFile) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file != nil && l.file != os.Stdout {
+		l.file.Close()
+	}
+	l.file = nil
+}
@@ -0,0 +1,33 @@
+package utils
+
+import (
+	"runtime"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+)
+
+// MSSControl returns a socket control function clamping TCP_MAXSEG to mss, so
+// the MSS is announced in the SYN of dialed connections and inherited by
+// connections accepted from a listener. TCP_MAXSEG is only set on Linux, on
+// other systems or with an mss of 0 the function does nothing. A failure is
+// logged when a logger is given and the socket is used without clamping.
+func MSSControl(mss int, logger *logrus.Logger) func(network, address string, s syscall.RawConn) error {
+	return func(network, address string, s syscall.RawConn) error {
+		if mss <= 0 || runtime.GOOS != "linux" {
+			return nil
+		}
+
+		err := s.Control(func(fd uintptr) {
+			if err := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, 0x2 /* TCP_MAXSEG */, mss); err != nil && logger != nil {
+				logger.Warnf("failed to set TCP_MAXSEG to %d on %s: %v", mss, address, err)
+			}
+		})
+
+		if err != nil && logger != nil {
+			logger.Warnf("failed to access socket of %s for MSS clamping: %v", address, err)
+		}
+
+		return nil
+	}
+}
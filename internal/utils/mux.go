@@ -0,0 +1,68 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	"github.com/xtaci/smux"
+)
+
+// MuxVersionHeader carries the mux version of a wsmux client on its control
+// channel request, and that of the server when it refuses the request.
+const MuxVersionHeader = "X-Mux-Version"
+
+// MuxSignal is the signal that tells the peer the mux version of this side
+// during the control channel handshake, before any mux session exists. A
+// tcpmux or tcpsingle server answers the handshake with it instead of SG_Chan,
+// older clients ignore that byte.
+func MuxSignal(version int) byte {
+	if version == 2 {
+		return SG_MuxV2
+	}
+	return SG_MuxV1
+}
+
+// SignaledMuxVersion returns the mux version signal tells, or 0 for other
+// signals such as the SG_Chan answer of older servers.
+func SignaledMuxVersion(signal byte) int {
+	switch signal {
+	case SG_MuxV1:
+		return 1
+	case SG_MuxV2:
+		return 2
+	}
+	return 0
+}
+
+// MuxVersionMismatch is the error for a peer whose mux version differs from
+// this side, mux sessions between them would fail with an opaque protocol error.
+func MuxVersionMismatch(peer string, peerVersion int, version int) error {
+	return fmt.Errorf("mux_version mismatch, %s uses %d and this side %d, set the same mux_version on the server and the client", peer, peerVersion, version)
+}
+
+// LogMuxSession logs the effective smux parameters of a new session.
+func LogMuxSession(session *smux.Session, config *smux.Config, logger *logrus.Logger) {
+	logger.Debugf("mux session with %s established, version: %d, frame size: %d, receive buffer: %d, stream buffer: %d",
+		session.RemoteAddr().String(), config.Version, config.MaxFrameSize, config.MaxReceiveBuffer, config.MaxStreamBuffer)
+}
+
+// WarnMuxMismatch reports whether err means the peer sent frames of another
+// smux version, which happens when mux_version differs between the server and
+// the client, and logs a warning in that case.
+func WarnMuxMismatch(err error, session *smux.Session, version int, logger *logrus.Logger) bool {
+	if !errors.Is(err, smux.ErrInvalidProtocol) {
+		return false
+	}
+
+	logger.Warnf("mux protocol mismatch with %s, check that mux_version (%d here) is the same on the server and the client", session.RemoteAddr().String(), version)
+	return true
+}
+
+// WatchMuxMismatch waits on a session whose peer never opens streams and warns
+// about a version mismatch as soon as the peer's first frame arrives.
+func WatchMuxMismatch(session *smux.Session, version int, logger *logrus.Logger) {
+	if _, err := session.AcceptStream(); WarnMuxMismatch(err, session, version, logger) {
+		session.Close()
+	}
+}
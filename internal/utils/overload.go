@@ -0,0 +1,95 @@
+package utils
+
+import (
+	"context"
+	"runtime"
+	"runtime/metrics"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	overloadInterval = time.Second // how often the goroutines and the memory are sampled
+	overloadResume   = 0.9         // fraction of a threshold usage has to fall below to accept again
+)
+
+// overload samples the goroutines and the memory of the process, past a
+// threshold it is overloaded until both are back below overloadResume of
+// their thresholds, so it does not flap around a threshold.
+type overload struct {
+	maxGoroutines int
+	maxMemory     uint64 // bytes
+	active        atomic.Bool
+	logger        *logrus.Logger
+}
+
+// activeOverload is nil until InitOverload is called, so connections are never shed
+var activeOverload atomic.Pointer[overload]
+
+// InitOverload sheds new local connections while the process runs more than
+// maxGoroutines goroutines or holds more than maxMemory MB, until ctx is done.
+// A threshold of 0 is not checked.
+func InitOverload(ctx context.Context, maxGoroutines int, maxMemory int, logger *logrus.Logger) {
+	o := &overload{maxGoroutines: maxGoroutines, maxMemory: uint64(maxMemory) * 1024 * 1024, logger: logger}
+	activeOverload.Store(o)
+
+	logger.Infof("shedding new connections above %d goroutines or %d MB of memory, 0 is not checked", maxGoroutines, maxMemory)
+
+	go func() {
+		ticker := time.NewTicker(overloadInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				activeOverload.CompareAndSwap(o, nil)
+				return
+			case <-ticker.C:
+				o.sample()
+			}
+		}
+	}()
+}
+
+// Overloaded reports whether new local connections are to be refused, the
+// connections in flight keep going.
+func Overloaded() bool {
+	o := activeOverload.Load()
+	return o != nil && o.active.Load()
+}
+
+func (o *overload) sample() {
+	goroutines := runtime.NumGoroutine()
+	memory := processMemory()
+
+	over := (o.maxGoroutines > 0 && goroutines > o.maxGoroutines) || (o.maxMemory > 0 && memory > o.maxMemory)
+	under := (o.maxGoroutines == 0 || float64(goroutines) < float64(o.maxGoroutines)*overloadResume) &&
+		(o.maxMemory == 0 || float64(memory) < float64(o.maxMemory)*overloadResume)
+
+	switch {
+	case over && !o.active.Load():
+		o.active.Store(true)
+		o.logger.Warnf("overloaded with %d goroutines and %d MB of memory, refusing new connections", goroutines, memory/1024/1024)
+	case under && o.active.Load():
+		o.active.Store(false)
+		o.logger.Infof("load is back to %d goroutines and %d MB of memory, accepting new connections", goroutines, memory/1024/1024)
+	}
+}
+
+// processMemory returns the memory the Go runtime holds from the system,
+// without the heap it already returned. Unlike runtime.ReadMemStats it does
+// not stop the world.
+func processMemory() uint64 {
+	samples := []metrics.Sample{
+		{Name: "/memory/classes/total:bytes"},
+		{Name: "/memory/classes/heap/released:bytes"},
+	}
+	metrics.Read(samples)
+
+	if samples[0].Value.Kind() != metrics.KindUint64 || samples[1].Value.Kind() != metrics.KindUint64 {
+		return 0
+	}
+	return samples[0].Value.Uint64() - samples[1].Value.Uint64()
+}
@@ -0,0 +1,85 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// prefaceSignature starts every preface, no common protocol opens with it
+var prefaceSignature = []byte("\r\nBHPF\r\n")
+
+// PrefaceVersion is the newest preface format this build writes and reads.
+const PrefaceVersion byte = 1
+
+// Preface is sent ahead of the data of a forwarded connection whose backend is
+// another Backhaul server, so chained tunnels pass on the user and how the
+// connection came in. Unlike a PROXY protocol header it is only sent to and
+// only stripped by Backhaul, on ports configured on both ends.
+type Preface struct {
+	Protocol  byte   // control channel handshake version of the first hop, see HandshakeVersion
+	Transport string // transport of the first hop, e.g. tcpmux
+	Source    string // user address as "ip:port"
+	Local     string // listener address the user connected to on the first hop
+	Label     string // label of the port mapping on the first hop, if any
+}
+
+// Bytes returns the preface: the signature, the preface version, the
+// protocol version, a 2-byte length and the fields, each a 1-byte length and
+// the value.
+func (p Preface) Bytes() []byte {
+	var body []byte
+	for _, field := range []string{p.Transport, p.Source, p.Local, p.Label} {
+		if len(field) > 255 {
+			field = field[:255]
+		}
+		body = append(body, byte(len(field)))
+		body = append(body, field...)
+	}
+
+	buf := make([]byte, 0, len(prefaceSignature)+4+len(body))
+	buf = append(buf, prefaceSignature...)
+	buf = append(buf, PrefaceVersion, p.Protocol)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(body)))
+	return append(buf, body...)
+}
+
+// ReadPreface reads a preface from r. When r does not start with one, ok is
+// false and head holds the bytes consumed, which belong to the connection. A
+// newer preface version is read as far as this build knows its fields.
+func ReadPreface(r io.Reader) (p Preface, head []byte, ok bool, err error) {
+	head = make([]byte, len(prefaceSignature))
+	n, err := io.ReadFull(r, head)
+	if err != nil || !bytes.Equal(head, prefaceSignature) {
+		return p, head[:n], false, err
+	}
+
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return p, nil, false, fmt.Errorf("failed to read preface header: %w", err)
+	}
+	if header[0] == 0 {
+		return p, nil, false, fmt.Errorf("invalid preface version 0")
+	}
+	p.Protocol = header[1]
+
+	body := make([]byte, binary.BigEndian.Uint16(header[2:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return p, nil, false, fmt.Errorf("failed to read preface: %w", err)
+	}
+
+	for _, field := range []*string{&p.Transport, &p.Source, &p.Local, &p.Label} {
+		if len(body) == 0 {
+			break
+		}
+		size := int(body[0])
+		if 1+size > len(body) {
+			return p, nil, false, fmt.Errorf("truncated preface field")
+		}
+		*field = string(body[1 : 1+size])
+		body = body[1+size:]
+	}
+
+	return p, nil, true, nil
+}
@@ -0,0 +1,81 @@
+package utils
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// capNetBindService is the bit of CAP_NET_BIND_SERVICE in the capability sets of /proc/self/status
+const capNetBindService = 10
+
+// CheckBindPermission reports an error with a hint how to fix it when addr
+// has a privileged port that this process is not allowed to bind. It only
+// checks on Linux, elsewhere listening reports the failure itself.
+func CheckBindPermission(addr string) error {
+	if runtime.GOOS != "linux" || os.Geteuid() == 0 {
+		return nil
+	}
+
+	_, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil // listening reports the invalid address
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port == 0 || port >= unprivilegedPortStart() {
+		return nil
+	}
+
+	if hasBindCapability() {
+		return nil
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		executable = os.Args[0]
+	}
+
+	return fmt.Errorf("port %d is privileged and the process lacks CAP_NET_BIND_SERVICE, "+
+		"grant it with \"sudo setcap cap_net_bind_service=+ep %s\", add AmbientCapabilities=CAP_NET_BIND_SERVICE "+
+		"to the systemd unit, run as root or use a port above %d", port, executable, unprivilegedPortStart()-1)
+}
+
+// unprivilegedPortStart is the lowest port anyone may bind, 1024 unless the sysctl lowers it
+func unprivilegedPortStart() int {
+	data, err := os.ReadFile("/proc/sys/net/ipv4/ip_unprivileged_port_start")
+	if err != nil {
+		return 1024
+	}
+
+	start, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 1024
+	}
+	return start
+}
+
+// hasBindCapability reports whether CAP_NET_BIND_SERVICE is in the effective set, an unreadable set counts as present
+func hasBindCapability() bool {
+	data, err := os.ReadFile("/proc/self/status")
+	if err != nil {
+		return true
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		value, ok := strings.CutPrefix(line, "CapEff:")
+		if !ok {
+			continue
+		}
+
+		caps, err := strconv.ParseUint(strings.TrimSpace(value), 16, 64)
+		if err != nil {
+			return true
+		}
+		return caps&(1<<capNetBindService) != 0
+	}
+
+	return true
+}
@@ -0,0 +1,62 @@
+package utils
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+// proxyV2Signature starts every PROXY protocol v2 header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	proxyV2Local = 0x20 // version 2, LOCAL command
+	proxyV2Proxy = 0x21 // version 2, PROXY command
+	proxyV2TCP4  = 0x11
+	proxyV2TCP6  = 0x21
+)
+
+// ProxyTLV is a type-length-value field appended to the addresses of a PROXY
+// protocol v2 header, types 0xE0 to 0xEF are reserved for custom use.
+type ProxyTLV struct {
+	Type  byte
+	Value []byte
+}
+
+// ProxyHeader returns a PROXY protocol v2 header for a TCP connection from src
+// to dst, both IP and port, so the backend sees the user instead of the tunnel
+// client. Addresses that are not TCP give a LOCAL header without addresses.
+func ProxyHeader(src, dst net.Addr, tlvs ...ProxyTLV) []byte {
+	var tail []byte
+	for _, tlv := range tlvs {
+		tail = append(tail, tlv.Type)
+		tail = binary.BigEndian.AppendUint16(tail, uint16(len(tlv.Value)))
+		tail = append(tail, tlv.Value...)
+	}
+
+	srcAddr, srcOk := src.(*net.TCPAddr)
+	dstAddr, dstOk := dst.(*net.TCPAddr)
+	if !srcOk || !dstOk {
+		header := append(append([]byte{}, proxyV2Signature...), proxyV2Local, 0x00)
+		header = binary.BigEndian.AppendUint16(header, uint16(len(tail)))
+		return append(header, tail...)
+	}
+
+	family := byte(proxyV2TCP4)
+	srcIP, dstIP := srcAddr.IP.To4(), dstAddr.IP.To4()
+	if srcIP == nil || dstIP == nil {
+		// Both addresses of a header share the family, an IPv4 one is mapped
+		family = proxyV2TCP6
+		srcIP, dstIP = srcAddr.IP.To16(), dstAddr.IP.To16()
+	}
+
+	header := make([]byte, 0, len(proxyV2Signature)+4+2*len(srcIP)+4+len(tail))
+	header = append(header, proxyV2Signature...)
+	header = append(header, proxyV2Proxy, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(2*len(srcIP)+4+len(tail)))
+	header = append(header, srcIP...)
+	header = append(header, dstIP...)
+	header = binary.BigEndian.AppendUint16(header, uint16(srcAddr.Port))
+	header = binary.BigEndian.AppendUint16(header, uint16(dstAddr.Port))
+
+	return append(header, tail...)
+}
@@ -10,21 +10,27 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-func QConnectionHandler(from net.Conn, to quic.Stream, logger *logrus.Logger, usage *web.Usage, remotePort int, sniffer bool) {
+// QConnectionHandler copies data between a TCP connection and a QUIC stream
+// until one side closes. fromUser tells whether from is the user's connection,
+// as on the server, or the backend's, as on the client.
+func QConnectionHandler(from net.Conn, to quic.Stream, logger *logrus.Logger, usage *web.Usage, remotePort int, sniffer bool, fromUser bool) {
 	done := make(chan struct{})
 
+	OpenConnection()
+	defer CloseConnection()
+
 	go func() {
 		defer close(done)
-		q1transferData(from, to, from, to, logger, usage, remotePort, sniffer)
+		q1transferData(from, to, from, to, logger, usage, remotePort, sniffer, fromUser)
 	}()
 
-	q1transferData(to, from, from, to, logger, usage, remotePort, sniffer)
+	q1transferData(to, from, from, to, logger, usage, remotePort, sniffer, !fromUser)
 
 	<-done
 }
 
 // Using direct Read and Write for transferring data
-func q1transferData(from io.ReadWriter, to io.ReadWriter, tcp net.Conn, quic quic.Stream, logger *logrus.Logger, usage *web.Usage, remotePort int, sniffer bool) {
+func q1transferData(from io.ReadWriter, to io.ReadWriter, tcp net.Conn, quic quic.Stream, logger *logrus.Logger, usage *web.Usage, remotePort int, sniffer bool, upstream bool) {
 	buf := make([]byte, 16*1024) // 16K
 	for {
 		// Read data from the source connection
@@ -58,6 +64,7 @@ func q1transferData(from io.ReadWriter, to io.ReadWriter, tcp net.Conn, quic qui
 		}
 
 		logger.Tracef("read data: %d bytes, written data: %d bytes", r, totalWritten)
+		CountTraffic(upstream, totalWritten)
 		if sniffer {
 			usage.AddOrUpdatePort(remotePort, uint64(totalWritten))
 		}
@@ -0,0 +1,212 @@
+package utils
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Directions of a recorded chunk, upstream is the user to backend direction.
+const (
+	recordUpstream   byte = '>'
+	recordDownstream byte = '<'
+)
+
+// recordHeaderSize is the direction byte, the offset in milliseconds since the
+// connection started and the length of the chunk that follows.
+const recordHeaderSize = 1 + 4 + 4
+
+type recorder struct {
+	dir    string
+	ports  map[int]bool
+	logger *logrus.Logger
+}
+
+// activeRecorder is nil until InitRecording is called, so recording costs nothing when it is disabled
+var activeRecorder atomic.Pointer[recorder]
+
+// InitRecording writes the full byte stream of every connection on the given
+// ports to a file in dir until ctx is done. The files can be fed to a backend
+// again with ReplayRecording.
+func InitRecording(ctx context.Context, dir string, ports []int, logger *logrus.Logger) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		logger.Errorf("failed to create record directory %s: %v", dir, err)
+		return
+	}
+
+	r := &recorder{dir: dir, ports: make(map[int]bool), logger: logger}
+	for _, port := range ports {
+		r.ports[port] = true
+	}
+	activeRecorder.Store(r)
+
+	logger.Warnf("recording connections on ports %v to %s, this is meant for debugging only", ports, dir)
+
+	go func() {
+		<-ctx.Done()
+		activeRecorder.CompareAndSwap(r, nil)
+	}()
+}
+
+// connRecording is the record file of a single connection. A nil connRecording
+// is valid and does nothing.
+type connRecording struct {
+	mu      sync.Mutex
+	file    *os.File
+	writer  *bufio.Writer
+	started time.Time
+	logger  *logrus.Logger
+}
+
+// startRecording opens the record file of a connection, it returns nil when
+// recording is disabled or the port is not recorded.
+func startRecording(port int) *connRecording {
+	r := activeRecorder.Load()
+	if r == nil || !r.ports[port] {
+		return nil
+	}
+
+	path := filepath.Join(r.dir, fmt.Sprintf("%d-%d.rec", port, time.Now().UnixNano()))
+	file, err := os.Create(path)
+	if err != nil {
+		r.logger.Errorf("failed to create record file: %v", err)
+		return nil
+	}
+
+	r.logger.Debugf("recording connection on port %d to %s", port, path)
+
+	return &connRecording{
+		file:    file,
+		writer:  bufio.NewWriter(file),
+		started: time.Now(),
+		logger:  r.logger,
+	}
+}
+
+func (c *connRecording) write(direction byte, data []byte) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// The recording is dropped after the first failed write
+	if c.file == nil {
+		return
+	}
+
+	header := make([]byte, recordHeaderSize)
+	header[0] = direction
+	binary.BigEndian.PutUint32(header[1:5], uint32(time.Since(c.started).Milliseconds()))
+	binary.BigEndian.PutUint32(header[5:], uint32(len(data)))
+
+	_, err := c.writer.Write(header)
+	if err == nil {
+		_, err = c.writer.Write(data)
+	}
+	if err != nil {
+		c.logger.Errorf("failed to write record file %s: %v", c.file.Name(), err)
+		c.file.Close()
+		c.file = nil
+	}
+}
+
+func (c *connRecording) close() {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.file == nil {
+		return
+	}
+
+	if err := c.writer.Flush(); err != nil {
+		c.logger.Errorf("failed to write record file %s: %v", c.file.Name(), err)
+	}
+	c.file.Close()
+	c.file = nil
+}
+
+// ReplayRecording sends the upstream chunks of a record file to target with
+// their original timing and logs how much the backend answered compared to
+// the recorded connection.
+func ReplayRecording(path string, target string, logger *logrus.Logger) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	conn, err := net.DialTimeout("tcp", target, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	received := make(chan int64, 1)
+	go func() {
+		n, _ := io.Copy(io.Discard, conn)
+		received <- n
+	}()
+
+	reader := bufio.NewReader(file)
+	header := make([]byte, recordHeaderSize)
+	started := time.Now()
+	var sent, recorded int64
+
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return fmt.Errorf("failed to read record header: %w", err)
+		}
+
+		data := make([]byte, binary.BigEndian.Uint32(header[5:]))
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return fmt.Errorf("failed to read recorded chunk: %w", err)
+		}
+
+		if header[0] == recordDownstream {
+			recorded += int64(len(data))
+			continue
+		}
+
+		offset := time.Duration(binary.BigEndian.Uint32(header[1:5])) * time.Millisecond
+		time.Sleep(time.Until(started.Add(offset)))
+
+		if _, err := conn.Write(data); err != nil {
+			return fmt.Errorf("failed to write to %s: %w", target, err)
+		}
+		sent += int64(len(data))
+		logger.Tracef("replayed %d bytes at %v", len(data), offset)
+	}
+
+	// Half close so the backend sees the end of the request, then wait for its answer
+	if tcpConn, ok := TCPConn(conn); ok {
+		tcpConn.CloseWrite()
+	}
+
+	select {
+	case n := <-received:
+		logger.Infof("replayed %d bytes to %s, received %d bytes (recorded: %d bytes)", sent, target, n, recorded)
+	case <-time.After(30 * time.Second):
+		logger.Warnf("replayed %d bytes to %s, backend did not close the connection within 30s (recorded response: %d bytes)", sent, target, recorded)
+	}
+
+	return nil
+}
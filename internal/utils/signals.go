@@ -8,4 +8,9 @@ const (
 	SG_TCP                // TCP Transport ID
 	SG_UDP                // TCP Transport ID
 	SG_RTT                // For RTT measurment
+	SG_Ports              // for channel, with client port mappings
+	SG_Swap               // for switching over to the standby control channel
+	SG_MuxV1              // for channel, from a peer with mux version 1
+	SG_MuxV2              // for channel, from a peer with mux version 2
+	SG_Busy               // tunnel channel of the server is full, hold back new tunnel connections
 )
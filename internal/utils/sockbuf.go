@@ -0,0 +1,89 @@
+package utils
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+)
+
+type socketBuffers struct {
+	read   int // bytes, 0 keeps the system default
+	write  int
+	logger *logrus.Logger
+}
+
+// activeSocketBuffers is nil until InitSocketBuffers is called, so sockets keep the system default
+var activeSocketBuffers atomic.Pointer[socketBuffers]
+
+// InitSocketBuffers sets SO_RCVBUF to read and SO_SNDBUF to write bytes on
+// dialed and accepted tunnel and local connections until ctx is done, for
+// links whose bandwidth-delay product outgrows the default buffers. A size of 0
+// keeps the system default. The kernel caps the sizes at net.core.rmem_max and
+// net.core.wmem_max.
+func InitSocketBuffers(ctx context.Context, read int, write int, logger *logrus.Logger) {
+	sb := &socketBuffers{read: read, write: write, logger: logger}
+	activeSocketBuffers.Store(sb)
+
+	logger.Infof("using socket buffers of %d bytes for receiving and %d bytes for sending, 0 is the system default", read, write)
+
+	go func() {
+		<-ctx.Done()
+		activeSocketBuffers.CompareAndSwap(sb, nil)
+	}()
+}
+
+// SocketBuffers is a socket control function setting SO_RCVBUF and SO_SNDBUF
+// on dialed sockets before they connect, so the receive window is scaled for
+// them. It does nothing unless InitSocketBuffers was called.
+func SocketBuffers(network, address string, s syscall.RawConn) error {
+	sb := activeSocketBuffers.Load()
+	if sb == nil {
+		return nil
+	}
+
+	err := s.Control(func(fd uintptr) {
+		if sb.read > 0 {
+			if err := syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF, sb.read); err != nil {
+				sb.logger.Warnf("failed to set SO_RCVBUF to %d on %s: %v", sb.read, address, err)
+			}
+		}
+		if sb.write > 0 {
+			if err := syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF, sb.write); err != nil {
+				sb.logger.Warnf("failed to set SO_SNDBUF to %d on %s: %v", sb.write, address, err)
+			}
+		}
+	})
+	if err != nil {
+		sb.logger.Warnf("failed to access socket of %s for its buffers: %v", address, err)
+	}
+
+	return nil
+}
+
+// SetSocketBuffers sets SO_RCVBUF and SO_SNDBUF on an accepted connection, a
+// TLS or encrypted connection is unwrapped to its TCP connection.
+func SetSocketBuffers(conn net.Conn) {
+	sb := activeSocketBuffers.Load()
+	if sb == nil {
+		return
+	}
+
+	tcpConn, ok := TCPConn(conn)
+	if !ok {
+		return
+	}
+
+	if sb.read > 0 {
+		if err := tcpConn.SetReadBuffer(sb.read); err != nil {
+			sb.logger.Warnf("failed to set SO_RCVBUF to %d on %s: %v", sb.read, conn.RemoteAddr().String(), err)
+		}
+	}
+	if sb.write > 0 {
+		if err := tcpConn.SetWriteBuffer(sb.write); err != nil {
+			sb.logger.Warnf("failed to set SO_SNDBUF to %d on %s: %v", sb.write, conn.RemoteAddr().String(), err)
+		}
+	}
+}
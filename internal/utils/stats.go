@@ -0,0 +1,101 @@
+package utils
+
+import (
+	"encoding/json"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Process wide counters summarized when backhaul shuts down. They span reloads,
+// connections are counted when opened and bytes as they are forwarded, so the
+// connections still open at shutdown are part of the summary. Upstream is the
+// user to backend direction.
+var runStats struct {
+	started     atomic.Int64 // unix nano
+	connections atomic.Int64
+	open        atomic.Int64
+	upstream    atomic.Int64
+	downstream  atomic.Int64
+	restarts    atomic.Int64
+	poolSize    atomic.Int64 // target size of the client connection pool
+}
+
+// RunSummary is the final summary logged and optionally saved on shutdown.
+type RunSummary struct {
+	Uptime          string `json:"uptime"`
+	Connections     int64  `json:"connections"`
+	OpenConnections int64  `json:"openConnections"`
+	UpstreamBytes   int64  `json:"upstreamBytes"`
+	DownstreamBytes int64  `json:"downstreamBytes"`
+	Restarts        int64  `json:"restarts"`
+}
+
+func init() {
+	runStats.started.Store(time.Now().UnixNano())
+}
+
+// CountRestart records a restart of the tunnel transport.
+func CountRestart() {
+	runStats.restarts.Add(1)
+	StatsdCount("restarts", 1)
+}
+
+// GaugePoolSize records the target size of the client connection pool.
+func GaugePoolSize(size int) {
+	runStats.poolSize.Store(int64(size))
+	StatsdGauge("pool.size", int64(size))
+}
+
+// OpenConnection counts a forwarded connection, CloseConnection has to follow
+// once it is closed.
+func OpenConnection() {
+	runStats.connections.Add(1)
+	runStats.open.Add(1)
+}
+
+// CloseConnection records that a connection counted by OpenConnection closed.
+func CloseConnection() {
+	runStats.open.Add(-1)
+}
+
+// CountTraffic adds n bytes forwarded upstream or downstream.
+func CountTraffic(upstream bool, n int) {
+	if upstream {
+		runStats.upstream.Add(int64(n))
+	} else {
+		runStats.downstream.Add(int64(n))
+	}
+}
+
+// LogStats logs the summary since the process started and writes it as JSON to path
+// when path is not empty.
+func LogStats(logger *logrus.Logger, path string) {
+	summary := RunSummary{
+		Uptime:          time.Since(time.Unix(0, runStats.started.Load())).Round(time.Second).String(),
+		Connections:     runStats.connections.Load(),
+		OpenConnections: runStats.open.Load(),
+		UpstreamBytes:   runStats.upstream.Load(),
+		DownstreamBytes: runStats.downstream.Load(),
+		Restarts:        runStats.restarts.Load(),
+	}
+
+	logger.Infof("uptime: %s, connections: %d (%d still open), upstream: %d bytes, downstream: %d bytes, restarts: %d",
+		summary.Uptime, summary.Connections, summary.OpenConnections, summary.UpstreamBytes, summary.DownstreamBytes, summary.Restarts)
+
+	if path == "" {
+		return
+	}
+
+	data, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		logger.Errorf("error marshalling final stats: %v", err)
+		return
+	}
+
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		logger.Errorf("error writing final stats to %s: %v", path, err)
+	}
+}
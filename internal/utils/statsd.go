@@ -0,0 +1,150 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/musix/backhaul/internal/web"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	statsdFlushInterval = time.Second
+	statsdMaxPacket     = 1432 // stays below the usual MTU, like the Datadog agent expects
+)
+
+type statsdClient struct {
+	mu     sync.Mutex
+	conn   net.Conn
+	prefix string
+	tags   string // common tags, already joined
+	buf    bytes.Buffer
+	logger *logrus.Logger
+}
+
+// activeStatsd is nil until InitStatsd succeeds, so metrics cost nothing when they are disabled
+var activeStatsd atomic.Pointer[statsdClient]
+
+// InitStatsd pushes connection, byte, pool, restart and heartbeat metrics as
+// StatsD packets to addr until ctx is done. Every metric name starts with
+// prefix and carries tags in the DogStatsD format, e.g. "env:prod".
+func InitStatsd(ctx context.Context, addr string, prefix string, tags []string, logger *logrus.Logger) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		logger.Errorf("failed to set up StatsD client for %s: %v", addr, err)
+		return
+	}
+
+	s := &statsdClient{conn: conn, prefix: prefix, tags: strings.Join(tags, ","), logger: logger}
+	activeStatsd.Store(s)
+
+	logger.Infof("sending StatsD metrics to %s with prefix %q", addr, prefix)
+
+	go func() {
+		ticker := time.NewTicker(statsdFlushInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				activeStatsd.CompareAndSwap(s, nil)
+
+				s.mu.Lock()
+				s.flush()
+				s.mu.Unlock()
+				conn.Close()
+				return
+			case <-ticker.C:
+				sampleConcurrency()
+
+				s.mu.Lock()
+				s.flush()
+				s.mu.Unlock()
+			}
+		}
+	}()
+}
+
+// StatsdCount adds value to the counter name.
+func StatsdCount(name string, value int64, tags ...string) {
+	if s := activeStatsd.Load(); s != nil {
+		s.add(name, value, "c", tags)
+	}
+}
+
+// StatsdGauge sets the gauge name to value.
+func StatsdGauge(name string, value int64, tags ...string) {
+	if s := activeStatsd.Load(); s != nil {
+		s.add(name, value, "g", tags)
+	}
+}
+
+// StatsdHistogram adds value to the distribution of the histogram name.
+func StatsdHistogram(name string, value int64, tags ...string) {
+	if s := activeStatsd.Load(); s != nil {
+		s.add(name, value, "h", tags)
+	}
+}
+
+// sampleConcurrency sends the forwarded connections in flight per port as a
+// histogram sample, so the collector shows their distribution over time and
+// not only the count at the moment.
+func sampleConcurrency() {
+	for port, active := range web.ActiveConnections() {
+		StatsdHistogram("connections.concurrent", active, portTags(port, web.PortLabel(port))...)
+	}
+}
+
+// StatsdTiming records d in milliseconds under the timer name, which the
+// collector aggregates into a histogram.
+func StatsdTiming(name string, d time.Duration, tags ...string) {
+	if s := activeStatsd.Load(); s != nil {
+		s.add(name, d.Milliseconds(), "ms", tags)
+	}
+}
+
+func (s *statsdClient) add(name string, value int64, kind string, tags []string) {
+	line := fmt.Sprintf("%s%s:%d|%s", s.prefix, name, value, kind)
+
+	allTags := s.tags
+	if len(tags) > 0 {
+		if allTags != "" {
+			allTags += ","
+		}
+		allTags += strings.Join(tags, ",")
+	}
+	if allTags != "" {
+		line += "|#" + allTags
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Several metrics share a packet, one per line
+	if s.buf.Len() > 0 && s.buf.Len()+1+len(line) > statsdMaxPacket {
+		s.flush()
+	}
+	if s.buf.Len() > 0 {
+		s.buf.WriteByte('\n')
+	}
+	s.buf.WriteString(line)
+}
+
+// flush sends the buffered metrics. Caller must hold s.mu.
+func (s *statsdClient) flush() {
+	if s.buf.Len() == 0 {
+		return
+	}
+
+	// UDP is fire and forget, a missing collector only shows up as a write error here
+	if _, err := s.conn.Write(s.buf.Bytes()); err != nil {
+		s.logger.Debugf("failed to send StatsD metrics: %v", err)
+	}
+	s.buf.Reset()
+}
@@ -4,58 +4,207 @@ import (
 	"errors"
 	"io"
 	"net"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/musix/backhaul/internal/web"
 	"github.com/sirupsen/logrus"
 )
 
-func TCPConnectionHandler(from net.Conn, to net.Conn, logger *logrus.Logger, usage *web.Usage, remotePort int, sniffer bool) {
+// OpDeadlines bounds a single read or write of the copy loop, a zero value
+// disables the bound. A read has to return data within the read deadline, so it
+// has to be longer than the peer ever stays silent.
+// Idle closes the connection once no data moved in either direction for that
+// long, unlike the read deadline it keeps one-way transfers open. Lifetime
+// closes it that long after it was opened, however busy it is.
+type OpDeadlines struct {
+	Read     time.Duration
+	Write    time.Duration
+	Idle     time.Duration
+	Lifetime time.Duration
+}
+
+// TCPConnectionHandler copies data in both directions until one side closes.
+// from is the side facing the user and to is the side facing the backend,
+// target is the backend address the connection is forwarded to.
+func TCPConnectionHandler(from net.Conn, to net.Conn, logger *logrus.Logger, usage *web.Usage, remotePort int, target string, sniffer bool, trace *ConnTrace, deadlines OpDeadlines) {
+	started := time.Now()
 	done := make(chan struct{})
+	var upstream, upstreamRead int64
+	var upstreamReason string
+
+	rec := startRecording(remotePort)
+	access := startAccessLog(remotePort, from.RemoteAddr().String())
+
+	if sniffer {
+		usage.AddPortConnection(remotePort)
+	}
+	usage.OpenPortConnection(remotePort)
+	defer usage.ClosePortConnection(remotePort)
+	OpenConnection()
+	defer CloseConnection()
+
+	label := web.PortLabel(remotePort)
+	tags := portTags(remotePort, label)
+
+	web.PublishEvent("connection_open", ConnRecord{Time: started, Source: from.RemoteAddr().String(), Port: remotePort, Label: label, Target: target})
+	StatsdCount("connections", 1, tags...)
+
+	idle := watchIdle(from, to, deadlines.Idle)
+
+	var expired atomic.Bool
+	if deadlines.Lifetime > 0 {
+		lifetime := time.AfterFunc(deadlines.Lifetime, func() {
+			expired.Store(true)
+			from.Close()
+			to.Close()
+		})
+		defer lifetime.Stop()
+	}
 
 	go func() {
 		defer close(done)
-		transferData(from, to, logger, usage, remotePort, sniffer)
+		upstream, upstreamRead, upstreamReason = transferData(from, to, logger, usage, remotePort, sniffer, deadlines, idle, rec, access, recordUpstream)
 	}()
 
-	transferData(to, from, logger, usage, remotePort, sniffer)
+	downstream, downstreamRead, reason := transferData(to, from, logger, usage, remotePort, sniffer, deadlines, idle, rec, access, recordDownstream)
 
 	<-done
+
+	// The direction that ended first closed both, the other one reports no reason
+	if reason == "" {
+		reason = upstreamReason
+	}
+	if idle.stop() {
+		logger.Debugf("no data for %v on the connection to %s, closed it", deadlines.Idle, target)
+		reason = "idle timeout"
+	}
+	if expired.Load() {
+		logger.Debugf("the connection to %s reached its %v lifetime, closed it", target, deadlines.Lifetime)
+		reason = "max lifetime"
+	}
+
+	rec.close()
+	access.close()
+	record := ConnRecord{
+		Time:            started,
+		Source:          from.RemoteAddr().String(),
+		Port:            remotePort,
+		Label:           label,
+		Target:          target,
+		UpstreamBytes:   upstream,
+		DownstreamBytes: downstream,
+		DurationMs:      time.Since(started).Milliseconds(),
+		Reason:          reason,
+	}
+	logger.Debugf("connection closed: port=%d source=%s target=%s reason=%q upstream=%d downstream=%d duration=%v",
+		remotePort, record.Source, target, reason, upstream, downstream, time.Since(started).Round(time.Millisecond))
+	logConnection(record)
+	checkFlow(record, upstreamRead, downstreamRead, logger)
+	web.PublishEvent("connection_close", record)
+	StatsdCount("bytes.upstream", upstream, tags...)
+	StatsdCount("bytes.downstream", downstream, tags...)
+	trace.end(upstream, downstream)
 }
 
-// Using direct Read and Write for transferring data
-func transferData(from net.Conn, to net.Conn, logger *logrus.Logger, usage *web.Usage, remotePort int, sniffer bool) {
+// portTags are the metric tags of a connection on port, with the label of its mapping if it has one
+func portTags(port int, label string) []string {
+	tags := []string{"port:" + strconv.Itoa(port)}
+	if label != "" {
+		tags = append(tags, "label:"+label)
+	}
+	return tags
+}
+
+// Using direct Read and Write for transferring data, returns the number of bytes
+// written and read and why the copy ended. The reason is empty when the
+// connection was closed by the other direction.
+func transferData(from net.Conn, to net.Conn, logger *logrus.Logger, usage *web.Usage, remotePort int, sniffer bool, deadlines OpDeadlines, idle *idleWatch, rec *connRecording, access *connAccess, direction byte) (int64, int64, string) {
 	buf := make([]byte, 16*1024) // 16K
+	var total, read int64
+
+	// The side facing the user tells the connections of a port apart on the capture stream
+	user := from
+	if direction == recordDownstream {
+		user = to
+	}
+
 	for {
 		// Read data from the source connection
-		r, err := from.Read(buf)
+		r, err := readOp(from, buf, deadlines.Read)
 		if err != nil {
-			if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+			// Bytes returned with the error still go out before the close
+			if r > 0 {
+				if w, err := to.Write(buf[:r]); err == nil {
+					total += int64(w)
+					read += int64(r)
+				}
+			}
+
+			var reason string
+			if errors.Is(err, io.EOF) {
+				logger.Trace("reader stream closed or EOF received")
+				reason = "closed by " + from.RemoteAddr().String()
+			} else if errors.Is(err, net.ErrClosed) || errors.Is(err, io.ErrClosedPipe) {
 				logger.Trace("reader stream closed or EOF received")
+			} else if errors.Is(err, syscall.ECONNRESET) {
+				logger.Debugf("connection reset by %s, passing the reset on to %s", from.RemoteAddr().String(), to.RemoteAddr().String())
+				abortOnClose(to)
+				reason = "reset by " + from.RemoteAddr().String()
+			} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				logger.Debugf("read exceeded the %v deadline, closing the connection", deadlines.Read)
+				reason = "read timeout"
 			} else {
 				logger.Trace("unable to read from the connection: ", err)
+				reason = "read error: " + err.Error()
 			}
 			from.Close()
 			to.Close()
-			return
+			return total, read, reason
 		}
 
+		read += int64(r)
+		idle.touch()
+		waitBandwidth(direction, r)
+
 		totalWritten := 0
 		for totalWritten < r {
+			if deadlines.Write > 0 {
+				to.SetWriteDeadline(time.Now().Add(deadlines.Write))
+			}
+
 			// Write data to the destination connection
 			w, err := to.Write(buf[totalWritten:r])
 			if err != nil {
-				if errors.Is(err, net.ErrClosed) {
+				var reason string
+				if errors.Is(err, net.ErrClosed) || errors.Is(err, io.ErrClosedPipe) {
 					logger.Trace("writer stream closed or EOF received")
+				} else if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) {
+					logger.Debugf("connection reset by %s, passing the reset on to %s", to.RemoteAddr().String(), from.RemoteAddr().String())
+					abortOnClose(from)
+					reason = "reset by " + to.RemoteAddr().String()
+				} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					logger.Debugf("write exceeded the %v deadline, closing the connection", deadlines.Write)
+					reason = "write timeout"
 				} else {
 					logger.Trace("unable to write to the connection: ", err)
+					reason = "write error: " + err.Error()
 				}
 				from.Close()
 				to.Close()
-				return
+				return total + int64(totalWritten), read, reason
 
 			}
 			totalWritten += w
 		}
+		total += int64(totalWritten)
+		rec.write(direction, buf[:r])
+		access.write(direction, buf[:r])
+		web.Capture(remotePort, user.RemoteAddr(), direction == recordUpstream, buf[:r])
+		web.CountThroughput(direction == recordUpstream, totalWritten)
+		CountTraffic(direction == recordUpstream, totalWritten)
 
 		logger.Tracef("read data: %d bytes, written data: %d bytes", r, totalWritten)
 		if sniffer {
@@ -64,3 +213,98 @@ func transferData(from net.Conn, to net.Conn, logger *logrus.Logger, usage *web.
 	}
 
 }
+
+// readOp reads into buf, with a deadline the read has to return within it.
+// Whatever arrived is returned right away, a read never waits for more.
+func readOp(conn net.Conn, buf []byte, deadline time.Duration) (int, error) {
+	if deadline > 0 {
+		conn.SetReadDeadline(time.Now().Add(deadline))
+	}
+	return conn.Read(buf)
+}
+
+// idleWatch closes both sides of a connection once no data moved in either
+// direction for grace. A nil idleWatch never closes anything.
+type idleWatch struct {
+	last     atomic.Int64 // unix nanoseconds of the last read
+	timedOut atomic.Bool
+	done     chan struct{}
+}
+
+// watchIdle returns nil when grace is 0, which disables the watch.
+func watchIdle(from net.Conn, to net.Conn, grace time.Duration) *idleWatch {
+	if grace <= 0 {
+		return nil
+	}
+
+	w := &idleWatch{done: make(chan struct{})}
+	w.touch()
+
+	go func() {
+		timer := time.NewTimer(grace)
+		defer timer.Stop()
+
+		for {
+			select {
+			case <-w.done:
+				return
+			case <-timer.C:
+				since := time.Since(time.Unix(0, w.last.Load()))
+				if since < grace {
+					timer.Reset(grace - since)
+					continue
+				}
+
+				w.timedOut.Store(true)
+				from.Close()
+				to.Close()
+				return
+			}
+		}
+	}()
+
+	return w
+}
+
+func (w *idleWatch) touch() {
+	if w != nil {
+		w.last.Store(time.Now().UnixNano())
+	}
+}
+
+// stop ends the watch, it reports whether the watch closed the connection.
+func (w *idleWatch) stop() bool {
+	if w == nil {
+		return false
+	}
+	close(w.done)
+	return w.timedOut.Load()
+}
+
+// abortOnClose makes the next Close of a TCP connection send a RST instead of
+// a FIN, so a reset on one side of the tunnel reaches the peer on the other side
+// as a reset rather than a clean end of stream. Mux streams have no reset and
+// are closed as usual.
+func abortOnClose(conn net.Conn) {
+	// Wrappers of the TCP connection pass the reset on as well
+	if tcpConn, ok := conn.(interface{ SetLinger(int) error }); ok {
+		tcpConn.SetLinger(0)
+	} else if tcpConn, ok := TCPConn(conn); ok {
+		tcpConn.SetLinger(0)
+	}
+}
+
+// TCPConn returns the TCP connection of conn, unwrapping TLS and encrypted
+// connections, which expose it with NetConn.
+func TCPConn(conn net.Conn) (*net.TCPConn, bool) {
+	for {
+		switch c := conn.(type) {
+		case *net.TCPConn:
+			return c, true
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return nil, false
+		}
+	}
+}
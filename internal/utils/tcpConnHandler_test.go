@@ -0,0 +1,38 @@
+package utils
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReadOpReturnsWhatArrived(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	// A single byte and then silence, e.g. a keystroke waiting on its echo
+	go client.Write([]byte{'y'})
+
+	buf := make([]byte, 16)
+	started := time.Now()
+	n, err := readOp(server, buf, time.Second)
+	if err != nil || n != 1 {
+		t.Fatalf("readOp returned %d bytes with %v, want the single byte", n, err)
+	}
+	if waited := time.Since(started); waited > 500*time.Millisecond {
+		t.Errorf("readOp held the byte for %v", waited)
+	}
+}
+
+func TestReadOpDeadline(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	buf := make([]byte, 16)
+	_, err := readOp(server, buf, 50*time.Millisecond)
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Errorf("read of a silent peer returned %v, want a timeout", err)
+	}
+}
@@ -0,0 +1,107 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// crypto/tls has no TLS-PSK cipher suites, so this is not TLS-PSK: the mode
+// derives an Ed25519 key pair from the token and a random salt. The server
+// presents a self-signed certificate built on that key, carrying the salt, and
+// the client accepts only a certificate whose public key it derives from the
+// same token and salt, which gives an encrypted and authenticated tunnel
+// without any PKI. The public key lets anyone who connects check guesses of the
+// token offline, argon2id makes each guess slow, a long random token makes them
+// hopeless.
+
+const (
+	pskLabel    = "backhaul tls-psk v2"
+	pskSaltSize = 16
+	pskTime     = 3         // argon2id passes
+	pskMemory   = 64 * 1024 // argon2id memory in KiB
+	pskThreads  = 4
+)
+
+// pskKey derives the Ed25519 private key shared by both ends from the token and salt.
+func pskKey(token string, salt []byte) ed25519.PrivateKey {
+	seed := argon2.IDKey([]byte(token), append([]byte(pskLabel), salt...), pskTime, pskMemory, pskThreads, ed25519.SeedSize)
+	return ed25519.NewKeyFromSeed(seed)
+}
+
+// PSKCertificate generates an in-memory self-signed certificate from the token
+// and a new random salt.
+func PSKCertificate(token string) (tls.Certificate, error) {
+	salt := make([]byte, pskSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to generate PSK salt: %w", err)
+	}
+	key := pskKey(token, salt)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "backhaul", SerialNumber: hex.EncodeToString(salt)},
+		NotBefore:             time.Now().Add(-1 * time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(nil, template, template, key.Public(), key)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to create PSK certificate: %w", err)
+	}
+
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}, nil
+}
+
+// VerifyPSKCertificate returns a VerifyConnection callback that accepts only a
+// server certificate built from the same token. The key of the last salt seen
+// is kept, the server keeps its salt until it restarts.
+func VerifyPSKCertificate(token string) func(tls.ConnectionState) error {
+	var mu sync.Mutex
+	var lastSalt string
+	var expected ed25519.PublicKey
+
+	return func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return errors.New("tls-psk: server presented no certificate")
+		}
+
+		cert := cs.PeerCertificates[0]
+		salt, err := hex.DecodeString(cert.Subject.SerialNumber)
+		if err != nil || len(salt) != pskSaltSize {
+			return errors.New("tls-psk: server certificate carries no salt, the server may run an older version")
+		}
+
+		mu.Lock()
+		if cert.Subject.SerialNumber != lastSalt {
+			expected = pskKey(token, salt).Public().(ed25519.PublicKey)
+			lastSalt = cert.Subject.SerialNumber
+		}
+		want := expected
+		mu.Unlock()
+
+		pub, ok := cert.PublicKey.(ed25519.PublicKey)
+		if !ok || !bytes.Equal(pub, want) {
+			return errors.New("tls-psk: server certificate does not match the token")
+		}
+
+		return nil
+	}
+}
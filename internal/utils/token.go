@@ -0,0 +1,16 @@
+package utils
+
+import (
+	"crypto/subtle"
+)
+
+// ValidToken reports whether the received token matches the expected one. The
+// comparison runs in constant time and tokens longer than maxLen are rejected
+// up front, a maxLen of 0 disables the length check.
+func ValidToken(received string, expected string, maxLen int) bool {
+	if maxLen > 0 && len(received) > maxLen {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(received), []byte(expected)) == 1
+}
@@ -0,0 +1,29 @@
+package utils
+
+import "testing"
+
+func TestValidToken(t *testing.T) {
+	tests := []struct {
+		name     string
+		received string
+		expected string
+		maxLen   int
+		want     bool
+	}{
+		{"match", "secret", "secret", 0, true},
+		{"mismatch", "secret", "Secret", 0, false},
+		{"prefix", "secre", "secret", 0, false},
+		{"longer", "secrets", "secret", 0, false},
+		{"empty received", "", "secret", 0, false},
+		{"both empty", "", "", 0, true},
+		{"within max length", "secret", "secret", 6, true},
+		{"over max length", "secret", "secret", 5, false},
+		{"over max length mismatch", "a-very-long-token", "secret", 8, false},
+	}
+
+	for _, tt := range tests {
+		if got := ValidToken(tt.received, tt.expected, tt.maxLen); got != tt.want {
+			t.Errorf("%s: ValidToken(%q, %q, %d) = %v, want %v", tt.name, tt.received, tt.expected, tt.maxLen, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+//go:build !otel
+
+package utils
+
+import (
+	"context"
+
+	"github.com/sirupsen/logrus"
+)
+
+// InitTracing needs the OTLP exporter, which is left out of builds without the
+// otel build tag together with its gRPC and protobuf dependencies.
+func InitTracing(ctx context.Context, endpoint string, serviceName string, logger *logrus.Logger) {
+	logger.Errorf("otlp_endpoint is set but this build has no OpenTelemetry support, build with -tags otel to export connection traces to %s", endpoint)
+}
+
+// ConnTrace is the span of a single forwarded connection. Without the otel
+// build tag it is always nil and does nothing.
+type ConnTrace struct{}
+
+// StartConnTrace returns nil, tracing is not built in.
+func StartConnTrace(ctx context.Context, port int, target string) *ConnTrace {
+	return nil
+}
+
+// Event marks a lifecycle step of the connection, e.g. stream open or backend dial.
+func (t *ConnTrace) Event(name string) {}
+
+// Fail ends the span of a connection that was dropped before being forwarded.
+func (t *ConnTrace) Fail(err error) {}
+
+func (t *ConnTrace) end(upstream int64, downstream int64) {}
@@ -0,0 +1,103 @@
+//go:build otel
+
+package utils
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer is nil until InitTracing succeeds, so tracing costs nothing when it is disabled
+var tracer atomic.Pointer[trace.Tracer]
+
+// InitTracing exports connection spans over OTLP/HTTP to the given collector URL
+// (e.g. http://127.0.0.1:4318) until ctx is done. The exporter and its
+// dependencies are only built in with the otel build tag.
+func InitTracing(ctx context.Context, endpoint string, serviceName string, logger *logrus.Logger) {
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		logger.Errorf("failed to create OTLP trace exporter: %v", err)
+		return
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", serviceName))),
+	)
+
+	t := provider.Tracer("github.com/musix/backhaul")
+	tracer.Store(&t)
+
+	logger.Infof("OpenTelemetry tracing enabled, exporting spans to %s", endpoint)
+
+	go func() {
+		<-ctx.Done()
+		tracer.CompareAndSwap(&t, nil)
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if err := provider.Shutdown(shutdownCtx); err != nil {
+			logger.Debugf("failed to flush OTLP spans: %v", err)
+		}
+	}()
+}
+
+// ConnTrace is the span of a single forwarded connection. A nil ConnTrace is
+// valid and does nothing.
+type ConnTrace struct {
+	span trace.Span
+}
+
+// StartConnTrace opens a connection span, it returns nil when tracing is disabled.
+func StartConnTrace(ctx context.Context, port int, target string) *ConnTrace {
+	t := tracer.Load()
+	if t == nil {
+		return nil
+	}
+
+	_, span := (*t).Start(ctx, "backhaul.connection", trace.WithAttributes(
+		attribute.Int("backhaul.port", port),
+		attribute.String("backhaul.target", target),
+	))
+
+	return &ConnTrace{span: span}
+}
+
+// Event marks a lifecycle step of the connection, e.g. stream open or backend dial.
+func (t *ConnTrace) Event(name string) {
+	if t == nil {
+		return
+	}
+	t.span.AddEvent(name)
+}
+
+// Fail ends the span of a connection that was dropped before being forwarded.
+func (t *ConnTrace) Fail(err error) {
+	if t == nil {
+		return
+	}
+	t.span.RecordError(err)
+	t.span.SetStatus(codes.Error, err.Error())
+	t.span.End()
+}
+
+func (t *ConnTrace) end(upstream int64, downstream int64) {
+	if t == nil {
+		return
+	}
+	t.span.SetAttributes(
+		attribute.Int64("backhaul.bytes.upstream", upstream),
+		attribute.Int64("backhaul.bytes.downstream", downstream),
+	)
+	t.span.End()
+}
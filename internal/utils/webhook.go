@@ -0,0 +1,107 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/musix/backhaul/internal/web"
+	"github.com/sirupsen/logrus"
+)
+
+// webhookTimeout bounds a single POST, a slow receiver never holds up the next snapshot for long
+const webhookTimeout = 10 * time.Second
+
+// StatsSnapshot is the JSON body posted to the stats webhook.
+type StatsSnapshot struct {
+	Time            time.Time       `json:"time"`
+	Transport       string          `json:"transport"`
+	Status          string          `json:"status"`
+	Uptime          string          `json:"uptime"`
+	Connections     int64           `json:"connections"`
+	UpstreamBytes   int64           `json:"upstreamBytes"`
+	DownstreamBytes int64           `json:"downstreamBytes"`
+	Restarts        int64           `json:"restarts"`
+	PoolSize        int64           `json:"poolSize,omitempty"` // client only
+	Ports           []web.PortUsage `json:"ports,omitempty"`    // with the sniffer enabled
+}
+
+// InitWebhook posts a StatsSnapshot as JSON to url every interval until ctx is
+// done. header is an optional "Name: value" header sent with every request,
+// e.g. for authentication.
+func InitWebhook(ctx context.Context, url string, interval time.Duration, header string, transport string, logger *logrus.Logger) {
+	var headerName, headerValue string
+	if header != "" {
+		name, value, ok := strings.Cut(header, ":")
+		if !ok || strings.TrimSpace(name) == "" {
+			logger.Errorf("invalid stats webhook header %q, expected \"Name: value\"", header)
+			return
+		}
+		headerName, headerValue = strings.TrimSpace(name), strings.TrimSpace(value)
+	}
+
+	client := &http.Client{Timeout: min(interval, webhookTimeout)}
+
+	logger.Infof("posting stats snapshots to %s every %v", url, interval)
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := postSnapshot(ctx, client, url, headerName, headerValue, transport); err != nil {
+					logger.Warnf("failed to post stats snapshot to %s: %v", url, err)
+				}
+			}
+		}
+	}()
+}
+
+func postSnapshot(ctx context.Context, client *http.Client, url string, headerName string, headerValue string, transport string) error {
+	status, ports := web.Snapshot()
+	snapshot := StatsSnapshot{
+		Time:            time.Now(),
+		Transport:       transport,
+		Status:          status,
+		Uptime:          time.Since(time.Unix(0, runStats.started.Load())).Round(time.Second).String(),
+		Connections:     runStats.connections.Load(),
+		UpstreamBytes:   runStats.upstream.Load(),
+		DownstreamBytes: runStats.downstream.Load(),
+		Restarts:        runStats.restarts.Load(),
+		PoolSize:        runStats.poolSize.Load(),
+		Ports:           ports,
+	}
+
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if headerName != "" {
+		req.Header.Set(headerName, headerValue)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
@@ -10,22 +10,27 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-// WebSocketToTCPConnectionHandler handles data transfer between a WebSocket and a TCP connection
-func WSConnectionHandler(wsConn *websocket.Conn, tcpConn net.Conn, logger *logrus.Logger, usage *web.Usage, remotePort int, sniffer bool) {
+// WebSocketToTCPConnectionHandler handles data transfer between a WebSocket and a TCP connection.
+// tcpUser tells whether tcpConn is the user's connection, as on the server, or
+// the backend's, as on the client.
+func WSConnectionHandler(wsConn *websocket.Conn, tcpConn net.Conn, logger *logrus.Logger, usage *web.Usage, remotePort int, sniffer bool, tcpUser bool) {
 	done := make(chan struct{})
 
+	OpenConnection()
+	defer CloseConnection()
+
 	go func() {
 		defer close(done)
-		transferWebSocketToTCP(wsConn, tcpConn, logger, usage, remotePort, sniffer)
+		transferWebSocketToTCP(wsConn, tcpConn, logger, usage, remotePort, sniffer, !tcpUser)
 	}()
 
-	transferTCPToWebSocket(tcpConn, wsConn, logger, usage, remotePort, sniffer)
+	transferTCPToWebSocket(tcpConn, wsConn, logger, usage, remotePort, sniffer, tcpUser)
 
 	<-done
 }
 
 // transferWebSocketToTCP transfers data from a WebSocket connection to a TCP connection
-func transferWebSocketToTCP(wsConn *websocket.Conn, tcpConn net.Conn, logger *logrus.Logger, usage *web.Usage, remotePort int, sniffer bool) {
+func transferWebSocketToTCP(wsConn *websocket.Conn, tcpConn net.Conn, logger *logrus.Logger, usage *web.Usage, remotePort int, sniffer bool, upstream bool) {
 	for {
 		// Read message from the WebSocket connection
 		messageType, message, err := wsConn.ReadMessage()
@@ -51,6 +56,7 @@ func transferWebSocketToTCP(wsConn *websocket.Conn, tcpConn net.Conn, logger *lo
 				return
 			}
 			logger.Tracef("transferred data from WebSocket to TCP: %d bytes", w)
+			CountTraffic(upstream, w)
 			if sniffer {
 				go usage.AddOrUpdatePort(remotePort, uint64(w))
 			}
@@ -59,7 +65,7 @@ func transferWebSocketToTCP(wsConn *websocket.Conn, tcpConn net.Conn, logger *lo
 }
 
 // transferTCPToWebSocket transfers data from a TCP connection to a WebSocket connection
-func transferTCPToWebSocket(tcpConn net.Conn, wsConn *websocket.Conn, logger *logrus.Logger, usage *web.Usage, remotePort int, sniffer bool) {
+func transferTCPToWebSocket(tcpConn net.Conn, wsConn *websocket.Conn, logger *logrus.Logger, usage *web.Usage, remotePort int, sniffer bool, upstream bool) {
 	buf := make([]byte, 16*1024) // 16K buffer size
 	for {
 		// Read data from the TCP connection
@@ -89,6 +95,7 @@ func transferTCPToWebSocket(tcpConn net.Conn, wsConn *websocket.Conn, logger *lo
 		}
 
 		logger.Tracef("transferred data from TCP to WebSocket: %d bytes", n)
+		CountTraffic(upstream, n)
 		if sniffer {
 			go usage.AddOrUpdatePort(remotePort, uint64(n))
 		}
@@ -0,0 +1,185 @@
+package web
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// captureBuffer is the chunks queued per watcher, newer ones are dropped for a slow watcher
+const captureBuffer = 1024
+
+// CaptureChunk is a single message of the /capture stream, the bytes one
+// read of a forwarded connection returned.
+type CaptureChunk struct {
+	Time      time.Time `json:"time"`
+	Port      int       `json:"port"`
+	Source    string    `json:"source"`    // user side of the connection, tells the connections apart
+	Direction string    `json:"direction"` // "upstream" from the user to the backend, or "downstream"
+	Data      []byte    `json:"data"`      // base64 encoded
+}
+
+type captureHub struct {
+	mu       sync.Mutex
+	watchers map[chan CaptureChunk]int // port each watcher watches
+	count    atomic.Int32
+}
+
+// activeCapture is nil unless the web monitor runs with the sniffer and the
+// event stream, and the hub has no watchers most of the time, so capturing
+// costs a load or two per read.
+var activeCapture atomic.Pointer[captureHub]
+
+// Capture sends the bytes of one read on a connection of port to the
+// watchers of that port on the /capture stream.
+func Capture(port int, source net.Addr, upstream bool, data []byte) {
+	h := activeCapture.Load()
+	if h == nil || h.count.Load() == 0 {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var chunk *CaptureChunk
+	for ch, watched := range h.watchers {
+		if watched != port {
+			continue
+		}
+
+		if chunk == nil {
+			direction := "downstream"
+			if upstream {
+				direction = "upstream"
+			}
+			chunk = &CaptureChunk{Time: time.Now(), Port: port, Source: source.String(), Direction: direction, Data: append([]byte(nil), data...)}
+		}
+
+		select {
+		case ch <- *chunk:
+		default:
+			// The watcher is too slow, it misses this chunk
+		}
+	}
+}
+
+func (h *captureHub) watch(port int) chan CaptureChunk {
+	ch := make(chan CaptureChunk, captureBuffer)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.watchers[ch] = port
+	h.count.Add(1)
+
+	return ch
+}
+
+func (h *captureHub) unwatch(ch chan CaptureChunk) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// Already closed if the monitor was shut down
+	if _, ok := h.watchers[ch]; ok {
+		close(ch)
+		delete(h.watchers, ch)
+		h.count.Add(-1)
+	}
+}
+
+func (h *captureHub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for ch := range h.watchers {
+		close(ch)
+		delete(h.watchers, ch)
+	}
+	h.count.Store(0)
+}
+
+// startCapture enables the /capture stream until the monitor shuts down.
+func (m *Usage) startCapture() {
+	h := &captureHub{watchers: make(map[chan CaptureChunk]int)}
+	activeCapture.Store(h)
+
+	go func() {
+		<-m.shutdownCtx.Done()
+		activeCapture.CompareAndSwap(h, nil)
+		h.close()
+	}()
+}
+
+// handleCapture streams the traffic of the connections on ?port=N live over a
+// WebSocket, authenticated like /events. It is meant for debugging, the
+// watcher sees the payload of every user of the port.
+func (m *Usage) handleCapture(w http.ResponseWriter, r *http.Request) {
+	events := activeEvents.Load()
+	h := activeCapture.Load()
+	if events == nil || h == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if !events.authorized(r) {
+		m.logger.Warnf("unauthorized capture request from %s", r.RemoteAddr)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	port, err := strconv.Atoi(r.URL.Query().Get("port"))
+	if err != nil || port < 1 || port > 65535 {
+		http.Error(w, "port is required", http.StatusBadRequest)
+		return
+	}
+
+	upgrader := websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool {
+			return true // Dashboards may be served from elsewhere, the token protects the stream
+		},
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		m.logger.Debugf("failed to upgrade capture request from %s: %v", r.RemoteAddr, err)
+		return
+	}
+	defer conn.Close()
+
+	chunks := h.watch(port)
+	defer h.unwatch(chunks)
+
+	m.logger.Warnf("%s is watching the traffic of port %d", r.RemoteAddr, port)
+
+	// Reading is only needed to notice the watcher going away
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-closed:
+			m.logger.Infof("%s stopped watching the traffic of port %d", r.RemoteAddr, port)
+			return
+		case chunk, ok := <-chunks:
+			if !ok {
+				return
+			}
+
+			conn.SetWriteDeadline(time.Now().Add(eventWriteTimeout))
+			if err := conn.WriteJSON(chunk); err != nil {
+				m.logger.Debugf("failed to send captured traffic to %s: %v", r.RemoteAddr, err)
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// concurrencyInterval is how often the connections in flight per port are sampled
+const concurrencyInterval = time.Second
+
+// concurrencyBuckets are the upper bounds of the concurrency histogram, a
+// last bucket takes the samples above them.
+var concurrencyBuckets = []int64{0, 1, 2, 5, 10, 20, 50, 100, 200, 500, 1000}
+
+// concurrency counts the forwarded connections in flight per port and samples
+// them into a histogram per port, so the peaks show next to the momentary
+// count when pools and limits are sized.
+type concurrency struct {
+	mu    sync.Mutex
+	ports map[int]*portConcurrency
+}
+
+type portConcurrency struct {
+	active  int64
+	peak    int64
+	samples uint64
+	buckets []uint64 // one per concurrencyBuckets entry and one above them
+}
+
+// PortConcurrency is the concurrency of a port in /concurrency.
+type PortConcurrency struct {
+	Port    int                 `json:"port"`
+	Label   string              `json:"label,omitempty"`
+	Active  int64               `json:"active"`
+	Peak    int64               `json:"peak"` // highest sampled count
+	Samples uint64              `json:"samples"`
+	Buckets []ConcurrencyBucket `json:"buckets"`
+}
+
+// ConcurrencyBucket holds the samples up to an upper bound and above the
+// previous one, "+Inf" holds the ones above the last bound.
+type ConcurrencyBucket struct {
+	Le    string `json:"le"`
+	Count uint64 `json:"count"`
+}
+
+func newConcurrency() *concurrency {
+	return &concurrency{ports: make(map[int]*portConcurrency)}
+}
+
+func (c *concurrency) add(port int, delta int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	p, ok := c.ports[port]
+	if !ok {
+		p = &portConcurrency{buckets: make([]uint64, len(concurrencyBuckets)+1)}
+		c.ports[port] = p
+	}
+	p.active += delta
+}
+
+// sample adds the count in flight of every port to its histogram.
+func (c *concurrency) sample() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, p := range c.ports {
+		bucket := sort.Search(len(concurrencyBuckets), func(i int) bool {
+			return concurrencyBuckets[i] >= p.active
+		})
+		p.buckets[bucket]++
+		p.samples++
+		p.peak = max(p.peak, p.active)
+	}
+}
+
+func (c *concurrency) snapshot() []PortConcurrency {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ports := make([]PortConcurrency, 0, len(c.ports))
+	for port, p := range c.ports {
+		buckets := make([]ConcurrencyBucket, 0, len(p.buckets))
+		for i, count := range p.buckets {
+			bound := "+Inf"
+			if i < len(concurrencyBuckets) {
+				bound = strconv.FormatInt(concurrencyBuckets[i], 10)
+			}
+			buckets = append(buckets, ConcurrencyBucket{Le: bound, Count: count})
+		}
+		ports = append(ports, PortConcurrency{Port: port, Label: PortLabel(port), Active: p.active, Peak: p.peak, Samples: p.samples, Buckets: buckets})
+	}
+	sort.Slice(ports, func(i, j int) bool {
+		return ports[i].Port < ports[j].Port
+	})
+	return ports
+}
+
+// OpenPortConnection counts a forwarded connection on port as in flight until
+// ClosePortConnection is called for it.
+func (m *Usage) OpenPortConnection(port int) {
+	m.concurrency.add(port, 1)
+}
+
+func (m *Usage) ClosePortConnection(port int) {
+	m.concurrency.add(port, -1)
+}
+
+// ActiveConnections returns the forwarded connections in flight per port of
+// the running transport.
+func ActiveConnections() map[int]int64 {
+	m := currentUsage.Load()
+	if m == nil {
+		return nil
+	}
+
+	m.concurrency.mu.Lock()
+	defer m.concurrency.mu.Unlock()
+
+	active := make(map[int]int64, len(m.concurrency.ports))
+	for port, p := range m.concurrency.ports {
+		active[port] = p.active
+	}
+	return active
+}
+
+// sampleConcurrency samples the connections in flight until the monitor stops.
+func (m *Usage) sampleConcurrency() {
+	ticker := time.NewTicker(concurrencyInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.concurrency.sample()
+		case <-m.shutdownCtx.Done():
+			return
+		}
+	}
+}
+
+func (m *Usage) handleConcurrency(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(m.concurrency.snapshot()); err != nil {
+		m.logger.Errorf("error encoding JSON response: %v", err)
+	}
+}
@@ -0,0 +1,47 @@
+package web
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// SetDrainer enables POST /drain, which stops a port mapping with drain while
+// the other mappings and the control channel keep running.
+func (m *Usage) SetDrainer(drain func(port int) error) {
+	m.drainer = drain
+}
+
+// handleDrain serves POST /drain with the port query parameter of the mapping
+// to drain.
+func (m *Usage) handleDrain(w http.ResponseWriter, r *http.Request) {
+	h := activeEvents.Load()
+	if h == nil || m.drainer == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if !h.authorized(r) {
+		m.logger.Warnf("unauthorized drain request from %s", r.RemoteAddr)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	port, err := strconv.Atoi(r.URL.Query().Get("port"))
+	if err != nil || port < 1 || port > 65535 {
+		http.Error(w, "invalid port", http.StatusBadRequest)
+		return
+	}
+
+	if err := m.drainer(port); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	m.logger.Infof("port %d drained by %s, its open connections are left to finish", port, r.RemoteAddr)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,239 @@
+package web
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	eventBuffer       = 256              // events queued per subscriber, newer ones are dropped for a slow subscriber
+	eventWriteTimeout = 10 * time.Second // a subscriber that takes longer to receive an event is disconnected
+)
+
+// Event is a single message of the /events stream.
+type Event struct {
+	Time time.Time `json:"time"`
+	Type string    `json:"type"`
+	Data any       `json:"data,omitempty"`
+}
+
+// StatusEvent is the data of a status event, sent when the tunnel status changes.
+type StatusEvent struct {
+	Status string `json:"status"`
+}
+
+// ThroughputEvent is the data of the throughput event sent every second.
+type ThroughputEvent struct {
+	Upstream   uint64 `json:"upstream"`   // bytes per second from users to backends
+	Downstream uint64 `json:"downstream"` // bytes per second from backends to users
+}
+
+// PoolEvent is the data of a pool event, sent when the client resizes its pool.
+type PoolEvent struct {
+	From int `json:"from"`
+	To   int `json:"to"`
+}
+
+// HeartbeatEvent is the data of a heartbeat event.
+type HeartbeatEvent struct {
+	Acked  bool `json:"acked"`
+	Missed int  `json:"missed,omitempty"` // unacknowledged heartbeats in a row
+}
+
+type eventHub struct {
+	mu          sync.Mutex
+	subscribers map[chan Event]struct{}
+	token       string
+}
+
+// activeEvents is nil until InitEvents is called, so publishing costs nothing when the stream is disabled
+var activeEvents atomic.Pointer[eventHub]
+
+// Bytes forwarded since the last throughput event
+var upstreamBytes, downstreamBytes atomic.Uint64
+
+// InitEvents enables the /events WebSocket stream of the web monitor until ctx
+// is done. Subscribers authenticate with token, as a bearer token or in the
+// token query parameter for browsers.
+func InitEvents(ctx context.Context, token string, logger *logrus.Logger) {
+	h := &eventHub{subscribers: make(map[chan Event]struct{}), token: token}
+	activeEvents.Store(h)
+
+	logger.Info("event stream enabled on the web monitor at /events")
+
+	go func() {
+		<-ctx.Done()
+		activeEvents.CompareAndSwap(h, nil)
+
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		for ch := range h.subscribers {
+			close(ch)
+			delete(h.subscribers, ch)
+		}
+	}()
+}
+
+// PublishEvent sends an event to every subscriber of the /events stream.
+func PublishEvent(eventType string, data any) {
+	h := activeEvents.Load()
+	if h == nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(h.subscribers) == 0 {
+		return
+	}
+
+	event := Event{Time: time.Now(), Type: eventType, Data: data}
+	for ch := range h.subscribers {
+		select {
+		case ch <- event:
+		default:
+			// The subscriber is too slow, it misses this event
+		}
+	}
+}
+
+// CountThroughput adds n forwarded bytes to the next throughput event.
+func CountThroughput(upstream bool, n int) {
+	if activeEvents.Load() == nil {
+		return
+	}
+
+	if upstream {
+		upstreamBytes.Add(uint64(n))
+	} else {
+		downstreamBytes.Add(uint64(n))
+	}
+}
+
+func (h *eventHub) subscribe() chan Event {
+	ch := make(chan Event, eventBuffer)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.subscribers[ch] = struct{}{}
+
+	return ch
+}
+
+func (h *eventHub) unsubscribe(ch chan Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// Already closed if the hub was shut down
+	if _, ok := h.subscribers[ch]; ok {
+		close(ch)
+		delete(h.subscribers, ch)
+	}
+}
+
+func (h *eventHub) authorized(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		token = r.URL.Query().Get("token")
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(h.token)) == 1
+}
+
+// watchEvents publishes the throughput every second and the tunnel status when
+// it changes, until the monitor shuts down.
+func (m *Usage) watchEvents() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	status := *m.tunnelStatus
+
+	for {
+		select {
+		case <-m.shutdownCtx.Done():
+			return
+		case <-ticker.C:
+			PublishEvent("throughput", ThroughputEvent{Upstream: upstreamBytes.Swap(0), Downstream: downstreamBytes.Swap(0)})
+
+			if current := *m.tunnelStatus; current != status {
+				status = current
+				PublishEvent("status", StatusEvent{Status: status})
+			}
+		}
+	}
+}
+
+func (m *Usage) handleEvents(w http.ResponseWriter, r *http.Request) {
+	h := activeEvents.Load()
+	if h == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if !h.authorized(r) {
+		m.logger.Warnf("unauthorized event stream request from %s", r.RemoteAddr)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	upgrader := websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool {
+			return true // Dashboards may be served from elsewhere, the token protects the stream
+		},
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		m.logger.Debugf("failed to upgrade event stream request from %s: %v", r.RemoteAddr, err)
+		return
+	}
+	defer conn.Close()
+
+	// Start with the current status so a dashboard does not wait for a change
+	conn.SetWriteDeadline(time.Now().Add(eventWriteTimeout))
+	if err := conn.WriteJSON(Event{Time: time.Now(), Type: "status", Data: StatusEvent{Status: *m.tunnelStatus}}); err != nil {
+		m.logger.Debugf("failed to send event to %s: %v", r.RemoteAddr, err)
+		return
+	}
+
+	events := h.subscribe()
+	defer h.unsubscribe(events)
+
+	m.logger.Debugf("event stream subscriber connected from %s", r.RemoteAddr)
+
+	// Reading is only needed to notice the subscriber going away
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-closed:
+			m.logger.Debugf("event stream subscriber %s disconnected", r.RemoteAddr)
+			return
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+
+			conn.SetWriteDeadline(time.Now().Add(eventWriteTimeout))
+			if err := conn.WriteJSON(event); err != nil {
+				m.logger.Debugf("failed to send event to %s: %v", r.RemoteAddr, err)
+				return
+			}
+		}
+	}
+}
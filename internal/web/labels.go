@@ -0,0 +1,24 @@
+package web
+
+import "sync"
+
+// portLabels holds the labels of the port mappings, keyed by local port
+var portLabels sync.Map
+
+// SetPortLabel names the mapping of port in metrics, connection logs and the
+// web interface. An empty label removes the name.
+func SetPortLabel(port int, label string) {
+	if label == "" {
+		portLabels.Delete(port)
+		return
+	}
+	portLabels.Store(port, label)
+}
+
+// PortLabel returns the label of the mapping of port, empty when it has none.
+func PortLabel(port int) string {
+	if label, ok := portLabels.Load(port); ok {
+		return label.(string)
+	}
+	return ""
+}
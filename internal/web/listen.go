@@ -0,0 +1,38 @@
+package web
+
+import (
+	"net"
+	"time"
+)
+
+const maxListenRetry = 30 * time.Second
+
+// listen binds the web interface. While the address is taken, e.g. by the web
+// interface of the previous run that is still shutting down after a restart,
+// it keeps retrying in the background and the tunnel runs without it. It gives
+// up when the usage monitor stops.
+func (m *Usage) listen() (net.Listener, error) {
+	retry := time.Second
+	for attempt := 1; ; attempt++ {
+		listener, err := net.Listen("tcp", m.listenAddr)
+		if err == nil {
+			if attempt > 1 {
+				m.logger.Infof("web interface on %s is available again", m.listenAddr)
+			}
+			return listener, nil
+		}
+
+		if attempt == 1 {
+			m.logger.Errorf("failed to start web interface on %s, the tunnel keeps running without it and retries: %v", m.listenAddr, err)
+		} else {
+			m.logger.Debugf("web interface on %s still unavailable, retrying in %v: %v", m.listenAddr, retry, err)
+		}
+
+		select {
+		case <-m.shutdownCtx.Done():
+			return nil, err
+		case <-time.After(retry):
+		}
+		retry = min(retry*2, maxListenRetry)
+	}
+}
@@ -0,0 +1,97 @@
+package web
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	queueSamples      = 1024             // number of recent wait times kept for the percentiles
+	queueWarnInterval = 10 * time.Second // minimum time between two slow queue warnings
+)
+
+// QueueStats records how long local connections wait in the local channel
+// before a tunnel connection or stream picks them up, and warns when a wait
+// exceeds the threshold. A threshold of 0 disables the warning.
+type QueueStats struct {
+	mu        sync.Mutex
+	samples   []time.Duration // ring buffer of the most recent wait times
+	next      int
+	threshold time.Duration
+	slow      int // waits above the threshold since the last warning
+	lastWarn  time.Time
+	logger    *logrus.Logger
+}
+
+func NewQueueStats(threshold time.Duration, logger *logrus.Logger) *QueueStats {
+	return &QueueStats{
+		samples:   make([]time.Duration, 0, queueSamples),
+		threshold: threshold,
+		logger:    logger,
+	}
+}
+
+// Observe records the wait time of a connection that left the local channel.
+func (q *QueueStats) Observe(wait time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.samples) < queueSamples {
+		q.samples = append(q.samples, wait)
+	} else {
+		q.samples[q.next] = wait
+		q.next = (q.next + 1) % queueSamples
+	}
+
+	if q.threshold <= 0 || wait <= q.threshold {
+		return
+	}
+
+	q.slow++
+	if time.Since(q.lastWarn) < queueWarnInterval {
+		return
+	}
+
+	p50, p95, p99 := q.percentiles()
+	q.logger.Warnf("%d connections waited longer than %v in the local channel, latest: %v (p50: %v, p95: %v, p99: %v)",
+		q.slow, q.threshold, wait.Round(time.Millisecond), p50, p95, p99)
+
+	q.slow = 0
+	q.lastWarn = time.Now()
+}
+
+// Percentiles returns the p50, p95 and p99 of the recent wait times.
+func (q *QueueStats) Percentiles() (time.Duration, time.Duration, time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.percentiles()
+}
+
+// percentiles computes the wait time percentiles. Caller must hold q.mu.
+func (q *QueueStats) percentiles() (time.Duration, time.Duration, time.Duration) {
+	if len(q.samples) == 0 {
+		return 0, 0, 0
+	}
+
+	sorted := make([]time.Duration, len(q.samples))
+	copy(sorted, q.samples)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] < sorted[j]
+	})
+
+	at := func(p int) time.Duration {
+		return sorted[(len(sorted)-1)*p/100].Round(time.Millisecond)
+	}
+
+	return at(50), at(95), at(99)
+}
+
+func (q *QueueStats) String() string {
+	p50, p95, p99 := q.Percentiles()
+	return fmt.Sprintf("p50 %v / p95 %v / p99 %v", p50, p95, p99)
+}
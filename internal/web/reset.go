@@ -0,0 +1,103 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// ResetUsage clears the recorded bytes and connections of port, or of every
+// port when port is 0, both in memory and in the sniffer log. Active
+// connections keep counting and their later traffic goes to the new window.
+func (m *Usage) ResetUsage(port int) error {
+	// Hold off the periodic save, it would write back the cleared data
+	m.saveMu.Lock()
+	defer m.saveMu.Unlock()
+
+	m.mu.Lock()
+	if port == 0 {
+		m.dataStore.Range(func(key, value interface{}) bool {
+			m.dataStore.Delete(key)
+			return true
+		})
+	} else {
+		m.dataStore.Delete(port)
+	}
+	m.mu.Unlock()
+
+	var saved []PortUsage
+	data, err := os.ReadFile(m.snifferLog)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error reading usage data: %v", err)
+	}
+	if err == nil && port != 0 {
+		if err := json.Unmarshal(data, &saved); err != nil {
+			return fmt.Errorf("error decoding usage data: %v", err)
+		}
+	}
+
+	kept := []PortUsage{}
+	m.totalTraffic = 0
+	for _, usage := range saved {
+		if usage.Port != port {
+			kept = append(kept, usage)
+			m.totalTraffic += usage.Usage
+		}
+	}
+
+	data, err = json.MarshalIndent(kept, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error marshalling usage data: %v", err)
+	}
+	if err := os.WriteFile(m.snifferLog, data, 0644); err != nil {
+		return fmt.Errorf("error writing usage data to file: %v", err)
+	}
+
+	return nil
+}
+
+// handleReset serves POST /reset, with an optional port query parameter to
+// reset a single port instead of all of them.
+func (m *Usage) handleReset(w http.ResponseWriter, r *http.Request) {
+	h := activeEvents.Load()
+	if h == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if !h.authorized(r) {
+		m.logger.Warnf("unauthorized usage reset request from %s", r.RemoteAddr)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	port := 0
+	if value := r.URL.Query().Get("port"); value != "" {
+		var err error
+		port, err = strconv.Atoi(value)
+		if err != nil || port < 1 || port > 65535 {
+			http.Error(w, "invalid port", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := m.ResetUsage(port); err != nil {
+		m.logger.Errorf("failed to reset usage: %v", err)
+		http.Error(w, "reset failed", http.StatusInternalServerError)
+		return
+	}
+
+	if port == 0 {
+		m.logger.Infof("usage of all ports reset by %s", r.RemoteAddr)
+	} else {
+		m.logger.Infof("usage of port %d reset by %s", port, r.RemoteAddr)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
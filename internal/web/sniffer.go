@@ -10,6 +10,7 @@ import (
 	"os"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/shirou/gopsutil/v4/cpu"
@@ -30,13 +31,23 @@ type Usage struct {
 	sniffer      bool
 	snifferLog   string
 	mu           sync.Mutex
+	saveMu       sync.Mutex // serializes writes of the sniffer log
 	totalTraffic uint64
 	tunnelStatus *string
+	maxPorts     int                  // maximum number of ports kept in the sniffer log, 0 means unlimited
+	retention    time.Duration        // how long an idle port is kept, 0 means forever
+	queueStats   *QueueStats          // local channel wait times, nil when not tracked
+	drainer      func(port int) error // stops a port mapping, nil when the transport cannot drain ports
+	targeter     targetOverride       // steers new connections of a port mapping, nil when the transport cannot
+	concurrency  *concurrency         // forwarded connections in flight per port
+	successor    *Usage               // monitor that took over on a restart, guarded by mu
 }
 
 type PortUsage struct {
-	Port  int
-	Usage uint64
+	Port        int
+	Usage       uint64
+	Connections uint64 `json:",omitempty"` // forwarded connections, counted on tcp, tcpmux, tcpsingle and wsmux
+	LastSeen    int64  `json:",omitempty"` // unix time of the last recorded traffic
 }
 
 type SystemStats struct {
@@ -51,9 +62,11 @@ type SystemStats struct {
 	BackhaulTraffic string `json:"backhaulTraffic"`
 	Sniffer         string `json:"sniffer"`
 	AllConnections  string `json:"allConnections"`
+	QueueWait       string `json:"queueWait,omitempty"`
+	Transport       string `json:"transport,omitempty"`
 }
 
-func NewDataStore(listenAddr string, shutdownCtx context.Context, snifferLog string, sniffer bool, tunnelStatus *string, logger *logrus.Logger) *Usage {
+func NewDataStore(listenAddr string, shutdownCtx context.Context, snifferLog string, sniffer bool, tunnelStatus *string, logger *logrus.Logger, maxPorts int, retention time.Duration) *Usage {
 	ctx, cancel := context.WithCancel(shutdownCtx)
 	u := &Usage{
 		listenAddr:   listenAddr,
@@ -65,17 +78,114 @@ func NewDataStore(listenAddr string, shutdownCtx context.Context, snifferLog str
 		tunnelStatus: tunnelStatus,
 		mu:           sync.Mutex{},
 		totalTraffic: 0,
+		maxPorts:     maxPorts,
+		retention:    retention,
+		concurrency:  newConcurrency(),
 	}
+
+	// A restart replaces the monitor, the web interface keeps counting from where it was
+	if prev := currentUsage.Load(); prev != nil && prev.listenAddr == listenAddr {
+		prev.handOver(u)
+	}
+
+	currentUsage.Store(u)
 	return u
 }
 
+// handOver moves the traffic not saved yet, the totals and the connections in
+// flight to next, a fresh monitor replacing m on a restart. Connections still
+// counted on m report their traffic to next from now on.
+func (m *Usage) handOver(next *Usage) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.dataStore.Range(func(key, value interface{}) bool {
+		next.dataStore.Store(key, value)
+		m.dataStore.Delete(key)
+		return true
+	})
+	next.totalTraffic = m.totalTraffic
+	next.concurrency = m.concurrency
+	m.successor = next
+}
+
+// currentUsage is the usage monitor of the running transport, a restart replaces it
+var currentUsage atomic.Pointer[Usage]
+
+// Snapshot returns the tunnel status and the traffic per port of the running
+// transport. Ports are only tracked with the sniffer enabled.
+func Snapshot() (string, []PortUsage) {
+	m := currentUsage.Load()
+	if m == nil {
+		return "", nil
+	}
+	return *m.tunnelStatus, m.portTotals()
+}
+
+// portTotals merges the traffic saved to the sniffer log with the traffic not
+// saved yet, without draining it.
+func (m *Usage) portTotals() []PortUsage {
+	if !m.sniffer {
+		return nil
+	}
+
+	totals := make(map[int]PortUsage)
+	for _, usage := range m.getUsageFromFile() {
+		totals[usage.Port] = usage
+	}
+
+	m.mu.Lock()
+	m.dataStore.Range(func(key, value interface{}) bool {
+		if usage, ok := value.(PortUsage); ok {
+			total := totals[usage.Port]
+			total.Port = usage.Port
+			total.Usage += usage.Usage
+			total.Connections += usage.Connections
+			total.LastSeen = usage.LastSeen
+			totals[usage.Port] = total
+		}
+		return true
+	})
+	m.mu.Unlock()
+
+	ports := make([]PortUsage, 0, len(totals))
+	for _, usage := range totals {
+		ports = append(ports, usage)
+	}
+	sort.Slice(ports, func(i, j int) bool {
+		return ports[i].Port < ports[j].Port
+	})
+	return ports
+}
+
+// SetQueueStats reports the local channel wait times of q in the stats endpoint.
+func (m *Usage) SetQueueStats(q *QueueStats) {
+	m.queueStats = q
+}
+
 func (m *Usage) Monitor() {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", m.handleIndex) // handle index
 	mux.HandleFunc("/stats", m.statsHandler)
+	mux.HandleFunc("/concurrency", m.handleConcurrency)
 	if m.sniffer {
 		mux.HandleFunc("/data", m.handleData) // New route for JSON data
 	}
+	if activeEvents.Load() != nil {
+		mux.HandleFunc("/events", m.handleEvents)
+		if m.sniffer {
+			mux.HandleFunc("/reset", m.handleReset)
+			mux.HandleFunc("/capture", m.handleCapture)
+			m.startCapture()
+		}
+		if m.drainer != nil {
+			mux.HandleFunc("/drain", m.handleDrain)
+		}
+		if m.targeter != nil {
+			mux.HandleFunc("/target", m.handleTarget)
+		}
+		go m.watchEvents()
+	}
 	m.server = &http.Server{
 		Addr:    m.listenAddr,
 		Handler: mux,
@@ -93,6 +203,9 @@ func (m *Usage) Monitor() {
 		}
 	}()
 
+	// The histograms are only read through the web interface
+	go m.sampleConcurrency()
+
 	// start save data
 	if m.sniffer {
 		go func() {
@@ -109,9 +222,13 @@ func (m *Usage) Monitor() {
 			}
 		}()
 	}
-	// Start the server
+	// Start the server, a taken port only costs the web interface and not the tunnel
+	listener, err := m.listen()
+	if err != nil {
+		return
+	}
 	m.logger.Info("sniffer service listening on port: ", m.listenAddr)
-	if err := m.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+	if err := m.server.Serve(listener); err != nil && err != http.ErrServerClosed {
 		m.logger.Errorf("sniffer server error: %v", err)
 	}
 }
@@ -159,23 +276,80 @@ func (m *Usage) statsHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func (m *Usage) AddOrUpdatePort(port int, usage uint64) {
+	m.updatePort(port, usage, 0)
+}
+
+// AddPortConnection counts a new connection forwarded on port.
+func (m *Usage) AddPortConnection(port int) {
+	m.updatePort(port, 0, 1)
+}
+
+func (m *Usage) updatePort(port int, usage uint64, connections uint64) {
 	m.mu.Lock()
+	if next := m.successor; next != nil {
+		m.mu.Unlock()
+		next.updatePort(port, usage, connections)
+		return
+	}
 	defer m.mu.Unlock()
 
+	now := time.Now().Unix()
+
 	// Retrieve current usage data for the port
 	value, ok := m.dataStore.Load(port)
 	if ok {
 		// Port exists, update usage
 		portUsage := value.(PortUsage)
 		portUsage.Usage += usage
+		portUsage.Connections += connections
+		portUsage.LastSeen = now
 		m.dataStore.Store(port, portUsage)
 	} else {
 		// Port does not exist, create new entry
-		m.dataStore.Store(port, PortUsage{Port: port, Usage: usage})
+		m.dataStore.Store(port, PortUsage{Port: port, Usage: usage, Connections: connections, LastSeen: now})
+	}
+}
+
+// pruneUsageMap drops ports idle for longer than the retention period, then
+// evicts the least recently used ports until the map fits in maxPorts.
+func (m *Usage) pruneUsageMap(usageMap map[int]PortUsage) {
+	now := time.Now().Unix()
+
+	for port, usage := range usageMap {
+		// Entries saved by older versions have no timestamp, start their clock now
+		if usage.LastSeen == 0 {
+			usage.LastSeen = now
+			usageMap[port] = usage
+		}
+
+		if m.retention > 0 && now-usage.LastSeen > int64(m.retention.Seconds()) {
+			delete(usageMap, port)
+		}
+	}
+
+	if m.maxPorts <= 0 || len(usageMap) <= m.maxPorts {
+		return
+	}
+
+	ports := make([]PortUsage, 0, len(usageMap))
+	for _, usage := range usageMap {
+		ports = append(ports, usage)
+	}
+
+	// Oldest first
+	sort.Slice(ports, func(i, j int) bool {
+		return ports[i].LastSeen < ports[j].LastSeen
+	})
+
+	for _, usage := range ports[:len(ports)-m.maxPorts] {
+		delete(usageMap, usage.Port)
 	}
 }
 
 func (m *Usage) saveUsageData() {
+	m.saveMu.Lock()
+	defer m.saveMu.Unlock()
+
 	// Step 1: Load existing usage data from the JSON file
 	var existingUsageData []PortUsage
 	file, err := os.Open(m.snifferLog)
@@ -209,6 +383,8 @@ func (m *Usage) saveUsageData() {
 		if existing, exists := usageMap[usage.Port]; exists {
 			// Update existing port usage
 			existing.Usage += usage.Usage
+			existing.Connections += usage.Connections
+			existing.LastSeen = usage.LastSeen
 			usageMap[usage.Port] = existing
 		} else {
 			// Add new port usage
@@ -216,6 +392,9 @@ func (m *Usage) saveUsageData() {
 		}
 	}
 
+	// Drop stale ports and enforce the port limit
+	m.pruneUsageMap(usageMap)
+
 	m.totalTraffic = 0
 
 	// Step 4: Convert the map back to a slice
@@ -287,19 +466,23 @@ func (m *Usage) getUsageFromFile() []PortUsage {
 // converts the byte usage to a human-readable format
 func (m *Usage) usageDataWithReadableUsage(usageData []PortUsage) []struct {
 	Port          int
+	Label         string `json:",omitempty"`
 	ReadableUsage string
 } {
 	var result []struct {
 		Port          int
+		Label         string `json:",omitempty"`
 		ReadableUsage string
 	}
 
 	for _, portUsage := range usageData {
 		result = append(result, struct {
 			Port          int
+			Label         string `json:",omitempty"`
 			ReadableUsage string
 		}{
 			Port:          portUsage.Port,
+			Label:         PortLabel(portUsage.Port),
 			ReadableUsage: m.convertBytesToReadable(portUsage.Usage),
 		})
 	}
@@ -417,6 +600,12 @@ func (m *Usage) getSystemStats() (*SystemStats, error) {
 		AllConnections:  fmt.Sprintf("%d", len(connections)),
 	}
 
+	if m.queueStats != nil {
+		stats.QueueWait = m.queueStats.String()
+	}
+
+	stats.Transport = CurrentTransport().String()
+
 	return stats, nil
 }
 
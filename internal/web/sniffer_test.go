@@ -0,0 +1,59 @@
+package web
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPruneUsageMap(t *testing.T) {
+	now := time.Now().Unix()
+
+	tests := []struct {
+		name      string
+		maxPorts  int
+		retention time.Duration
+		want      []int
+	}{
+		{"keep all", 0, 0, []int{80, 443, 8080, 8443, 9000}},
+		{"retention", 0, time.Hour, []int{80, 443, 8443, 9000}},
+		{"max ports evicts least recently used", 2, 0, []int{80, 9000}},
+		{"retention then max ports", 3, time.Hour, []int{80, 443, 9000}},
+	}
+
+	for _, tt := range tests {
+		usageMap := map[int]PortUsage{
+			80:   {Port: 80, Usage: 10, LastSeen: now},
+			443:  {Port: 443, Usage: 20, LastSeen: now - 60},
+			8080: {Port: 8080, Usage: 30, LastSeen: now - 2*3600},
+			8443: {Port: 8443, Usage: 40, LastSeen: now - 1800},
+			9000: {Port: 9000, Usage: 50}, // saved by an older version, no timestamp
+		}
+
+		m := &Usage{maxPorts: tt.maxPorts, retention: tt.retention}
+		m.pruneUsageMap(usageMap)
+
+		if len(usageMap) != len(tt.want) {
+			t.Errorf("%s: kept %d ports, want %v", tt.name, len(usageMap), tt.want)
+		}
+		for _, port := range tt.want {
+			if _, ok := usageMap[port]; !ok {
+				t.Errorf("%s: port %d was pruned", tt.name, port)
+			}
+		}
+	}
+}
+
+func TestPruneUsageMapStartsClockOfOldEntries(t *testing.T) {
+	usageMap := map[int]PortUsage{9000: {Port: 9000, Usage: 50}}
+
+	m := &Usage{retention: time.Second}
+	m.pruneUsageMap(usageMap)
+
+	usage, ok := usageMap[9000]
+	if !ok {
+		t.Fatal("entry without a timestamp was pruned")
+	}
+	if usage.LastSeen == 0 {
+		t.Error("entry without a timestamp did not get one")
+	}
+}
@@ -0,0 +1,57 @@
+package web
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// targetOverride sends the new connections of port to target, an empty target
+// restores the target of the port mapping.
+type targetOverride func(port int, target string) error
+
+// SetTargeter enables POST /target, which steers the new connections of a
+// port mapping to another target while its open connections keep theirs.
+func (m *Usage) SetTargeter(override func(port int, target string) error) {
+	m.targeter = override
+}
+
+// handleTarget serves POST /target with the port query parameter of the
+// mapping and the target to send its new connections to, an empty or missing
+// target goes back to the target of the mapping.
+func (m *Usage) handleTarget(w http.ResponseWriter, r *http.Request) {
+	h := activeEvents.Load()
+	if h == nil || m.targeter == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if !h.authorized(r) {
+		m.logger.Warnf("unauthorized target override request from %s", r.RemoteAddr)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	port, err := strconv.Atoi(r.URL.Query().Get("port"))
+	if err != nil || port < 1 || port > 65535 {
+		http.Error(w, "invalid port", http.StatusBadRequest)
+		return
+	}
+
+	target := r.URL.Query().Get("target")
+	if err := m.targeter(port, target); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if target == "" {
+		m.logger.Infof("target override of port %d removed by %s", port, r.RemoteAddr)
+	} else {
+		m.logger.Infof("new connections on port %d sent to %s by %s", port, target, r.RemoteAddr)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,76 @@
+package web
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// TransportInfo is the running configuration of the tunnel, shown on the
+// status page so operators can confirm it at a glance.
+type TransportInfo struct {
+	Transport  string   `json:"transport"`
+	Parameters []string `json:"parameters,omitempty"` // key settings as "name value", e.g. "mux_con 8"
+	Features   []string `json:"features,omitempty"`   // enabled features, e.g. "encryption"
+	Negotiated []string `json:"negotiated,omitempty"` // settings agreed with the peer as "name value"
+}
+
+// transportInfo holds the info of the running transport, the negotiated
+// settings change whenever the control channel is set up again.
+var transportInfo struct {
+	mu         sync.Mutex
+	info       TransportInfo
+	negotiated map[string]string
+}
+
+// SetTransportInfo sets the configuration shown on the status page and
+// forgets the settings negotiated so far.
+func SetTransportInfo(info TransportInfo) {
+	transportInfo.mu.Lock()
+	defer transportInfo.mu.Unlock()
+
+	transportInfo.info = info
+	transportInfo.negotiated = nil
+}
+
+// SetNegotiated records a setting the peer agreed on, e.g. the handshake
+// version, when the control channel is set up.
+func SetNegotiated(name string, value string) {
+	transportInfo.mu.Lock()
+	defer transportInfo.mu.Unlock()
+
+	if transportInfo.negotiated == nil {
+		transportInfo.negotiated = make(map[string]string)
+	}
+	transportInfo.negotiated[name] = value
+}
+
+// CurrentTransport returns the configuration set by SetTransportInfo with the
+// settings negotiated since, the transport is empty before it is set.
+func CurrentTransport() TransportInfo {
+	transportInfo.mu.Lock()
+	defer transportInfo.mu.Unlock()
+
+	info := transportInfo.info
+	info.Negotiated = nil
+	for name, value := range transportInfo.negotiated {
+		info.Negotiated = append(info.Negotiated, name+" "+value)
+	}
+	sort.Strings(info.Negotiated)
+
+	return info
+}
+
+func (i TransportInfo) String() string {
+	if i.Transport == "" {
+		return ""
+	}
+
+	parts := []string{i.Transport}
+	for _, list := range [][]string{i.Parameters, i.Features, i.Negotiated} {
+		if len(list) > 0 {
+			parts = append(parts, strings.Join(list, ", "))
+		}
+	}
+	return strings.Join(parts, " | ")
+}
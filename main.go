@@ -7,10 +7,12 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/musix/backhaul/cmd"
+	"github.com/musix/backhaul/internal/config"
 	"github.com/musix/backhaul/internal/utils"
 )
 
@@ -30,9 +32,103 @@ func getLastModTime(file string) (time.Time, error) {
 	return fileInfo.ModTime(), nil
 }
 
+// instance is a server or client running a configuration.
+type instance struct {
+	cfg     *config.Config
+	cancel  context.CancelFunc
+	cutover *utils.Cutover
+	stopped chan struct{} // closed once Run returned
+	err     error         // why Run returned, read after stopped is closed
+}
+
+// start runs cfg until ctx is done or the instance is stopped. Its tunnel
+// starts once release is closed.
+func start(ctx context.Context, cfg *config.Config, release <-chan struct{}) *instance {
+	ctx, cancel := context.WithCancel(ctx)
+	ctx, cutover := utils.WithCutover(ctx, release)
+	inst := &instance{cfg: cfg, cancel: cancel, cutover: cutover, stopped: make(chan struct{})}
+
+	go func() {
+		defer close(inst.stopped)
+		inst.err = cmd.Run(cfg, ctx)
+	}()
+
+	return inst
+}
+
+// stop shuts the instance down and waits until it is.
+func (i *instance) stop() {
+	i.cancel()
+	<-i.stopped
+}
+
+// reload runs cfg in place of the running instance. The new instance sets
+// itself up while the running one keeps serving, when that fails the running
+// one is kept. Otherwise the running one is stopped and hands its tunnel over,
+// its listeners are parked for the new instance, so the ports stay open and
+// users connecting meanwhile wait in the accept queue instead of being refused.
+func reload(ctx context.Context, running *instance, cfg *config.Config) (*instance, error) {
+	release := make(chan struct{})
+	next := start(ctx, cfg, release)
+
+	select {
+	case <-next.cutover.Waiting():
+	case <-next.stopped:
+		return nil, next.err
+	}
+
+	utils.ParkListeners(logger)
+	running.stop()
+
+	// Start as soon as the old instance released the ports it could not park
+	cmd.WaitForRelease(running.cfg, 2*time.Second)
+	close(release)
+
+	return next, nil
+}
+
+// released is closed, the first instance has no tunnel to wait for.
+var released = func() <-chan struct{} {
+	c := make(chan struct{})
+	close(c)
+	return c
+}()
+
+// runBenchmark measures the tunnel through the local port mapping addr and
+// stops the tunnel afterwards.
+func runBenchmark(ctx context.Context, inst *instance, addr string, duration time.Duration, transport config.TransportType) {
+	if !strings.Contains(addr, ":") {
+		addr = "127.0.0.1:" + addr
+	}
+
+	readyCtx, readyCancel := context.WithTimeout(ctx, 60*time.Second)
+	defer readyCancel()
+
+	logger.Infof("waiting for the tunnel to reach the benchmark backend through %s", addr)
+	err := utils.WaitBenchReady(readyCtx, addr)
+	if err == nil {
+		var result *utils.BenchResult
+		if result, err = utils.RunBenchmark(addr, duration, logger); err == nil {
+			utils.LogBenchResult(result, string(transport), logger)
+		}
+	}
+
+	inst.stop()
+
+	if err != nil {
+		logger.Fatalf("benchmark failed: %v", err)
+	}
+	os.Exit(0)
+}
+
 func main() {
 	configPath := flag.String("c", "", "path to the configuration file (TOML format)")
 	showVersion := flag.Bool("v", false, "print the version and exit")
+	replayFile := flag.String("replay", "", "replay a connection recorded with record_dir to the backend given by -target and exit")
+	replayTarget := flag.String("target", "", "backend address for -replay, e.g. 127.0.0.1:8080")
+	benchAddr := flag.String("bench", "", "server only: measure the tunnel through this local port mapping, whose target runs -bench-backend, then exit")
+	benchTime := flag.Duration("bench-time", 5*time.Second, "how long -bench measures throughput in each direction")
+	benchBackend := flag.String("bench-backend", "", "client only: serve the synthetic backend for -bench on this address, e.g. 127.0.0.1:5201")
 
 	flag.Parse()
 
@@ -42,6 +138,17 @@ func main() {
 		os.Exit(0)
 	}
 
+	// Replay a recorded connection without starting a tunnel
+	if *replayFile != "" {
+		if *replayTarget == "" {
+			logger.Fatalf("Usage: %s -replay /path/to/file.rec -target 127.0.0.1:8080", flag.CommandLine.Name())
+		}
+		if err := utils.ReplayRecording(*replayFile, *replayTarget, logger); err != nil {
+			logger.Fatalf("failed to replay %s: %v", *replayFile, err)
+		}
+		os.Exit(0)
+	}
+
 	// Check if the configPath is provided
 	if *configPath == "" {
 		logger.Fatalf("Usage: %s -c /path/to/config.toml", flag.CommandLine.Name())
@@ -52,12 +159,32 @@ func main() {
 
 	// Create a context for graceful shutdown handling
 	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
 	// Set up signal handling for graceful shutdown
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 
-	go cmd.Run(*configPath, ctx)
+	cfg, err := cmd.LoadConfig(*configPath)
+	if err != nil {
+		logger.Fatalf("failed to load configuration: %v", err)
+	}
+
+	current := start(ctx, cfg, released)
+
+	// The synthetic backend runs next to the client for as long as the process
+	if *benchBackend != "" {
+		go func() {
+			if err := utils.RunBenchBackend(ctx, *benchBackend, logger); err != nil {
+				logger.Fatalf("failed to run the benchmark backend: %v", err)
+			}
+		}()
+	}
+
+	// Benchmark through the tunnel once it is up, then exit
+	if *benchAddr != "" {
+		runBenchmark(ctx, current, *benchAddr, *benchTime, cfg.Server.Transport)
+	}
 
 	// Get initial modification time of the config file
 	lastModTime, err := getLastModTime(*configPath)
@@ -66,44 +193,64 @@ func main() {
 	}
 
 	// Polling for file changes
-	go func() {
-		ticker := time.NewTicker(2 * time.Second)
-		defer ticker.Stop()
-
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case <-ticker.C:
-				modTime, err := getLastModTime(*configPath)
-				if err != nil {
-					logger.Errorf("Error checking file modification time: %v", err)
-					continue
-				}
-
-				// If the modification time has changed, reload the app
-				if modTime.After(lastModTime) {
-					logger.Info("Config file changed, reloading application")
-
-					// Cancel the previous context to stop the old running instance
-					cancel()
-
-					time.Sleep(2 * time.Second)
-
-					// Create a new context for the new instance
-					newCtx, newCancel := context.WithCancel(context.Background())
-					go cmd.Run(*configPath, newCtx)
-
-					// Update the last modification time and the context
-					lastModTime = modTime
-					ctx = newCtx
-					cancel = newCancel
-				}
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+
+	// The configuration to go back to when the reloaded one fails to run,
+	// until the control channel of the reloaded one is up
+	var previous *config.Config
+	var healthy <-chan struct{}
+
+	for {
+		select {
+		case <-sigChan:
+			current.stop()
+			cmd.LogStats(current.cfg)
+			return
+
+		case <-healthy:
+			logger.Info("the changed configuration is up")
+			previous, healthy = nil, nil
+
+		case <-current.stopped:
+			// Run only returns by itself when the instance could not be set up
+			if previous == nil {
+				logger.Fatalf("failed to run: %v", current.err)
+			}
+			logger.Errorf("failed to run the changed configuration, going back to the previous one: %v", current.err)
+			cmd.WaitForRelease(current.cfg, 2*time.Second)
+			current = start(ctx, previous, released)
+			previous, healthy = nil, nil
+
+		case <-ticker.C:
+			modTime, err := getLastModTime(*configPath)
+			if err != nil {
+				logger.Errorf("Error checking file modification time: %v", err)
+				continue
+			}
+
+			// If the modification time has changed, reload the app
+			if !modTime.After(lastModTime) {
+				continue
+			}
+			lastModTime = modTime
+
+			logger.Info("Config file changed, reloading application")
+
+			// Check the new configuration before touching the running instance
+			newCfg, err := cmd.LoadConfig(*configPath)
+			if err != nil {
+				logger.Errorf("failed to load the changed configuration, keeping the running one: %v", err)
+				continue
 			}
-		}
-	}()
 
-	<-sigChan
-	cancel()
-	time.Sleep(1 * time.Second)
+			next, err := reload(ctx, current, newCfg)
+			if err != nil {
+				logger.Errorf("failed to set up the changed configuration, keeping the running one: %v", err)
+				continue
+			}
+			previous, healthy = current.cfg, next.cutover.Ready()
+			current = next
+		}
+	}
 }